@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// 帶有 API token 的請求只能訪問 apiTokenRoutes 中的路徑,
+// 並且必須擁有該路徑所需的權限範圍 (scope), 否則一律拒絕.
+
+const (
+	TokenRouteRead   = "read"
+	TokenRouteWrite  = "write"
+	TokenRouteBackup = "backup"
+
+	localsAPIToken   = "api_token"
+	localsTokenRoute = "api_token_route"
+)
+
+var apiTokenRoutes = map[string]string{
+	"/api/auto-get-keywords":  TokenRouteRead,
+	"/api/auto-get-buckets":   TokenRouteRead,
+	"/api/get-bucket":         TokenRouteRead,
+	"/api/files":              TokenRouteRead,
+	"/api/pics":               TokenRouteRead,
+	"/api/search-files":       TokenRouteRead,
+	"/api/search-pics":        TokenRouteRead,
+	"/api/file-info":          TokenRouteRead,
+	"/api/download-file":      TokenRouteRead,
+	"/api/download-small-pic": TokenRouteRead,
+	"/api/trash":              TokenRouteRead,
+	"/api/file-versions":      TokenRouteRead,
+	"/api/download-version":   TokenRouteRead,
+	"/api/tags":               TokenRouteRead,
+
+	"/api/waiting-files":       TokenRouteWrite,
+	"/api/upload-new-files":    TokenRouteWrite,
+	"/api/overwrite-file":      TokenRouteWrite,
+	"/api/update-file-info":    TokenRouteWrite,
+	"/api/move-file-to-bucket": TokenRouteWrite,
+	"/api/delete-file":         TokenRouteWrite,
+	"/api/restore-file":        TokenRouteWrite,
+	"/api/restore-version":     TokenRouteWrite,
+
+	"/api/project-status":    TokenRouteBackup,
+	"/api/bk-project-status": TokenRouteBackup,
+	"/api/check-now":         TokenRouteBackup,
+	"/api/damaged-files":     TokenRouteBackup,
+	"/api/repair-files":      TokenRouteBackup,
+	"/api/sync-backup":       TokenRouteBackup,
+}
+
+// 帶參數的路徑, 例如 /file/:id
+var apiTokenRoutePrefixes = map[string]string{
+	"/file/":          TokenRouteRead,
+	"/secret-thumbs/": TokenRouteRead,
+	"/file-version/":  TokenRouteRead,
+}
+
+func tokenRouteOf(path string) string {
+	if route, ok := apiTokenRoutes[path]; ok {
+		return route
+	}
+	for prefix, route := range apiTokenRoutePrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return route
+		}
+	}
+	return ""
+}
+
+func tokenAllowsRoute(token *database.APIToken, route string) bool {
+	switch route {
+	case TokenRouteRead:
+		return token.HasScope(model.ScopeReadPublic) || token.HasScope(model.ScopeReadEncrypted)
+	case TokenRouteWrite:
+		return len(token.WriteBuckets()) > 0
+	case TokenRouteBackup:
+		return token.HasScope(model.ScopeBackup)
+	}
+	return false
+}
+
+// apiTokenAuth is a middleware.
+// 沒有 API token 的請求不受影響; 帶有 API token 的請求則根據 token 的權限範圍決定是否允許.
+func apiTokenAuth(c *fiber.Ctx) error {
+	raw, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	raw = strings.TrimSpace(raw)
+	if !found || !strings.HasPrefix(raw, database.APITokenPrefix) {
+		return c.Next()
+	}
+	token, err := db.FindAPIToken(raw)
+	if err != nil {
+		return err
+	}
+	route := tokenRouteOf(c.Path())
+	if !tokenAllowsRoute(token, route) {
+		return fmt.Errorf("該 API token (%s) 沒有使用此功能的權限", token.Name)
+	}
+	c.Locals(localsAPIToken, token)
+	c.Locals(localsTokenRoute, route)
+	return c.Next()
+}
+
+// getAPIToken 返回當前請求的 API token, 如果不是用 API token 訪問則返回 nil.
+func getAPIToken(c *fiber.Ctx) *database.APIToken {
+	token, _ := c.Locals(localsAPIToken).(*database.APIToken)
+	return token
+}
+
+// canSeeEncrypted 判斷當前請求能否看見加密倉庫 (已登入, 或 API token 有 read:encrypted 權限).
+func canSeeEncrypted(c *fiber.Ctx) bool {
+	if token := getAPIToken(c); token != nil {
+		return token.HasScope(model.ScopeReadEncrypted) && db.IsLoggedIn()
+	}
+	return isAdmin(c)
+}
+
+// checkTokenBucket 檢查 API token 能否處理該倉庫中的檔案.
+func checkTokenBucket(c *fiber.Ctx, token *database.APIToken, bucketName string, encrypted bool) error {
+	route := c.Locals(localsTokenRoute)
+	if route == TokenRouteWrite && !token.CanWrite(bucketName) {
+		return fmt.Errorf("該 API token (%s) 沒有寫入倉庫 %s 的權限", token.Name, bucketName)
+	}
+	if !encrypted {
+		return nil
+	}
+	if route == TokenRouteRead && !token.HasScope(model.ScopeReadEncrypted) {
+		return fmt.Errorf("該 API token (%s) 沒有讀取加密倉庫的權限", token.Name)
+	}
+	if !db.IsLoggedIn() {
+		return fmt.Errorf("管理員未登入, 無法處理加密檔案")
+	}
+	return checkBucketUnlocked(bucketName)
+}
+
+func createAPIToken(c *fiber.Ctx) error {
+	form := new(model.CreateAPITokenForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	token, t, err := db.CreateAPIToken(form)
+	if err != nil {
+		return err
+	}
+	return c.JSON(model.CreatedAPIToken{APIToken: t, Token: token})
+}
+
+func getAPITokens(c *fiber.Ctx) error {
+	tokens, err := db.GetAllAPITokens()
+	if err != nil {
+		return err
+	}
+	return c.JSON(tokens)
+}
+
+func revokeAPIToken(c *fiber.Ctx) error {
+	form := new(model.FileIdForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	return db.RevokeAPIToken(form.ID)
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/samber/lo"
+	"golang.org/x/crypto/blake2b"
+)
+
+// 除了備份專案 (資料夾鏡像) 以外, 還可以把專案打包為一個歸檔檔案 (archive), 用於冷備份.
+// 歸檔是 tar 或 zip (可選 zstd 壓縮), 包括數據庫, project.toml, 以及 buckets, trash,
+// versions 資料夾中的檔案 (按原樣保存, 加密倉庫中的檔案仍然是密文),
+// 最後是記錄了全部檔案 checksum 的 manifest.json, 用專案的真正密鑰簽名 (見 database.SignManifest).
+// 縮略圖不在歸檔中, 導入後可在新專案中重建.
+
+const (
+	ArchiveVersion      = 1
+	ArchiveManifestName = "manifest.json"
+	ArchiveTimeLayout   = SnapshotTimeLayout
+
+	DotTar    = ".tar"
+	DotTarZst = ".tar.zst"
+	DotZip    = ".zip"
+)
+
+var errArchiveInvalid = errors.New("歸檔驗證失敗")
+
+// archiveFolders 是歸檔中除了數據庫及 project.toml 以外的資料夾.
+var archiveFolders = []string{BucketsFolderName, TrashFolderName, VersionsFolderName}
+
+// archiveWriter 依次把檔案寫入歸檔.
+type archiveWriter interface {
+	add(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type tarArchiveWriter struct {
+	tw  *tar.Writer
+	zw  *zstd.Encoder // 不壓縮時為 nil
+	buf *bufio.Writer
+}
+
+func newTarArchiveWriter(w io.Writer, compress bool) (*tarArchiveWriter, error) {
+	a := &tarArchiveWriter{buf: bufio.NewWriter(w)}
+	if !compress {
+		a.tw = tar.NewWriter(a.buf)
+		return a, nil
+	}
+	zw, err := zstd.NewWriter(a.buf)
+	if err != nil {
+		return nil, err
+	}
+	a.zw = zw
+	a.tw = tar.NewWriter(zw)
+	return a, nil
+}
+
+func (a *tarArchiveWriter) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0o644,
+		ModTime:  modTime,
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	err := a.tw.Close()
+	if a.zw != nil {
+		err = util.WrapErrors(err, a.zw.Close())
+	}
+	return util.WrapErrors(err, a.buf.Flush())
+}
+
+type zipArchiveWriter struct {
+	zw     *zip.Writer
+	method uint16
+}
+
+func newZipArchiveWriter(w io.Writer, compress bool) *zipArchiveWriter {
+	a := &zipArchiveWriter{zw: zip.NewWriter(w), method: zip.Store}
+	if compress {
+		a.method = zstd.ZipMethodWinZip
+		a.zw.RegisterCompressor(a.method, zstd.ZipCompressor())
+	}
+	return a
+}
+
+func (a *zipArchiveWriter) add(name string, size int64, modTime time.Time, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: a.method, Modified: modTime}
+	hdr.UncompressedSize64 = uint64(size)
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+// walkArchive 依次讀取歸檔中的每個檔案, 歸檔的格式由副檔名決定.
+func walkArchive(archivePath string, fn func(name string, r io.Reader) error) error {
+	switch {
+	case strings.HasSuffix(archivePath, DotTar), strings.HasSuffix(archivePath, DotTarZst):
+		return walkTarArchive(archivePath, fn)
+	case strings.HasSuffix(archivePath, DotZip):
+		return walkZipArchive(archivePath, fn)
+	}
+	return fmt.Errorf("unknown archive format: %s", archivePath)
+}
+
+func walkTarArchive(archivePath string, fn func(name string, r io.Reader) error) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(archivePath, DotTarZst) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := fn(hdr.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func walkZipArchive(archivePath string, fn func(name string, r io.Reader) error) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	zr.RegisterDecompressor(zstd.ZipMethodWinZip, zstd.ZipDecompressor())
+
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(f.Name, r)
+		if err = util.WrapErrors(err, r.Close()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveEntryPath 返回歸檔中的檔案 name 在專案 root 中的路徑,
+// 只允許數據庫, project.toml 及 archiveFolders 中的檔案, 以免被用於寫入其他路徑.
+func archiveEntryPath(root, name string) (string, error) {
+	local := filepath.FromSlash(name)
+	if !filepath.IsLocal(local) {
+		return "", fmt.Errorf("invalid entry: %s", name)
+	}
+	first, _, _ := strings.Cut(name, "/")
+	if name != DatabaseFileName && name != ProjectTOML &&
+		(first == name || !lo.Contains(archiveFolders, first)) {
+		return "", fmt.Errorf("invalid entry: %s", name)
+	}
+	return filepath.Join(root, local), nil
+}
+
+func newArchiveHash() hash.Hash {
+	return lo.Must(blake2b.New512(nil))
+}
+
+// archiveName 返回歸檔檔案名, 例如 myproject-20060102-150405.tar.zst
+func archiveName(format string, compress bool) string {
+	ext := lo.Ternary(format == "zip", DotZip, lo.Ternary(compress, DotTarZst, DotTar))
+	return filepath.Base(ProjectRoot) + "-" + time.Now().Format(ArchiveTimeLayout) + ext
+}
+
+// createArchive 把本專案打包為歸檔檔案, 保存在資料夾 form.Dir 中. 需要先登入 (用於簽名).
+// 先寫入 <檔案名>.partial, 完成後才改名, 因此中途出錯不會留下不完整的歸檔.
+func createArchive(c *fiber.Ctx, form *model.ArchiveForm) (*model.ArchiveReport, error) {
+	if !db.IsLoggedIn() {
+		return nil, fmt.Errorf("建立歸檔需要管理員權限")
+	}
+	rotation, err := db.GetKeyRotation()
+	if err != nil {
+		return nil, err
+	}
+	if rotation != nil {
+		return nil, fmt.Errorf("正在更換密鑰, 完成後才能建立歸檔")
+	}
+	if util.PathNotExists(form.Dir) {
+		return nil, fmt.Errorf("not found: %s", form.Dir)
+	}
+
+	archivePath := filepath.Join(form.Dir, archiveName(form.Format, form.Zstd))
+	partial := archivePath + partialSuffix
+	report, err := writeArchive(partial, form)
+	if err == nil {
+		err = os.Rename(partial, archivePath)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return nil, err
+	}
+	report.Path = archivePath
+	report.Valid = true
+	err = logEvent(c, model.EventCreateArchive, 0, 0, nil, map[string]any{
+		"path":       report.Path,
+		"entries":    report.Entries,
+		"total_size": report.TotalSize,
+	})
+	return report, err
+}
+
+func writeArchive(partial string, form *model.ArchiveForm) (*model.ArchiveReport, error) {
+	f, err := os.Create(partial)
+	if err != nil {
+		return nil, err
+	}
+	var w archiveWriter
+	if form.Format == "zip" {
+		w = newZipArchiveWriter(f, form.Zstd)
+	} else if w, err = newTarArchiveWriter(f, form.Zstd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	report, err := fillArchive(w)
+	err = util.WrapErrors(err, w.Close())
+	err = util.WrapErrors(err, f.Close())
+	return report, err
+}
+
+// fillArchive 寫入數據庫, project.toml, archiveFolders 中的檔案, 最後寫入簽名後的 manifest.
+func fillArchive(w archiveWriter) (*model.ArchiveReport, error) {
+	schema, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	manifest := &model.ArchiveManifest{
+		Version:       ArchiveVersion,
+		Title:         ProjectConfig.Title,
+		Source:        ProjectRoot,
+		IsBackup:      ProjectConfig.IsBackup,
+		SchemaVersion: schema,
+		CreatedAt:     model.Now(),
+	}
+	addFile := func(name, filePath string) error {
+		entry, err := addArchiveFile(w, name, filePath)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	}
+
+	// 數據庫先複製到 temp 資料夾, 以免打包期間數據庫被修改.
+	dbCopy := filepath.Join(TempFolder, "archive-"+time.Now().Format(ArchiveTimeLayout)+".db")
+	if err := db.Exec(stmt.BackupDatabase, dbCopy); err != nil {
+		return nil, err
+	}
+	defer os.Remove(dbCopy)
+	if err := addFile(DatabaseFileName, dbCopy); err != nil {
+		return nil, err
+	}
+	if err := addFile(ProjectTOML, ProjectConfigPath); err != nil {
+		return nil, err
+	}
+	for _, folder := range archiveFolders {
+		err := filepath.WalkDir(filepath.Join(ProjectRoot, folder),
+			func(filePath string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() {
+					return err
+				}
+				rel, err := filepath.Rel(ProjectRoot, filePath)
+				if err != nil {
+					return err
+				}
+				return addFile(filepath.ToSlash(rel), filePath)
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := db.SignManifest(manifestJSON)
+	if err != nil {
+		return nil, err
+	}
+	signed, err := json.MarshalIndent(model.SignedManifest{
+		Manifest: manifestJSON, Signature: sig}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	err = w.add(ArchiveManifestName, int64(len(signed)), time.Now(), bytes.NewReader(signed))
+	return newArchiveReport(manifest), err
+}
+
+// addArchiveFile 把檔案寫入歸檔, 同時計算其 checksum.
+func addArchiveFile(w archiveWriter, name, filePath string) (*model.ArchiveEntry, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	h := newArchiveHash()
+	if err := w.add(name, info.Size(), info.ModTime(), io.TeeReader(f, h)); err != nil {
+		return nil, err
+	}
+	return &model.ArchiveEntry{
+		Name:     name,
+		Size:     info.Size(),
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func newArchiveReport(manifest *model.ArchiveManifest) *model.ArchiveReport {
+	report := &model.ArchiveReport{
+		Title:     manifest.Title,
+		CreatedAt: manifest.CreatedAt,
+		Entries:   int64(len(manifest.Entries)),
+	}
+	for _, entry := range manifest.Entries {
+		report.TotalSize += entry.Size
+	}
+	return report
+}
+
+// verifyArchive 驗證 manifest 的簽名, 並逐一對比歸檔中的檔案與 manifest 中的 checksum.
+// password 是歸檔中的 project.toml 的密碼, 歸檔與本專案的密鑰相同並且已登入時可以省略.
+func verifyArchive(archivePath, password string) (*model.ArchiveReport, *model.ArchiveManifest, error) {
+	var signedData, tomlData []byte
+	actual := make(map[string]*model.ArchiveEntry)
+	err := walkArchive(archivePath, func(name string, r io.Reader) (err error) {
+		switch name {
+		case ArchiveManifestName:
+			signedData, err = io.ReadAll(r)
+			return
+		case ProjectTOML:
+			if tomlData, err = io.ReadAll(r); err != nil {
+				return
+			}
+			r = bytes.NewReader(tomlData)
+		}
+		h := newArchiveHash()
+		size, err := io.Copy(h, r)
+		actual[name] = &model.ArchiveEntry{
+			Name: name, Size: size, Checksum: hex.EncodeToString(h.Sum(nil))}
+		return
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if signedData == nil || tomlData == nil {
+		return nil, nil, fmt.Errorf("歸檔中找不到 %s 或 %s", ArchiveManifestName, ProjectTOML)
+	}
+
+	var signed model.SignedManifest
+	if err := json.Unmarshal(signedData, &signed); err != nil {
+		return nil, nil, err
+	}
+	// manifest.json 是縮進格式, 簽名的則是緊湊格式的 manifest.
+	compact := new(bytes.Buffer)
+	if err := json.Compact(compact, signed.Manifest); err != nil {
+		return nil, nil, err
+	}
+	signed.Manifest = compact.Bytes()
+	manifest := new(model.ArchiveManifest)
+	if err := json.Unmarshal(signed.Manifest, manifest); err != nil {
+		return nil, nil, err
+	}
+	report := newArchiveReport(manifest)
+	report.Path = archivePath
+
+	if err := verifyArchiveSignature(tomlData, password, &signed); err != nil {
+		if !errors.Is(err, database.ErrBadSignature) {
+			return nil, nil, err
+		}
+		report.SigError = err.Error()
+	}
+	for _, entry := range manifest.Entries {
+		got, ok := actual[entry.Name]
+		if !ok {
+			report.Missing = append(report.Missing, entry.Name)
+			continue
+		}
+		delete(actual, entry.Name)
+		if got.Size != entry.Size || got.Checksum != entry.Checksum {
+			report.Damaged = append(report.Damaged, entry.Name)
+		}
+	}
+	for name := range actual {
+		report.Extra = append(report.Extra, name)
+	}
+	report.Valid = report.SigError == "" && len(report.Missing)+len(report.Damaged)+len(report.Extra) == 0
+	return report, manifest, nil
+}
+
+// verifyArchiveSignature 優先使用 password, 否則使用內存中的密鑰 (只限歸檔與本專案的密鑰相同).
+func verifyArchiveSignature(tomlData []byte, password string, signed *model.SignedManifest) error {
+	var cfg Project
+	if err := toml.Unmarshal(tomlData, &cfg); err != nil {
+		return err
+	}
+	if password != "" {
+		return database.VerifyManifestWith(cfg.CipherKey, password, signed.Manifest, signed.Signature)
+	}
+	if cfg.CipherKey != ProjectConfig.CipherKey || !db.IsLoggedIn() {
+		return fmt.Errorf("驗證簽名需要歸檔的密碼")
+	}
+	return db.VerifyManifest(signed.Manifest, signed.Signature)
+}
+
+// importArchive 驗證歸檔後, 在空資料夾 target 中重建專案 (作為主專案).
+// 原專案的備份專案不會被登記, 縮略圖需要在新專案中重建.
+func importArchive(c *fiber.Ctx, form *model.ArchivePathForm) (*model.ArchiveReport, error) {
+	if form.Target == "" {
+		return nil, fmt.Errorf("target is empty")
+	}
+	if util.PathNotExists(form.Target) {
+		return nil, fmt.Errorf("not found: %s", form.Target)
+	}
+	notEmpty, err := util.DirIsNotEmpty(form.Target)
+	if err != nil {
+		return nil, err
+	}
+	if notEmpty {
+		return nil, fmt.Errorf("不是空資料夾: %s", form.Target)
+	}
+
+	report, manifest, err := verifyArchive(form.Path, form.Password)
+	if err != nil {
+		return nil, err
+	}
+	if !report.Valid {
+		return report, errArchiveInvalid
+	}
+	if err := extractArchive(form.Path, form.Target, manifest); err != nil {
+		return report, err
+	}
+	if err := syncExeFile(form.Target); err != nil {
+		return report, err
+	}
+
+	cfgPath := filepath.Join(form.Target, ProjectTOML)
+	cfg, err := readProjCfgFrom(cfgPath)
+	if err != nil {
+		return report, err
+	}
+	cfg.IsBackup = false
+	cfg.LastBackupAt = ""
+	cfg.BackupProjects = []string{}
+	if err := util.WriteTOML(cfg, cfgPath); err != nil {
+		return report, err
+	}
+	newDB, err := database.OpenDB(filepath.Join(form.Target, DatabaseFileName), &cfg)
+	if err != nil {
+		return report, err
+	}
+	defer newDB.DB.Close()
+	if err := newDB.DeleteSyncState(); err != nil {
+		return report, err
+	}
+	report.Root = form.Target
+	return report, logEventTo(newDB, c, model.EventImportArchive, 0, 0, nil, map[string]any{
+		"path":       form.Path,
+		"root":       report.Root,
+		"created_at": report.CreatedAt,
+		"entries":    report.Entries,
+	})
+}
+
+// extractArchive 把歸檔中的檔案解壓到 root, 解壓時再次對比 checksum
+// (歸檔可能在驗證之後被修改). 倉庫等資料夾中的檔案設為只讀.
+func extractArchive(archivePath, root string, manifest *model.ArchiveManifest) error {
+	entries := lo.KeyBy(manifest.Entries, func(e *model.ArchiveEntry) string { return e.Name })
+	return walkArchive(archivePath, func(name string, r io.Reader) error {
+		if name == ArchiveManifestName {
+			return nil
+		}
+		entry, ok := entries[name]
+		if !ok {
+			return fmt.Errorf("not in manifest: %s", name)
+		}
+		dst, err := archiveEntryPath(root, name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), util.NormalFolerPerm); err != nil {
+			return err
+		}
+		h := newArchiveHash()
+		if err := util.CreateFile(dst, io.TeeReader(r, h)); err != nil {
+			return err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != entry.Checksum {
+			return fmt.Errorf("checksum mismatch: %s", name)
+		}
+		if first, _, _ := strings.Cut(name, "/"); lo.Contains(archiveFolders, first) {
+			return util.LockFile(dst)
+		}
+		return nil
+	})
+}
+
+func createArchiveHandler(c *fiber.Ctx) error {
+	form := new(model.ArchiveForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	report, err := createArchive(c, form)
+	if err != nil {
+		return err
+	}
+	return c.JSON(report)
+}
+
+func verifyArchiveHandler(c *fiber.Ctx) error {
+	form := new(model.ArchivePathForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	report, _, err := verifyArchive(form.Path, form.Password)
+	if err != nil {
+		return err
+	}
+	return c.JSON(report)
+}
+
+func importArchiveHandler(c *fiber.Ctx) error {
+	form := new(model.ArchivePathForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	report, err := importArchive(c, form)
+	if errors.Is(err, errArchiveInvalid) {
+		return c.Status(409).JSON(report)
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(report)
+}
+
+// readPasswordCLI 從環境變量 LB_PASSWORD 或標準輸入讀取密碼.
+func readPasswordCLI() (string, error) {
+	if password := os.Getenv("LB_PASSWORD"); password != "" {
+		return password, nil
+	}
+	fmt.Fprint(os.Stderr, "password: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(err == io.EOF && line != "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// runArchiveCLI 通過命令行建立 (dir), 驗證 (verify) 或導入 (importFrom, 導入到 target) 歸檔,
+// 結果以 JSON 格式輸出到 stdout.
+func runArchiveCLI(dir, format string, compress bool, verify, importFrom, target string) error {
+	password, err := readPasswordCLI()
+	if err != nil {
+		return err
+	}
+	var report *model.ArchiveReport
+	switch {
+	case dir != "":
+		if err = login(password); err != nil {
+			return err
+		}
+		if format != "" && format != "tar" && format != "zip" {
+			return fmt.Errorf("unknown format: %s", format)
+		}
+		report, err = createArchive(nil, &model.ArchiveForm{Dir: dir, Format: format, Zstd: compress})
+	case verify != "":
+		report, _, err = verifyArchive(verify, password)
+	default:
+		report, err = importArchive(nil, &model.ArchivePathForm{
+			Path: importFrom, Target: target, Password: password})
+	}
+	if report != nil {
+		data, e := json.MarshalIndent(report, "", "  ")
+		if e != nil {
+			return e
+		}
+		fmt.Println(string(data))
+	}
+	if err == nil && !report.Valid {
+		err = errArchiveInvalid
+	}
+	return err
+}
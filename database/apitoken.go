@@ -0,0 +1,109 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+type APIToken = model.APIToken
+
+// APITokenPrefix 便於區分 API token 與 session token.
+const APITokenPrefix = "lbt_"
+
+var ErrInvalidAPIToken = errors.New("invalid api token (無效的 API token)")
+
+// token 是 32 字節的隨機數, 因此用 sha256 保存 hash 即可, 不需要 argon2id.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIToken 新建 API token, 返回 token 本身 (只有這一次機會看到).
+func (db *DB) CreateAPIToken(form *model.CreateAPITokenForm) (string, *APIToken, error) {
+	t, err := model.NewAPIToken(form)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, bucketName := range t.WriteBuckets() {
+		if _, err := db.GetBucketByName(bucketName); err != nil {
+			return "", nil, fmt.Errorf("%w: %s", err, bucketName)
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	token := APITokenPrefix + hex.EncodeToString(b)
+	t.Hash = hashAPIToken(token)
+	result, err := db.DB.Exec(stmt.InsertAPIToken,
+		t.Name, t.Hash, t.Scopes, t.CTime, t.Expires, t.Revoked)
+	if err != nil {
+		return "", nil, err
+	}
+	if t.ID, err = result.LastInsertId(); err != nil {
+		return "", nil, err
+	}
+	return token, t, nil
+}
+
+// FindAPIToken 查找有效的 API token (未撤銷, 未過期).
+func (db *DB) FindAPIToken(token string) (*APIToken, error) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return nil, ErrInvalidAPIToken
+	}
+	row := db.QueryRow(stmt.GetAPITokenByHash, hashAPIToken(token))
+	t, err := scanAPIToken(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if t.Revoked || t.Expired() {
+		return nil, ErrInvalidAPIToken
+	}
+	return &t, nil
+}
+
+func (db *DB) GetAllAPITokens() (all []*APIToken, err error) {
+	rows, err := db.Query(stmt.GetAllAPITokens)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		all = append(all, &t)
+	}
+	err = util.WrapErrors(rows.Err(), rows.Close())
+	return
+}
+
+func (db *DB) RevokeAPIToken(id int64) error {
+	return db.Exec(stmt.RevokeAPIToken, id)
+}
+
+func scanAPIToken(row Row) (t APIToken, err error) {
+	err = row.Scan(
+		&t.ID,
+		&t.Name,
+		&t.Hash,
+		&t.Scopes,
+		&t.CTime,
+		&t.Expires,
+		&t.Revoked,
+	)
+	return
+}
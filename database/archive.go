@@ -0,0 +1,67 @@
+package database
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+
+	"github.com/ahui2016/local-buckets/util"
+	"golang.org/x/crypto/blake2b"
+)
+
+// 歸檔 (archive) 中的 manifest 用專案的真正密鑰簽名: 簽名是用真正的密鑰加密的
+// manifest 的 checksum (blake2b-512), 能解密並且與 manifest 一致才算有效.
+// 沒有真正的密鑰無法偽造簽名, 因此 manifest 及其中記錄的 checksum 不能被篡改.
+
+var ErrBadSignature = errors.New("invalid manifest signature (manifest 簽名無效)")
+
+// SignManifest 用專案的真正密鑰為 manifest 簽名, 需要先登入.
+// 注意不使用更換密鑰過程中的新密鑰, 因為歸檔中的 CipherKey 仍然是舊密鑰.
+func (db *DB) SignManifest(manifest []byte) (Base64String, error) {
+	aesgcm := db.keys().aesgcm
+	if aesgcm == nil {
+		return "", fmt.Errorf("簽名需要管理員權限")
+	}
+	sum := blake2b.Sum512(manifest)
+	sig, err := encrypt(sum[:], aesgcm)
+	if err != nil {
+		return "", err
+	}
+	return util.Base64Encode(sig), nil
+}
+
+// VerifyManifest 用內存中的真正密鑰驗證 manifest 的簽名, 需要先登入.
+func (db *DB) VerifyManifest(manifest []byte, sig Base64String) error {
+	aesgcm := db.keys().aesgcm
+	if aesgcm == nil {
+		return fmt.Errorf("驗證簽名需要管理員權限")
+	}
+	return verifyManifest(aesgcm, manifest, sig)
+}
+
+// VerifyManifestWith 用 cipherKey 及其密碼驗證 manifest 的簽名,
+// 用於驗證其他專案 (或更換密鑰之前) 的歸檔.
+func VerifyManifestWith(cipherKey, password string, manifest []byte, sig Base64String) error {
+	realKey, err := unwrapKey(cipherKey, password)
+	if err != nil {
+		return err
+	}
+	return verifyManifest(newKeyGCM(realKey), manifest, sig)
+}
+
+func verifyManifest(aesgcm cipher.AEAD, manifest []byte, sig Base64String) error {
+	blob, err := util.Base64Decode(sig)
+	if err != nil {
+		return ErrBadSignature
+	}
+	sum, err := decrypt(blob, aesgcm)
+	if err != nil {
+		return ErrBadSignature
+	}
+	want := blake2b.Sum512(manifest)
+	if !bytes.Equal(sum, want[:]) {
+		return ErrBadSignature
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package database
+
+import (
+	"crypto/cipher"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/samber/lo"
+)
+
+// 每個加密倉庫有自己的密鑰, 被加密後保存在 bucket 表的 cipherkey 欄位中. 有三種情況:
+//
+//   - 空字符串: 舊版倉庫, 直接使用專案的真正密鑰, 管理員登入後即解鎖.
+//   - lbkey1$<hex>: 倉庫密鑰被專案的真正密鑰加密, 管理員登入後即解鎖.
+//   - lbkdf1$argon2id$...: 倉庫密鑰被倉庫專用密碼加密 (格式與 CipherKey 相同),
+//     管理員登入後, 還需要輸入倉庫密碼才能解鎖.
+const BucketKeyVersion = "lbkey1"
+
+var ErrBucketLocked = fmt.Errorf("bucket is locked (倉庫未解鎖)")
+
+// BucketHasPassword 判斷倉庫是否設有專用密碼.
+func BucketHasPassword(b *Bucket) bool {
+	return strings.HasPrefix(b.CipherKey, KDFVersion+"$")
+}
+
+// wrapWithDataKey 用專案的真正密鑰加密倉庫密鑰.
+// dataGCM 為 nil 表示在此期間已被登出.
+func wrapWithDataKey(bucketKey []byte, dataGCM cipher.AEAD) (string, error) {
+	if dataGCM == nil {
+		return "", ErrBucketLocked
+	}
+	encrypted, err := encrypt(bucketKey, dataGCM)
+	if err != nil {
+		return "", err
+	}
+	return BucketKeyVersion + "$" + hex.EncodeToString(encrypted), nil
+}
+
+// unwrapWithDataKey 用專案的真正密鑰解密倉庫密鑰.
+// 在更換密鑰的過程中, 倉庫密鑰可能已經被新密鑰加密, 因此會依次嘗試.
+func unwrapWithDataKey(cipherKey string, keys ...cipher.AEAD) ([]byte, error) {
+	encrypted, err := hex.DecodeString(strings.TrimPrefix(cipherKey, BucketKeyVersion+"$"))
+	if err != nil {
+		return nil, ErrBadCipherKey
+	}
+	for _, aesgcm := range lo.Compact(keys) {
+		if bucketKey, err := decrypt(encrypted, aesgcm); err == nil {
+			return bucketKey, nil
+		}
+	}
+	return nil, ErrBucketLocked
+}
+
+// newBucketCipherKey 為新的加密倉庫生成密鑰.
+// 如果 password 為空, 則用專案的真正密鑰加密倉庫密鑰, 否則用 password 加密.
+func (db *DB) newBucketCipherKey(password string) (cipherKey string, err error) {
+	if !db.IsLoggedIn() {
+		return "", fmt.Errorf("新建加密倉庫需要管理員權限")
+	}
+	bucketKey, err := randomKey()
+	if err != nil {
+		return
+	}
+	if password != "" {
+		cipherKey, err = wrapKey(bucketKey[:], password)
+	} else {
+		cipherKey, err = wrapWithDataKey(bucketKey[:], db.writeGCM())
+	}
+	if err != nil {
+		return
+	}
+	db.setBucketGCM(cipherKey, newKeyGCM(bucketKey[:]))
+	return
+}
+
+func (db *DB) setBucketGCM(cipherKey string, aesgcm cipher.AEAD) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if aesgcm == nil {
+		delete(db.bucketGCMs, cipherKey)
+		return
+	}
+	db.bucketGCMs[cipherKey] = aesgcm
+}
+
+func (db *DB) getBucketGCM(cipherKey string) cipher.AEAD {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.bucketGCMs[cipherKey]
+}
+
+// unlockDataKeyBuckets 在管理員登入後, 解鎖全部沒有專用密碼的加密倉庫.
+func (db *DB) unlockDataKeyBuckets() error {
+	k := db.keys()
+	buckets, err := db.GetAllBuckets()
+	if err != nil {
+		return err
+	}
+	for _, b := range buckets {
+		if !strings.HasPrefix(b.CipherKey, BucketKeyVersion+"$") {
+			continue
+		}
+		bucketKey, err := unwrapWithDataKey(b.CipherKey, k.pendingGCM, k.aesgcm)
+		if err != nil {
+			return fmt.Errorf("%s: %w", b.Name, err)
+		}
+		db.setBucketGCM(b.CipherKey, newKeyGCM(bucketKey))
+	}
+	return db.unlockPendingBucketKeys()
+}
+
+// UnlockBucket 用倉庫專用密碼解鎖倉庫.
+func (db *DB) UnlockBucket(b *Bucket, password string) error {
+	if !db.IsLoggedIn() {
+		return fmt.Errorf("請先登入管理員")
+	}
+	if !BucketHasPassword(b) {
+		return nil
+	}
+	bucketKey, err := unwrapKey(b.CipherKey, password)
+	if err != nil {
+		return err
+	}
+	db.setBucketGCM(b.CipherKey, newKeyGCM(bucketKey))
+	// 更換密鑰的過程中, 倉庫的新密鑰也是用同一個密碼加密的.
+	pending, err := db.getBucketKeyRotation(b.ID)
+	if err != nil || pending == "" || pending == b.CipherKey {
+		return err
+	}
+	return db.unlockPendingBucketKey(pending, password)
+}
+
+// LockBucket 鎖上設有專用密碼的倉庫 (從內存中刪除倉庫密鑰).
+func (db *DB) LockBucket(b *Bucket) {
+	if BucketHasPassword(b) {
+		db.setBucketGCM(b.CipherKey, nil)
+	}
+}
+
+// BucketIsUnlocked 判斷能否讀寫倉庫 b 中的檔案.
+func (db *DB) BucketIsUnlocked(b *Bucket) bool {
+	if !b.Encrypted {
+		return true
+	}
+	if !db.IsLoggedIn() {
+		return false
+	}
+	return b.CipherKey == "" || db.getBucketGCM(b.CipherKey) != nil
+}
+
+// ChangeBucketPassword 更改倉庫專用密碼, 倉庫密鑰不變 (因此不需要重新加密檔案).
+// 如果 newPwd 為空, 則取消專用密碼, 改為用專案的真正密鑰加密倉庫密鑰.
+// 舊版倉庫 (沒有自己的密鑰) 不可設置專用密碼.
+func (db *DB) ChangeBucketPassword(b *Bucket, oldPwd, newPwd string) error {
+	if !db.IsLoggedIn() {
+		return fmt.Errorf("請先登入管理員")
+	}
+	if !b.Encrypted || b.CipherKey == "" {
+		return fmt.Errorf("該倉庫沒有自己的密鑰, 不可設置倉庫密碼")
+	}
+	// 倉庫的新密鑰是用舊密碼加密的, 因此在更換密鑰的過程中不可更改倉庫密碼.
+	if err := db.errIfKeyRotating(); err != nil {
+		return err
+	}
+	bucketKey, err := db.exportBucketKey(b, oldPwd)
+	if err != nil {
+		return err
+	}
+	var cipherKey string
+	if newPwd != "" {
+		cipherKey, err = wrapKey(bucketKey, newPwd)
+	} else {
+		cipherKey, err = wrapWithDataKey(bucketKey, db.writeGCM())
+	}
+	if err != nil {
+		return err
+	}
+	if err := db.Exec(stmt.UpdateBucketCipherKey, cipherKey, b.ID); err != nil {
+		return err
+	}
+	db.setBucketGCM(b.CipherKey, nil)
+	db.setBucketGCM(cipherKey, newKeyGCM(bucketKey))
+	b.CipherKey = cipherKey
+	return nil
+}
+
+// exportBucketKey 獲取倉庫的明文密鑰 (只用於重新加密倉庫密鑰),
+// 如果該倉庫設有專用密碼, 則需要提供正確的密碼.
+func (db *DB) exportBucketKey(b *Bucket, password string) ([]byte, error) {
+	if BucketHasPassword(b) {
+		return unwrapKey(b.CipherKey, password)
+	}
+	k := db.keys()
+	return unwrapWithDataKey(b.CipherKey, k.pendingGCM, k.aesgcm)
+}
+
+// bucketKeys 返回倉庫的解密用 key (可能有多個) 與加密用 key.
+func (db *DB) bucketKeys(bucketName string) (readKeys []cipher.AEAD, writeKey cipher.AEAD, err error) {
+	b, err := db.GetBucketByName(bucketName)
+	if err != nil {
+		return
+	}
+	if !db.BucketIsUnlocked(&b) {
+		return nil, nil, ErrBucketLocked
+	}
+	// 使用快照, 以免在檢查之後被其他請求登出.
+	if b.CipherKey == "" {
+		k := db.keys()
+		if k.aesgcm == nil {
+			return nil, nil, ErrBucketLocked
+		}
+		return []cipher.AEAD{k.aesgcm, k.pendingGCM}, k.write(), nil
+	}
+	aesgcm := db.getBucketGCM(b.CipherKey)
+	if aesgcm == nil {
+		return nil, nil, ErrBucketLocked
+	}
+	// 更換密鑰的過程中, 新舊密鑰都可以解密, 用新密鑰加密.
+	pending, err := db.pendingBucketGCM(&b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if pending != nil {
+		return []cipher.AEAD{pending, aesgcm}, pending, nil
+	}
+	return []cipher.AEAD{aesgcm}, aesgcm, nil
+}
+
+// lockedBuckets 返回未解鎖的加密倉庫的名稱 (只在管理員已登入時有意義).
+func (db *DB) lockedBuckets() (map[string]bool, error) {
+	locked := make(map[string]bool)
+	buckets, err := db.GetAllBuckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		if !db.BucketIsUnlocked(b) {
+			locked[b.Name] = true
+		}
+	}
+	return locked, nil
+}
+
+// revealFiles 隱藏未解鎖倉庫中的檔案的名稱等資訊,
+// 並解密已解鎖的密封倉庫中的檔案的名稱等資訊.
+func (db *DB) revealFiles(files []*FilePlus) ([]*FilePlus, error) {
+	if !db.IsLoggedIn() {
+		return files, nil
+	}
+	locked, err := db.lockedBuckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if locked[file.BucketName] {
+			file.Redact()
+			continue
+		}
+		if _, err := db.UnsealFile(&file.File); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// dropLockedFiles 刪除未解鎖倉庫中的檔案 (用於搜尋結果, 避免洩露檔案名稱).
+func (db *DB) dropLockedFiles(files []*FilePlus) ([]*FilePlus, error) {
+	if !db.IsLoggedIn() {
+		return files, nil
+	}
+	locked, err := db.lockedBuckets()
+	if err != nil {
+		return nil, err
+	}
+	return lo.Filter(files, func(file *FilePlus, _ int) bool {
+		return !locked[file.BucketName]
+	}), nil
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+type SyncState = model.SyncState
+
+// 檔案及倉庫的變化由觸發器記錄在 change_log 表中 (見 stmt.CreateChangeLogTable),
+// 備份專案在 sync_state 表中記錄上次同步到主專案的哪個 seq,
+// 下次同步時只需要處理 seq 更大的檔案及倉庫.
+
+// ChangeSeq 返回最新的變化序號, 沒有任何記錄時返回 0.
+func (db *DB) ChangeSeq() (int64, error) {
+	return db.GetInt1(stmt.GetMaxChangeSeq)
+}
+
+// GetChangesSince 返回序號大於 seq 的變化, 按發生的先後排列.
+func (db *DB) GetChangesSince(seq int64) (fileIDs, bucketIDs []int64, err error) {
+	rows, err := db.Query(stmt.GetChangesSince, seq)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var kind string
+		var id int64
+		if err = rows.Scan(&kind, &id); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		switch kind {
+		case model.ChangeFile:
+			fileIDs = append(fileIDs, id)
+		case model.ChangeBucket:
+			bucketIDs = append(bucketIDs, id)
+		default:
+			rows.Close()
+			return nil, nil, fmt.Errorf("unknown change kind: %s", kind)
+		}
+	}
+	err = util.WrapErrors(rows.Err(), rows.Close())
+	return
+}
+
+// GetSyncState 獲取備份專案的同步進度, 從未記錄 (需要全量對比) 則返回 nil.
+func (db *DB) GetSyncState() (*SyncState, error) {
+	state := new(SyncState)
+	row := db.QueryRow(stmt.GetSyncState)
+	err := row.Scan(&state.SourceSeq, &state.SyncedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return state, err
+}
+
+// SetSyncState 記錄備份專案已同步到主專案的變化序號 seq.
+func (db *DB) SetSyncState(seq int64) error {
+	return db.Exec(stmt.SetSyncState, seq, model.Now())
+}
+
+// DeleteSyncState 清除同步進度, 下次同步時全量對比 (例如改為從另一個主專案同步).
+func (db *DB) DeleteSyncState() error {
+	return db.Exec(stmt.DeleteSyncState)
+}
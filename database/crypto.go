@@ -7,17 +7,40 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/samber/lo"
+	"golang.org/x/crypto/argon2"
 )
 
 const (
 	KeySize         = 16
 	NonceSize       = 12
-	BcryptCost      = 15 // 根据服务器运算速度而定, 由于我这个是本地程序, 因此设大一点
+	SaltSize        = 16
 	DefaultPassword = "abc123"
 )
 
+// 被加密的真正密鑰 (CipherKey) 的格式:
+//
+//	lbkdf1$argon2id$t=3,m=65536,p=4$<salt hex>$<encrypted key hex>
+//
+// 舊版格式沒有 header, 只有 <encrypted key hex>, 並且是用 md5(password) 加密的.
+const (
+	KDFVersion = "lbkdf1"
+	KDFArgon2  = "argon2id"
+
+	// Argon2id 參數, 由於這是本地程式, 可以設大一點.
+	argonTime    uint32 = 3
+	argonMemory  uint32 = 64 * 1024 // 單位: KiB
+	argonThreads uint8  = 4
+
+	// CipherKey 來自 project.toml, 參數過大 (例如檔案受損或被篡改) 會在登入時耗盡內存,
+	// 因此設定上限. Threads 是 uint8, 本身不會超過 255.
+	maxArgonTime   uint32 = 16
+	maxArgonMemory uint32 = 4 * 1024 * 1024 // 4 GiB, 單位: KiB
+)
+
 type (
 	HexString = string
 	Nonce     = [NonceSize]byte
@@ -26,6 +49,7 @@ type (
 
 var (
 	ErrWrongPassword = errors.New("wrong password (密碼錯誤)")
+	ErrBadCipherKey  = errors.New("invalid CipherKey format (CipherKey 格式錯誤)")
 )
 
 // Never use more than 2^32 random nonces with a given key because of the risk of a repeat.
@@ -49,21 +73,124 @@ func encrypt(data []byte, aesgcm cipher.AEAD) (encrypted []byte, err error) {
 }
 
 func decrypt(blob []byte, aesgcm cipher.AEAD) (data []byte, err error) {
+	if len(blob) < NonceSize {
+		return nil, ErrStreamTruncated
+	}
 	nonce := blob[:NonceSize]
 	encryped := blob[NonceSize:]
 	return aesgcm.Open(nil, nonce, encryped, nil)
 }
 
+// newGCM 是舊版的做法, 用 md5(password) 作為密鑰.
+// 現在只用於讀取舊版格式的 CipherKey 及舊版格式的加密檔案.
 func newGCM(password string) cipher.AEAD {
 	key := md5.Sum([]byte(password))
-	block := lo.Must(aes.NewCipher(key[:]))
+	return newKeyGCM(key[:])
+}
+
+// newKeyGCM 用真正的密鑰 (而不是密碼) 生成 AEAD, 用於加密檔案.
+func newKeyGCM(key []byte) cipher.AEAD {
+	block := lo.Must(aes.NewCipher(key))
 	return lo.Must(cipher.NewGCM(block))
 }
 
+// kdfParams 是從密碼生成密鑰的參數, 與 salt 一起保存在 CipherKey 中.
+type kdfParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Salt    []byte
+}
+
+func newKDFParams() (*kdfParams, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &kdfParams{
+		Time:    argonTime,
+		Memory:  argonMemory,
+		Threads: argonThreads,
+		Salt:    salt,
+	}, nil
+}
+
+func (p *kdfParams) gcm(password string) cipher.AEAD {
+	key := argon2.IDKey([]byte(password), p.Salt, p.Time, p.Memory, p.Threads, KeySize)
+	return newKeyGCM(key)
+}
+
+func (p *kdfParams) String() string {
+	return fmt.Sprintf("t=%d,m=%d,p=%d", p.Time, p.Memory, p.Threads)
+}
+
+// parseCipherKey 解析 CipherKey, 如果是舊版格式, 返回的 params 為 nil.
+func parseCipherKey(cipherKey string) (params *kdfParams, encryptedKey []byte, err error) {
+	if !strings.HasPrefix(cipherKey, KDFVersion+"$") {
+		encryptedKey, err = hex.DecodeString(cipherKey)
+		return nil, encryptedKey, err
+	}
+	parts := strings.Split(cipherKey, "$")
+	if len(parts) != 5 || parts[1] != KDFArgon2 {
+		return nil, nil, ErrBadCipherKey
+	}
+	params = new(kdfParams)
+	_, err = fmt.Sscanf(parts[2], "t=%d,m=%d,p=%d", &params.Time, &params.Memory, &params.Threads)
+	if err != nil || params.Time == 0 || params.Memory == 0 || params.Threads == 0 ||
+		params.Time > maxArgonTime || params.Memory > maxArgonMemory {
+		return nil, nil, ErrBadCipherKey
+	}
+	if params.Salt, err = hex.DecodeString(parts[3]); err != nil {
+		return nil, nil, ErrBadCipherKey
+	}
+	if encryptedKey, err = hex.DecodeString(parts[4]); err != nil {
+		return nil, nil, ErrBadCipherKey
+	}
+	return
+}
+
+// IsLegacyCipherKey 判斷 CipherKey 是不是舊版格式 (用 md5 處理密碼).
+func IsLegacyCipherKey(cipherKey string) bool {
+	return !strings.HasPrefix(cipherKey, KDFVersion+"$")
+}
+
+// wrapKey 用密碼加密真正的密鑰, 採用新格式 (argon2id).
+func wrapKey(realKey []byte, password string) (HexString, error) {
+	params, err := newKDFParams()
+	if err != nil {
+		return "", err
+	}
+	encryptedKey, err := encrypt(realKey, params.gcm(password))
+	if err != nil {
+		return "", err
+	}
+	return strings.Join([]string{
+		KDFVersion,
+		KDFArgon2,
+		params.String(),
+		hex.EncodeToString(params.Salt),
+		hex.EncodeToString(encryptedKey),
+	}, "$"), nil
+}
+
+// unwrapKey 用密碼解密真正的密鑰, 同時支持新舊兩種格式.
+func unwrapKey(cipherKey, password string) (realKey []byte, err error) {
+	params, encryptedKey, err := parseCipherKey(cipherKey)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm := lo.TernaryF(params == nil,
+		func() cipher.AEAD { return newGCM(password) },
+		func() cipher.AEAD { return params.gcm(password) },
+	)
+	if realKey, err = decrypt(encryptedKey, aesgcm); err != nil {
+		return nil, ErrWrongPassword
+	}
+	return
+}
+
 // DefaultCipherKey 用默認密碼去加密真正的密鑰.
 func DefaultCipherKey() HexString {
-	aesgcm := newGCM(DefaultPassword)
 	realKey := lo.Must(randomKey())
-	encryptedKey := lo.Must(encrypt(realKey[:], aesgcm))
-	return hex.EncodeToString(encryptedKey)
+	return lo.Must(wrapKey(realKey[:], DefaultPassword))
 }
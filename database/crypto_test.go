@@ -0,0 +1,131 @@
+package database
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestParseCipherKey(t *testing.T) {
+	salt := bytes.Repeat([]byte{0xab}, SaltSize)
+	saltHex := hex.EncodeToString(salt)
+	tests := []struct {
+		name      string
+		cipherKey string
+		legacy    bool
+		params    *kdfParams
+		key       string // encrypted key hex
+		err       error
+	}{
+		{"legacy", "0102ff", true, nil, "0102ff", nil},
+		{"legacy bad hex", "xyz", true, nil, "", hex.InvalidByteError('x')},
+		{"lbkdf1", "lbkdf1$argon2id$t=3,m=65536,p=4$" + saltHex + "$0102ff", false,
+			&kdfParams{Time: 3, Memory: 65536, Threads: 4, Salt: salt}, "0102ff", nil},
+		{"other params", "lbkdf1$argon2id$t=1,m=8,p=1$" + saltHex + "$00", false,
+			&kdfParams{Time: 1, Memory: 8, Threads: 1, Salt: salt}, "00", nil},
+		{"too few parts", "lbkdf1$argon2id$t=3,m=65536,p=4$" + saltHex, false, nil, "", ErrBadCipherKey},
+		{"too many parts", "lbkdf1$argon2id$t=3,m=65536,p=4$" + saltHex + "$00$00", false, nil, "", ErrBadCipherKey},
+		{"unknown kdf", "lbkdf1$scrypt$t=3,m=65536,p=4$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"bad params", "lbkdf1$argon2id$m=65536$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"zero time", "lbkdf1$argon2id$t=0,m=65536,p=4$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"zero memory", "lbkdf1$argon2id$t=3,m=0,p=4$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"zero threads", "lbkdf1$argon2id$t=3,m=65536,p=0$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"max params", "lbkdf1$argon2id$t=16,m=4194304,p=255$" + saltHex + "$00", false,
+			&kdfParams{Time: 16, Memory: 4194304, Threads: 255, Salt: salt}, "00", nil},
+		{"time too large", "lbkdf1$argon2id$t=17,m=65536,p=4$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"memory too large", "lbkdf1$argon2id$t=3,m=4194305,p=4$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"memory overflow", "lbkdf1$argon2id$t=3,m=99999999999,p=4$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"threads too large", "lbkdf1$argon2id$t=3,m=65536,p=256$" + saltHex + "$00", false, nil, "", ErrBadCipherKey},
+		{"bad salt", "lbkdf1$argon2id$t=3,m=65536,p=4$zz$00", false, nil, "", ErrBadCipherKey},
+		{"bad key", "lbkdf1$argon2id$t=3,m=65536,p=4$" + saltHex + "$zz", false, nil, "", ErrBadCipherKey},
+		{"uppercase version", "LBKDF1$argon2id$t=3,m=65536,p=4$" + saltHex + "$00", true, nil, "", hex.InvalidByteError('L')},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsLegacyCipherKey(tt.cipherKey); got != tt.legacy {
+				t.Fatalf("IsLegacyCipherKey = %v, want %v", got, tt.legacy)
+			}
+			params, key, err := parseCipherKey(tt.cipherKey)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(key) != tt.key {
+				t.Fatalf("got key %x, want %s", key, tt.key)
+			}
+			if tt.params == nil {
+				if params != nil {
+					t.Fatalf("got params %+v, want nil", params)
+				}
+				return
+			}
+			if params == nil || params.String() != tt.params.String() || !bytes.Equal(params.Salt, tt.params.Salt) {
+				t.Fatalf("got params %+v, want %+v", params, tt.params)
+			}
+		})
+	}
+}
+
+func TestWrapUnwrapKey(t *testing.T) {
+	realKey, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := wrapKey(realKey[:], DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacyKey, err := encrypt(realKey[:], newGCM(DefaultPassword))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := hex.EncodeToString(legacyKey)
+
+	if IsLegacyCipherKey(wrapped) {
+		t.Fatal("wrapKey should use the lbkdf1 format")
+	}
+	params, _, err := parseCipherKey(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Time != argonTime || params.Memory != argonMemory || params.Threads != argonThreads ||
+		len(params.Salt) != SaltSize {
+		t.Fatalf("unexpected params %+v", params)
+	}
+
+	tests := []struct {
+		name      string
+		cipherKey string
+		password  string
+		err       error
+	}{
+		{"lbkdf1", wrapped, DefaultPassword, nil},
+		{"lbkdf1 wrong password", wrapped, "wrong", ErrWrongPassword},
+		{"legacy", legacy, DefaultPassword, nil},
+		{"legacy wrong password", legacy, "wrong", ErrWrongPassword},
+		{"bad format", "lbkdf1$argon2id$" + wrapped, DefaultPassword, ErrBadCipherKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unwrapKey(tt.cipherKey, tt.password)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, realKey[:]) {
+				t.Fatal("unwrapped key mismatch")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ahui2016/local-buckets/model"
+)
+
+// 列出檔案時使用 keyset 分頁: 按 (排序欄位, id) 排列 (默認降序),
+// 下一頁從上一頁最後一個檔案之後開始. 這樣即使很多檔案的 utime 相同
+// (例如批量上傳), 也不會在翻頁時遺漏或重複.
+//
+// 游標 (cursor) 是上一頁最後一個檔案的排序欄位的值及 id, 編碼為 base64 字符串,
+// 對客戶端而言是不透明的, 客戶端只需原樣傳回.
+
+type FilesPage = model.FilesPage
+
+type cursor struct {
+	Sort  string `json:"s"`
+	Order string `json:"o"`
+	Int   int64  `json:"i,omitempty"`
+	Str   string `json:"t,omitempty"`
+	ID    int64  `json:"id"`
+}
+
+func newCursor(file *FilePlus, sortBy, order string) cursor {
+	c := cursor{Sort: sortBy, Order: order, ID: file.ID}
+	switch sortBy {
+	case "utime":
+		c.Str = file.UTime
+	case "ctime":
+		c.Str = file.CTime
+	case "name":
+		c.Str = file.Name
+	case "like":
+		c.Int = file.Like
+	case "size":
+		c.Int = file.Size
+	case "id":
+		c.Int = file.ID
+	case "deleted_at":
+		c.Str = file.DeletedAt
+	}
+	return c
+}
+
+func (c cursor) value() any {
+	if sortColumns[c.Sort].isInt {
+		return c.Int
+	}
+	return c.Str
+}
+
+func (c cursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor 解碼游標, 並檢查其排序欄位及方向是否與 sortBy, order 一致.
+func decodeCursor(s, sortBy, order string) (c cursor, err error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("無效的 cursor: %w", err)
+	}
+	if c.Sort != sortBy || c.Order != order {
+		return c, fmt.Errorf("cursor 的排序 (%s %s) 與參數 (%s %s) 不一致",
+			c.Sort, c.Order, sortBy, order)
+	}
+	return
+}
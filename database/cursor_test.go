@@ -0,0 +1,133 @@
+package database
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	file := &FilePlus{File: File{
+		ID: 42, Name: "報告.txt", Like: 3, Size: 1024,
+		CTime: "2023-06-15 12:00:00+08:00", UTime: "2024-01-02 03:04:05+08:00",
+	}, DeletedAt: "2024-02-01 00:00:00+08:00"}
+	tests := []struct {
+		sort  string
+		value any
+	}{
+		{"utime", file.UTime},
+		{"ctime", file.CTime},
+		{"name", file.Name},
+		{"like", file.Like},
+		{"size", file.Size},
+		{"id", file.ID},
+		{"deleted_at", file.DeletedAt},
+	}
+	if len(tests) != len(sortColumns) {
+		t.Fatal("every sort column should be tested")
+	}
+	for _, tt := range tests {
+		for _, order := range []string{"asc", "desc"} {
+			t.Run(tt.sort+" "+order, func(t *testing.T) {
+				s := newCursor(file, tt.sort, order).encode()
+				if strings.ContainsAny(s, "+/=") {
+					t.Fatalf("cursor %q is not url-safe", s)
+				}
+				c, err := decodeCursor(s, tt.sort, order)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.ID != file.ID || c.value() != tt.value {
+					t.Fatalf("got (%v, %d), want (%v, %d)", c.value(), c.ID, tt.value, file.ID)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeCursorError(t *testing.T) {
+	valid := newCursor(&FilePlus{File: File{ID: 1, Like: 2}}, "like", "desc").encode()
+	tests := []struct {
+		name   string
+		cursor string
+		sort   string
+		order  string
+	}{
+		{"not base64", "!!!", "like", "desc"},
+		{"padded base64", valid + "==", "like", "desc"},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("like,2")), "like", "desc"},
+		{"other sort", valid, "size", "desc"},
+		{"other order", valid, "like", "asc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeCursor(tt.cursor, tt.sort, tt.order); err == nil {
+				t.Fatal("want error")
+			}
+		})
+	}
+}
+
+// 按任何欄位排序並翻頁, 結果都應與不分頁時一致, 即使很多檔案的排序欄位的值相同.
+func TestCursorPaging(t *testing.T) {
+	db := newTestDB(t)
+	addTestBucket(t, db, "pub", false)
+	for _, f := range []File{
+		{Name: "e.txt", Like: 1, Size: 10, UTime: "2024-01-01 00:00:00+08:00"},
+		{Name: "a.txt", Like: 1, Size: 30, UTime: "2024-01-01 00:00:00+08:00"},
+		{Name: "g.txt", Like: 0, Size: 10, UTime: "2024-01-01 00:00:00+08:00"},
+		{Name: "b.txt", Like: 2, Size: 20, UTime: "2024-01-03 00:00:00+08:00"},
+		{Name: "f.txt", Like: 1, Size: 10, UTime: "2024-01-01 00:00:00+08:00"},
+		{Name: "c.txt", Like: 0, Size: 20, UTime: "2024-01-02 00:00:00+08:00"},
+		{Name: "d.txt", Like: 2, Size: 10, UTime: "2024-01-01 00:00:00+08:00"},
+	} {
+		f.BucketName = "pub"
+		addTestFile(t, db, f)
+	}
+	ids := func(files []*FilePlus) (all []int64) {
+		for _, f := range files {
+			all = append(all, f.ID)
+		}
+		return
+	}
+	for sortBy := range sortColumns {
+		for _, order := range []string{"asc", "desc"} {
+			for _, limit := range []int64{1, 2, 3, 7} {
+				q := FileQuery{Sort: sortBy, Order: order}
+				all, err := db.ListFiles(q, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if all.HasMore || len(all.Files) != 7 {
+					t.Fatalf("%s %s: got %d files without limit", sortBy, order, len(all.Files))
+				}
+				var paged []*FilePlus
+				q.Limit = limit
+				for pages := 1; ; pages++ {
+					page, err := db.ListFiles(q, false)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if int64(len(page.Files)) > limit {
+						t.Fatalf("%s %s: page size %d > limit %d", sortBy, order, len(page.Files), limit)
+					}
+					paged = append(paged, page.Files...)
+					if !page.HasMore {
+						if page.NextCursor != "" {
+							t.Fatalf("%s %s: last page has a cursor", sortBy, order)
+						}
+						break
+					}
+					if pages > 7 {
+						t.Fatalf("%s %s: too many pages", sortBy, order)
+					}
+					q.Cursor = page.NextCursor
+				}
+				if got, want := ids(paged), ids(all.Files); !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s %s limit %d: got %v, want %v", sortBy, order, limit, got, want)
+				}
+			}
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package database
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/cipher"
 	"database/sql"
-	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ahui2016/local-buckets/model"
@@ -23,6 +29,7 @@ type (
 	Bucket           = model.Bucket
 	File             = model.File
 	FilePlus         = model.FilePlus
+	FileVersion      = model.FileVersion
 	FileExportImport = model.FileExportImport
 	Project          = model.Project
 	ProjectStatus    = model.ProjectStatus
@@ -36,8 +43,39 @@ type DB struct {
 	Path       string // 数据库的路径
 	IsBackup   bool
 	FilesLimit int64
+
+	// 登入, 登出以及清理過期 session 的 goroutine 都會修改密鑰,
+	// 因此 dk 與 bucketGCMs 都由 mu 保護, dk 要通過 keys() 讀取.
+	mu         sync.RWMutex
+	dk         dataKeys
+	bucketGCMs map[string]cipher.AEAD // 已解鎖的倉庫密鑰, key 是 Bucket.CipherKey
+}
+
+// dataKeys 是專案的真正密鑰在內存中的狀態.
+type dataKeys struct {
 	cipherKey  HexString
-	aesgcm     cipher.AEAD
+	aesgcm     cipher.AEAD // 用真正的密鑰加密解密檔案
+	legacyGCM  cipher.AEAD // 用密碼加密解密舊版格式的檔案
+	pendingGCM cipher.AEAD // 更換密鑰的過程中, 用新密鑰加密檔案
+}
+
+// write 返回用來加密新檔案的 AEAD, 在更換密鑰的過程中使用新密鑰.
+func (k dataKeys) write() cipher.AEAD {
+	return lo.Ternary(k.pendingGCM != nil, k.pendingGCM, k.aesgcm)
+}
+
+// keys 返回密鑰的快照, 之後即使登出, 快照中的密鑰也不會被清除.
+func (db *DB) keys() dataKeys {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.dk
+}
+
+// updateKeys 在鎖定的狀態下修改密鑰.
+func (db *DB) updateKeys(update func(k *dataKeys)) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	update(&db.dk)
 }
 
 func OpenDB(dbPath string, projCfg *Project) (*DB, error) {
@@ -51,13 +89,53 @@ func OpenDB(dbPath string, projCfg *Project) (*DB, error) {
 		Path:       dbPath,
 		IsBackup:   projCfg.IsBackup,
 		FilesLimit: projCfg.RecentFilesLimit,
-		cipherKey:  projCfg.CipherKey,
-		aesgcm:     nil,
+		dk:         dataKeys{cipherKey: projCfg.CipherKey},
+		bucketGCMs: make(map[string]cipher.AEAD),
 	}
-	err = db.Exec(stmt.CreateTables)
+	err = db.migrate()
 	return db, err
 }
 
+// OpenReadonlyDB 以只讀方式打開數據庫 (例如快照, 同步預覽), 不執行遷移, 也不會新建數據庫.
+// 數據庫的版本必須與本程序一致, 否則拒絕打開.
+func OpenReadonlyDB(dbPath string, projCfg *Project) (*DB, error) {
+	if util.PathNotExists(dbPath) {
+		return nil, fmt.Errorf("not found: %s", dbPath)
+	}
+	sqlDB, err := sql.Open("sqlite", readonlyDSN(dbPath))
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{
+		DB:         sqlDB,
+		Path:       dbPath,
+		IsBackup:   projCfg.IsBackup,
+		FilesLimit: projCfg.RecentFilesLimit,
+		dk:         dataKeys{cipherKey: projCfg.CipherKey},
+		bucketGCMs: make(map[string]cipher.AEAD),
+	}
+	version, err := db.SchemaVersion()
+	if err == nil && version != LatestSchemaVersion {
+		err = fmt.Errorf("數據庫版本 (%d) 與本程序支持的版本 (%d) 不一致: %s",
+			version, LatestSchemaVersion, dbPath)
+	}
+	if err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// readonlyDSN 返回只讀的 SQLite URI, 例如 file:///path/to/project.db?mode=ro
+func readonlyDSN(dbPath string) string {
+	p := filepath.ToSlash(dbPath)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p // Windows: C:/... => /C:/...
+	}
+	u := url.URL{Scheme: "file", Path: p, RawQuery: "mode=ro&_pragma=foreign_keys(1)"}
+	return u.String()
+}
+
 func (db *DB) Exec(query string, args ...any) (err error) {
 	_, err = db.DB.Exec(query, args...)
 	return
@@ -80,51 +158,124 @@ func (db *DB) GetInt1(query string, arg ...any) (int64, error) {
 	return getInt1(db.DB, query, arg...)
 }
 
+// IsLoggedIn 表示真正的密鑰是否已在內存中 (至少有一個有效的 session).
+// 注意, 這不代表當前請求已登入, 當前請求是否有管理員權限由 session 決定,
+// 並通過參數 admin 傳入需要區分的函數.
 func (db *DB) IsLoggedIn() bool {
-	return db.aesgcm != nil
+	return db.keys().aesgcm != nil
 }
 
 func (db *DB) Logout() {
-	db.aesgcm = nil
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.dk = dataKeys{cipherKey: db.dk.cipherKey}
+	db.bucketGCMs = make(map[string]cipher.AEAD)
 }
 
+// SetAESGCM 用密碼解密真正的密鑰, 成功後即為登入狀態.
+// 新格式的檔案用真正的密鑰加密, 舊版格式的檔案則是直接用 md5(password) 加密的.
+// 只替換專案的密鑰, 已用倉庫密碼解鎖的倉庫保持解鎖.
 func (db *DB) SetAESGCM(password string) (realKey []byte, err error) {
-	aesgcm := newGCM(password)
-	cipherBytes, err := hex.DecodeString(db.cipherKey)
-	if err != nil {
+	if realKey, err = unwrapKey(db.keys().cipherKey, password); err != nil {
 		return nil, err
 	}
-	realKey, err = decrypt(cipherBytes, aesgcm)
-	if err == nil {
-		db.aesgcm = aesgcm
+	// 如果有未完成的更換密鑰操作, 則同時解密新密鑰.
+	pendingGCM, err := db.pendingKey(password)
+	if err != nil {
+		return nil, err
 	}
+	db.updateKeys(func(k *dataKeys) {
+		k.aesgcm = newKeyGCM(realKey)
+		k.legacyGCM = newGCM(password)
+		k.pendingGCM = pendingGCM
+	})
+	err = db.unlockDataKeyBuckets()
 	return
 }
 
+// CheckPassword 只檢查密碼是否正確, 不改變內存中的密鑰 (不影響已解鎖的倉庫).
+func (db *DB) CheckPassword(password string) error {
+	_, err := unwrapKey(db.keys().cipherKey, password)
+	return err
+}
+
+// ChangePassword 只更改用來加密真正密鑰的密碼, 真正的密鑰不變.
+// 新的 CipherKey 一律採用新格式 (argon2id).
+// 注意, 舊版格式的檔案是直接用密碼加密的, 因此在更改密碼之前,
+// 應先使用 ReEncryptFile 把舊版格式的檔案轉換為新格式.
 func (db *DB) ChangePassword(oldPwd, newPwd string) (HexString, error) {
-	realKey, err := db.SetAESGCM(oldPwd)
+	realKey, err := unwrapKey(db.keys().cipherKey, oldPwd)
 	if err != nil {
 		return "", err
 	}
-	aesgcm := newGCM(newPwd)
-	encryptedKey := lo.Must(encrypt(realKey[:], aesgcm))
-	db.aesgcm = aesgcm
-	db.cipherKey = hex.EncodeToString(encryptedKey)
-	return db.cipherKey, nil
+	cipherKey, err := wrapKey(realKey, newPwd)
+	if err != nil {
+		return "", err
+	}
+	db.updateKeys(func(k *dataKeys) { k.cipherKey = cipherKey })
+	return cipherKey, nil
 }
 
-func (db *DB) AutoGetKeywords() ([]string, error) {
-	query := lo.Ternary(db.IsLoggedIn(), stmt.GetAllKeywords, stmt.GetPublicKeywords)
-	rows, err := db.Query(query)
+// CipherKeyIsLegacy 判斷當前的 CipherKey 是不是舊版格式.
+func (db *DB) CipherKeyIsLegacy() bool {
+	return IsLegacyCipherKey(db.keys().cipherKey)
+}
+
+// AutoGetKeywords 獲取全部標籤 (不包括回收站中的檔案的標籤).
+func (db *DB) AutoGetKeywords(admin bool) ([]string, error) {
+	if admin && db.IsLoggedIn() {
+		return db.unlockedKeywords()
+	}
+	rows, err := db.Query(stmt.GetPublicTags)
 	if err != nil {
 		return nil, err
 	}
 	return scanKeywords(rows)
 }
 
-// autoGetBuckets 根据 db.IsLoggedIn 自动获取公开仓库或全部仓库
-func (db *DB) autoGetBuckets() ([]*Bucket, error) {
-	query := lo.Ternary(db.IsLoggedIn(), stmt.GetAllBuckets, stmt.GetPublicBuckets)
+// unlockedKeywords 獲取已解鎖倉庫 (包括公開倉庫) 中的標籤.
+func (db *DB) unlockedKeywords() (all []string, err error) {
+	locked, err := db.lockedBuckets()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(stmt.GetTagsWithBucket)
+	if err != nil {
+		return nil, err
+	}
+	var kw, bucketName string
+	for rows.Next() {
+		if err := rows.Scan(&kw, &bucketName); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !locked[bucketName] {
+			all = append(all, kw)
+		}
+	}
+	if err = util.WrapErrors(rows.Err(), rows.Close()); err != nil {
+		return nil, err
+	}
+	// 密封倉庫中的檔案的標籤需要解密.
+	sealed, err := db.getUnsealedFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range sealed {
+		if !file.Deleted {
+			all = append(all, model.SplitTags(file.Keywords)...)
+		}
+	}
+	all = lo.UniqBy(all, strings.ToLower)
+	sort.Slice(all, func(i, j int) bool {
+		return strings.ToLower(all[i]) < strings.ToLower(all[j])
+	})
+	return all, nil
+}
+
+// autoGetBuckets 根据 admin 自动获取公开仓库或全部仓库
+func (db *DB) autoGetBuckets(admin bool) ([]*Bucket, error) {
+	query := lo.Ternary(admin, stmt.GetAllBuckets, stmt.GetPublicBuckets)
 	rows, err := db.Query(query)
 	if err != nil {
 		return nil, err
@@ -163,6 +314,11 @@ func (db *DB) InsertBucket(form *model.CreateBucketForm) (*Bucket, error) {
 	if err != nil {
 		return nil, err
 	}
+	if bucket.Encrypted {
+		if bucket.CipherKey, err = db.newBucketCipherKey(form.Password); err != nil {
+			return nil, err
+		}
+	}
 	if err = insertBucket(db.DB, bucket); err != nil {
 		return nil, err
 	}
@@ -179,12 +335,18 @@ func (db *DB) UpdateBucketInfo(bucket *Bucket) error {
 }
 
 func (db *DB) InsertFile(file *File) error {
-	return insertFile(db.DB, file)
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := insertFile(tx, file); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // InsertAndReturnFile 主要用于同名檔案冲突时的逐一处理.
 func (db *DB) InsertAndReturnFile(file *File) (*File, error) {
-	if err := insertFile(db.DB, file); err != nil {
+	if err := db.InsertFile(file); err != nil {
 		return nil, err
 	}
 	f, err := db.GetFileByChecksum(file.Checksum)
@@ -192,7 +354,13 @@ func (db *DB) InsertAndReturnFile(file *File) (*File, error) {
 }
 
 func (db *DB) InsertFileWithID(file *File) error {
-	return insertFileWithID(db.DB, file)
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := insertFileWithID(tx, file); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // 该函数可能可以删除。
@@ -202,7 +370,7 @@ func (db *DB) insertFiles(files []*File) error {
 	defer tx.Rollback()
 
 	for _, file := range files {
-		if err := insertFile(db.DB, file); err != nil {
+		if err := insertFile(tx, file); err != nil {
 			return err
 		}
 	}
@@ -215,9 +383,25 @@ func (db *DB) UpdateFileContent(file *File) error {
 		stmt.UpdateFileContent, file.Checksum, file.Size, file.UTime, file.ID)
 }
 
+// UpdateFileInfo 更新檔案資訊, 並同時更新標籤.
 func (db *DB) UpdateFileInfo(file *File) error {
-	return db.Exec(stmt.UpdateFileInfo, file.Name, file.Notes,
-		file.Keywords, file.Type, file.Like, file.CTime, file.UTime, file.ID)
+	file.Keywords = model.NormalizeKeywords(file.Keywords)
+	return db.execWithTags(file, stmt.UpdateFileInfo, file.Name, file.Notes,
+		file.Keywords, file.Type, file.Like, file.CTime, file.UTime, file.Sealed, file.ID)
+}
+
+// execWithTags 在一個事務中執行 query 並根據 file.Keywords 更新標籤.
+func (db *DB) execWithTags(file *File, query string, args ...any) error {
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(query, args...); err != nil {
+		return err
+	}
+	if err := setFileTags(tx, file.ID, file.Keywords); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (db *DB) MoveFileToBucket(fileID int64, bucketName string) error {
@@ -254,13 +438,18 @@ func (db *DB) checkSameFile(file *File) error {
 }
 
 // 有同名檔案时返回 ErrSameNameFiles, 无同名檔案则返回 nil 或其他错误.
+// 密封倉庫中的檔案, 只有在倉庫已解鎖時才能檢查其真正名稱.
 func (db *DB) CheckSameFilename(name string) error {
 	same, err := db.GetFileByName(name)
 	if err == nil && len(same.Name) > 0 {
 		return model.NewErrSameNameFiles(same)
 	}
-	if errors.Is(err, sql.ErrNoRows) {
-		err = nil
+	if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	sealed, err := db.findSealedFileByName(name)
+	if err == nil && sealed != nil {
+		return model.NewErrSameNameFiles(sealed.File)
 	}
 	return err
 }
@@ -270,8 +459,8 @@ func (db *DB) CheckSameFilename(name string) error {
 func (db *DB) CheckSameChecksum(file *File) error {
 	same, err := db.GetFileByChecksum(file.Checksum)
 	if err == nil && len(same.Name) > 0 {
-		return fmt.Errorf(
-			"相同内容的檔案已存在: %s ↔ %s/%s", file.Name, same.BucketName, same.Name)
+		return fmt.Errorf("相同内容的檔案已存在: %s ↔ %s/%s%s", file.Name,
+			same.BucketName, same.Name, lo.Ternary(same.Deleted, " (在回收站中)", ""))
 	}
 	if errors.Is(err, sql.ErrNoRows) {
 		err = nil
@@ -310,9 +499,19 @@ func (db *DB) GetFilePlus(id int64) (file FilePlus, err error) {
 	return
 }
 
+// GetFilePlusByName 如果在數據庫中找不到, 會再嘗試在已解鎖的密封倉庫中尋找,
+// 注意返回的是數據庫中的檔案資訊 (即密封檔案的名稱是硬碟上的隨機名稱).
 func (db *DB) GetFilePlusByName(name string) (file FilePlus, err error) {
 	row := db.QueryRow(stmt.GetFilePlusByName, name)
-	if file, err = scanFilePlus(row); err != nil {
+	file, err = scanFilePlus(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		sealed, err2 := db.findSealedFileByName(name)
+		if err2 != nil || sealed == nil {
+			return file, util.WrapErrors(err, err2)
+		}
+		return db.GetFilePlus(sealed.ID)
+	}
+	if err != nil {
 		return
 	}
 	file.Checksum = ""
@@ -324,45 +523,6 @@ func (db *DB) GetAllFiles() (files []*File, err error) {
 	return getFiles(db.DB, stmt.GetAllFiles)
 }
 
-func (db *DB) GetFilesLimit(sortBy, utime string) (files []*FilePlus, err error) {
-	// Bug: 有注入風險, 但这是單用戶系統, 因此風險可控.
-	queryAll := fmt.Sprintf(stmt.GetAllFilesLimit, sortBy)
-	queryPublic := fmt.Sprintf(stmt.GetPublicFilesLimit, sortBy)
-	query := lo.Ternary(db.IsLoggedIn(), queryAll, queryPublic)
-	if files, err = getFilesPlus(db.DB, query, utime, db.FilesLimit); err != nil {
-		return
-	}
-	files = RemoveChecksum(files)
-	return
-}
-
-func (db *DB) GetFilesInBucket(id int64, utime string) (files []*FilePlus, err error) {
-	query := lo.Ternary(db.IsLoggedIn(), stmt.AllFilesInBucket, stmt.PublicFilesInBucket)
-	if files, err = getFilesPlus(db.DB, query, id, utime, db.FilesLimit); err != nil {
-		return
-	}
-	files = RemoveChecksum(files)
-	return
-}
-
-func (db *DB) GetPicsLimit(utime string) (files []*FilePlus, err error) {
-	query := lo.Ternary(db.IsLoggedIn(), stmt.GetAllPicsLimit, stmt.GetPublicPicsLimit)
-	if files, err = getFilesPlus(db.DB, query, utime, db.FilesLimit); err != nil {
-		return
-	}
-	files = RemoveChecksum(files)
-	return
-}
-
-func (db *DB) GetPicsInBucket(id int64, utime string) (files []*FilePlus, err error) {
-	query := lo.Ternary(db.IsLoggedIn(), stmt.AllPicsInBucket, stmt.PublicPicsInBucket)
-	if files, err = getFilesPlus(db.DB, query, id, utime, db.FilesLimit); err != nil {
-		return
-	}
-	files = RemoveChecksum(files)
-	return
-}
-
 func RemoveChecksum(files []*FilePlus) []*FilePlus {
 	for i := range files {
 		files[i].Checksum = ""
@@ -375,7 +535,9 @@ func (db *DB) GetProjStat(projCfg *Project) (ProjectStatus, error) {
 	allFilesCount, e2 := getInt1(db.DB, stmt.CountAllFiles)
 	needCheckCount, e3 := countFilesNeedCheck(db.DB, projCfg.CheckInterval)
 	damagedCount, e4 := getInt1(db.DB, stmt.CountDamagedFiles)
-	err := util.WrapErrors(e1, e2, e3, e4)
+	rotation, e5 := db.GetKeyRotation()
+	pending, e6 := db.countJournals()
+	err := util.WrapErrors(e1, e2, e3, e4, e5, e6)
 	projStat := ProjectStatus{
 		Project:           projCfg,
 		Root:              filepath.Dir(db.Path),
@@ -383,13 +545,17 @@ func (db *DB) GetProjStat(projCfg *Project) (ProjectStatus, error) {
 		FilesCount:        allFilesCount,
 		WaitingCheckCount: needCheckCount,
 		DamagedCount:      damagedCount,
+		PendingJournals:   pending,
+	}
+	if rotation != nil {
+		projStat.KeyRotationStartedAt = rotation.StartedAt
 	}
 	return projStat, err
 }
 
-// AllBucketsStatus 根据 db.IsLoggedIn 選擇获取公开仓库或全部仓库的狀態
-func (db *DB) AllBucketsStatus() (statusList []BucketStatus, err error) {
-	buckets, err := db.autoGetBuckets()
+// AllBucketsStatus 根据 admin 選擇获取公开仓库或全部仓库的狀態
+func (db *DB) AllBucketsStatus(admin bool) (statusList []BucketStatus, err error) {
+	buckets, err := db.autoGetBuckets(admin)
 	if err != nil {
 		return nil, err
 	}
@@ -400,9 +566,14 @@ func (db *DB) AllBucketsStatus() (statusList []BucketStatus, err error) {
 			return nil, err
 		}
 		bucketStat := BucketStatus{
-			Bucket:     bucket,
-			TotalSize:  totalSize,
-			FilesCount: filesCount,
+			Bucket:      bucket,
+			TotalSize:   totalSize,
+			FilesCount:  filesCount,
+			HasPassword: BucketHasPassword(bucket),
+			Locked:      !db.BucketIsUnlocked(bucket),
+		}
+		if bucketStat.Locked {
+			bucket.Redact()
 		}
 		statusList = append(statusList, bucketStat)
 	}
@@ -411,28 +582,39 @@ func (db *DB) AllBucketsStatus() (statusList []BucketStatus, err error) {
 
 // UpdateBackupFileInfo 更新一个文档的大多数信息, 但不更新 Checked 和 Damaged.
 func (db *DB) UpdateBackupFileInfo(file *File) error {
-	return db.Exec(stmt.UpdateBackupFileInfo, file.Checksum, file.BucketName,
+	return db.execWithTags(file, stmt.UpdateBackupFileInfo, file.Checksum, file.BucketName,
 		file.Name, file.Notes, file.Keywords, file.Size, file.Type,
-		file.Like, file.CTime, file.UTime, file.Deleted, file.ID)
+		file.Like, file.CTime, file.UTime, file.Deleted, file.Sealed, file.ID)
 }
 
-// DeleteFile 刪除檔案, 包括從數據庫中刪除和從硬碟中刪除.
-func (db *DB) DeleteFile(bucketsDir, tempDir, thumbPath string, file *File) error {
+// DeleteFile 徹底刪除檔案, 包括從數據庫中刪除和從硬碟中刪除.
+// filePath 是檔案在硬碟上的位置 (倉庫資料夾或回收站).
+func (db *DB) DeleteFile(filePath, tempDir, thumbPath string, file *File) error {
 	tempFile := MovedFile{
-		Src: filepath.Join(bucketsDir, file.BucketName, file.Name),
+		Src: filePath,
 		Dst: filepath.Join(tempDir, file.Name),
 	}
-	if err := tempFile.Move(); err != nil {
+	j := model.NewJournal(model.EventPurge, file.ID).
+		Move(tempFile.Src, tempFile.Dst).
+		ThenRemove(tempFile.Dst)
+	j.Target.Gone = true
+	if err := db.BeginJournal(j); err != nil {
 		return err
 	}
+	if err := tempFile.Move(); err != nil {
+		return db.FailJournal(j, err)
+	}
 	if err := db.Exec(stmt.DeleteFile, file.ID); err != nil {
-		err2 := tempFile.Rollback()
-		return util.WrapErrors(err, err2)
+		return db.FailJournal(j, err)
 	}
 	if err := os.Remove(thumbPath); err != nil {
 		fmt.Println(err)
 	}
-	return os.Remove(tempFile.Dst)
+	err1 := db.Exec(stmt.DeleteUnusedTags)
+	if err := util.WrapErrors(err1, os.Remove(tempFile.Dst)); err != nil {
+		return err
+	}
+	return db.EndJournal(j)
 }
 
 func (db *DB) DeleteBucket(bucketID int64) error {
@@ -441,7 +623,7 @@ func (db *DB) DeleteBucket(bucketID int64) error {
 		return err
 	}
 	if count > 0 {
-		return fmt.Errorf("該倉庫內仍有檔案, 不可刪除. 只能刪除空倉庫.")
+		return fmt.Errorf("該倉庫內仍有檔案 (包括回收站中的檔案), 不可刪除. 只能刪除空倉庫.")
 	}
 	return db.Exec(stmt.DeleteBucket, bucketID)
 }
@@ -454,41 +636,163 @@ func (db *DB) UpdateBucketTitle(bucket *Bucket) error {
 	return db.Exec(stmt.UpdateBucketTitle, bucket.Title, bucket.Subtitle, bucket.ID)
 }
 
-// EncryptFile 读取 srcPath 的文件, 加密后保存到 dstPath.
-func (db *DB) EncryptFile(srcPath, dstPath string, perm fs.FileMode) error {
-	if util.PathExists(dstPath) {
-		return fmt.Errorf("file exists: %s", dstPath)
+func (db *DB) UpdateBucketCipherKey(bucket *Bucket) error {
+	return db.Exec(stmt.UpdateBucketCipherKey, bucket.CipherKey, bucket.ID)
+}
+
+// EncryptFile 读取 srcPath 的文件, 用仓库 bucketName 的密钥分段加密后保存到 dstPath.
+// 采用流式处理, 因此不需要把整个文件读进内存.
+func (db *DB) EncryptFile(bucketName, srcPath, dstPath string, perm fs.FileMode) error {
+	_, writeKey, err := db.bucketKeys(bucketName)
+	if err != nil {
+		return err
 	}
-	data, err := os.ReadFile(srcPath)
+	src, err := os.Open(srcPath)
 	if err != nil {
 		return err
 	}
-	encrypted, err := encrypt(data, db.aesgcm)
+	defer src.Close()
+	return writeNewFile(dstPath, perm, func(dst io.Writer) error {
+		return encryptStream(dst, src, writeKey)
+	})
+}
+
+// writeGCM 返回用來加密新檔案的 AEAD, 在更換密鑰的過程中使用新密鑰.
+func (db *DB) writeGCM() cipher.AEAD {
+	return db.keys().write()
+}
+
+// DecryptSaveFile 读取仓库 bucketName 中的加密文件 srcPath, 解密后保存到 dstPath.
+func (db *DB) DecryptSaveFile(bucketName, srcPath, dstPath string, perm fs.FileMode) error {
+	src, err := db.OpenDecrypted(bucketName, srcPath)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(dstPath, encrypted, perm)
+	defer src.Close()
+	return writeNewFile(dstPath, perm, func(dst io.Writer) error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
 }
 
-// DecryptSaveFile 读取 srcPath 的文件, 解密后保存到 dstPath.
-func (db *DB) DecryptSaveFile(srcPath, dstPath string, perm fs.FileMode) error {
-	content, err := db.DecryptFile(srcPath)
+// ReEncryptFile 读取仓库 srcBucket 的加密文件 srcPath (新旧格式均可),
+// 用仓库 dstBucket 的密钥以新格式重新加密后保存到 dstPath.
+// 在更换密钥的过程中, 采用新密钥加密.
+func (db *DB) ReEncryptFile(srcBucket, dstBucket, srcPath, dstPath string, perm fs.FileMode) error {
+	_, writeKey, err := db.bucketKeys(dstBucket)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(dstPath, content, perm)
+	src, err := db.OpenDecrypted(srcBucket, srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeNewFile(dstPath, perm, func(dst io.Writer) error {
+		return encryptStream(dst, src, writeKey)
+	})
+}
+
+// DecryptFile 把整个文件解密到内存中, 只适用于小文件 (例如生成缩略图).
+func (db *DB) DecryptFile(bucketName, filePath string) ([]byte, error) {
+	src, err := db.OpenDecrypted(bucketName, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return io.ReadAll(src)
 }
 
-func (db *DB) DecryptFile(filePath string) ([]byte, error) {
-	data, err := os.ReadFile(filePath)
+// OpenDecrypted 打开仓库 bucketName 中的一个加密文件, 返回的 reader 边读边解密.
+// 同时支持新格式 (分段加密) 与旧版格式 (一次性加密整个文件),
+// 其中旧版格式仍需把整个文件读进内存. 注意用完后要 Close.
+func (db *DB) OpenDecrypted(bucketName, filePath string) (io.ReadCloser, error) {
+	readKeys, _, err := db.bucketKeys(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	head, _ := r.Peek(len(StreamMagic))
+	if isStreamFormat(head) {
+		dr, err := newDecryptReader(r, readKeys...)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return readCloser{dr, f}, nil
+	}
+	defer f.Close()
+	blob, err := io.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
-	return decrypt(data, db.aesgcm)
+	data, err := decrypt(blob, db.keys().legacyGCM)
+	if err != nil {
+		return nil, ErrStreamAuth
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
 }
 
+// IsLegacyEncrypted 判断一个加密文件是不是旧版格式 (一次性加密整个文件).
+func IsLegacyEncrypted(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	head := make([]byte, len(StreamMagic))
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return !isStreamFormat(head[:n]), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// writeNewFile 新建文件 dstPath (如果已存在则返回错误), 用 write 写入内容.
+// 如果写入失败, 会删除不完整的 dstPath.
+func writeNewFile(dstPath string, perm fs.FileMode, write func(io.Writer) error) error {
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("file exists: %s", dstPath)
+	}
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(dst, ChunkSize)
+	err1 := write(w)
+	err2 := w.Flush()
+	err3 := dst.Sync()
+	err4 := dst.Close()
+	if err = util.WrapErrors(err1, err2, err3, err4); err != nil {
+		err5 := os.Remove(dstPath)
+		return util.WrapErrors(err, err5)
+	}
+	return nil
+}
+
+// GetEncryptedFiles 获取加密仓库中 ID 大于 afterID 的全部文件, 按 ID 排序.
+func (db *DB) GetEncryptedFiles(afterID int64) ([]*File, error) {
+	return getFiles(db.DB, stmt.GetEncryptedFiles, afterID)
+}
+
+// UpdateChecksum 只更新 checksum (例如重新加密后), 不改变其他信息.
+func (db *DB) UpdateChecksum(fileID int64, checksum string) error {
+	return db.Exec(stmt.UpdateChecksum, checksum, fileID)
+}
+
+// GetDamagedFiles 獲取全部已損壞的檔案 (包括回收站中的檔案), 不解密.
 func (db *DB) GetDamagedFiles() ([]*FilePlus, error) {
-	return getFilesPlus(db.DB, stmt.GetDamagedFiles)
+	page, err := db.queryFiles(FileQuery{Damaged: lo.ToPtr(true), Trash: TrashInclude}, true)
+	return page.Files, err
 }
 
 // GetFilesNeedCheck 获取需要检查的文件, checkInterval 的单位是秒.
@@ -503,18 +807,33 @@ func (db *DB) SetFileCheckedDamaged(file *File) error {
 	return db.Exec(stmt.CheckFile, file.Checked, file.Damaged, file.ID)
 }
 
-func (db *DB) SearchFiles(pattern, fileType string, limit int64) (files []*FilePlus, err error) {
-	query := stmt.SearchPublicFiles
-	if db.IsLoggedIn() && fileType == "" {
-		query = stmt.SearchAllFiles
+// SearchFiles 搜尋檔案, 語法見 ParseSearchQuery. fileType 可以是空字符串或 "image".
+// 有全文搜尋詞時按相關度排序, 否則按更新時間排序.
+func (db *DB) SearchFiles(input, fileType string, limit int64, admin bool) (files []*FilePlus, err error) {
+	q, err := ParseSearchQuery(input)
+	if err != nil {
+		return nil, err
 	}
-	if fileType == "image" {
-		query = stmt.SearchPublicPics
+	var inMemory []*FilePlus
+	if admin {
+		if inMemory, err = db.searchEncryptedFiles(q, fileType); err != nil {
+			return nil, err
+		}
 	}
-	if fileType == "image" && db.IsLoggedIn() {
-		query = stmt.SearchAllPics
+	query, args := q.searchFilesSQL(fileType, limit, admin)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
 	}
-
-	pattern = "%" + pattern + "%"
-	return getFilesPlus(db.DB, query, pattern, pattern, pattern, limit)
+	if files, err = scanSearchResults(rows); err != nil {
+		return
+	}
+	if files, err = db.dropLockedFiles(files); err != nil {
+		return
+	}
+	// 在內存中搜尋的檔案沒有相關度, 排在後面.
+	if q.ranked() {
+		return appendFilesLimit(files, inMemory, limit), nil
+	}
+	return mergeFilesByUTime(files, inMemory, limit), nil
 }
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahui2016/local-buckets/model"
+)
+
+// newTestDB 在臨時資料夾中新建一個數據庫, 測試結束後自動關閉.
+func newTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := OpenDB(filepath.Join(t.TempDir(), "project.db"), &Project{RecentFilesLimit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.DB.Close() })
+	return db
+}
+
+func addTestBucket(t *testing.T, db *DB, name string, encrypted bool) {
+	t.Helper()
+	bucket := &Bucket{Name: name, Title: name, Encrypted: encrypted}
+	if err := insertBucket(db.DB, bucket); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addTestFile 插入檔案, 未指定的 Checksum, CTime, UTime 自動填寫.
+func addTestFile(t *testing.T, db *DB, f File) *File {
+	t.Helper()
+	if f.Checksum == "" {
+		f.Checksum = fmt.Sprintf("%s/%s", f.BucketName, f.Name)
+	}
+	if f.CTime == "" {
+		f.CTime = "2023-06-15 12:00:00+08:00"
+	}
+	if f.UTime == "" {
+		f.UTime = f.CTime
+	}
+	if err := db.InsertFile(&f); err != nil {
+		t.Fatal(err)
+	}
+	inserted, err := db.GetFileByChecksum(f.Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &inserted
+}
+
+// 清理過期 session 的 goroutine 可能隨時登出, 與處理請求的 goroutine 不可發生 data race
+// (用 go test -race 檢查), 登出後也不可使用 nil 密鑰.
+func TestLogoutRace(t *testing.T) {
+	db := newTestDB(t)
+	addTestBucket(t, db, "secret", true)
+	aesgcm := testGCM(t)
+	login := func() {
+		db.updateKeys(func(k *dataKeys) { k.aesgcm = aesgcm })
+	}
+	login()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			db.Logout()
+			login()
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		db.EncryptThumb([]byte("thumb")) // 登出時返回錯誤, 不可 panic
+		if _, _, err := db.bucketKeys("secret"); err != nil && !errors.Is(err, ErrBucketLocked) {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+// 重新輸入專案密碼 (再次登入, 更換密鑰) 不可鎖上已用倉庫密碼解鎖的倉庫.
+func TestSetAESGCMKeepsUnlockedBuckets(t *testing.T) {
+	db := newTestDB(t)
+	realKey, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherKey, err := wrapKey(realKey[:], DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.updateKeys(func(k *dataKeys) { k.cipherKey = cipherKey })
+	if _, err := db.SetAESGCM(DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.InsertBucket(&model.CreateBucketForm{Name: "secret", Encrypted: true, Password: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.BucketIsUnlocked(b) {
+		t.Fatal("new bucket should be unlocked")
+	}
+
+	if _, err := db.SetAESGCM(DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	if !db.BucketIsUnlocked(b) {
+		t.Fatal("bucket locked by SetAESGCM")
+	}
+	if _, err := db.StartKeyRotation(DefaultPassword, map[int64]string{b.ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	if !db.BucketIsUnlocked(b) {
+		t.Fatal("bucket locked by StartKeyRotation")
+	}
+	if _, err := db.StartKeyRotation("wrong", nil); !errors.Is(err, ErrWrongPassword) {
+		t.Fatalf("got error %v, want %v", err, ErrWrongPassword)
+	}
+}
+
+// 更換密鑰的過程中重新登入 (例如程序中斷後重新啟動), 倉庫的新密鑰也要解鎖,
+// 否則無法繼續用新密鑰加密檔案.
+func TestResumeBucketKeyRotation(t *testing.T) {
+	db := newTestDB(t)
+	realKey, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipherKey, err := wrapKey(realKey[:], DefaultPassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.updateKeys(func(k *dataKeys) { k.cipherKey = cipherKey })
+	if _, err := db.SetAESGCM(DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	own, err := db.InsertBucket(&model.CreateBucketForm{Name: "own", Encrypted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := db.InsertBucket(&model.CreateBucketForm{Name: "secret", Encrypted: true, Password: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.StartKeyRotation(DefaultPassword, map[int64]string{secret.ID: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+	writeKeys := make(map[string]cipher.AEAD)
+	for _, b := range []*Bucket{own, secret} {
+		_, writeKey, err := db.bucketKeys(b.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if writeKey == db.getBucketGCM(b.CipherKey) {
+			t.Fatalf("%s: want the new bucket key", b.Name)
+		}
+		writeKeys[b.Name] = writeKey
+	}
+	if err := db.ChangeBucketPassword(secret, "abc", "def"); err == nil {
+		t.Fatal("want error for changing the bucket password during rotation")
+	}
+
+	db.Logout()
+	if _, err := db.SetAESGCM(DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.bucketKeys(secret.Name); !errors.Is(err, ErrBucketLocked) {
+		t.Fatalf("got error %v, want %v", err, ErrBucketLocked)
+	}
+	if err := db.UnlockBucket(secret, "abc"); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Bucket{own, secret} {
+		_, writeKey, err := db.bucketKeys(b.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, err := encrypt([]byte(b.Name), writeKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := decrypt(blob, writeKeys[b.Name]); err != nil {
+			t.Fatalf("%s: new bucket key changed after login", b.Name)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// 每個修改檔案或倉庫的操作都會在 event 表中記錄一條事件 (審計日誌),
+// 用來追查檔案是被刪除, 移動, 覆蓋還是改名了, 以及是何時, 由誰操作的.
+// event 表由觸發器禁止 UPDATE 及 DELETE.
+
+type Event = model.Event
+
+const (
+	DefaultEventsLimit = 100
+	MaxEventsLimit     = 1000
+)
+
+// NewEvent 新建一條事件, before 及 after 會被轉換為 JSON, nil 表示沒有.
+func NewEvent(actor, ip, action string, fileID, bucketID int64, before, after any) (*Event, error) {
+	e := &Event{
+		Time:     model.Now(),
+		Actor:    actor,
+		IP:       ip,
+		Action:   action,
+		FileID:   fileID,
+		BucketID: bucketID,
+	}
+	var err1, err2 error
+	if before != nil {
+		e.Before, err1 = json.Marshal(before)
+	}
+	if after != nil {
+		e.After, err2 = json.Marshal(after)
+	}
+	return e, util.WrapErrors(err1, err2)
+}
+
+func (db *DB) InsertEvent(e *Event) error {
+	result, err := db.DB.Exec(stmt.InsertEvent, e.Time, e.Actor, e.IP, e.Action,
+		e.FileID, e.BucketID, string(e.Before), string(e.After))
+	if err != nil {
+		return err
+	}
+	e.ID, err = result.LastInsertId()
+	return err
+}
+
+// eventsWhere 生成 SQL 的 WHERE 條件及參數.
+func eventsWhere(form *model.EventsOptions) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg any) {
+		conds = append(conds, cond)
+		args = append(args, arg)
+	}
+	if form.Action != "" {
+		add("action = ?", form.Action)
+	}
+	if form.Actor != "" {
+		add("actor = ?", form.Actor)
+	}
+	if form.FileID > 0 {
+		add("file_id = ?", form.FileID)
+	}
+	if form.BucketID > 0 {
+		add("bucket_id = ?", form.BucketID)
+	}
+	if form.From != "" {
+		add("time >= ?", form.From)
+	}
+	if form.To != "" {
+		add("time <= ?", form.To)
+	}
+	if form.BeforeID > 0 {
+		add("id < ?", form.BeforeID)
+	}
+	return strings.Join(append(conds, "TRUE"), " AND "), args
+}
+
+// queryEvents 按條件查詢事件, limit 為 0 表示不限, 每條事件都交給 fn 處理.
+func (db *DB) queryEvents(form *model.EventsOptions, limit int64, fn func(*Event) error) error {
+	where, args := eventsWhere(form)
+	limitStr := ""
+	if limit > 0 {
+		limitStr = " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := db.Query(fmt.Sprintf(stmt.GetEvents, where, limitStr), args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var e Event
+		var before, after string
+		if err := rows.Scan(&e.ID, &e.Time, &e.Actor, &e.IP, &e.Action,
+			&e.FileID, &e.BucketID, &before, &after); err != nil {
+			rows.Close()
+			return err
+		}
+		if before != "" {
+			e.Before = json.RawMessage(before)
+		}
+		if after != "" {
+			e.After = json.RawMessage(after)
+		}
+		if err := fn(&e); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	return util.WrapErrors(rows.Err(), rows.Close())
+}
+
+// GetEvents 查詢事件 (一頁), 最新的排在前面.
+func (db *DB) GetEvents(form *model.EventsOptions) (events []*Event, err error) {
+	limit := form.Limit
+	if limit <= 0 {
+		limit = DefaultEventsLimit
+	}
+	if limit > MaxEventsLimit {
+		limit = MaxEventsLimit
+	}
+	err = db.queryEvents(form, limit, func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	return
+}
+
+// ExportEvents 把符合條件的全部事件以 JSONL 格式 (每行一條) 寫入 w, 返回事件數量.
+func (db *DB) ExportEvents(w io.Writer, form *model.EventsOptions) (n int, err error) {
+	enc := json.NewEncoder(w)
+	err = db.queryEvents(form, 0, func(e *Event) error {
+		n++
+		return enc.Encode(e)
+	})
+	return
+}
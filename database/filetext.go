@@ -0,0 +1,187 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/samber/lo"
+)
+
+// 從 PDF, Office 文檔等檔案中提取的文字 (見 extract 包) 保存在 file_text 表中, 用於搜尋.
+//
+//   - 公開倉庫: 文字保存在 text 欄位, 並建立全文搜尋索引 (file_text_fts).
+//   - 加密倉庫: 文字用倉庫密鑰加密後保存在 encrypted 欄位 (text 欄位為空),
+//     只有在解鎖倉庫後才能在內存中解密並搜尋.
+//
+// 刪除檔案時, file_text 中的記錄會自動刪除 (ON DELETE CASCADE).
+
+// SaveFileText 保存從檔案中提取的文字, 加密倉庫中的檔案會自動加密.
+// 如果 text 為空, 則刪除舊的記錄.
+func (db *DB) SaveFileText(fileID int64, bucketName, text string) error {
+	if text == "" {
+		return db.Exec(stmt.DeleteFileText, fileID)
+	}
+	bucket, err := db.GetBucketByName(bucketName)
+	if err != nil {
+		return err
+	}
+	if !bucket.Encrypted {
+		return db.Exec(stmt.UpsertFileText, fileID, text, []byte{})
+	}
+	_, writeKey, err := db.bucketKeys(bucketName)
+	if err != nil {
+		return err
+	}
+	encrypted, err := encrypt([]byte(text), writeKey)
+	if err != nil {
+		return err
+	}
+	return db.Exec(stmt.UpsertFileText, fileID, "", encrypted)
+}
+
+// GetFileText 獲取從檔案中提取的文字 (必要時解密), 沒有記錄則返回空字符串.
+// bucketName 是檔案所在的倉庫 (用於解密), 移動檔案時要注意使用舊倉庫的名稱.
+func (db *DB) GetFileText(fileID int64, bucketName string) (string, error) {
+	var text string
+	var encrypted []byte
+	err := db.QueryRow(stmt.GetFileText, fileID).Scan(&text, &encrypted)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil || len(encrypted) == 0 {
+		return text, err
+	}
+	return db.decryptFileText(bucketName, encrypted)
+}
+
+func (db *DB) decryptFileText(bucketName string, encrypted []byte) (string, error) {
+	readKeys, _, err := db.bucketKeys(bucketName)
+	if err != nil {
+		return "", err
+	}
+	for _, aesgcm := range lo.Compact(readKeys) {
+		if data, err := decrypt(encrypted, aesgcm); err == nil {
+			return string(data), nil
+		}
+	}
+	return "", ErrStreamAuth
+}
+
+// getDecryptedFileTexts 解密已解鎖的加密倉庫中的全部檔案內容, 返回 map[檔案ID]文字.
+func (db *DB) getDecryptedFileTexts() (map[int64]string, error) {
+	locked, err := db.lockedBuckets()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(stmt.GetEncryptedFileTexts)
+	if err != nil {
+		return nil, err
+	}
+	type encryptedText struct {
+		id         int64
+		bucketName string
+		encrypted  []byte
+	}
+	var all []encryptedText
+	for rows.Next() {
+		var t encryptedText
+		if err := rows.Scan(&t.id, &t.bucketName, &t.encrypted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !locked[t.bucketName] {
+			all = append(all, t)
+		}
+	}
+	if err := util.WrapErrors(rows.Err(), rows.Close()); err != nil {
+		return nil, err
+	}
+	texts := make(map[int64]string)
+	for _, t := range all {
+		text, err := db.decryptFileText(t.bucketName, t.encrypted)
+		if err != nil {
+			return nil, err
+		}
+		texts[t.id] = text
+	}
+	return texts, nil
+}
+
+// searchEncryptedFiles 在內存中搜尋 (不分大小寫) 已解鎖的密封倉庫中的檔案,
+// 以及已解鎖的加密倉庫中有加密內容的檔案.
+func (db *DB) searchEncryptedFiles(q *SearchQuery, fileType string) (found []*FilePlus, err error) {
+	if !db.IsLoggedIn() {
+		return nil, nil
+	}
+	texts, err := db.getDecryptedFileTexts()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := db.getUnsealedFiles()
+	if err != nil {
+		return nil, err
+	}
+	withText, err := getFilesPlus(db.DB, stmt.GetEncryptedTextFiles)
+	if err != nil {
+		return nil, err
+	}
+	if withText, err = db.dropLockedFiles(withText); err != nil {
+		return nil, err
+	}
+	for _, f := range append(sealed, withText...) {
+		if f.Deleted || (fileType != "" && !strings.HasPrefix(f.Type, fileType+"/")) {
+			continue
+		}
+		text := texts[f.ID]
+		if q.Match(f, text) {
+			f.Snippet = q.textSnippet(text)
+			found = append(found, f)
+		}
+	}
+	return
+}
+
+// RotateFileTexts 在更換密鑰的過程中, 用新密鑰 (專案或倉庫的新密鑰) 重新加密加密倉庫中的檔案內容.
+func (db *DB) RotateFileTexts() error {
+	rows, err := db.Query(stmt.GetEncryptedFileTexts)
+	if err != nil {
+		return err
+	}
+	type fileText struct {
+		bucketName string
+		blob       []byte
+	}
+	texts := make(map[int64]fileText)
+	for rows.Next() {
+		var id int64
+		var t fileText
+		if err := rows.Scan(&id, &t.bucketName, &t.blob); err != nil {
+			rows.Close()
+			return err
+		}
+		texts[id] = t
+	}
+	if err := util.WrapErrors(rows.Err(), rows.Close()); err != nil {
+		return err
+	}
+	for id, t := range texts {
+		readKeys, writeKey, err := db.bucketKeys(t.bucketName)
+		if err != nil {
+			return fmt.Errorf("%s: %w", t.bucketName, err)
+		}
+		newBlob, changed, err := reEncrypt(t.blob, readKeys, writeKey)
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err := db.Exec(stmt.UpdateFileTextEncrypted, newBlob, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// 移動檔案, 覆蓋檔案等操作需要先處理硬碟上的檔案, 再更新數據庫, 最後清理臨時檔案.
+// 為了在程序中途退出後也能恢復, 動手之前先把計劃的步驟寫入 journal 表 (見 model.Journal),
+// 全部完成後再刪除該記錄. 啟動時仍存在的記錄, 就是被中斷的操作.
+//
+// 日誌中的路徑保存為相對於專案根目錄 (數據庫所在的資料夾) 的路徑,
+// 因此即使整個專案資料夾被移動了, 也能正確恢復.
+
+type (
+	Journal       = model.Journal
+	JournalStep   = model.JournalStep
+	JournalResult = model.JournalResult
+)
+
+// Root 返回專案根目錄 (數據庫所在的資料夾).
+func (db *DB) Root() string {
+	return filepath.Dir(db.Path)
+}
+
+// convertSteps 把步驟中的路徑轉換為相對路徑 (toRel 為 true) 或絕對路徑.
+func (db *DB) convertSteps(steps []JournalStep, toRel bool) []JournalStep {
+	root := db.Root()
+	convert := func(p string) string {
+		if p == "" {
+			return p
+		}
+		if !toRel {
+			return filepath.Join(root, filepath.FromSlash(p))
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return p
+		}
+		return filepath.ToSlash(rel)
+	}
+	converted := make([]JournalStep, len(steps))
+	for i, step := range steps {
+		step.Src = convert(step.Src)
+		step.Dst = convert(step.Dst)
+		converted[i] = step
+	}
+	return converted
+}
+
+// BeginJournal 在動手之前把操作日誌寫入數據庫.
+func (db *DB) BeginJournal(j *Journal) error {
+	j.StartedAt = model.Now()
+	steps, e1 := json.Marshal(db.convertSteps(j.Steps, true))
+	cleanup, e2 := json.Marshal(db.convertSteps(j.Cleanup, true))
+	target, e3 := json.Marshal(j.Target)
+	if err := util.WrapErrors(e1, e2, e3); err != nil {
+		return err
+	}
+	result, err := db.DB.Exec(stmt.InsertJournal,
+		j.Op, j.FileID, string(steps), string(cleanup), string(target), j.StartedAt)
+	if err != nil {
+		return err
+	}
+	j.ID, err = result.LastInsertId()
+	return err
+}
+
+// SetJournalTarget 更新 j.Target, 用於動手之後才知道的資訊 (例如加密後的 checksum).
+// 必須在更新數據庫中的檔案資訊之前調用.
+func (db *DB) SetJournalTarget(j *Journal) error {
+	target, err := json.Marshal(j.Target)
+	if err != nil {
+		return err
+	}
+	return db.Exec(stmt.UpdateJournalTarget, string(target), j.ID)
+}
+
+// EndJournal 操作全部完成 (或已完全回滾) 後刪除日誌.
+func (db *DB) EndJournal(j *Journal) error {
+	return db.Exec(stmt.DeleteJournal, j.ID)
+}
+
+// FailJournal 在更新數據庫之前出錯時調用: 回滾已執行的步驟, 成功則刪除日誌.
+// 如果回滾失敗, 則保留日誌, 下次啟動時再處理.
+func (db *DB) FailJournal(j *Journal, err error) error {
+	rbErr := RollbackJournal(j)
+	if rbErr == nil {
+		rbErr = db.EndJournal(j)
+	}
+	return util.WrapErrors(err, rbErr)
+}
+
+// GetJournals 獲取全部未完成的操作日誌, 路徑已轉換為絕對路徑.
+func (db *DB) GetJournals() (all []*Journal, err error) {
+	rows, err := db.Query(stmt.GetJournals)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var j Journal
+		var steps, cleanup, target string
+		if err := rows.Scan(&j.ID, &j.Op, &j.FileID,
+			&steps, &cleanup, &target, &j.StartedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		e1 := json.Unmarshal([]byte(steps), &j.Steps)
+		e2 := json.Unmarshal([]byte(cleanup), &j.Cleanup)
+		e3 := json.Unmarshal([]byte(target), &j.Target)
+		if err := util.WrapErrors(e1, e2, e3); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		j.Steps = db.convertSteps(j.Steps, false)
+		j.Cleanup = db.convertSteps(j.Cleanup, false)
+		all = append(all, &j)
+	}
+	err = util.WrapErrors(rows.Err(), rows.Close())
+	return
+}
+
+// JournalCommitted 根據 j.Target 判斷被中斷的操作是否已更新數據庫.
+// Target 為空說明在記錄 Target 之前就中斷了 (數據庫必然未更新), 應回滾.
+func (db *DB) JournalCommitted(j *Journal) (bool, error) {
+	if j.Target.IsEmpty() {
+		return false, nil
+	}
+	file, err := txGetFileByID(db.DB, j.FileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return j.Target.Gone, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	t := j.Target
+	if t.Gone ||
+		(t.Checksum != "" && t.Checksum != file.Checksum) ||
+		(t.BucketName != "" && t.BucketName != file.BucketName) ||
+		(t.Deleted != nil && *t.Deleted != file.Deleted) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// RollbackJournal 按相反順序撤銷 j.Steps, 可以重複執行:
+// 只在檔案仍在 Dst 而 Src 不存在時才移回, 以免覆蓋已恢復的檔案.
+func RollbackJournal(j *Journal) error {
+	for i := len(j.Steps) - 1; i >= 0; i-- {
+		step := j.Steps[i]
+		switch step.Action {
+		case model.JournalMove:
+			if util.PathExists(step.Dst) && util.PathNotExists(step.Src) {
+				moved := MovedFile{Src: step.Src, Dst: step.Dst}
+				if err := moved.Rollback(); err != nil {
+					return err
+				}
+			}
+		case model.JournalCreate:
+			if util.PathNotExists(step.Dst) || restoredBefore(j.Steps[:i], step.Dst) {
+				continue
+			}
+			if err := os.Remove(step.Dst); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// restoredBefore 判斷 path 是否原本就有檔案, 並且已被移回原位
+// (例如覆蓋檔案時, 新檔案與舊檔案可能使用同一個路徑), 此時不可刪除.
+func restoredBefore(steps []JournalStep, path string) bool {
+	for _, step := range steps {
+		if step.Action == model.JournalMove && step.Src == path {
+			return util.PathNotExists(step.Dst)
+		}
+	}
+	return false
+}
+
+func (db *DB) countJournals() (int64, error) {
+	return getInt1(db.DB, stmt.CountJournals)
+}
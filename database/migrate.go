@@ -0,0 +1,165 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// 數據庫結構的版本記錄在 schema_version 表中, 每次打開數據庫時按順序執行
+// 尚未執行的遷移步驟. 以後要修改數據庫結構, 只能在 migrations 末尾添加新步驟,
+// 不可修改或刪除已有的步驟.
+//
+// 引入 schema_version 之前的舊版數據庫版本視為 0, 因此前面幾個步驟都必須
+// 可以重複執行 (例如 CREATE TABLE IF NOT EXISTS, addColumnIfNotExists).
+
+type migration struct {
+	name    string
+	migrate func(tx TX) error
+}
+
+// migrations 的第 i 個步驟把數據庫從版本 i 升級到版本 i+1.
+var migrations = []migration{
+	{"create tables", func(tx TX) error {
+		_, err := tx.Exec(stmt.CreateTables)
+		return err
+	}},
+	{"add cipherkey and sealed columns", func(tx TX) error {
+		e1 := addColumnIfNotExists(tx, "bucket", "cipherkey", "TEXT NOT NULL DEFAULT ''")
+		e2 := addColumnIfNotExists(tx, "bucket", "sealed", "BOOLEAN NOT NULL DEFAULT FALSE")
+		e3 := addColumnIfNotExists(tx, "file", "sealed", "TEXT NOT NULL DEFAULT ''")
+		return util.WrapErrors(e1, e2, e3)
+	}},
+	{"create file_fts", func(tx TX) error {
+		return createFTS(tx, "file_fts", stmt.CreateFileFTS, stmt.RebuildFileFTS)
+	}},
+	{"create file_text_fts", func(tx TX) error {
+		return createFTS(tx, "file_text_fts", stmt.CreateFileTextFTS, stmt.RebuildFileTextFTS)
+	}},
+	{"create tag tables and split keywords", func(tx TX) error {
+		if _, err := tx.Exec(stmt.CreateTagTables); err != nil {
+			return err
+		}
+		return splitAllKeywords(tx)
+	}},
+	{"create event table", func(tx TX) error {
+		_, err := tx.Exec(stmt.CreateEventTable)
+		return err
+	}},
+	{"create journal table", func(tx TX) error {
+		_, err := tx.Exec(stmt.CreateJournalTable)
+		return err
+	}},
+	{"create change_log and sync_state", func(tx TX) error {
+		_, err := tx.Exec(stmt.CreateChangeLogTable)
+		return err
+	}},
+	{"create bucket_key_rotation", func(tx TX) error {
+		_, err := tx.Exec(stmt.CreateBucketKeyRotationTable)
+		return err
+	}},
+}
+
+// LatestSchemaVersion 是本程序支持的數據庫結構版本.
+var LatestSchemaVersion = int64(len(migrations))
+
+// SchemaVersion 返回數據庫結構的版本, 舊版數據庫 (沒有版本記錄) 返回 0.
+func (db *DB) SchemaVersion() (int64, error) {
+	version, err := db.GetInt1(stmt.GetSchemaVersion)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return version, err
+}
+
+// migrate 把數據庫升級到最新版本. 如果數據庫中已有數據, 會先備份數據庫.
+// 如果數據庫的版本比本程序更新, 則拒絕打開, 以免舊版程序破壞新版數據.
+func (db *DB) migrate() error {
+	if err := db.Exec(stmt.CreateSchemaVersion); err != nil {
+		return err
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > LatestSchemaVersion {
+		return fmt.Errorf(
+			"數據庫版本 (%d) 比本程序支持的版本 (%d) 更新, 請更新 local-buckets: %s",
+			version, LatestSchemaVersion, db.Path)
+	}
+	if version == LatestSchemaVersion {
+		return nil
+	}
+	if err := db.backupBeforeMigrate(version); err != nil {
+		return err
+	}
+	for ; version < LatestSchemaVersion; version++ {
+		if err := db.runMigration(version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runMigration 在一個事務中執行一個遷移步驟並更新版本號.
+func (db *DB) runMigration(version int64) error {
+	m := migrations[version]
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if err := m.migrate(tx); err != nil {
+		return fmt.Errorf("migration %d (%s): %w", version+1, m.name, err)
+	}
+	if _, err := tx.Exec(stmt.SetSchemaVersion, version+1, model.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// backupBeforeMigrate 在遷移前把數據庫複製一份, 新建的空數據庫不需要備份.
+// 備份檔案與數據庫放在同一個資料夾, 檔案名包含遷移前的版本號及時間.
+func (db *DB) backupBeforeMigrate(version int64) error {
+	n, err := db.GetInt1(stmt.CountAllTables)
+	if err != nil {
+		return err
+	}
+	// 只有 schema_version 一個表, 說明是新建的數據庫.
+	if n <= 1 {
+		return nil
+	}
+	bakPath := fmt.Sprintf("%s.v%d-%s.bak",
+		db.Path, version, time.Now().Format("20060102-150405"))
+	if err := db.Exec(stmt.BackupDatabase, bakPath); err != nil {
+		return fmt.Errorf("遷移前備份數據庫失敗: %w", err)
+	}
+	fmt.Println("database backup:", bakPath)
+	return nil
+}
+
+// createFTS 建立全文搜尋索引, 如果是舊版數據庫 (已有數據), 則同時為現有數據建立索引.
+func createFTS(tx TX, table, createStmt, rebuildStmt string) error {
+	n, err := getInt1(tx, stmt.CountTable, table)
+	if err != nil || n > 0 {
+		return err
+	}
+	if _, err := tx.Exec(createStmt); err != nil {
+		return err
+	}
+	_, err = tx.Exec(rebuildStmt)
+	return err
+}
+
+// addColumnIfNotExists 給舊版數據庫的表添加新欄位.
+func addColumnIfNotExists(tx TX, table, column, definition string) error {
+	n, err := getInt1(tx, stmt.CountColumn, table, column)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, column, definition))
+	return err
+}
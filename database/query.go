@@ -0,0 +1,199 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/samber/lo"
+)
+
+// FileQuery 列出檔案的條件. 各欄位的零值表示不限.
+// 排序欄位及方向只能從 sortColumns 及 "asc", "desc" 中選擇, 因此可以安全地拼接到 SQL 中,
+// 其他條件一律使用參數 (?).
+type FileQuery struct {
+	BucketID  int64  // 0 表示全部倉庫
+	Type      string // 檔案類型前綴, 例如 "image/"
+	Tag       string // 標籤 (不分大小寫)
+	MinSize   int64
+	MaxSize   int64 // 0 表示不限
+	MinLike   int64
+	CTimeFrom string // 日期範圍都是閉區間, 空字符串表示不限
+	CTimeTo   string
+	UTimeFrom string
+	UTimeTo   string
+	Damaged   *bool
+	Encrypted *bool
+	Trash     TrashFilter
+
+	Sort   string // 見 sortColumns, 空字符串表示 utime
+	Order  string // "desc" (默認) 或 "asc"
+	Cursor string // 上一頁返回的 FilesPage.NextCursor
+	Limit  int64  // 0 表示不限 (不分頁)
+}
+
+// TrashFilter 是否列出回收站中的檔案.
+type TrashFilter int
+
+const (
+	TrashExclude TrashFilter = iota // 不包括回收站中的檔案
+	TrashOnly                       // 只列出回收站中的檔案
+	TrashInclude                    // 全部檔案
+)
+
+type sortColumn struct {
+	expr  string
+	isInt bool
+}
+
+// sortColumns 可用於排序的欄位.
+var sortColumns = map[string]sortColumn{
+	"utime":      {"file.utime", false},
+	"ctime":      {"file.ctime", false},
+	"name":       {"file.name", false},
+	"like":       {"file.like", true},
+	"size":       {"file.size", true},
+	"id":         {"file.id", true},
+	"deleted_at": {"COALESCE(trash.deleted_at, '')", false},
+}
+
+// CheckSort 檢查排序欄位及方向, 並返回填上默認值後的結果.
+func CheckSort(sortBy, order string) (string, string, error) {
+	sortBy = lo.Ternary(sortBy == "", "utime", sortBy)
+	order = strings.ToLower(lo.Ternary(order == "", "desc", order))
+	if _, ok := sortColumns[sortBy]; !ok {
+		return "", "", fmt.Errorf("不支持按 %s 排序", sortBy)
+	}
+	if order != "desc" && order != "asc" {
+		return "", "", fmt.Errorf("排序方向只能是 asc 或 desc: %s", order)
+	}
+	return sortBy, order, nil
+}
+
+// where 生成 SQL 的 WHERE 條件及參數. admin 為 false 時只包括公開倉庫.
+func (q *FileQuery) where(admin bool) (string, []any) {
+	var conds []string
+	var args []any
+	add := func(cond string, arg ...any) {
+		conds = append(conds, cond)
+		args = append(args, arg...)
+	}
+	switch q.Trash {
+	case TrashExclude:
+		add("file.deleted = FALSE")
+	case TrashOnly:
+		add("file.deleted = TRUE")
+	}
+	if q.BucketID > 0 {
+		add("bucket.id = ?", q.BucketID)
+	}
+	if q.Type != "" {
+		add(`file.type LIKE ? ESCAPE '\'`, escapeLike(q.Type)+"%")
+	}
+	if q.Tag != "" {
+		add("file.id IN (SELECT file_tag.file_id FROM file_tag"+
+			" INNER JOIN tag ON tag.id = file_tag.tag_id WHERE tag.name = ?)", q.Tag)
+	}
+	if q.MinSize > 0 {
+		add("file.size >= ?", q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		add("file.size <= ?", q.MaxSize)
+	}
+	if q.MinLike > 0 {
+		add("file.like >= ?", q.MinLike)
+	}
+	if q.CTimeFrom != "" {
+		add("file.ctime >= ?", q.CTimeFrom)
+	}
+	if q.CTimeTo != "" {
+		add("file.ctime <= ?", q.CTimeTo)
+	}
+	if q.UTimeFrom != "" {
+		add("file.utime >= ?", q.UTimeFrom)
+	}
+	if q.UTimeTo != "" {
+		add("file.utime <= ?", q.UTimeTo)
+	}
+	if q.Damaged != nil {
+		add("file.damaged = ?", *q.Damaged)
+	}
+	if q.Encrypted != nil {
+		add("bucket.encrypted = ?", *q.Encrypted)
+	}
+	if !admin {
+		add("bucket.encrypted = FALSE")
+	}
+	return strings.Join(append(conds, "TRUE"), " AND "), args
+}
+
+// toSQL 生成完整的 SQL 及參數, 採用 keyset 分頁 (見 cursor.go).
+// 如果 Limit 大於 0, 會多取一個檔案, 用來判斷是否還有下一頁.
+func (q *FileQuery) toSQL(admin bool) (query string, args []any, err error) {
+	if q.Sort, q.Order, err = CheckSort(q.Sort, q.Order); err != nil {
+		return
+	}
+	where, args := q.where(admin)
+	col := sortColumns[q.Sort].expr
+	if q.Cursor != "" {
+		c, err := decodeCursor(q.Cursor, q.Sort, q.Order)
+		if err != nil {
+			return "", nil, err
+		}
+		op := lo.Ternary(q.Order == "desc", "<", ">")
+		where += fmt.Sprintf(" AND (%s, file.id) %s (?, ?)", col, op)
+		args = append(args, c.value(), c.ID)
+	}
+	order := fmt.Sprintf("%[1]s %[2]s, file.id %[2]s", col, strings.ToUpper(q.Order))
+	limit := ""
+	if q.Limit > 0 {
+		limit = " LIMIT ?"
+		args = append(args, q.Limit+1)
+	}
+	query = fmt.Sprintf(stmt.ListFiles, where, order, limit)
+	return
+}
+
+// queryFiles 執行查詢並生成一頁檔案, 不解密檔案名稱等資訊 (見 ListFiles).
+func (db *DB) queryFiles(q FileQuery, admin bool) (page FilesPage, err error) {
+	query, args, err := q.toSQL(admin)
+	if err != nil {
+		return
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return
+	}
+	var files []*FilePlus
+	for rows.Next() {
+		var f FilePlus
+		if err = rows.Scan(append(filePlusFields(&f), &f.DeletedAt)...); err != nil {
+			rows.Close()
+			return
+		}
+		files = append(files, &f)
+	}
+	if err = util.WrapErrors(rows.Err(), rows.Close()); err != nil {
+		return
+	}
+	if q.Limit > 0 && int64(len(files)) > q.Limit {
+		files = files[:q.Limit]
+		page.HasMore = true
+		page.NextCursor = newCursor(files[len(files)-1], q.Sort, q.Order).encode()
+	}
+	page.Files = files
+	return
+}
+
+// ListFiles 列出檔案 (一頁), 並解密已解鎖的密封檔案, 隱藏未解鎖倉庫中的檔案的資訊.
+// 注意, 密封倉庫中的檔案的名稱等資訊是加密的, 因此按名稱排序及按標籤篩選對它們無效.
+func (db *DB) ListFiles(q FileQuery, admin bool) (FilesPage, error) {
+	page, err := db.queryFiles(q, admin)
+	if err != nil {
+		return page, err
+	}
+	// 游標已在 queryFiles 中生成, 因此解密密封檔案的名稱不影響分頁.
+	page.Files, err = db.revealFiles(RemoveChecksum(page.Files))
+	return page, err
+}
@@ -0,0 +1,195 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/samber/lo"
+)
+
+func TestCheckSort(t *testing.T) {
+	tests := []struct {
+		sort, order         string
+		wantSort, wantOrder string
+		ok                  bool
+	}{
+		{"", "", "utime", "desc", true},
+		{"name", "", "name", "desc", true},
+		{"", "asc", "utime", "asc", true},
+		{"size", "ASC", "size", "asc", true},
+		{"deleted_at", "Desc", "deleted_at", "desc", true},
+		{"Name", "asc", "", "", false},
+		{"file.name", "asc", "", "", false},
+		{"name; DROP TABLE file", "asc", "", "", false},
+		{"checksum", "asc", "", "", false},
+		{"name", "up", "", "", false},
+		{"name", "asc, id", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort+" "+tt.order, func(t *testing.T) {
+			sortBy, order, err := CheckSort(tt.sort, tt.order)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got error %v, want ok=%v", err, tt.ok)
+			}
+			if sortBy != tt.wantSort || order != tt.wantOrder {
+				t.Fatalf("got (%s, %s), want (%s, %s)", sortBy, order, tt.wantSort, tt.wantOrder)
+			}
+		})
+	}
+}
+
+// 排序欄位及方向以外的條件都應該使用參數, 不可拼接到 SQL 中.
+func TestFileQueryToSQL(t *testing.T) {
+	const evil = "x' OR '1'='1"
+	cursor := newCursor(&FilePlus{File: File{ID: 7, Name: evil}}, "name", "asc").encode()
+	q := FileQuery{
+		BucketID: 1, Type: evil, Tag: evil, MinSize: 1, MaxSize: 2, MinLike: 3,
+		CTimeFrom: evil, CTimeTo: evil, UTimeFrom: evil, UTimeTo: evil,
+		Damaged: lo.ToPtr(true), Encrypted: lo.ToPtr(false),
+		Sort: "name", Order: "asc", Cursor: cursor, Limit: 10,
+	}
+	query, args, err := q.toSQL(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(query, evil) {
+		t.Fatalf("filter value in SQL: %s", query)
+	}
+	if n := strings.Count(query, "?"); n != len(args) {
+		t.Fatalf("%d placeholders, %d args", n, len(args))
+	}
+	if args[len(args)-1] != int64(11) {
+		t.Fatalf("want limit+1 as the last arg, got %v", args[len(args)-1])
+	}
+	if !strings.Contains(query, "file.name ASC, file.id ASC") {
+		t.Fatalf("unexpected order: %s", query)
+	}
+
+	q.Sort = "name; DROP TABLE file"
+	if _, _, err := q.toSQL(false); err == nil {
+		t.Fatal("want error for unknown sort column")
+	}
+	q.Sort, q.Order = "name", "desc"
+	if _, _, err := q.toSQL(false); err == nil {
+		t.Fatal("want error for a cursor of another order")
+	}
+}
+
+func TestListFilesFilters(t *testing.T) {
+	db := newTestDB(t)
+	addTestBucket(t, db, "pub", false)
+	addTestBucket(t, db, "secret", true)
+	pub, err := db.GetBucketByName("pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []File{
+		{BucketName: "pub", Name: "a.png", Type: "image/png", Size: 100, Like: 0,
+			Keywords: "Family", CTime: "2023-01-01 10:00:00+08:00", UTime: "2024-01-01 10:00:00+08:00"},
+		{BucketName: "pub", Name: "b.md", Type: "text/md", Size: 200, Like: 2,
+			Keywords: "family, work", CTime: "2023-06-01 10:00:00+08:00", UTime: "2023-06-01 10:00:00+08:00"},
+		{BucketName: "pub", Name: "c.txt", Type: "text_txt", Size: 300, Like: 5, Damaged: true,
+			CTime: "2024-01-01 10:00:00+08:00", UTime: "2024-02-01 10:00:00+08:00"},
+		{BucketName: "secret", Name: "d.txt", Type: "text/txt", Size: 400, Like: 1,
+			Keywords: "family", CTime: "2024-03-01 10:00:00+08:00", UTime: "2024-03-01 10:00:00+08:00"},
+		{BucketName: "pub", Name: "e.txt", Type: "text/txt", Size: 500,
+			CTime: "2024-04-01 10:00:00+08:00", UTime: "2024-04-01 10:00:00+08:00"},
+	} {
+		addTestFile(t, db, f)
+	}
+	trashed, err := db.GetFileByName("e.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFileDeleted(trashed.ID, true, "2024-05-01 10:00:00+08:00"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		q     FileQuery
+		admin bool
+		want  []string
+	}{
+		{"all public", FileQuery{}, false, []string{"a.png", "b.md", "c.txt"}},
+		{"all admin", FileQuery{}, true, []string{"a.png", "b.md", "c.txt", "d.txt"}},
+		{"bucket", FileQuery{BucketID: pub.ID}, true, []string{"a.png", "b.md", "c.txt"}},
+		{"type prefix", FileQuery{Type: "text/"}, true, []string{"b.md", "d.txt"}},
+		{"type escapes _", FileQuery{Type: "text_"}, true, []string{"c.txt"}},
+		{"tag ignores case", FileQuery{Tag: "FAMILY"}, false, []string{"a.png", "b.md"}},
+		{"tag admin", FileQuery{Tag: "family"}, true, []string{"a.png", "b.md", "d.txt"}},
+		{"min size", FileQuery{MinSize: 200}, false, []string{"b.md", "c.txt"}},
+		{"max size", FileQuery{MaxSize: 200}, false, []string{"a.png", "b.md"}},
+		{"size range", FileQuery{MinSize: 200, MaxSize: 300}, false, []string{"b.md", "c.txt"}},
+		{"min like", FileQuery{MinLike: 2}, false, []string{"b.md", "c.txt"}},
+		{"ctime range is inclusive", FileQuery{
+			CTimeFrom: "2023-06-01 10:00:00+08:00", CTimeTo: "2024-01-01 10:00:00+08:00",
+		}, false, []string{"b.md", "c.txt"}},
+		{"utime from", FileQuery{UTimeFrom: "2024-01-01"}, true, []string{"a.png", "c.txt", "d.txt"}},
+		{"utime to", FileQuery{UTimeTo: "2024-01-01"}, true, []string{"b.md"}},
+		{"damaged", FileQuery{Damaged: lo.ToPtr(true)}, false, []string{"c.txt"}},
+		{"not damaged", FileQuery{Damaged: lo.ToPtr(false)}, false, []string{"a.png", "b.md"}},
+		{"encrypted", FileQuery{Encrypted: lo.ToPtr(true)}, true, []string{"d.txt"}},
+		{"encrypted public", FileQuery{Encrypted: lo.ToPtr(true)}, false, nil},
+		{"trash only", FileQuery{Trash: TrashOnly}, false, []string{"e.txt"}},
+		{"trash include", FileQuery{Trash: TrashInclude}, false, []string{"a.png", "b.md", "c.txt", "e.txt"}},
+		{"combined", FileQuery{Type: "text/", Tag: "family", MinLike: 1}, true, []string{"b.md", "d.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := db.ListFiles(tt.q, tt.admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range page.Files {
+				names = append(names, f.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("got %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestListFilesOrder(t *testing.T) {
+	db := newTestDB(t)
+	addTestBucket(t, db, "pub", false)
+	for _, f := range []File{
+		{Name: "b.txt", Like: 2, Size: 30},
+		{Name: "c.txt", Like: 1, Size: 10},
+		{Name: "a.txt", Like: 2, Size: 20},
+	} {
+		f.BucketName = "pub"
+		addTestFile(t, db, f)
+	}
+	tests := []struct {
+		sort, order string
+		want        []string
+	}{
+		{"name", "asc", []string{"a.txt", "b.txt", "c.txt"}},
+		{"name", "desc", []string{"c.txt", "b.txt", "a.txt"}},
+		{"size", "asc", []string{"c.txt", "a.txt", "b.txt"}},
+		{"like", "desc", []string{"a.txt", "b.txt", "c.txt"}}, // 點贊數相同時按 id 降序
+		{"like", "asc", []string{"c.txt", "b.txt", "a.txt"}},
+		{"id", "asc", []string{"b.txt", "c.txt", "a.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort+" "+tt.order, func(t *testing.T) {
+			page, err := db.ListFiles(FileQuery{Sort: tt.sort, Order: tt.order}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range page.Files {
+				names = append(names, f.Name)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("got %q, want %q", names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,290 @@
+package database
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// 更换密钥时, 除了专案的真正密钥, 有自己密钥的加密仓库也会生成新的仓库密钥,
+// 记录在 bucket_key_rotation 表中 (被新的真正密钥或仓库专用密码加密).
+// 在重新加密的过程中, 仓库的新旧密钥都可以解密, 新文件用新密钥加密,
+// 全部文件重新加密后, 才用新密钥替换 bucket 表的 cipherkey.
+
+type KeyRotation = model.KeyRotation
+
+// GetKeyRotation 获取未完成的更换密钥操作, 如果没有则返回 nil.
+func (db *DB) GetKeyRotation() (*KeyRotation, error) {
+	rotation := new(KeyRotation)
+	row := db.QueryRow(stmt.GetKeyRotation)
+	err := row.Scan(&rotation.CipherKey, &rotation.LastFileID, &rotation.StartedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return rotation, err
+}
+
+// errIfKeyRotating 在更换密钥的过程中返回错误.
+func (db *DB) errIfKeyRotating() error {
+	rotation, err := db.GetKeyRotation()
+	if err == nil && rotation != nil {
+		err = fmt.Errorf("正在更換密鑰, 請先完成更換密鑰 (rotate data key)")
+	}
+	return err
+}
+
+// pendingKey 如果有未完成的更换密钥操作, 则用密码解密新密钥, 否则返回 nil.
+func (db *DB) pendingKey(password string) (cipher.AEAD, error) {
+	rotation, err := db.GetKeyRotation()
+	if err != nil || rotation == nil {
+		return nil, err
+	}
+	newKey, err := unwrapKey(rotation.CipherKey, password)
+	if err != nil {
+		return nil, err
+	}
+	return newKeyGCM(newKey), nil
+}
+
+// StartKeyRotation 生成新的真正密钥 (用同一个密码加密) 以及各个仓库的新密钥, 并记录到数据库中.
+// 设有专用密码的仓库需要提供密码 (bucketPasswords 的 key 是仓库 ID), 新的仓库密钥用同一个密码加密.
+// 如果已有未完成的更换密钥操作, 则继续使用之前生成的新密钥.
+// 需要先登入, 其他 session 与已解锁的仓库不受影响.
+func (db *DB) StartKeyRotation(password string, bucketPasswords map[int64]string) (*KeyRotation, error) {
+	if !db.IsLoggedIn() {
+		return nil, fmt.Errorf("請先登入管理員")
+	}
+	if err := db.CheckPassword(password); err != nil {
+		return nil, err
+	}
+	buckets, err := db.ownKeyBuckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		if !BucketHasPassword(b) {
+			continue
+		}
+		if bucketPasswords[b.ID] == "" {
+			return nil, fmt.Errorf("倉庫 %s 設有專用密碼, 更換密鑰時需要提供倉庫密碼", b.Name)
+		}
+		if err := db.UnlockBucket(b, bucketPasswords[b.ID]); err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name, err)
+		}
+	}
+	rotation, err := db.GetKeyRotation()
+	if err != nil {
+		return nil, err
+	}
+	if rotation != nil {
+		pendingGCM, err := db.pendingKey(password)
+		if err != nil {
+			return nil, err
+		}
+		db.updateKeys(func(k *dataKeys) { k.pendingGCM = pendingGCM })
+		return rotation, db.unlockPendingBucketKeys()
+	}
+	newKey, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	cipherKey, err := wrapKey(newKey[:], password)
+	if err != nil {
+		return nil, err
+	}
+	pendingGCM := newKeyGCM(newKey[:])
+	bucketGCMs := make(map[string]cipher.AEAD)
+	rotation = &KeyRotation{CipherKey: cipherKey, StartedAt: model.Now()}
+
+	tx := db.MustBegin()
+	defer tx.Rollback()
+	_, err = tx.Exec(stmt.InsertKeyRotation,
+		rotation.CipherKey, rotation.LastFileID, rotation.StartedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range buckets {
+		bucketKey, err := randomKey()
+		if err != nil {
+			return nil, err
+		}
+		var newCipherKey string
+		if BucketHasPassword(b) {
+			newCipherKey, err = wrapKey(bucketKey[:], bucketPasswords[b.ID])
+		} else {
+			newCipherKey, err = wrapWithDataKey(bucketKey[:], pendingGCM)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(stmt.InsertBucketKeyRotation, b.ID, newCipherKey); err != nil {
+			return nil, err
+		}
+		bucketGCMs[newCipherKey] = newKeyGCM(bucketKey[:])
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	db.updateKeys(func(k *dataKeys) { k.pendingGCM = pendingGCM })
+	for newCipherKey, aesgcm := range bucketGCMs {
+		db.setBucketGCM(newCipherKey, aesgcm)
+	}
+	return rotation, nil
+}
+
+// ownKeyBuckets 返回有自己密钥的加密仓库.
+func (db *DB) ownKeyBuckets() (buckets []*Bucket, err error) {
+	all, err := db.GetAllBuckets()
+	for _, b := range all {
+		if b.Encrypted && b.CipherKey != "" {
+			buckets = append(buckets, b)
+		}
+	}
+	return
+}
+
+// getBucketKeyRotation 返回更换密钥时为仓库生成的新密钥 (被加密), 如果没有则返回空字符串.
+func (db *DB) getBucketKeyRotation(bucketID int64) (cipherKey string, err error) {
+	err = db.QueryRow(stmt.GetBucketKeyRotation, bucketID).Scan(&cipherKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = nil
+	}
+	return
+}
+
+// unlockPendingBucketKeys 解锁被新的真正密钥加密的仓库新密钥,
+// 设有专用密码的仓库的新密钥在 UnlockBucket 时解锁.
+func (db *DB) unlockPendingBucketKeys() error {
+	if db.keys().pendingGCM == nil {
+		return nil
+	}
+	rows, err := db.Query(stmt.GetBucketKeyRotations)
+	if err != nil {
+		return err
+	}
+	var cipherKeys []string
+	for rows.Next() {
+		var bucketID int64
+		var cipherKey string
+		if err := rows.Scan(&bucketID, &cipherKey); err != nil {
+			rows.Close()
+			return err
+		}
+		cipherKeys = append(cipherKeys, cipherKey)
+	}
+	if err := util.WrapErrors(rows.Err(), rows.Close()); err != nil {
+		return err
+	}
+	for _, cipherKey := range cipherKeys {
+		if !strings.HasPrefix(cipherKey, BucketKeyVersion+"$") {
+			continue
+		}
+		if err := db.unlockPendingBucketKey(cipherKey, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unlockPendingBucketKey 解密仓库的新密钥, 被新的真正密钥加密的不需要 password.
+func (db *DB) unlockPendingBucketKey(cipherKey, password string) error {
+	var bucketKey []byte
+	var err error
+	if strings.HasPrefix(cipherKey, BucketKeyVersion+"$") {
+		bucketKey, err = unwrapWithDataKey(cipherKey, db.keys().pendingGCM)
+	} else {
+		bucketKey, err = unwrapKey(cipherKey, password)
+	}
+	if err != nil {
+		return err
+	}
+	db.setBucketGCM(cipherKey, newKeyGCM(bucketKey))
+	return nil
+}
+
+// pendingBucketGCM 返回更换密钥的过程中仓库 b 的新密钥, 如果没有则返回 nil.
+func (db *DB) pendingBucketGCM(b *Bucket) (cipher.AEAD, error) {
+	if db.keys().pendingGCM == nil {
+		return nil, nil
+	}
+	cipherKey, err := db.getBucketKeyRotation(b.ID)
+	if err != nil || cipherKey == "" || cipherKey == b.CipherKey {
+		return nil, err
+	}
+	aesgcm := db.getBucketGCM(cipherKey)
+	if aesgcm == nil {
+		return nil, ErrBucketLocked
+	}
+	return aesgcm, nil
+}
+
+// NeedsRotation 判断仓库 bucketName 中的一个加密文件是否仍未使用新密钥加密.
+func (db *DB) NeedsRotation(bucketName, filePath string) (bool, error) {
+	_, writeKey, err := db.bucketKeys(bucketName)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	head, _ := r.Peek(len(StreamMagic))
+	if !isStreamFormat(head) {
+		return true, nil
+	}
+	_, err = newDecryptReader(r, writeKey)
+	if errors.Is(err, ErrStreamAuth) {
+		return true, nil
+	}
+	return false, err
+}
+
+// UpdateKeyRotation 记录进度, 表示 ID 小于或等于 fileID 的文件都已处理.
+func (db *DB) UpdateKeyRotation(rotation *KeyRotation, fileID int64) error {
+	if err := db.Exec(stmt.UpdateKeyRotation, fileID); err != nil {
+		return err
+	}
+	rotation.LastFileID = fileID
+	return nil
+}
+
+// ApplyBucketKeyRotation 用新的仓库密钥替换 bucket 表的 cipherkey, 可以重复执行.
+// 注意, 在此之前, 仓库中的全部文件都应已用新密钥重新加密;
+// 在此之后, 才可以把新的 CipherKey 写入 project.toml.
+func (db *DB) ApplyBucketKeyRotation() error {
+	return db.Exec(stmt.ApplyBucketKeyRotation)
+}
+
+// FinishKeyRotation 启用新密钥, 旧密钥从此作废.
+// 注意, 在此之前, 应先把新的 CipherKey 写入 project.toml.
+func (db *DB) FinishKeyRotation(rotation *KeyRotation) error {
+	tx := db.MustBegin()
+	defer tx.Rollback()
+	if _, err := tx.Exec(stmt.DeleteBucketKeyRotations); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(stmt.DeleteKeyRotation); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	db.updateKeys(func(k *dataKeys) {
+		k.cipherKey = rotation.CipherKey
+		if k.pendingGCM != nil {
+			k.aesgcm = k.pendingGCM
+			k.pendingGCM = nil
+		}
+	})
+	return nil
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/samber/lo"
+)
+
+// 密封倉庫 (sealed bucket) 中的檔案:
+//
+//   - 在硬碟上 (以及數據庫的 name 欄位) 採用隨機名稱, 例如 3f9a...c2,
+//   - 真正的名稱, 備註, 關鍵詞被倉庫密鑰加密, 保存在 file 表的 sealed 欄位中,
+//   - notes 與 keywords 欄位為空字符串.
+//
+// 因此, 只有解鎖倉庫後才能看到檔案的真正名稱, 搜尋也只能在解密後在內存中進行.
+// 但是, 檔案類型, 體積, 日期等資訊並未加密.
+
+type SealedInfo = model.SealedInfo
+
+const sealedNameSize = 16
+
+func newSealedName() (string, error) {
+	b := make([]byte, sealedNameSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SealFile 如果 file 所在的倉庫是密封倉庫, 則加密 file 的名稱, 備註, 關鍵詞,
+// 並把 file.Name 改為 diskName (如果 diskName 為空, 則生成新的隨機名稱).
+// 如果不是密封倉庫, 則不做任何處理.
+func (db *DB) SealFile(file *File, diskName string) error {
+	bucket, err := db.GetBucketByName(file.BucketName)
+	if err != nil {
+		return err
+	}
+	if !bucket.Sealed {
+		file.Sealed = ""
+		return nil
+	}
+	_, writeKey, err := db.bucketKeys(bucket.Name)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(SealedInfo{
+		Name:     file.Name,
+		Notes:    file.Notes,
+		Keywords: file.Keywords,
+	})
+	if err != nil {
+		return err
+	}
+	encrypted, err := encrypt(data, writeKey)
+	if err != nil {
+		return err
+	}
+	if diskName == "" {
+		if diskName, err = newSealedName(); err != nil {
+			return err
+		}
+	}
+	file.Name = diskName
+	file.Notes = ""
+	file.Keywords = ""
+	file.Sealed = hex.EncodeToString(encrypted)
+	return nil
+}
+
+// UnsealFile 解密 file 的名稱, 備註, 關鍵詞, 並返回原本的名稱 (即硬碟上的檔案名).
+// 注意, file.Sealed 不會被清空, 因此仍可用 file.Sealed != "" 來判斷是否密封檔案.
+func (db *DB) UnsealFile(file *File) (diskName string, err error) {
+	diskName = file.Name
+	if file.Sealed == "" {
+		return
+	}
+	readKeys, _, err := db.bucketKeys(file.BucketName)
+	if err != nil {
+		return
+	}
+	encrypted, err := hex.DecodeString(file.Sealed)
+	if err != nil {
+		return
+	}
+	var data []byte
+	for _, aesgcm := range lo.Compact(readKeys) {
+		if data, err = decrypt(encrypted, aesgcm); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return diskName, fmt.Errorf("%s: %w", diskName, ErrStreamAuth)
+	}
+	var info SealedInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return
+	}
+	file.Name = info.Name
+	file.Notes = info.Notes
+	file.Keywords = info.Keywords
+	return
+}
+
+// RotateSealedInfo 在更換密鑰的過程中, 用倉庫的新密鑰重新加密密封檔案的名稱等資訊.
+func (db *DB) RotateSealedInfo(file *File) error {
+	if file.Sealed == "" {
+		return nil
+	}
+	readKeys, writeKey, err := db.bucketKeys(file.BucketName)
+	if err != nil {
+		return err
+	}
+	encrypted, err := hex.DecodeString(file.Sealed)
+	if err != nil {
+		return err
+	}
+	newBlob, changed, err := reEncrypt(encrypted, readKeys, writeKey)
+	if err != nil || !changed {
+		return err
+	}
+	file.Sealed = hex.EncodeToString(newBlob)
+	return db.Exec(stmt.UpdateFileSealed, file.Sealed, file.ID)
+}
+
+// MoveSealedFile 用於檔案移進或移出密封倉庫 (名稱, checksum 等會同時改變).
+func (db *DB) MoveSealedFile(file *File) error {
+	return db.execWithTags(file, stmt.MoveSealedFile, file.Checksum, file.BucketName,
+		file.Name, file.Notes, file.Keywords, file.Sealed, file.ID)
+}
+
+// getUnsealedFiles 獲取已解鎖的密封倉庫中的全部檔案, 並解密檔案名稱等資訊.
+func (db *DB) getUnsealedFiles() (files []*FilePlus, err error) {
+	if !db.IsLoggedIn() {
+		return nil, nil
+	}
+	locked, err := db.lockedBuckets()
+	if err != nil {
+		return nil, err
+	}
+	all, err := getFilesPlus(db.DB, stmt.GetSealedFiles)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range all {
+		if locked[file.BucketName] {
+			continue
+		}
+		if _, err := db.UnsealFile(&file.File); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return
+}
+
+// findSealedFileByName 在已解鎖的密封倉庫中尋找真正名稱為 name 的檔案 (不分大小寫).
+func (db *DB) findSealedFileByName(name string) (file *FilePlus, err error) {
+	files, err := db.getUnsealedFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if strings.EqualFold(f.Name, name) {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// mergeFilesByUTime 合併兩組檔案, 按 utime 從新到舊排序, 最多保留 limit 個.
+func mergeFilesByUTime(a, b []*FilePlus, limit int64) []*FilePlus {
+	files := append(a, b...)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].UTime > files[j].UTime
+	})
+	if int64(len(files)) > limit {
+		files = files[:limit]
+	}
+	return files
+}
+
+// appendFilesLimit 把 b 接在 a 後面, 最多保留 limit 個.
+func appendFilesLimit(a, b []*FilePlus, limit int64) []*FilePlus {
+	files := append(a, b...)
+	if int64(len(files)) > limit {
+		files = files[:limit]
+	}
+	return files
+}
@@ -0,0 +1,503 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/samber/lo"
+)
+
+// 搜尋語法:
+//
+//	日記 報告          同時包含兩個詞 (AND 可省略)
+//	日記 OR 報告       包含其中一個詞
+//	NOT 草稿, -草稿    不包含
+//	"hello world"     短語
+//	repo*             前綴
+//	name:日記本        只搜尋指定欄位 (name, notes, keywords, content)
+//	bucket:photos     指定倉庫
+//	type:image        檔案類型 (前綴匹配, 例如 type:text/md)
+//	like>0, like>=2   點贊數
+//	size>10MB         檔案體積, 單位可以是 B, KB, MB, GB (或 K, M, G)
+//	ctime:2023..2024  入庫日期範圍, 也可以是 2023-05, 2023-05-01, 2023.., ..2024
+//	utime:2024        更新日期
+//
+// 不指定欄位時, 同時搜尋名稱, 備註, 關鍵詞以及檔案內容 (從 PDF 等檔案中提取的文字, 見 extract 包).
+// 全文搜尋採用 trigram 分詞, 少於 3 個字的詞無法使用全文搜尋索引, 會自動改用 LIKE.
+
+const (
+	SnippetMarkStart = "\x02"
+	SnippetMarkEnd   = "\x03"
+)
+
+const minFTSRunes = 3
+
+var searchFieldPattern = regexp.MustCompile(
+	`^(name|notes|keywords|content|bucket|type|like|size|ctime|utime)(:|>=|<=|>|<|=)(.+)$`)
+
+type searchTerm struct {
+	negate bool
+	field  string // 空字符串表示同時搜尋 name, notes, keywords, content
+	op     string // ":", ">", ">=", "<", "<=", "="
+	text   string // 搜尋詞, 或 bucket, type 的值
+	prefix bool
+	num    int64  // like, size
+	from   string // ctime, utime 的範圍 [from, to), 空字符串表示不限
+	to     string
+}
+
+// SearchQuery 由多個 OR 組構成, 組與組之間是 AND 關係, 組內各項是 OR 關係.
+type SearchQuery struct {
+	groups [][]searchTerm
+}
+
+// ParseSearchQuery 解析搜尋語法.
+func ParseSearchQuery(input string) (*SearchQuery, error) {
+	tokens, err := splitSearchTokens(input)
+	if err != nil {
+		return nil, err
+	}
+	q := new(SearchQuery)
+	negate, joinOR := false, false
+	for _, token := range tokens {
+		switch token {
+		case "AND":
+			continue
+		case "OR":
+			joinOR = len(q.groups) > 0
+			continue
+		case "NOT":
+			negate = true
+			continue
+		}
+		term, err := parseSearchTerm(token)
+		if err != nil {
+			return nil, err
+		}
+		term.negate = term.negate != negate
+		if joinOR {
+			last := len(q.groups) - 1
+			q.groups[last] = append(q.groups[last], term)
+		} else {
+			q.groups = append(q.groups, []searchTerm{term})
+		}
+		negate, joinOR = false, false
+	}
+	if len(q.groups) == 0 {
+		return nil, fmt.Errorf("請輸入搜尋內容")
+	}
+	return q, nil
+}
+
+// splitSearchTokens 以空格分割, 但雙引號內的空格不分割.
+func splitSearchTokens(input string) (tokens []string, err error) {
+	var token strings.Builder
+	inQuote := false
+	for _, r := range input {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			token.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuote:
+			if token.Len() > 0 {
+				tokens = append(tokens, token.String())
+				token.Reset()
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	if inQuote {
+		return nil, fmt.Errorf("引號不成對: %s", input)
+	}
+	if token.Len() > 0 {
+		tokens = append(tokens, token.String())
+	}
+	return
+}
+
+func parseSearchTerm(token string) (term searchTerm, err error) {
+	if strings.HasPrefix(token, "-") && len(token) > 1 {
+		term.negate = true
+		token = token[1:]
+	}
+	term.op = ":"
+	if m := searchFieldPattern.FindStringSubmatch(token); m != nil {
+		term.field, term.op, token = m[1], m[2], m[3]
+	}
+	if term.op != ":" && term.field != "like" && term.field != "size" {
+		return term, fmt.Errorf("%s 不可使用 %s", term.field, term.op)
+	}
+	switch term.field {
+	case "like":
+		term.op = strings.Replace(term.op, ":", "=", 1)
+		term.num, err = strconv.ParseInt(token, 10, 64)
+	case "size":
+		term.op = strings.Replace(term.op, ":", "=", 1)
+		term.num, err = parseSize(token)
+	case "ctime", "utime":
+		term.from, term.to, err = parseDateRange(token)
+	case "bucket", "type":
+		term.text = strings.Trim(token, `"`)
+	default:
+		term.text, term.prefix = parseSearchText(token)
+		if term.text == "" {
+			err = fmt.Errorf("搜尋詞不可為空")
+		}
+	}
+	return
+}
+
+func parseSearchText(token string) (text string, prefix bool) {
+	if strings.HasPrefix(token, `"`) && strings.HasSuffix(token, `"`) && len(token) > 1 {
+		return token[1 : len(token)-1], false
+	}
+	if strings.HasSuffix(token, "*") {
+		return strings.TrimSuffix(token, "*"), true
+	}
+	return token, false
+}
+
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(s)
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}}
+	for _, unit := range units {
+		if num, ok := strings.CutSuffix(s, unit.suffix); ok {
+			n, err := strconv.ParseFloat(num, 64)
+			return int64(n * float64(unit.size)), err
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// parseDateRange 解析 2023..2024, 2023-05, ..2024-01-31 等日期範圍,
+// 返回 [from, to) 以便與 RFC3339 格式的字符串直接比較.
+func parseDateRange(s string) (from, to string, err error) {
+	start, end, isRange := strings.Cut(s, "..")
+	if !isRange {
+		end = start
+	}
+	if start != "" {
+		if from, _, err = parseDate(start); err != nil {
+			return
+		}
+	}
+	if end != "" {
+		_, to, err = parseDate(end)
+	}
+	return
+}
+
+// parseDate 返回該年, 月或日的開始與 (下一個時段的) 開始.
+func parseDate(s string) (start, next string, err error) {
+	layouts := []struct {
+		layout  string
+		y, m, d int
+	}{{"2006", 1, 0, 0}, {"2006-01", 0, 1, 0}, {"2006-01-02", 0, 0, 1}}
+	for _, l := range layouts {
+		if len(s) != len(l.layout) {
+			continue
+		}
+		t, err := time.ParseInLocation(l.layout, s, time.Local)
+		if err != nil {
+			return "", "", err
+		}
+		return t.Format(model.RFC3339), t.AddDate(l.y, l.m, l.d).Format(model.RFC3339), nil
+	}
+	return "", "", fmt.Errorf("日期格式錯誤: %s (例: 2023, 2023-05, 2023-05-01)", s)
+}
+
+// searchesFile 判斷是否搜尋檔案的名稱, 備註, 關鍵詞.
+func (term *searchTerm) searchesFile() bool {
+	return term.text != "" && (term.field == "" ||
+		term.field == "name" || term.field == "notes" || term.field == "keywords")
+}
+
+// searchesText 判斷是否搜尋檔案內容.
+func (term *searchTerm) searchesText() bool {
+	return term.text != "" && (term.field == "" || term.field == "content")
+}
+
+func (term *searchTerm) useFTS() bool {
+	return (term.searchesFile() || term.searchesText()) &&
+		utf8.RuneCountInString(term.text) >= minFTSRunes
+}
+
+// textFTSExpr 轉換為 FTS5 的搜尋表達式 (用於 file_text_fts).
+func (term *searchTerm) textFTSExpr() string {
+	expr := `"` + strings.ReplaceAll(term.text, `"`, `""`) + `"`
+	if term.prefix {
+		expr += " *"
+	}
+	return expr
+}
+
+// fileFTSExpr 轉換為 FTS5 的搜尋表達式 (用於 file_fts).
+func (term *searchTerm) fileFTSExpr() string {
+	if term.field != "" {
+		return term.field + " : " + term.textFTSExpr()
+	}
+	return term.textFTSExpr()
+}
+
+func escapeLike(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "%", `\%`)
+	return strings.ReplaceAll(s, "_", `\_`)
+}
+
+// toSQL 轉換為 SQL 條件.
+func (term *searchTerm) toSQL() (cond string, args []any) {
+	switch term.field {
+	case "bucket":
+		cond, args = "file.bucket_name = ? COLLATE NOCASE", []any{term.text}
+	case "type":
+		cond, args = `file.type LIKE ? ESCAPE '\'`, []any{escapeLike(term.text) + "%"}
+	case "like", "size":
+		cond, args = fmt.Sprintf("file.%s %s ?", term.field, term.op), []any{term.num}
+	case "ctime", "utime":
+		var conds []string
+		if term.from != "" {
+			conds = append(conds, fmt.Sprintf("file.%s >= ?", term.field))
+			args = append(args, term.from)
+		}
+		if term.to != "" {
+			conds = append(conds, fmt.Sprintf("file.%s < ?", term.field))
+			args = append(args, term.to)
+		}
+		cond = "(" + strings.Join(append(conds, "TRUE"), " AND ") + ")"
+	default:
+		var conds []string
+		pattern := "%" + escapeLike(term.text) + "%"
+		if term.searchesFile() && term.useFTS() {
+			conds = append(conds, "file.id IN (SELECT rowid FROM file_fts WHERE file_fts MATCH ?)")
+			args = append(args, term.fileFTSExpr())
+		} else if term.searchesFile() {
+			columns := []string{"name", "notes", "keywords"}
+			if term.field != "" {
+				columns = []string{term.field}
+			}
+			for _, col := range columns {
+				conds = append(conds, fmt.Sprintf(`file.%s LIKE ? ESCAPE '\'`, col))
+				args = append(args, pattern)
+			}
+		}
+		if term.searchesText() && term.useFTS() {
+			conds = append(conds, "file.id IN (SELECT rowid FROM file_text_fts WHERE file_text_fts MATCH ?)")
+			args = append(args, term.textFTSExpr())
+		} else if term.searchesText() {
+			conds = append(conds, `file.id IN (SELECT id FROM file_text WHERE text LIKE ? ESCAPE '\')`)
+			args = append(args, pattern)
+		}
+		cond = "(" + strings.Join(conds, " OR ") + ")"
+	}
+	if term.negate {
+		cond = "NOT " + cond
+	}
+	return
+}
+
+// match 在內存中判斷檔案是否符合條件 (用於密封倉庫中的檔案, 以及加密倉庫中的檔案內容).
+// text 是從檔案中提取的文字.
+func (term *searchTerm) match(f *FilePlus, text string) (ok bool) {
+	switch term.field {
+	case "bucket":
+		ok = strings.EqualFold(f.BucketName, term.text)
+	case "type":
+		ok = strings.HasPrefix(f.Type, term.text)
+	case "like", "size":
+		ok = compareInt(lo.Ternary(term.field == "like", f.Like, f.Size), term.op, term.num)
+	case "ctime", "utime":
+		t := lo.Ternary(term.field == "ctime", f.CTime, f.UTime)
+		ok = (term.from == "" || t >= term.from) && (term.to == "" || t < term.to)
+	default:
+		lowerText := strings.ToLower(term.text)
+		values := map[string]string{
+			"name": f.Name, "notes": f.Notes, "keywords": f.Keywords, "content": text}
+		for field, value := range values {
+			if (term.field == "" || term.field == field) &&
+				strings.Contains(strings.ToLower(value), lowerText) {
+				ok = true
+				break
+			}
+		}
+	}
+	return ok != term.negate
+}
+
+func compareInt(a int64, op string, b int64) bool {
+	switch op {
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	}
+	return a == b
+}
+
+// Match 在內存中判斷檔案是否符合搜尋條件, text 是從檔案中提取的文字 (可以是空字符串).
+func (q *SearchQuery) Match(f *FilePlus, text string) bool {
+	for _, group := range q.groups {
+		matched := false
+		for i := range group {
+			if group[i].match(f, text) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// where 生成 SQL 的 WHERE 條件及參數.
+func (q *SearchQuery) where() (string, []any) {
+	var conds []string
+	var args []any
+	for _, group := range q.groups {
+		var groupConds []string
+		for i := range group {
+			cond, condArgs := group[i].toSQL()
+			groupConds = append(groupConds, cond)
+			args = append(args, condArgs...)
+		}
+		conds = append(conds, "("+strings.Join(groupConds, " OR ")+")")
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// rankExpr 用全部 (非否定的) 全文搜尋詞生成一個 FTS5 表達式, 用於排序和摘要.
+// 分別用於 file_fts (searchesFile) 與 file_text_fts (searchesText).
+func (q *SearchQuery) rankExpr(text bool) string {
+	var exprs []string
+	for _, group := range q.groups {
+		for i := range group {
+			term := &group[i]
+			if term.negate || !term.useFTS() {
+				continue
+			}
+			if text && term.searchesText() {
+				exprs = append(exprs, term.textFTSExpr())
+			}
+			if !text && term.searchesFile() {
+				exprs = append(exprs, term.fileFTSExpr())
+			}
+		}
+	}
+	return strings.Join(exprs, " OR ")
+}
+
+// ranked 判斷搜尋結果是否按相關度排序 (有全文搜尋詞).
+func (q *SearchQuery) ranked() bool {
+	return q.rankExpr(false) != "" || q.rankExpr(true) != ""
+}
+
+// searchFilesSQL 生成完整的 SQL 及參數. admin 為 false 時只搜尋公開倉庫.
+// 密封倉庫中的檔案在數據庫中的名稱是隨機的, 加密倉庫中的檔案內容也是加密的,
+// 因此不在這裡搜尋 (見 searchEncryptedFiles). 回收站中的檔案也不搜尋.
+func (q *SearchQuery) searchFilesSQL(fileType string, limit int64, admin bool) (string, []any) {
+	where, args := q.where()
+	conds := []string{"file.sealed = ''", "file.deleted = FALSE"}
+	if admin {
+		conds = append(conds, "file.id NOT IN (SELECT id FROM file_text WHERE length(encrypted) > 0)")
+	} else {
+		conds = append(conds, "bucket.encrypted = FALSE")
+	}
+	if fileType != "" {
+		conds = append(conds, "file.type LIKE ?")
+		args = append([]any{fileType + "/%"}, args...)
+	}
+	where = strings.Join(append(conds, where), " AND ")
+	args = append(args, limit)
+
+	var joins, snippets, orders []string
+	var joinArgs []any
+	if expr := q.rankExpr(false); expr != "" {
+		joins = append(joins, stmt.SearchFileFTSJoin)
+		joinArgs = append(joinArgs, expr)
+		snippets = append(snippets, "fts.snip")
+		orders = append(orders, "fts.score IS NULL", "fts.score")
+	}
+	if expr := q.rankExpr(true); expr != "" {
+		joins = append(joins, stmt.SearchFileTextFTSJoin)
+		joinArgs = append(joinArgs, expr)
+		snippets = append(snippets, "tfts.snip")
+		orders = append(orders, "tfts.score IS NULL", "tfts.score")
+	}
+	snippet := "''"
+	if len(snippets) > 0 {
+		snippet = "COALESCE(" + strings.Join(append(snippets, "''"), ", ") + ")"
+	}
+	orders = append(orders, "file.utime DESC")
+	query := fmt.Sprintf(stmt.SearchFiles,
+		snippet, strings.Join(joins, ""), where, strings.Join(orders, ", "))
+	return query, append(joinArgs, args...)
+}
+
+// textSnippet 在內存中生成檔案內容的摘要 (格式與 FTS5 的 snippet 相同),
+// 如果檔案內容不包含任何搜尋詞, 則返回空字符串.
+func (q *SearchQuery) textSnippet(text string) string {
+	const around = 12 // 搜尋詞前後各保留多少個字
+	runes := []rune(text)
+	lower := strings.ToLower(text)
+	if utf8.RuneCountInString(lower) != len(runes) {
+		return ""
+	}
+	for _, group := range q.groups {
+		for i := range group {
+			term := &group[i]
+			if term.negate || !term.searchesText() {
+				continue
+			}
+			word := strings.ToLower(term.text)
+			index := strings.Index(lower, word)
+			if index < 0 {
+				continue
+			}
+			start := utf8.RuneCountInString(lower[:index])
+			end := start + utf8.RuneCountInString(word)
+			from, to := start-around, end+around
+			prefix, suffix := "…", "…"
+			if from <= 0 {
+				from, prefix = 0, ""
+			}
+			if to >= len(runes) {
+				to, suffix = len(runes), ""
+			}
+			return prefix + string(runes[from:start]) + SnippetMarkStart +
+				string(runes[start:end]) + SnippetMarkEnd + string(runes[end:to]) + suffix
+		}
+	}
+	return ""
+}
+
+func scanSearchResults(rows *sql.Rows) (all []*FilePlus, err error) {
+	for rows.Next() {
+		var f FilePlus
+		if err := rows.Scan(append(filePlusFields(&f), &f.Snippet)...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		all = append(all, &f)
+	}
+	err = util.WrapErrors(rows.Err(), rows.Close())
+	return
+}
@@ -0,0 +1,189 @@
+package database
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/samber/lo"
+)
+
+// localDay 返回當地時間某一天的開始, 格式與 parseDate 相同.
+func localDay(t *testing.T, s string) string {
+	t.Helper()
+	day, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return day.Format(model.RFC3339)
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	word := func(text string) searchTerm { return searchTerm{op: ":", text: text} }
+	tests := []struct {
+		input  string
+		groups [][]searchTerm
+	}{
+		{"日記 報告", [][]searchTerm{{word("日記")}, {word("報告")}}},
+		{"日記 AND 報告", [][]searchTerm{{word("日記")}, {word("報告")}}},
+		{"日記 OR 報告", [][]searchTerm{{word("日記"), word("報告")}}},
+		{"a OR b c", [][]searchTerm{{word("a"), word("b")}, {word("c")}}},
+		{"OR 日記", [][]searchTerm{{word("日記")}}},
+		{"NOT 草稿", [][]searchTerm{{{negate: true, op: ":", text: "草稿"}}}},
+		{"-草稿", [][]searchTerm{{{negate: true, op: ":", text: "草稿"}}}},
+		{"NOT -草稿", [][]searchTerm{{word("草稿")}}},
+		{"-", [][]searchTerm{{word("-")}}},
+		{`"hello world"`, [][]searchTerm{{word("hello world")}}},
+		{"repo*", [][]searchTerm{{{op: ":", text: "repo", prefix: true}}}},
+		{"name:日記本", [][]searchTerm{{{field: "name", op: ":", text: "日記本"}}}},
+		{`content:"a b"`, [][]searchTerm{{{field: "content", op: ":", text: "a b"}}}},
+		{"bucket:photos", [][]searchTerm{{{field: "bucket", op: ":", text: "photos"}}}},
+		{`bucket:"my photos"`, [][]searchTerm{{{field: "bucket", op: ":", text: "my photos"}}}},
+		{"type:text/md", [][]searchTerm{{{field: "type", op: ":", text: "text/md"}}}},
+		{"like>0", [][]searchTerm{{{field: "like", op: ">", num: 0}}}},
+		{"like:2", [][]searchTerm{{{field: "like", op: "=", num: 2}}}},
+		{"like>=2", [][]searchTerm{{{field: "like", op: ">=", num: 2}}}},
+		{"size>10MB", [][]searchTerm{{{field: "size", op: ">", num: 10 << 20}}}},
+		{"size<=1.5k", [][]searchTerm{{{field: "size", op: "<=", num: 1536}}}},
+		{"size<100", [][]searchTerm{{{field: "size", op: "<", num: 100}}}},
+		{"ctime:2023..2024", [][]searchTerm{{{field: "ctime", op: ":",
+			from: localDay(t, "2023-01-01"), to: localDay(t, "2025-01-01")}}}},
+		{"utime:2023-05", [][]searchTerm{{{field: "utime", op: ":",
+			from: localDay(t, "2023-05-01"), to: localDay(t, "2023-06-01")}}}},
+		{"ctime:..2024-01-31", [][]searchTerm{{{field: "ctime", op: ":",
+			to: localDay(t, "2024-02-01")}}}},
+		{"ctime:2023-12..", [][]searchTerm{{{field: "ctime", op: ":",
+			from: localDay(t, "2023-12-01")}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			q, err := ParseSearchQuery(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(q.groups, tt.groups) {
+				t.Fatalf("got %+v, want %+v", q.groups, tt.groups)
+			}
+		})
+	}
+}
+
+func TestParseSearchQueryError(t *testing.T) {
+	for _, input := range []string{
+		"",
+		"   ",
+		"AND OR NOT",
+		`"unclosed`,
+		`""`,
+		"*",
+		"name>3",
+		"bucket>=a",
+		"like:abc",
+		"size>abc",
+		"ctime:2023/05",
+		"utime:2023-13",
+	} {
+		if q, err := ParseSearchQuery(input); err == nil {
+			t.Errorf("%q: want error, got %+v", input, q.groups)
+		}
+	}
+}
+
+func TestSearchFilesSQL(t *testing.T) {
+	db := newTestDB(t)
+	addTestBucket(t, db, "pub", false)
+	addTestBucket(t, db, "secret", true)
+	for _, f := range []File{
+		{BucketName: "pub", Name: "diary 2023.txt", Type: "text/txt", Notes: "travel notes",
+			Keywords: "family", Like: 2, Size: 2048, CTime: "2023-06-15 12:00:00+08:00"},
+		{BucketName: "pub", Name: "beach.png", Type: "image/png", Notes: "family trip",
+			Size: 5 << 20, CTime: "2024-03-10 12:00:00+08:00"},
+		{BucketName: "pub", Name: "100%_done.md", Type: "text/md",
+			Size: 10, CTime: "2024-08-01 12:00:00+08:00"},
+		{BucketName: "pub", Name: "report.txt", Type: "text/txt", Notes: "draft", Like: 5},
+		{BucketName: "pub", Name: "old diary.txt", Type: "text/txt", Deleted: true},
+		{BucketName: "secret", Name: "secret diary.txt", Type: "text/txt"},
+	} {
+		addTestFile(t, db, f)
+	}
+
+	tests := []struct {
+		input    string
+		fileType string
+		admin    bool
+		want     []string
+	}{
+		{"diary", "", false, []string{"diary 2023.txt"}},
+		{"diary", "", true, []string{"diary 2023.txt", "secret diary.txt"}},
+		{"DIARY", "", false, []string{"diary 2023.txt"}},
+		{"family", "", false, []string{"beach.png", "diary 2023.txt"}},
+		{"family", "image", false, []string{"beach.png"}},
+		{"keywords:family", "", false, []string{"diary 2023.txt"}},
+		{"notes:family", "", false, []string{"beach.png"}},
+		{"name:family", "", false, nil},
+		{"content:family", "", false, nil},
+		{"diary OR beach", "", false, []string{"beach.png", "diary 2023.txt"}},
+		{"family -beach", "", false, []string{"diary 2023.txt"}},
+		{"NOT family", "", false, []string{"100%_done.md", "report.txt"}},
+		{`"travel notes"`, "", false, []string{"diary 2023.txt"}},
+		{"be", "", false, []string{"beach.png"}},
+		{"%", "", false, []string{"100%_done.md"}},
+		{"_", "", false, []string{"100%_done.md"}},
+		{"type:image", "", false, []string{"beach.png"}},
+		{"type:text/m", "", false, []string{"100%_done.md"}},
+		{"like>0", "", false, []string{"diary 2023.txt", "report.txt"}},
+		{"like>=5", "", false, []string{"report.txt"}},
+		{"like:0", "", false, []string{"100%_done.md", "beach.png"}},
+		{"size>1MB", "", false, []string{"beach.png"}},
+		{"size<1KB", "", false, []string{"100%_done.md", "report.txt"}},
+		{"ctime:2024", "", false, []string{"100%_done.md", "beach.png"}},
+		{"ctime:..2023", "", false, []string{"diary 2023.txt", "report.txt"}},
+		{"ctime:2024-03", "", false, []string{"beach.png"}},
+		{"bucket:PUB family", "", false, []string{"beach.png", "diary 2023.txt"}},
+		{"bucket:secret", "", false, nil},
+		{"bucket:secret", "", true, []string{"secret diary.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			files, err := db.SearchFiles(tt.input, tt.fileType, 100, tt.admin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Fatalf("got %q, want %q", names, tt.want)
+			}
+
+			// 在內存中搜尋 (見 searchTerm.match) 應與 SQL 的結果一致.
+			q := lo.Must(ParseSearchQuery(tt.input))
+			for _, f := range files {
+				if !q.Match(f, "") {
+					t.Errorf("%s: found by SQL but not matched in memory", f.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchFilesLimit(t *testing.T) {
+	db := newTestDB(t)
+	addTestBucket(t, db, "pub", false)
+	for _, name := range []string{"note 1.txt", "note 2.txt", "note 3.txt"} {
+		addTestFile(t, db, File{BucketName: "pub", Name: name, Type: "text/txt"})
+	}
+	for _, input := range []string{"note", "type:text"} {
+		files, err := db.SearchFiles(input, "", 2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 2 {
+			t.Fatalf("%s: got %d files, want 2", input, len(files))
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/samber/lo"
+)
+
+// 分段加密格式 (streaming chunked AEAD)
+//
+//	header:  magic(8) | chunkSize(4, big-endian) | noncePrefix(7)
+//	segment: aesgcm.Seal(plaintext[i*chunkSize : (i+1)*chunkSize])
+//
+// 每一段的 nonce = noncePrefix(7) | index(4, big-endian) | lastFlag(1),
+// 因此每一段的序號以及 "最後一段" 的標記都受到認證,
+// 段被重排, 刪除, 或檔案被截斷, 都會導致解密失敗.
+// 另外, header 作為每一段的 additional data, 因此 header 也受到認證.
+//
+// 舊版格式 (一次性加密整個檔案) 是 nonce(12) | ciphertext, 沒有 magic.
+
+const (
+	StreamMagic     = "LBSTRM01"
+	ChunkSize       = 64 * 1024
+	maxChunkSize    = 16 * 1024 * 1024
+	noncePrefixSize = NonceSize - 5
+	streamHeaderLen = len(StreamMagic) + 4 + noncePrefixSize
+)
+
+var (
+	ErrStreamAuth      = errors.New("encrypted file is damaged or the key is wrong (加密檔案受損或密鑰錯誤)")
+	ErrStreamTruncated = errors.New("encrypted file is truncated (加密檔案不完整)")
+)
+
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, NonceSize)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[NonceSize-1] = 1
+	}
+	return nonce
+}
+
+// isLastSegment 在讀完一段之後, 偷看下一個字節, 以判斷剛才那一段是不是最後一段.
+func isLastSegment(r *bufio.Reader) (bool, error) {
+	_, err := r.Peek(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return false, err
+}
+
+// encryptStream 從 src 讀取明文, 分段加密後寫入 dst.
+func encryptStream(dst io.Writer, src io.Reader, aesgcm cipher.AEAD) error {
+	header := make([]byte, streamHeaderLen)
+	copy(header, StreamMagic)
+	binary.BigEndian.PutUint32(header[len(StreamMagic):], ChunkSize)
+	prefix := header[len(StreamMagic)+4:]
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	r := bufio.NewReaderSize(src, ChunkSize)
+	plain := make([]byte, ChunkSize)
+	sealed := make([]byte, 0, ChunkSize+aesgcm.Overhead())
+
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(r, plain)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if !last {
+			if last, err = isLastSegment(r); err != nil {
+				return err
+			}
+		}
+		nonce := segmentNonce(prefix, index, last)
+		sealed = aesgcm.Seal(sealed[:0], nonce, plain[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if index == math.MaxUint32 {
+			return fmt.Errorf("file too large to encrypt (檔案太大)")
+		}
+	}
+}
+
+// decryptReader 邊讀邊解密, 每次只在內存中保留一段.
+type decryptReader struct {
+	src    *bufio.Reader
+	aesgcm cipher.AEAD
+	header []byte
+	prefix []byte
+	index  uint32
+	sealed []byte
+	buf    []byte
+	plain  []byte // 已解密但未被讀取的數據
+	done   bool   // 已解密最後一段
+}
+
+// newDecryptReader 讀取 header 並解密第一段.
+// 如果提供了多個 key (例如更換密鑰的過程中), 則依次嘗試, 採用能解密第一段的那個 key.
+func newDecryptReader(src io.Reader, keys ...cipher.AEAD) (*decryptReader, error) {
+	r := bufio.NewReaderSize(src, ChunkSize)
+	header := make([]byte, streamHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrStreamTruncated
+	}
+	if string(header[:len(StreamMagic)]) != StreamMagic {
+		return nil, fmt.Errorf("not a streaming encrypted file")
+	}
+	chunkSize := binary.BigEndian.Uint32(header[len(StreamMagic):])
+	if chunkSize == 0 || chunkSize > maxChunkSize {
+		return nil, ErrStreamAuth
+	}
+	keys = lo.Compact(keys)
+	if len(keys) == 0 {
+		return nil, ErrStreamAuth
+	}
+	d := &decryptReader{
+		src:    r,
+		header: header,
+		prefix: header[len(StreamMagic)+4:],
+		sealed: make([]byte, int(chunkSize)+keys[0].Overhead()),
+		buf:    make([]byte, 0, int(chunkSize)),
+	}
+	if err := d.nextSegment(keys...); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.nextSegment(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+// nextSegment 讀取並解密下一段, 第一段可以嘗試多個 key, 之後只用同一個 key.
+func (d *decryptReader) nextSegment(keys ...cipher.AEAD) error {
+	n, err := io.ReadFull(d.src, d.sealed)
+	if err == io.EOF {
+		// 未遇到標記為 "最後一段" 的段, 檔案就結束了.
+		return ErrStreamTruncated
+	}
+	last := err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return err
+	}
+	if !last {
+		if last, err = isLastSegment(d.src); err != nil {
+			return err
+		}
+	}
+	if d.aesgcm != nil {
+		keys = []cipher.AEAD{d.aesgcm}
+	}
+	nonce := segmentNonce(d.prefix, d.index, last)
+	opened := false
+	for _, aesgcm := range keys {
+		// 解密失敗時 Open 會清空輸出, 因此不可原地解密.
+		plain, err := aesgcm.Open(d.buf[:0], nonce, d.sealed[:n], d.header)
+		if err == nil {
+			d.aesgcm = aesgcm
+			d.plain = plain
+			opened = true
+			break
+		}
+	}
+	if !opened {
+		return ErrStreamAuth
+	}
+	d.done = last
+	d.index++
+	return nil
+}
+
+// isStreamFormat 判斷 data 的開頭是不是分段加密格式的 magic.
+func isStreamFormat(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(StreamMagic))
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+const sealedChunkSize = ChunkSize + 16 // 每一段密文的長度 (AES-GCM 的 tag 為 16 字節)
+
+func testGCM(t *testing.T) cipher.AEAD {
+	t.Helper()
+	key, err := randomKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newKeyGCM(key[:])
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func encryptBytes(t *testing.T, data []byte, aesgcm cipher.AEAD) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encryptStream(&buf, bytes.NewReader(data), aesgcm); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decryptBytes(blob []byte, keys ...cipher.AEAD) ([]byte, error) {
+	r, err := newDecryptReader(bytes.NewReader(blob), keys...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// segments 把密文拆成 header 及各段.
+func segments(blob []byte) (header []byte, segs [][]byte) {
+	header, blob = blob[:streamHeaderLen], blob[streamHeaderLen:]
+	for len(blob) > sealedChunkSize {
+		segs = append(segs, blob[:sealedChunkSize])
+		blob = blob[sealedChunkSize:]
+	}
+	return header, append(segs, blob)
+}
+
+// resealSegment 用指定的 lastFlag 重新加密第 index 段 (模擬 "最後一段" 的標記被改動).
+func resealSegment(t *testing.T, blob []byte, index int, last bool, aesgcm cipher.AEAD) []byte {
+	t.Helper()
+	header, segs := segments(blob)
+	prefix := header[len(StreamMagic)+4:]
+	plain, err := aesgcm.Open(nil, segmentNonce(prefix, uint32(index), index == len(segs)-1), segs[index], header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segs[index] = aesgcm.Seal(nil, segmentNonce(prefix, uint32(index), last), plain, header)
+	return bytes.Join(append([][]byte{header}, segs...), nil)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	aesgcm := testGCM(t)
+	tests := []struct {
+		name     string
+		size     int
+		segments int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"one segment", ChunkSize, 1},
+		{"segment plus one", ChunkSize + 1, 2},
+		{"three segments", 2*ChunkSize + 7, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomBytes(t, tt.size)
+			blob := encryptBytes(t, data, aesgcm)
+			if !isStreamFormat(blob) {
+				t.Fatal("missing magic")
+			}
+			if _, segs := segments(blob); len(segs) != tt.segments {
+				t.Fatalf("got %d segments, want %d", len(segs), tt.segments)
+			}
+			got, err := decryptBytes(blob, aesgcm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("decrypted data mismatch")
+			}
+		})
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	aesgcm := testGCM(t)
+	data := randomBytes(t, 2*ChunkSize+7)
+	blob := encryptBytes(t, data, aesgcm)
+
+	tests := []struct {
+		name   string
+		tamper func(blob []byte) []byte
+		keys   []cipher.AEAD
+	}{
+		{"drop last segment", func(blob []byte) []byte {
+			return blob[:streamHeaderLen+2*sealedChunkSize]
+		}, nil},
+		{"drop middle segment", func(blob []byte) []byte {
+			header, segs := segments(blob)
+			return bytes.Join([][]byte{header, segs[0], segs[2]}, nil)
+		}, nil},
+		{"reorder segments", func(blob []byte) []byte {
+			header, segs := segments(blob)
+			return bytes.Join([][]byte{header, segs[1], segs[0], segs[2]}, nil)
+		}, nil},
+		{"last flag on middle segment", func(blob []byte) []byte {
+			return resealSegment(t, blob, 1, true, aesgcm)
+		}, nil},
+		{"last flag cleared", func(blob []byte) []byte {
+			return resealSegment(t, blob, 2, false, aesgcm)
+		}, nil},
+		{"tampered nonce prefix", func(blob []byte) []byte {
+			blob[streamHeaderLen-1] ^= 1
+			return blob
+		}, nil},
+		{"tampered chunk size", func(blob []byte) []byte {
+			blob[len(StreamMagic)+3] ^= 1
+			return blob
+		}, nil},
+		{"zero chunk size", func(blob []byte) []byte {
+			copy(blob[len(StreamMagic):], []byte{0, 0, 0, 0})
+			return blob
+		}, nil},
+		{"flipped ciphertext bit", func(blob []byte) []byte {
+			blob[streamHeaderLen+sealedChunkSize+1] ^= 1
+			return blob
+		}, nil},
+		{"wrong key", func(blob []byte) []byte { return blob }, []cipher.AEAD{testGCM(t)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := tt.keys
+			if keys == nil {
+				keys = []cipher.AEAD{aesgcm}
+			}
+			tampered := tt.tamper(bytes.Clone(blob))
+			if _, err := decryptBytes(tampered, keys...); !errors.Is(err, ErrStreamAuth) {
+				t.Fatalf("got %v, want ErrStreamAuth", err)
+			}
+		})
+	}
+}
+
+// 更換密鑰的過程中, 提供多個 key 時應採用能解密的那個.
+func TestStreamMultipleKeys(t *testing.T) {
+	oldKey, newKey := testGCM(t), testGCM(t)
+	data := randomBytes(t, ChunkSize+1)
+	blob := encryptBytes(t, data, oldKey)
+	got, err := decryptBytes(blob, newKey, nil, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("decrypted data mismatch")
+	}
+}
+
+func TestStreamTruncatedHeader(t *testing.T) {
+	aesgcm := testGCM(t)
+	blob := encryptBytes(t, []byte("hello"), aesgcm)
+	for _, n := range []int{0, len(StreamMagic), streamHeaderLen} {
+		if _, err := decryptBytes(blob[:n], aesgcm); !errors.Is(err, ErrStreamTruncated) {
+			t.Fatalf("%d bytes: got %v, want ErrStreamTruncated", n, err)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/samber/lo"
+)
+
+// 標籤保存在 tag 表中, 檔案與標籤的關係保存在 file_tag 表中.
+// file.keywords 欄位同時保存整理過的標籤列表 (見 model.SplitTags), 用於顯示及全文搜尋,
+// 每次寫入 file.keywords 時都要用 setFileTags 同步更新 file_tag.
+//
+// 密封倉庫中的檔案的關鍵詞是加密的, 因此不寫入 tag 及 file_tag 表.
+
+// setFileTags 根據 keywords 重新設定檔案的標籤, 並刪除不再使用的標籤.
+func setFileTags(tx TX, fileID int64, keywords string) error {
+	if _, err := tx.Exec(stmt.DeleteFileTags, fileID); err != nil {
+		return err
+	}
+	for _, name := range model.SplitTags(keywords) {
+		tag, err := getOrInsertTag(tx, name)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(stmt.InsertFileTag, fileID, tag.id); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(stmt.DeleteUnusedTags)
+	return err
+}
+
+type tagRow struct {
+	id   int64
+	name string
+}
+
+func getTagByName(tx TX, name string) (tag tagRow, err error) {
+	err = tx.QueryRow(stmt.GetTagByName, name).Scan(&tag.id, &tag.name)
+	return
+}
+
+func getOrInsertTag(tx TX, name string) (tagRow, error) {
+	if _, err := tx.Exec(stmt.InsertTag, name); err != nil {
+		return tagRow{}, err
+	}
+	return getTagByName(tx, name)
+}
+
+// refreshKeywords 根據 file_tag 重新生成檔案的 keywords 欄位.
+func refreshKeywords(tx TX, fileID int64) error {
+	rows, err := tx.Query(stmt.GetFileTags, fileID)
+	if err != nil {
+		return err
+	}
+	tags, err := scanKeywords(rows)
+	if err != nil {
+		return err
+	}
+	keywords := model.JoinTags(model.SplitTags(strings.Join(tags, ",")))
+	_, err = tx.Exec(stmt.UpdateKeywords, keywords, fileID)
+	return err
+}
+
+func getFileIDsByTag(tx TX, tagID int64) (ids []int64, err error) {
+	rows, err := tx.Query(stmt.GetFileIDsByTag, tagID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = util.WrapErrors(rows.Err(), rows.Close())
+	return
+}
+
+// checkTagName 確保 name 是一個有效的標籤 (不可包含分隔符號), 並返回去除首尾空格後的名稱.
+func checkTagName(name string) (string, error) {
+	tags := model.SplitTags(name)
+	if len(tags) != 1 || tags[0] != strings.TrimSpace(name) {
+		return "", fmt.Errorf("標籤名稱不可為空, 不可包含逗號, 分號, 頓號: %s", name)
+	}
+	return tags[0], nil
+}
+
+// RenameTag 更改標籤名稱, 如果 newName 已存在, 則把兩個標籤合併.
+// 也可用於只改變大小寫, 例如 "travel" 改為 "Travel".
+func (db *DB) RenameTag(oldName, newName string) error {
+	return db.MergeTags([]string{oldName}, newName)
+}
+
+// MergeTags 把 tags 合併到 into, 即有 tags 中任何一個標籤的檔案都改為有 into 標籤,
+// 並刪除 tags 中的標籤. 如果 into 不存在, 則新建.
+func (db *DB) MergeTags(tags []string, into string) error {
+	into, err := checkTagName(into)
+	if err != nil {
+		return err
+	}
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	var affected []int64
+	var sources []tagRow
+	for _, name := range tags {
+		tag, err := getTagByName(tx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("找不到標籤: %s", name)
+		}
+		if err != nil {
+			return err
+		}
+		ids, err := getFileIDsByTag(tx, tag.id)
+		if err != nil {
+			return err
+		}
+		affected = append(affected, ids...)
+		sources = append(sources, tag)
+	}
+
+	target, err := getTagByName(tx, into)
+	if errors.Is(err, sql.ErrNoRows) {
+		// into 不存在, 則直接改名第一個標籤 (保留其 ID), 其餘合併過去.
+		target = sources[0]
+		if _, err := tx.Exec(stmt.RenameTag, into, target.id); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	for _, tag := range sources {
+		if tag.id == target.id {
+			// 只改變大小寫的情況.
+			if _, err := tx.Exec(stmt.RenameTag, into, target.id); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := tx.Exec(stmt.MergeFileTags, target.id, tag.id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(stmt.DeleteTag, tag.id); err != nil {
+			return err
+		}
+	}
+
+	for _, id := range lo.Uniq(affected) {
+		if err := refreshKeywords(tx, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetTagCounts 獲取每個標籤在每個倉庫中的檔案數量, 不包括未解鎖的倉庫及回收站中的檔案.
+func (db *DB) GetTagCounts(admin bool) (all []*model.TagCount, err error) {
+	locked, err := db.lockedBuckets()
+	if err != nil {
+		return nil, err
+	}
+	query := lo.Ternary(admin, stmt.CountAllTags, stmt.CountPublicTags)
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var tc model.TagCount
+		if err := rows.Scan(&tc.Name, &tc.BucketName, &tc.Count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !locked[tc.BucketName] {
+			all = append(all, &tc)
+		}
+	}
+	if err = util.WrapErrors(rows.Err(), rows.Close()); err != nil {
+		return nil, err
+	}
+	// 密封倉庫中的檔案的標籤不在 tag 表中, 需要解密後統計 (只限管理員).
+	if admin {
+		sealed, err := db.getUnsealedFiles()
+		if err != nil {
+			return nil, err
+		}
+		counts := make(map[[2]string]*model.TagCount)
+		for _, file := range sealed {
+			if file.Deleted {
+				continue
+			}
+			for _, name := range model.SplitTags(file.Keywords) {
+				key := [2]string{strings.ToLower(name), file.BucketName}
+				if counts[key] == nil {
+					counts[key] = &model.TagCount{Name: name, BucketName: file.BucketName}
+					all = append(all, counts[key])
+				}
+				counts[key].Count++
+			}
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return strings.ToLower(all[i].Name) < strings.ToLower(all[j].Name)
+	})
+	return all, nil
+}
+
+// splitAllKeywords 把舊版數據庫中的 keywords 拆分為標籤, 寫入 tag 及 file_tag 表.
+func splitAllKeywords(tx TX) error {
+	rows, err := tx.Query(stmt.GetIDAndKeywords)
+	if err != nil {
+		return err
+	}
+	keywords := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var kw string
+		if err := rows.Scan(&id, &kw); err != nil {
+			rows.Close()
+			return err
+		}
+		keywords[id] = kw
+	}
+	if err := util.WrapErrors(rows.Err(), rows.Close()); err != nil {
+		return err
+	}
+	for id, kw := range keywords {
+		if _, err := tx.Exec(stmt.UpdateKeywords, model.NormalizeKeywords(kw), id); err != nil {
+			return err
+		}
+		if err := setFileTags(tx, id, kw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
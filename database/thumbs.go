@@ -0,0 +1,56 @@
+package database
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"github.com/samber/lo"
+)
+
+// 加密倉庫中的圖片的縮略圖, 用專案的真正密鑰加密 (一次性加密, 因為縮略圖很小),
+// 保存在 public 資料夾之外, 只能通過需要登入的 API 獲取.
+
+// EncryptThumb 用專案密鑰加密縮略圖, 在更換密鑰的過程中使用新密鑰.
+func (db *DB) EncryptThumb(data []byte) ([]byte, error) {
+	k := db.keys()
+	if k.aesgcm == nil {
+		return nil, fmt.Errorf("加密縮略圖需要管理員權限")
+	}
+	return encrypt(data, k.write())
+}
+
+// DecryptThumb 解密縮略圖, 在更換密鑰的過程中, 新舊密鑰都會嘗試.
+func (db *DB) DecryptThumb(blob []byte) ([]byte, error) {
+	k := db.keys()
+	for _, aesgcm := range lo.Compact([]cipher.AEAD{k.pendingGCM, k.aesgcm}) {
+		if data, err := decrypt(blob, aesgcm); err == nil {
+			return data, nil
+		}
+	}
+	return nil, ErrStreamAuth
+}
+
+// ReEncryptThumb 在更換密鑰的過程中, 用新密鑰重新加密縮略圖.
+// 如果縮略圖已經是用新密鑰加密的, 則 changed 為 false.
+func (db *DB) ReEncryptThumb(blob []byte) (newBlob []byte, changed bool, err error) {
+	k := db.keys()
+	if k.pendingGCM == nil {
+		return blob, false, nil
+	}
+	return reEncrypt(blob, []cipher.AEAD{k.aesgcm}, k.pendingGCM)
+}
+
+// reEncrypt 用於一次性加密的小數據 (縮略圖, 檔案內容, 密封資訊等),
+// 在更換密鑰的過程中用 writeKey 重新加密. 如果已經是用 writeKey 加密的, 則 changed 為 false.
+func reEncrypt(blob []byte, readKeys []cipher.AEAD, writeKey cipher.AEAD) (newBlob []byte, changed bool, err error) {
+	if _, err := decrypt(blob, writeKey); err == nil {
+		return blob, false, nil
+	}
+	for _, aesgcm := range lo.Compact(readKeys) {
+		if data, err := decrypt(blob, aesgcm); err == nil {
+			newBlob, err = encrypt(data, writeKey)
+			return newBlob, err == nil, err
+		}
+	}
+	return nil, false, ErrStreamAuth
+}
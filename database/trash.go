@@ -0,0 +1,55 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/ahui2016/local-buckets/stmt"
+)
+
+// 刪除檔案時, 先把檔案標記為 "已刪除" (file.deleted) 並移到回收站,
+// 刪除時間記錄在 trash 表中, 用於自動清理超過保留期限的檔案.
+// 徹底刪除檔案時, trash 中的記錄會自動刪除 (ON DELETE CASCADE).
+
+// SetFileDeleted 把檔案移到回收站 (deleted=true) 或從回收站中恢復 (deleted=false).
+// deletedAt 只在 deleted=true 時有效.
+func (db *DB) SetFileDeleted(id int64, deleted bool, deletedAt string) error {
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(stmt.SetFileDeleted, deleted, id); err != nil {
+		return err
+	}
+	var err error
+	if deleted {
+		_, err = tx.Exec(stmt.UpsertTrash, id, deletedAt)
+	} else {
+		_, err = tx.Exec(stmt.DeleteTrash, id)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetTrashTime 獲取檔案移到回收站的時間, 沒有記錄則返回空字符串.
+func (db *DB) GetTrashTime(id int64) (string, error) {
+	var deletedAt string
+	err := db.QueryRow(stmt.GetTrashTime, id).Scan(&deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return deletedAt, err
+}
+
+// GetTrashFiles 獲取回收站中的檔案 (全部), 最近刪除的排在前面,
+// admin 為 false 時只獲取公開倉庫中的檔案.
+func (db *DB) GetTrashFiles(admin bool) ([]*FilePlus, error) {
+	page, err := db.ListFiles(FileQuery{Trash: TrashOnly, Sort: "deleted_at"}, admin)
+	return page.Files, err
+}
+
+// GetExpiredTrashFiles 獲取在 before 之前移到回收站的檔案.
+func (db *DB) GetExpiredTrashFiles(before string) ([]*File, error) {
+	return getFiles(db.DB, stmt.GetExpiredTrashFiles, before)
+}
@@ -40,6 +40,8 @@ func insertBucket(tx TX, b *Bucket) error {
 		b.Title,
 		b.Subtitle,
 		b.Encrypted,
+		b.CipherKey,
+		b.Sealed,
 	)
 	return err
 }
@@ -52,6 +54,8 @@ func insertBucketWithID(tx TX, b *Bucket) error {
 		b.Title,
 		b.Subtitle,
 		b.Encrypted,
+		b.CipherKey,
+		b.Sealed,
 	)
 	return err
 }
@@ -63,6 +67,8 @@ func scanBucket(row Row) (b Bucket, err error) {
 		&b.Title,
 		&b.Subtitle,
 		&b.Encrypted,
+		&b.CipherKey,
+		&b.Sealed,
 	)
 	return
 }
@@ -91,8 +97,10 @@ func scanKeywords(rows *sql.Rows) (all []string, err error) {
 	return
 }
 
+// insertFile 插入新檔案, 並同時寫入標籤.
 func insertFile(tx TX, f *File) error {
-	_, err := tx.Exec(
+	f.Keywords = model.NormalizeKeywords(f.Keywords)
+	result, err := tx.Exec(
 		stmt.InsertFile,
 		// f.ID, 自增ID
 		f.Checksum,
@@ -108,12 +116,20 @@ func insertFile(tx TX, f *File) error {
 		f.Checked,
 		f.Damaged,
 		f.Deleted,
+		f.Sealed,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	if f.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	return setFileTags(tx, f.ID, f.Keywords)
 }
 
 // insertFileWithID 主要用于复制文档到备份仓库.
 func insertFileWithID(tx TX, f *File) error {
+	f.Keywords = model.NormalizeKeywords(f.Keywords)
 	_, err := tx.Exec(
 		stmt.InsertFileWithID,
 		f.ID,
@@ -130,8 +146,12 @@ func insertFileWithID(tx TX, f *File) error {
 		f.Checked,
 		f.Damaged,
 		f.Deleted,
+		f.Sealed,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return setFileTags(tx, f.ID, f.Keywords)
 }
 
 func ScanFile(row Row) (f File, err error) {
@@ -150,12 +170,18 @@ func ScanFile(row Row) (f File, err error) {
 		&f.Checked,
 		&f.Damaged,
 		&f.Deleted,
+		&f.Sealed,
 	)
 	return
 }
 
 func scanFilePlus(row Row) (f FilePlus, err error) {
-	err = row.Scan(
+	err = row.Scan(filePlusFields(&f)...)
+	return
+}
+
+func filePlusFields(f *FilePlus) []any {
+	return []any{
 		&f.ID,
 		&f.Checksum,
 		&f.BucketName,
@@ -170,9 +196,9 @@ func scanFilePlus(row Row) (f FilePlus, err error) {
 		&f.Checked,
 		&f.Damaged,
 		&f.Deleted,
+		&f.Sealed,
 		&f.Encrypted,
-	)
-	return
+	}
 }
 
 func scanFiles(rows *sql.Rows) (all []*File, err error) {
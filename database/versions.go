@@ -0,0 +1,70 @@
+package database
+
+import (
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// 覆蓋檔案時, 舊的內容不刪除, 而是作為舊版本保存在 versions 資料夾中,
+// 數據庫 file_version 表記錄舊版本的 checksum, size, utime 等資訊.
+// 徹底刪除檔案時, file_version 中的記錄會自動刪除 (ON DELETE CASCADE),
+// 但 versions 資料夾中的檔案需要另外刪除.
+
+// InsertFileVersion 插入舊版本, 並把新的 ID 寫入 v.ID
+func (db *DB) InsertFileVersion(v *FileVersion) (err error) {
+	result, err := db.DB.Exec(stmt.InsertFileVersion,
+		v.FileID, v.Checksum, v.Size, v.UTime, v.CTime)
+	if err != nil {
+		return err
+	}
+	v.ID, err = result.LastInsertId()
+	return
+}
+
+func (db *DB) InsertFileVersionWithID(v *FileVersion) error {
+	return db.Exec(stmt.InsertFileVersionWithID,
+		v.ID, v.FileID, v.Checksum, v.Size, v.UTime, v.CTime)
+}
+
+func (db *DB) GetFileVersion(id int64) (FileVersion, error) {
+	return scanFileVersion(db.QueryRow(stmt.GetFileVersion, id))
+}
+
+// GetFileVersions 獲取一個檔案的全部舊版本, 最新的排在前面.
+func (db *DB) GetFileVersions(fileID int64) ([]*FileVersion, error) {
+	return getFileVersions(db.DB, stmt.GetFileVersions, fileID)
+}
+
+func (db *DB) GetAllFileVersions() ([]*FileVersion, error) {
+	return getFileVersions(db.DB, stmt.GetAllFileVersions)
+}
+
+func (db *DB) DeleteFileVersion(id int64) error {
+	return db.Exec(stmt.DeleteFileVersion, id)
+}
+
+func (db *DB) UpdateFileVersionChecksum(id int64, checksum string) error {
+	return db.Exec(stmt.UpdateFileVersionChecksum, checksum, id)
+}
+
+func scanFileVersion(row Row) (v FileVersion, err error) {
+	err = row.Scan(&v.ID, &v.FileID, &v.Checksum, &v.Size, &v.UTime, &v.CTime)
+	return
+}
+
+func getFileVersions(tx TX, query string, args ...any) (all []*FileVersion, err error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		v, err := scanFileVersion(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		all = append(all, &v)
+	}
+	err = util.WrapErrors(rows.Err(), rows.Close())
+	return
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// eventActor 返回當前請求的操作者, c 為 nil 表示由程序自動執行.
+func eventActor(c *fiber.Ctx) string {
+	if c == nil {
+		return model.ActorSystem
+	}
+	if token := getAPIToken(c); token != nil {
+		return "token:" + token.Name
+	}
+	if isAdmin(c) {
+		return model.ActorAdmin
+	}
+	return model.ActorGuest
+}
+
+// logEvent 在操作成功後記錄一條事件. c 為 nil 表示由程序自動執行.
+// 如果寫入失敗, 操作本身已經完成, 因此返回的錯誤要說明這一點.
+func logEvent(c *fiber.Ctx, action string, fileID, bucketID int64, before, after any) error {
+	return logEventTo(db, c, action, fileID, bucketID, before, after)
+}
+
+// logEventTo 與 logEvent 一樣, 但把事件記錄到 db1 中.
+func logEventTo(db1 *DB, c *fiber.Ctx, action string, fileID, bucketID int64, before, after any) error {
+	ip := ""
+	if c != nil {
+		ip = c.IP()
+	}
+	e, err := database.NewEvent(eventActor(c), ip, action, fileID, bucketID, before, after)
+	if err == nil {
+		err = db1.InsertEvent(e)
+	}
+	if err != nil {
+		return fmt.Errorf("操作已完成, 但記錄事件 (%s) 失敗: %w", action, err)
+	}
+	return nil
+}
+
+// logFileEvent 記錄與一個檔案有關的事件, before 是操作前的檔案資訊 (nil 表示沒有),
+// 操作後的檔案資訊則從數據庫重新讀取 (檔案已被徹底刪除則沒有).
+func logFileEvent(c *fiber.Ctx, action string, before *File, fileID int64) error {
+	// 用 any 而不是 *model.FileSnapshot, 以免 nil 指針被記錄為 "null".
+	var beforeSnap, afterSnap any
+	bucketName := ""
+	if before != nil {
+		beforeSnap = before.Snapshot()
+		bucketName = before.BucketName
+	}
+	if after, err := db.GetFilePlus(fileID); err == nil {
+		afterSnap = after.Snapshot()
+		bucketName = after.BucketName
+	}
+	bucketID := int64(0)
+	if bucket, err := db.GetBucketByName(bucketName); err == nil {
+		bucketID = bucket.ID
+	}
+	return logEvent(c, action, fileID, bucketID, beforeSnap, afterSnap)
+}
+
+func getEventsHandler(c *fiber.Ctx) error {
+	form := new(model.EventsOptions)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	events, err := db.GetEvents(form)
+	if err != nil {
+		return err
+	}
+	return c.JSON(events)
+}
+
+// exportEventsHandler 以 JSONL 格式 (每行一條事件) 下載符合條件的全部事件.
+func exportEventsHandler(c *fiber.Ctx) error {
+	form := new(model.EventsOptions)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if _, err := db.ExportEvents(&buf, form); err != nil {
+		return err
+	}
+	filename := fmt.Sprintf("events-%s.jsonl", time.Now().Format("20060102-150405"))
+	c.Attachment(filename)
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	return c.Send(buf.Bytes())
+}
@@ -0,0 +1,99 @@
+package extract
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type epubContainer struct {
+	Rootfiles []struct {
+		FullPath string `xml:"full-path,attr"`
+	} `xml:"rootfiles>rootfile"`
+}
+
+type epubPackage struct {
+	Manifest []struct {
+		ID   string `xml:"id,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// EPUB 按閱讀順序 (spine) 提取電子書每一章的文字.
+// 如果找不到 spine, 則按 zip 中的順序提取全部 xhtml/html 檔案.
+func EPUB(data []byte) (string, error) {
+	files, all, err := zipFiles(data)
+	if err != nil {
+		return "", err
+	}
+	chapters, err := epubSpine(files)
+	if err != nil || len(chapters) == 0 {
+		chapters = nil
+		for _, f := range all {
+			ext := strings.ToLower(path.Ext(f.Name))
+			if ext == ".xhtml" || ext == ".html" || ext == ".htm" {
+				chapters = append(chapters, f)
+			}
+		}
+	}
+	if len(chapters) == 0 {
+		return "", fmt.Errorf("epub: %w", errNoContent)
+	}
+	return zipXMLTexts(chapters, htmlOptions)
+}
+
+func unmarshalZipXML(f *zip.File, v any) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	d := xml.NewDecoder(io.LimitReader(rc, MaxFileSize))
+	d.Strict = false
+	return d.Decode(v)
+}
+
+// epubSpine 根據 META-INF/container.xml 找到 opf 檔案, 返回 spine 中的各章.
+func epubSpine(files map[string]*zip.File) (chapters []*zip.File, err error) {
+	f, ok := files["META-INF/container.xml"]
+	if !ok {
+		return nil, errNoContent
+	}
+	var container epubContainer
+	if err := unmarshalZipXML(f, &container); err != nil {
+		return nil, err
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, errNoContent
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	if f, ok = files[opfPath]; !ok {
+		return nil, errNoContent
+	}
+	var pkg epubPackage
+	if err := unmarshalZipXML(f, &pkg); err != nil {
+		return nil, err
+	}
+	hrefs := make(map[string]string)
+	for _, item := range pkg.Manifest {
+		hrefs[item.ID] = item.Href
+	}
+	for _, item := range pkg.Spine {
+		// href 是相對於 opf 檔案的路徑, 可能含有 URL 編碼.
+		href := hrefs[item.IDRef]
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		if f, ok := files[path.Join(path.Dir(opfPath), href)]; ok {
+			chapters = append(chapters, f)
+		}
+	}
+	return
+}
@@ -0,0 +1,110 @@
+// Package extract 從 PDF, Office 文檔, 電子書, 純文字等檔案中提取文字, 用於全文搜尋.
+//
+// 每種檔案類型 (即 model.File.Type) 對應一個 Extractor, 可通過 Register 添加新的類型.
+package extract
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxFileSize 超過此體積的檔案不提取文字.
+const MaxFileSize = 64 << 20
+
+// MaxTextSize 提取的文字最多保留這麼多字節, 以免數據庫過大.
+const MaxTextSize = 1 << 20
+
+// Extractor 從檔案內容中提取文字.
+type Extractor func(data []byte) (string, error)
+
+var (
+	extractors       = make(map[string]Extractor)
+	prefixExtractors = make(map[string]Extractor)
+)
+
+// Register 登記一種檔案類型的 Extractor, 例如 Register("application/pdf", PDF).
+// 如果 fileType 以 "/" 結尾, 則表示前綴, 例如 "text/".
+func Register(fileType string, ex Extractor) {
+	if strings.HasSuffix(fileType, "/") {
+		prefixExtractors[fileType] = ex
+		return
+	}
+	extractors[fileType] = ex
+}
+
+func init() {
+	Register("text/", Plain)
+	for _, t := range []string{"text/html", "text/htm", "text/xhtml", "text/xml", "text/atom", "text/rss"} {
+		Register(t, Markup)
+	}
+	Register("application/pdf", PDF)
+	Register("office/docx", DOCX)
+	Register("office/xlsx", XLSX)
+	Register("office/pptx", PPTX)
+	Register("application/vnd.oasis.opendocument.text", ODF)
+	Register("application/vnd.oasis.opendocument.spreadsheet", ODF)
+	Register("application/vnd.oasis.opendocument.presentation", ODF)
+	Register("ebook/epub", EPUB)
+}
+
+func find(fileType string) (Extractor, bool) {
+	if ex, ok := extractors[fileType]; ok {
+		return ex, true
+	}
+	for prefix, ex := range prefixExtractors {
+		if strings.HasPrefix(fileType, prefix) {
+			return ex, true
+		}
+	}
+	return nil, false
+}
+
+// Supported 判斷能否從該類型的檔案中提取文字.
+func Supported(fileType string) bool {
+	_, ok := find(fileType)
+	return ok
+}
+
+// Text 從檔案內容中提取文字. 不支援的類型返回空字符串 (不算錯誤).
+func Text(fileType string, data []byte) (string, error) {
+	ex, ok := find(fileType)
+	if !ok || len(data) > MaxFileSize {
+		return "", nil
+	}
+	text, err := ex(data)
+	if err != nil {
+		return "", err
+	}
+	return truncate(normalize(text), MaxTextSize), nil
+}
+
+// normalize 把每行的連續空白合併為一個空格, 並刪除空行.
+func normalize(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// truncate 截取最多 n 個字節, 並確保不會截斷多字節字符.
+func truncate(text string, n int) string {
+	if len(text) <= n {
+		return text
+	}
+	for n > 0 && !utf8.RuneStart(text[n]) {
+		n--
+	}
+	return text[:n]
+}
+
+// Plain 用於純文字檔案, 不是 UTF-8 編碼的檔案返回空字符串.
+func Plain(data []byte) (string, error) {
+	if !utf8.Valid(data) {
+		return "", nil
+	}
+	return string(data), nil
+}
@@ -0,0 +1,101 @@
+package extract
+
+import (
+	"archive/zip"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	docxOptions = xmlTextOptions{
+		breaks: nameSet("p", "br", "tr"),
+		spaces: nameSet("tab", "tc"),
+		only:   nameSet("t"),
+	}
+	xlsxOptions = xmlTextOptions{
+		breaks: nameSet("si", "row"),
+		spaces: nameSet("c"),
+		only:   nameSet("t"),
+	}
+	pptxOptions = xmlTextOptions{
+		breaks: nameSet("p", "br"),
+		only:   nameSet("t"),
+	}
+	odfOptions = xmlTextOptions{
+		breaks: nameSet("p", "h", "line-break", "list-item", "table-row"),
+		spaces: nameSet("tab", "s", "table-cell"),
+	}
+)
+
+// DOCX 提取 Word 文檔的正文.
+func DOCX(data []byte) (string, error) {
+	files, _, err := zipFiles(data)
+	if err != nil {
+		return "", err
+	}
+	f, ok := files["word/document.xml"]
+	if !ok {
+		return "", fmt.Errorf("docx: %w", errNoContent)
+	}
+	return zipXMLText(f, docxOptions)
+}
+
+// XLSX 提取 Excel 表格中的文字 (共享字符串, 以及工作表中的內嵌字符串), 不提取數字.
+func XLSX(data []byte) (string, error) {
+	files, all, err := zipFiles(data)
+	if err != nil {
+		return "", err
+	}
+	var parts []*zip.File
+	if f, ok := files["xl/sharedStrings.xml"]; ok {
+		parts = append(parts, f)
+	}
+	parts = append(parts, numberedFiles(all, "xl/worksheets/sheet")...)
+	return zipXMLTexts(parts, xlsxOptions)
+}
+
+// PPTX 按順序提取每一頁投影片中的文字.
+func PPTX(data []byte) (string, error) {
+	_, all, err := zipFiles(data)
+	if err != nil {
+		return "", err
+	}
+	return zipXMLTexts(numberedFiles(all, "ppt/slides/slide"), pptxOptions)
+}
+
+// ODF 提取 OpenDocument 格式 (odt, ods, odp) 的正文.
+func ODF(data []byte) (string, error) {
+	files, _, err := zipFiles(data)
+	if err != nil {
+		return "", err
+	}
+	f, ok := files["content.xml"]
+	if !ok {
+		return "", fmt.Errorf("odf: %w", errNoContent)
+	}
+	return zipXMLText(f, odfOptions)
+}
+
+var fileNumberPattern = regexp.MustCompile(`(\d+)\.xml$`)
+
+// numberedFiles 返回以 prefix 開頭並以數字編號的 xml 檔案, 按編號排序
+// (例如 sheet2.xml 排在 sheet10.xml 前面).
+func numberedFiles(all []*zip.File, prefix string) (files []*zip.File) {
+	number := func(f *zip.File) int {
+		m := fileNumberPattern.FindStringSubmatch(f.Name)
+		n, _ := strconv.Atoi(m[1])
+		return n
+	}
+	for _, f := range all {
+		if strings.HasPrefix(f.Name, prefix) && fileNumberPattern.MatchString(f.Name) {
+			files = append(files, f)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return number(files[i]) < number(files[j])
+	})
+	return
+}
@@ -0,0 +1,510 @@
+package extract
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// PDF 是簡易的 PDF 文字提取, 不依賴第三方庫:
+//
+//   - 找出全部 stream, 解壓 FlateDecode (圖片, 字型等 stream 會被跳過),
+//   - 從 ToUnicode CMap 中收集字符編碼與 Unicode 的對應關係 (全部字型合併在一起),
+//   - 解析內容流中的 Tj, TJ, ', " 等文字操作符.
+//
+// 不支援加密的 PDF. 文字順序按內容流的順序, 複雜排版的 PDF 可能順序不對, 但不影響搜尋.
+func PDF(data []byte) (string, error) {
+	if pdfEncryptPattern.Match(data) {
+		return "", errors.New("pdf: encrypted PDF is not supported")
+	}
+	cmap := &pdfCMap{codes: make(map[string]string)}
+	var contents [][]byte
+	for _, s := range pdfStreams(data) {
+		if bytes.Contains(s, []byte("begincmap")) {
+			cmap.parse(s)
+		} else {
+			contents = append(contents, s)
+		}
+	}
+	var b strings.Builder
+	for _, content := range contents {
+		pdfContentText(&b, content, cmap)
+	}
+	return b.String(), nil
+}
+
+var (
+	pdfEncryptPattern    = regexp.MustCompile(`/Encrypt\s*(<<|\d+\s+\d+\s+R)`)
+	pdfFilterPattern     = regexp.MustCompile(`/Filter\s*(/\w+|\[[^\]]*\])`)
+	pdfSkipStreamPattern = regexp.MustCompile(
+		`/Length[123]\b|/Subtype\s*/(Image|Type1C|CIDFontType0C|OpenType)|/Type\s*/(XRef|ObjStm|EmbeddedFile|Metadata)`)
+)
+
+// pdfStreams 返回全部可以解碼的 stream 的內容.
+func pdfStreams(data []byte) (streams [][]byte) {
+	keyword, endKeyword := []byte("stream"), []byte("endstream")
+	for pos := 0; ; {
+		i := bytes.Index(data[pos:], keyword)
+		if i < 0 {
+			return
+		}
+		i += pos
+		pos = i + len(keyword)
+		if i >= 3 && string(data[i-3:i]) == "end" {
+			continue
+		}
+		// stream 關鍵字後面必須是換行.
+		start := pos
+		if start < len(data) && data[start] == '\r' {
+			start++
+		}
+		if start < len(data) && data[start] == '\n' {
+			start++
+		}
+		if start == pos {
+			continue
+		}
+		end := bytes.Index(data[start:], endKeyword)
+		if end < 0 {
+			return
+		}
+		end += start
+		pos = end + len(endKeyword)
+
+		// stream 的字典在 "N 0 obj" 與 "stream" 之間.
+		dict := data[lastN(i, 4096):i]
+		if k := bytes.LastIndex(dict, []byte("obj")); k >= 0 {
+			dict = dict[k:]
+		}
+		if s, ok := decodePDFStream(dict, bytes.TrimRight(data[start:end], "\r\n")); ok {
+			streams = append(streams, s)
+		}
+	}
+}
+
+func lastN(i, n int) int {
+	if i < n {
+		return 0
+	}
+	return i - n
+}
+
+func decodePDFStream(dict, raw []byte) ([]byte, bool) {
+	if pdfSkipStreamPattern.Match(dict) {
+		return nil, false
+	}
+	m := pdfFilterPattern.FindSubmatch(dict)
+	if m == nil {
+		return raw, true
+	}
+	filters := strings.Fields(strings.NewReplacer("[", " ", "]", " ", "/", " ").Replace(string(m[1])))
+	if len(filters) != 1 || filters[0] != "FlateDecode" {
+		return nil, false
+	}
+	r, err := zlib.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	// 有些 PDF 的 stream 結尾不完整, 因此出錯時仍使用已解壓的部分.
+	out, _ := io.ReadAll(io.LimitReader(r, MaxFileSize))
+	return out, len(out) > 0
+}
+
+// pdfContentText 提取內容流中的文字, 寫入 b.
+func pdfContentText(b *strings.Builder, content []byte, cmap *pdfCMap) {
+	l := &pdfLexer{data: content}
+	var operands []pdfToken
+	inText := false
+	for {
+		tok, ok := l.next()
+		if !ok {
+			return
+		}
+		if tok.kind != pdfOperator {
+			operands = append(operands, tok)
+			continue
+		}
+		switch tok.text {
+		case "BT":
+			inText = true
+		case "ET":
+			inText = false
+			b.WriteString("\n")
+		case "ID":
+			l.skipInlineImage()
+		}
+		if inText {
+			writePDFText(b, tok.text, operands, cmap)
+		}
+		operands = operands[:0]
+	}
+}
+
+func writePDFText(b *strings.Builder, op string, operands []pdfToken, cmap *pdfCMap) {
+	var last pdfToken
+	if len(operands) > 0 {
+		last = operands[len(operands)-1]
+	}
+	switch op {
+	case "Tj":
+		b.WriteString(cmap.decode(last.str))
+	case "'", `"`:
+		b.WriteString("\n" + cmap.decode(last.str))
+	case "TJ":
+		for _, item := range last.array {
+			if item.kind == pdfString {
+				b.WriteString(cmap.decode(item.str))
+			} else if item.kind == pdfNumber && item.num < -250 {
+				// 較大的負數間距通常表示單詞之間的空格.
+				b.WriteString(" ")
+			}
+		}
+	case "Td", "TD":
+		if len(operands) == 2 && operands[1].num != 0 {
+			b.WriteString("\n")
+		} else {
+			b.WriteString(" ")
+		}
+	case "T*", "Tm":
+		b.WriteString("\n")
+	}
+}
+
+// pdfCMap 是 ToUnicode CMap, 把字符編碼 (一至四個字節) 轉換為 Unicode.
+type pdfCMap struct {
+	codes   map[string]string
+	lengths []int // 編碼的字節數, 從長到短
+}
+
+func (m *pdfCMap) add(code []byte, text string) {
+	if len(code) == 0 {
+		return
+	}
+	m.codes[string(code)] = text
+	for _, n := range m.lengths {
+		if n == len(code) {
+			return
+		}
+	}
+	m.lengths = append(m.lengths, len(code))
+	sort.Sort(sort.Reverse(sort.IntSlice(m.lengths)))
+}
+
+func (m *pdfCMap) addRange(lo, hi []byte, dst pdfToken) {
+	if len(lo) == 0 || len(lo) != len(hi) || len(lo) > 4 {
+		return
+	}
+	start, end := bytesToInt(lo), bytesToInt(hi)
+	if end < start || end-start > 0xFFFF {
+		return
+	}
+	for k := 0; k <= int(end-start); k++ {
+		code := intToBytes(start+uint32(k), len(lo))
+		if dst.kind == pdfArray {
+			if k < len(dst.array) {
+				m.add(code, utf16be(dst.array[k].str))
+			}
+			continue
+		}
+		runes := []rune(utf16be(dst.str))
+		if len(runes) > 0 {
+			runes[len(runes)-1] += rune(k)
+			m.add(code, string(runes))
+		}
+	}
+}
+
+func (m *pdfCMap) parse(data []byte) {
+	l := &pdfLexer{data: data}
+	var operands []pdfToken
+	for {
+		tok, ok := l.next()
+		if !ok {
+			return
+		}
+		if tok.kind != pdfOperator {
+			operands = append(operands, tok)
+			continue
+		}
+		switch tok.text {
+		case "endbfchar":
+			for i := 0; i+1 < len(operands); i += 2 {
+				m.add(operands[i].str, utf16be(operands[i+1].str))
+			}
+		case "endbfrange":
+			for i := 0; i+2 < len(operands); i += 3 {
+				m.addRange(operands[i].str, operands[i+1].str, operands[i+2])
+			}
+		}
+		operands = operands[:0]
+	}
+}
+
+// decode 把 PDF 字符串轉換為文字. 找不到對應的編碼則當作 Latin-1.
+func (m *pdfCMap) decode(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+		return utf16be(s[2:])
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		matched := false
+		for _, n := range m.lengths {
+			if i+n > len(s) {
+				continue
+			}
+			if text, ok := m.codes[string(s[i:i+n])]; ok {
+				b.WriteString(text)
+				i += n
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			if c := s[i]; c >= 0x20 || c == '\t' {
+				b.WriteRune(rune(c))
+			}
+			i++
+		}
+	}
+	return b.String()
+}
+
+func utf16be(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+func bytesToInt(b []byte) (n uint32) {
+	for _, c := range b {
+		n = n<<8 | uint32(c)
+	}
+	return
+}
+
+func intToBytes(n uint32, size int) []byte {
+	b := make([]byte, size)
+	for i := size - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+	return b
+}
+
+type pdfTokenKind int
+
+const (
+	pdfOperator pdfTokenKind = iota
+	pdfNumber
+	pdfString
+	pdfName
+	pdfArray
+	pdfOther
+)
+
+type pdfToken struct {
+	kind  pdfTokenKind
+	text  string // 操作符, 名稱
+	num   float64
+	str   []byte
+	array []pdfToken
+}
+
+// maxPDFArrayDepth 數組嵌套的最大深度. 數組是遞歸解析的, 過深的嵌套 (惡意構造的檔案)
+// 會耗盡 goroutine 的棧, 而這是無法 recover 的致命錯誤, 因此更深的 "[" 及與之配對的 "]"
+// 會被忽略, 其中的內容歸入第 maxPDFArrayDepth 層的數組.
+const maxPDFArrayDepth = 64
+
+// pdfLexer 把內容流 (或 CMap) 分割為 token.
+type pdfLexer struct {
+	data    []byte
+	pos     int
+	depth   int // 當前數組的嵌套深度
+	skipped int // 超過 maxPDFArrayDepth 而被忽略的 "[" 的數量 (尚未遇到配對的 "]")
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f' || c == 0
+}
+
+func isPDFDelimiter(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+func (l *pdfLexer) peek(k int) byte {
+	if l.pos+k < len(l.data) {
+		return l.data[l.pos+k]
+	}
+	return 0
+}
+
+func (l *pdfLexer) skipSpace() {
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		if c == '%' {
+			for l.pos < len(l.data) && l.data[l.pos] != '\n' && l.data[l.pos] != '\r' {
+				l.pos++
+			}
+			continue
+		}
+		if !isPDFSpace(c) {
+			return
+		}
+		l.pos++
+	}
+}
+
+func (l *pdfLexer) next() (pdfToken, bool) {
+	l.skipSpace()
+	if l.pos >= len(l.data) {
+		return pdfToken{}, false
+	}
+	c := l.data[l.pos]
+	for (c == '[' && l.depth >= maxPDFArrayDepth) || (c == ']' && l.skipped > 0) {
+		if c == '[' {
+			l.skipped++
+		} else {
+			l.skipped--
+		}
+		l.pos++
+		if l.skipSpace(); l.pos >= len(l.data) {
+			return pdfToken{}, false
+		}
+		c = l.data[l.pos]
+	}
+	switch {
+	case c == '(':
+		return pdfToken{kind: pdfString, str: l.literalString()}, true
+	case (c == '<' || c == '>') && l.peek(1) == c:
+		l.pos += 2
+		return pdfToken{kind: pdfOther}, true
+	case c == '<':
+		return pdfToken{kind: pdfString, str: l.hexString()}, true
+	case c == '[':
+		l.pos++
+		l.depth++
+		defer func() { l.depth-- }()
+		var array []pdfToken
+		for {
+			tok, ok := l.next()
+			if !ok || (tok.kind == pdfOther && tok.text == "]") {
+				break
+			}
+			array = append(array, tok)
+		}
+		return pdfToken{kind: pdfArray, array: array}, true
+	case c == '/':
+		l.pos++
+		return pdfToken{kind: pdfName, text: l.regular()}, true
+	case isPDFDelimiter(c):
+		l.pos++
+		return pdfToken{kind: pdfOther, text: string(c)}, true
+	}
+	word := l.regular()
+	if num, err := strconv.ParseFloat(word, 64); err == nil {
+		return pdfToken{kind: pdfNumber, num: num}, true
+	}
+	return pdfToken{kind: pdfOperator, text: word}, true
+}
+
+func (l *pdfLexer) regular() string {
+	start := l.pos
+	for l.pos < len(l.data) && !isPDFSpace(l.data[l.pos]) && !isPDFDelimiter(l.data[l.pos]) {
+		l.pos++
+	}
+	return string(l.data[start:l.pos])
+}
+
+func (l *pdfLexer) literalString() (s []byte) {
+	l.pos++ // 跳過 (
+	depth := 1
+	for l.pos < len(l.data) {
+		c := l.data[l.pos]
+		l.pos++
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return
+			}
+		case '\\':
+			if l.pos >= len(l.data) {
+				return
+			}
+			c = l.data[l.pos]
+			l.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r', '\n':
+				// 反斜線加換行表示續行
+				if c == '\r' && l.peek(0) == '\n' {
+					l.pos++
+				}
+				continue
+			default:
+				if c >= '0' && c <= '7' {
+					n := int(c - '0')
+					for i := 0; i < 2 && l.peek(0) >= '0' && l.peek(0) <= '7'; i++ {
+						n = n*8 + int(l.peek(0)-'0')
+						l.pos++
+					}
+					c = byte(n)
+				}
+			}
+		}
+		s = append(s, c)
+	}
+	return
+}
+
+func (l *pdfLexer) hexString() []byte {
+	l.pos++ // 跳過 <
+	var digits []byte
+	for l.pos < len(l.data) && l.data[l.pos] != '>' {
+		if c := l.data[l.pos]; strings.IndexByte("0123456789abcdefABCDEF", c) >= 0 {
+			digits = append(digits, c)
+		}
+		l.pos++
+	}
+	l.pos++ // 跳過 >
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+	b := make([]byte, len(digits)/2)
+	for i := range b {
+		n, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		b[i] = byte(n)
+	}
+	return b
+}
+
+// skipInlineImage 跳過內嵌圖片 (BI ... ID 二進制數據 EI).
+func (l *pdfLexer) skipInlineImage() {
+	for i := l.pos; i+1 < len(l.data); i++ {
+		if l.data[i] == 'E' && l.data[i+1] == 'I' && i > 0 && isPDFSpace(l.data[i-1]) &&
+			(i+2 == len(l.data) || isPDFSpace(l.data[i+2])) {
+			l.pos = i + 2
+			return
+		}
+	}
+	l.pos = len(l.data)
+}
@@ -0,0 +1,34 @@
+package extract
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPDFContentText(t *testing.T) {
+	deep := strings.Repeat("[", 10_000_000) + strings.Repeat("]", 10_000_000)
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"Tj", "BT (Hello) Tj ET", "Hello\n"},
+		{"TJ", "BT [(Hello) -300 (World)] TJ ET", "Hello World\n"},
+		{"nested array", "BT [[(a)] (b)] TJ ET", "b\n"},
+		{"max depth", "BT " + strings.Repeat("[", maxPDFArrayDepth) + "(x)" +
+			strings.Repeat("]", maxPDFArrayDepth) + " TJ (y) Tj ET", "y\n"},
+		// 過深的嵌套不可耗盡棧, 之後的文字仍可提取.
+		{"too deep", deep + " BT (after) Tj ET", "after\n"},
+		{"too deep TJ", "BT " + deep[:1000] + "(x)" + deep[len(deep)-1000:] + " TJ ET", "\n"},
+		{"too deep unclosed", "BT (before) Tj " + strings.Repeat("[", 10_000_000), "before"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			pdfContentText(&b, []byte(tt.content), &pdfCMap{})
+			if got := b.String(); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
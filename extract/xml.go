@@ -0,0 +1,129 @@
+package extract
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// xmlTextOptions 設定如何從 XML (或 HTML) 中提取文字. 元素名稱不含命名空間前綴.
+type xmlTextOptions struct {
+	breaks map[string]bool // 這些元素結束時換行
+	spaces map[string]bool // 這些元素 (例如 tab) 當作空格
+	skip   map[string]bool // 忽略這些元素中的文字
+	only   map[string]bool // 非空時, 只提取這些元素中的文字
+}
+
+func nameSet(names ...string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range names {
+		set[name] = true
+	}
+	return set
+}
+
+var htmlOptions = xmlTextOptions{
+	breaks: nameSet("p", "br", "div", "li", "tr", "h1", "h2", "h3", "h4", "h5", "h6",
+		"title", "blockquote", "pre", "section", "article", "dt", "dd", "entry", "item"),
+	spaces: nameSet("td", "th"),
+	skip:   nameSet("script", "style", "head"),
+}
+
+// xmlText 提取 XML 中的文字. HTML 也可以大致處理 (不要求嚴格的 XML 格式).
+func xmlText(r io.Reader, opts xmlTextOptions) (string, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var b strings.Builder
+	skipDepth, onlyDepth := 0, 0
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return b.String(), err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if opts.skip[name] || skipDepth > 0 {
+				skipDepth++
+			}
+			if opts.only[name] || onlyDepth > 0 {
+				onlyDepth++
+			}
+			if opts.spaces[name] {
+				b.WriteString(" ")
+			}
+		case xml.EndElement:
+			name := strings.ToLower(t.Name.Local)
+			if skipDepth > 0 {
+				skipDepth--
+			}
+			if onlyDepth > 0 {
+				onlyDepth--
+			}
+			if opts.breaks[name] {
+				b.WriteString("\n")
+			}
+		case xml.CharData:
+			if skipDepth == 0 && (len(opts.only) == 0 || onlyDepth > 0) {
+				b.Write(t)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// Markup 用於 HTML, XML 等檔案, 只提取其中的文字.
+func Markup(data []byte) (string, error) {
+	return xmlText(bytes.NewReader(data), htmlOptions)
+}
+
+var errNoContent = errors.New("no content found in archive")
+
+// zipFiles 打開 zip 格式的檔案 (docx, xlsx, epub 等).
+func zipFiles(data []byte) (map[string]*zip.File, []*zip.File, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range r.File {
+		files[f.Name] = f
+	}
+	return files, r.File, nil
+}
+
+// zipXMLText 提取 zip 中一個 XML 檔案的文字.
+func zipXMLText(f *zip.File, opts xmlTextOptions) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	// 限制解壓後的體積, 以防 zip 炸彈.
+	return xmlText(io.LimitReader(rc, MaxFileSize), opts)
+}
+
+// zipXMLTexts 依次提取多個 XML 檔案的文字, 並以換行連接.
+func zipXMLTexts(files []*zip.File, opts xmlTextOptions) (string, error) {
+	if len(files) == 0 {
+		return "", errNoContent
+	}
+	var texts []string
+	for _, f := range files {
+		text, err := zipXMLText(f, opts)
+		if err != nil {
+			return "", err
+		}
+		texts = append(texts, text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/ahui2016/local-buckets/extract"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/gofiber/fiber/v2"
+)
+
+// 上傳或覆蓋檔案時, 從 PDF, Office 文檔, 電子書, 純文字等檔案中提取文字, 用於搜尋.
+// 提取失敗不影響上傳, 只在終端顯示錯誤.
+
+// indexFileText 從 srcPath (未加密的原始檔案) 中提取文字.
+func indexFileText(srcPath string, file *File) {
+	indexFileTextIn(db, srcPath, file)
+}
+
+// indexFileTextIn 從 srcPath 中提取文字, 保存到 db1 (例如 fsck 檢查的專案).
+func indexFileTextIn(db1 *DB, srcPath string, file *File) {
+	if !extract.Supported(file.Type) || file.Size > extract.MaxFileSize {
+		saveFileTextIn(db1, file, "")
+		return
+	}
+	data, err := os.ReadFile(srcPath)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	indexFileTextBytesIn(db1, data, file)
+}
+
+func indexFileTextBytes(data []byte, file *File) {
+	indexFileTextBytesIn(db, data, file)
+}
+
+func indexFileTextBytesIn(db1 *DB, data []byte, file *File) {
+	text, err := extract.Text(file.Type, data)
+	if err != nil {
+		log.Printf("extract text from %s: %v\n", file.Name, err)
+	}
+	saveFileTextIn(db1, file, text)
+}
+
+func saveFileText(file *File, text string) {
+	saveFileTextIn(db, file, text)
+}
+
+func saveFileTextIn(db1 *DB, file *File, text string) {
+	if err := db1.SaveFileText(file.ID, file.BucketName, text); err != nil {
+		log.Println(err)
+	}
+}
+
+// moveFileText 用於在公開倉庫與加密倉庫之間移動檔案 (或加密倉庫的密鑰不同),
+// 用新倉庫的設定重新保存檔案內容 (加密或解密).
+func moveFileText(fileID int64, oldBucketName, newBucketName string) error {
+	text, err := db.GetFileText(fileID, oldBucketName)
+	if err != nil || text == "" {
+		return err
+	}
+	return db.SaveFileText(fileID, newBucketName, text)
+}
+
+func reindexTextHandler(c *fiber.Ctx) error {
+	form := new(model.FileIdRangeForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	return reindexText(form.Start, form.End)
+}
+
+// reindexText 对指定范围的文档重新提取文字, 例如 reindexText(1, 100),
+// 对从 id=1 到 id=100 之间的文档重新提取, 包括 1 和 100.
+// 自动跳过不存在的文档 以及 未解锁的仓库中的文档.
+func reindexText(start, end int64) error {
+	if end < start {
+		end = start
+	}
+	for i := start; i <= end; i++ {
+		file, err := db.GetFilePlus(i)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if file.Encrypted && checkBucketUnlocked(file.BucketName) != nil {
+			continue
+		}
+		if !extract.Supported(file.Type) || file.Size > extract.MaxFileSize {
+			saveFileText(&file.File, "")
+			continue
+		}
+		data, err := readFileData(file)
+		if err != nil {
+			return err
+		}
+		fmt.Println("reindex text", file.ID)
+		indexFileTextBytes(data, &file.File)
+	}
+	return nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/thumb"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// fsck 檢查專案 (或備份專案) 的數據庫與硬碟上的檔案是否一致, 並可以執行安全的修復.
+// 只檢查檔案是否存在, 不校驗檔案內容 (見 checkFilesChecksum).
+// 被隔離 (quarantine) 的檔案移到專案根目錄下的 quarantine/<時間>/ 中, 保留原來的相對路徑.
+
+const QuarantineFolderName = "quarantine"
+
+// staleTempAge temp 資料夾中的檔案超過這個時間沒有修改, 才當作殘留檔案.
+// 較新的檔案可能正在使用中 (例如預覽時的解密副本).
+const staleTempAge = time.Hour
+
+type fsckChecker struct {
+	root      string
+	db1       *DB
+	isBackup  bool
+	report    *model.FsckReport
+	files     map[string]*File // 檔案在硬碟上的位置 (絕對路徑)
+	encrypted map[string]bool  // 倉庫名稱 => 是否加密
+	journaled map[string]bool  // 未完成的操作日誌 (見 journal.go) 涉及的路徑, 不可觸碰
+	stamp     string           // 本次隔離的資料夾名稱
+}
+
+func (fc *fsckChecker) add(kind, path string, fileID int64, fix string) {
+	if fc.journaled[path] {
+		return
+	}
+	rel, err := filepath.Rel(fc.root, path)
+	if err != nil {
+		rel = path
+	}
+	fc.report.Issues = append(fc.report.Issues, &model.FsckIssue{
+		Kind:   kind,
+		Path:   filepath.ToSlash(rel),
+		FileID: fileID,
+		Fix:    fix,
+	})
+	fc.report.Counts[kind]++
+}
+
+// fsck 檢查專案 root, 並執行 fixes 中的修復方式 (見 model.FsckFixAdopt 等).
+func fsck(root string, db1 *DB, fixes []string) (*model.FsckReport, error) {
+	fc := &fsckChecker{
+		root:     root,
+		db1:      db1,
+		isBackup: db1.IsBackup,
+		report: &model.FsckReport{
+			Root:      root,
+			IsBackup:  db1.IsBackup,
+			CheckedAt: model.Now(),
+			Counts:    make(map[string]int),
+		},
+		files:     make(map[string]*File),
+		encrypted: make(map[string]bool),
+		journaled: make(map[string]bool),
+		stamp:     time.Now().Format("20060102-150405"),
+	}
+	if err := fc.load(); err != nil {
+		return nil, err
+	}
+	checks := []func() error{
+		fc.checkBuckets, fc.checkTrash, fc.checkFiles,
+		fc.checkVersions, fc.checkTemp, fc.checkThumbs,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(fc.report.Issues, func(i, k int) bool {
+		a, b := fc.report.Issues[i], fc.report.Issues[k]
+		return a.Kind < b.Kind || a.Kind == b.Kind && a.Path < b.Path
+	})
+	for _, issue := range fc.report.Issues {
+		fc.fix(issue, fixes)
+	}
+	return fc.report, nil
+}
+
+func (fc *fsckChecker) load() error {
+	buckets, err := fc.db1.GetAllBuckets()
+	if err != nil {
+		return err
+	}
+	for _, bucket := range buckets {
+		fc.encrypted[bucket.Name] = bucket.Encrypted
+	}
+	files, err := fc.db1.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fc.files[projectFilePath(fc.root, file)] = file
+	}
+	journals, err := fc.db1.GetJournals()
+	if err != nil {
+		return err
+	}
+	for _, j := range journals {
+		for _, step := range append(j.Steps, j.Cleanup...) {
+			fc.journaled[step.Src] = true
+			fc.journaled[step.Dst] = true
+		}
+	}
+	return nil
+}
+
+// checkBuckets 檢查 buckets 資料夾中的倉庫資料夾及檔案.
+func (fc *fsckChecker) checkBuckets() error {
+	bucketsDir := filepath.Join(fc.root, BucketsFolderName)
+	entries, err := os.ReadDir(bucketsDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(bucketsDir, entry.Name())
+		if !entry.IsDir() {
+			fc.add(model.FsckOrphanFile, path, 0, model.FsckFixQuarantine)
+			continue
+		}
+		encrypted, ok := fc.encrypted[entry.Name()]
+		if !ok {
+			fc.add(model.FsckUnknownBucketFolder, path, 0, model.FsckFixQuarantine)
+			continue
+		}
+		// 只有主專案的公開倉庫中的檔案可以收錄, 加密倉庫中的檔案無法得知原來的資訊,
+		// 備份專案則以主專案為準.
+		fix := lo.Ternary(encrypted || fc.isBackup, model.FsckFixQuarantine, model.FsckFixAdopt)
+		if err := fc.checkOrphans(path, fix); err != nil {
+			return err
+		}
+	}
+	for name := range fc.encrypted {
+		path := filepath.Join(bucketsDir, name)
+		if util.PathNotExists(path) {
+			fc.add(model.FsckMissingBucketFolder, path, 0, "")
+		}
+	}
+	return nil
+}
+
+func (fc *fsckChecker) checkTrash() error {
+	return fc.checkOrphans(filepath.Join(fc.root, TrashFolderName), model.FsckFixQuarantine)
+}
+
+// checkOrphans 檢查 folder 中是否有數據庫中沒有記錄的檔案 (或子資料夾).
+func (fc *fsckChecker) checkOrphans(folder, fix string) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(folder, entry.Name())
+		if _, ok := fc.files[path]; ok && !entry.IsDir() {
+			continue
+		}
+		fc.add(model.FsckOrphanFile, path, 0, lo.Ternary(entry.IsDir(), model.FsckFixQuarantine, fix))
+	}
+	return nil
+}
+
+// checkFiles 檢查數據庫中的檔案是否都存在.
+func (fc *fsckChecker) checkFiles() error {
+	for path, file := range fc.files {
+		if util.PathNotExists(path) {
+			fc.add(model.FsckMissingFile, path, file.ID, "")
+		}
+	}
+	return nil
+}
+
+func (fc *fsckChecker) checkVersions() error {
+	versions, err := fc.db1.GetAllFileVersions()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool)
+	for _, v := range versions {
+		path := versionPathIn(fc.root, v.ID)
+		known[path] = true
+		if util.PathNotExists(path) {
+			fc.add(model.FsckMissingVersion, path, v.FileID, "")
+		}
+	}
+	folder := filepath.Join(fc.root, VersionsFolderName)
+	entries, err := os.ReadDir(folder)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(folder, entry.Name())
+		if !known[path] {
+			fc.add(model.FsckOrphanVersion, path, 0, model.FsckFixQuarantine)
+		}
+	}
+	return nil
+}
+
+// checkTemp temp 資料夾中的檔案都是臨時的 (預覽, 覆蓋檔案等),
+// 除了等待加密的縮略圖 (見 moveLeakedThumbs), 未完成的操作日誌涉及的檔案,
+// 以及最近 staleTempAge 內修改過的檔案 (可能正在使用中).
+func (fc *fsckChecker) checkTemp() error {
+	tempDir := filepath.Join(fc.root, TempFolderName)
+	leakedDir := filepath.Join(tempDir, LeakedThumbsFolderName)
+	staleBefore := time.Now().Add(-staleTempAge)
+	err := filepath.WalkDir(tempDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return lo.Ternary(path == leakedDir, filepath.SkipDir, nil)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(staleBefore) {
+			return nil
+		}
+		fc.add(model.FsckStaleTemp, path, 0, model.FsckFixTemp)
+		return nil
+	})
+	return err
+}
+
+// checkThumbs 公開倉庫中的圖片的縮略圖在 public/thumbs 中, 加密倉庫的在 secret-thumbs 中
+// (或 temp/leaked-thumbs 中等待加密), 縮略圖以檔案 ID 為名稱.
+func (fc *fsckChecker) checkThumbs() error {
+	publicThumbs := make(map[int64]bool)
+	secretThumbs := make(map[int64]bool)
+	for _, file := range fc.files {
+		if fc.encrypted[file.BucketName] {
+			secretThumbs[file.ID] = file.IsImage()
+		} else {
+			publicThumbs[file.ID] = file.IsImage()
+		}
+	}
+	publicDir := filepath.Join(fc.root, PublicFolderName, ThumbsFolderName)
+	secretDir := filepath.Join(fc.root, SecretThumbsFolderName)
+	leakedDir := filepath.Join(fc.root, TempFolderName, LeakedThumbsFolderName)
+	e1 := fc.checkThumbsIn(publicDir, publicThumbs)
+	e2 := fc.checkThumbsIn(secretDir, secretThumbs)
+	e3 := fc.checkThumbsIn(leakedDir, secretThumbs)
+	if err := util.WrapErrors(e1, e2, e3); err != nil {
+		return err
+	}
+	// 剩下的是沒有縮略圖的圖片. 備份專案的縮略圖在同步時從主專案複製.
+	fix := lo.Ternary(fc.isBackup, "", model.FsckFixThumbs)
+	for id, isImage := range publicThumbs {
+		if isImage {
+			fc.add(model.FsckMissingThumb, filepath.Join(publicDir, strconv.FormatInt(id, 10)), id, fix)
+		}
+	}
+	for id, isImage := range secretThumbs {
+		if isImage {
+			fc.add(model.FsckMissingThumb, filepath.Join(secretDir, strconv.FormatInt(id, 10)), id, fix)
+		}
+	}
+	return nil
+}
+
+// checkThumbsIn 檢查 folder 中的縮略圖, expected 中的 ID 如果找到縮略圖, 就從 expected 中刪除.
+func (fc *fsckChecker) checkThumbsIn(folder string, expected map[int64]bool) error {
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(folder, entry.Name())
+		id, err := strconv.ParseInt(entry.Name(), 10, 64)
+		if _, ok := expected[id]; ok && err == nil && !entry.IsDir() {
+			delete(expected, id)
+			continue
+		}
+		fc.add(model.FsckOrphanThumb, path, id, model.FsckFixThumbs)
+	}
+	return nil
+}
+
+// fix 如果 issue 的修復方式在 fixes 中, 就執行修復.
+// 收錄失敗的孤兒檔案, 如果 fixes 中有 quarantine, 則改為隔離.
+func (fc *fsckChecker) fix(issue *model.FsckIssue, fixes []string) {
+	if issue.Fix == "" || !lo.Contains(fixes, issue.Fix) &&
+		!(issue.Fix == model.FsckFixAdopt && lo.Contains(fixes, model.FsckFixQuarantine)) {
+		return
+	}
+	path := filepath.Join(fc.root, filepath.FromSlash(issue.Path))
+	var err error
+	switch issue.Fix {
+	case model.FsckFixAdopt:
+		if lo.Contains(fixes, model.FsckFixAdopt) {
+			issue.FileID, err = fc.adoptFile(path)
+		}
+		if (err != nil || issue.FileID == 0) && lo.Contains(fixes, model.FsckFixQuarantine) {
+			err = fc.quarantine(path)
+		}
+	case model.FsckFixQuarantine:
+		err = fc.quarantine(path)
+	case model.FsckFixTemp:
+		err = os.Remove(path)
+	case model.FsckFixThumbs:
+		if issue.Kind == model.FsckOrphanThumb {
+			err = os.RemoveAll(path)
+		} else {
+			err = fc.regenerateThumb(issue.FileID)
+		}
+	}
+	issue.Fixed = err == nil
+	if err != nil {
+		issue.Error = err.Error()
+	}
+}
+
+// quarantine 把 path 移到 quarantine/<時間>/ 中, 保留相對於專案根目錄的路徑.
+func (fc *fsckChecker) quarantine(path string) error {
+	rel, err := filepath.Rel(fc.root, path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(fc.root, QuarantineFolderName, fc.stamp, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), util.NormalFolerPerm); err != nil {
+		return err
+	}
+	return os.Rename(path, dst)
+}
+
+// thumbPath 返回縮略圖在專案 fc.root 中的位置 (見 checkThumbs).
+func (fc *fsckChecker) thumbPath(fileID int64, encrypted bool) string {
+	folder := lo.Ternary(encrypted,
+		filepath.Join(fc.root, SecretThumbsFolderName),
+		filepath.Join(fc.root, PublicFolderName, ThumbsFolderName))
+	return filepath.Join(folder, strconv.FormatInt(fileID, 10))
+}
+
+// adoptFile 把公開倉庫中的孤兒檔案收錄進 fc.db1, 與上傳檔案一樣檢查同名及重複檔案.
+func (fc *fsckChecker) adoptFile(path string) (int64, error) {
+	file, err := model.NewWaitingFile(path)
+	if err != nil {
+		return 0, err
+	}
+	file.BucketName = filepath.Base(filepath.Dir(path))
+	e1 := fc.db1.CheckSameFilename(file.Name)
+	e2 := fc.db1.CheckSameChecksum(file)
+	if err := util.WrapErrors(e1, e2); err != nil {
+		return 0, err
+	}
+	if err := fc.db1.InsertFile(file); err != nil {
+		return 0, err
+	}
+	if file.IsImage() {
+		thumbPath := fc.thumbPath(file.ID, false)
+		fmt.Println("create thumb " + thumbPath)
+		if err := thumb.SmartCrop64(path, thumbPath); err != nil {
+			log.Println(err)
+		}
+	}
+	indexFileTextIn(fc.db1, path, file)
+	return file.ID, util.LockFile(path)
+}
+
+// regenerateThumb 重新生成 fc.db1 中的一個圖片的縮略圖, 加密倉庫需要先解鎖.
+func (fc *fsckChecker) regenerateThumb(fileID int64) error {
+	file, err := fc.db1.GetFilePlus(fileID)
+	if err != nil {
+		return err
+	}
+	filePath := projectFilePath(fc.root, &file.File)
+	thumbPath := fc.thumbPath(file.ID, file.Encrypted)
+	fmt.Println("rebuild thumb " + thumbPath)
+	if !file.Encrypted {
+		img, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		return thumb.SmartCropBytes64(img, thumbPath)
+	}
+	bucket, err := fc.db1.GetBucketByName(file.BucketName)
+	if err != nil {
+		return err
+	}
+	if !fc.db1.BucketIsUnlocked(&bucket) {
+		return fmt.Errorf("%w: %s", database.ErrBucketLocked, bucket.Name)
+	}
+	img, err := fc.db1.DecryptFile(file.BucketName, filePath)
+	if err != nil {
+		return err
+	}
+	data, err := thumb.SmartCropBytesBase64(img)
+	if err != nil {
+		return err
+	}
+	blob, err := fc.db1.EncryptThumb(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(thumbPath, blob)
+}
+
+// fsckProject 檢查專案 root (空字符串表示主專案), 執行修復後記錄事件.
+// c 為 nil 表示通過命令行執行.
+func fsckProject(c *fiber.Ctx, root string, fixes []string) (*model.FsckReport, error) {
+	root = lo.Ternary(root == "", ProjectRoot, root)
+	db1, _, err := getDatabaseFrom(root)
+	if err != nil {
+		return nil, err
+	}
+	if db1 != db {
+		defer db1.DB.Close()
+	}
+	report, err := fsck(root, db1, fixes)
+	if err != nil || len(fixes) == 0 {
+		return report, err
+	}
+	fixed := lo.CountBy(report.Issues, func(issue *model.FsckIssue) bool { return issue.Fixed })
+	return report, logEvent(c, model.EventFsck, 0, 0, nil, map[string]any{
+		"root":  root,
+		"fix":   fixes,
+		"fixed": fixed,
+	})
+}
+
+func fsckHandler(c *fiber.Ctx) error {
+	form := new(model.FsckForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	report, err := fsckProject(c, form.Root, form.Fix)
+	if err != nil {
+		return err
+	}
+	return c.JSON(report)
+}
+
+// runFsckCLI 通過命令行執行 fsck, fix 以逗號分隔, 報告以 JSON 格式輸出到 stdout.
+func runFsckCLI(root, fix string) error {
+	var fixes []string
+	for _, f := range strings.Split(fix, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if !lo.Contains([]string{model.FsckFixAdopt, model.FsckFixQuarantine,
+			model.FsckFixThumbs, model.FsckFixTemp}, f) {
+			return fmt.Errorf("unknown fix: %s", f)
+		}
+		fixes = append(fixes, f)
+	}
+	report, err := fsckProject(nil, root, fixes)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// fsck 檢查另一個專案時, 修復只作用於該專案, 不可寫入主專案.
+// temp 中最近修改過的檔案可能正在使用中, 不可刪除.
+func TestFsckOtherProject(t *testing.T) {
+	root := t.TempDir()
+	for _, folder := range []string{
+		filepath.Join(BucketsFolderName, "fsck-pub"),
+		filepath.Join(PublicFolderName, ThumbsFolderName),
+		TempFolderName,
+	} {
+		if err := os.MkdirAll(filepath.Join(root, folder), util.NormalFolerPerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db1, err := database.OpenDB(filepath.Join(root, DatabaseFileName), &Project{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db1.DB.Close()
+	if _, err := db1.InsertBucket(&model.CreateBucketForm{Name: "fsck-pub"}); err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := filepath.Join(root, BucketsFolderName, "fsck-pub", "fsck-orphan.txt")
+	oldTemp := filepath.Join(root, TempFolderName, "old")
+	newTemp := filepath.Join(root, TempFolderName, "new")
+	for _, path := range []string{orphan, oldTemp, newTemp} {
+		if err := os.WriteFile(path, []byte(path), util.NormalFilePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleTempAge)
+	if err := os.Chtimes(oldTemp, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := fsck(root, db1, []string{model.FsckFixAdopt, model.FsckFixTemp})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, issue := range report.Issues {
+		if issue.Fix != "" && !issue.Fixed {
+			t.Errorf("not fixed: %+v", *issue)
+		}
+		if issue.Path == "temp/new" {
+			t.Error("recently modified temp file reported")
+		}
+	}
+	if _, err := db1.GetFileByName("fsck-orphan.txt"); err != nil {
+		t.Fatalf("orphan not adopted into the checked project: %v", err)
+	}
+	if _, err := db.GetFileByName("fsck-orphan.txt"); err == nil {
+		t.Fatal("orphan adopted into the main project")
+	}
+	if util.PathExists(oldTemp) {
+		t.Fatal("stale temp file not removed")
+	}
+	if util.PathNotExists(newTemp) {
+		t.Fatal("recently modified temp file removed")
+	}
+}
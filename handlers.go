@@ -39,7 +39,7 @@ func sleep(c *fiber.Ctx) error {
 
 // requireAdmin is a middleware
 func requireAdmin(c *fiber.Ctx) error {
-	if !db.IsLoggedIn() {
+	if !isAdmin(c) {
 		return fmt.Errorf("該操作需要管理員權限")
 	}
 	return c.Next()
@@ -62,21 +62,40 @@ func noCache(c *fiber.Ctx) error {
 	return c.Next()
 }
 
-// 如果处理加密文档或加密仓库, 则需要管理员权限.
-func checkRequireAdmin(encrypted bool) error {
-	if encrypted && !db.IsLoggedIn() {
+// 如果处理加密文档或加密仓库, 则需要管理员权限,
+// 并且如果该仓库设有专用密码, 还需要先解锁该仓库.
+func checkRequireAdmin(c *fiber.Ctx, bucketName string, encrypted bool) error {
+	if token := getAPIToken(c); token != nil {
+		return checkTokenBucket(c, token, bucketName, encrypted)
+	}
+	if !encrypted {
+		return nil
+	}
+	if !isAdmin(c) {
 		return fmt.Errorf("處理加密檔案需要管理員權限")
 	}
+	return checkBucketUnlocked(bucketName)
+}
+
+// checkBucketUnlocked 檢查加密倉庫是否已解鎖 (調用者應先確認已登入).
+func checkBucketUnlocked(bucketName string) error {
+	bucket, err := db.GetBucketByName(bucketName)
+	if err != nil {
+		return err
+	}
+	if !db.BucketIsUnlocked(&bucket) {
+		return fmt.Errorf("%w: %s", database.ErrBucketLocked, bucket.Name)
+	}
 	return nil
 }
 
 // 如果是加密仓库, 则需要管理员权限.
-func checkBucketRequireAdmin(id int64) error {
+func checkBucketRequireAdmin(c *fiber.Ctx, id int64) error {
 	bucket, err := db.GetBucket(id)
 	if err != nil {
 		return err
 	}
-	return checkRequireAdmin(bucket.Encrypted)
+	return checkRequireAdmin(c, bucket.Name, bucket.Encrypted)
 }
 
 func parseValidate(form any, c *fiber.Ctx) error {
@@ -98,6 +117,7 @@ func getProjectStatus(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
+	projStat.JournalResults = journalResults
 	return c.JSON(projStat)
 }
 
@@ -106,12 +126,31 @@ func changePassword(c *fiber.Ctx) error {
 	if err := parseValidate(form, c); err != nil {
 		return err
 	}
+	// 新密鑰是用舊密碼加密的, 因此在更換密鑰的過程中不可更改密碼.
+	rotation, err := db.GetKeyRotation()
+	if err != nil {
+		return err
+	}
+	if rotation != nil {
+		return fmt.Errorf("正在更換密鑰, 請先完成更換密鑰 (rotate data key) 再更改密碼")
+	}
+	// 舊版格式的檔案是直接用密碼加密的, 更改密碼前必須先轉換為新格式.
+	// 只檢查密碼, 不可重新登入, 以免鎖上其他 session 已解鎖的倉庫.
+	if err := db.CheckPassword(form.OldPassword); err != nil {
+		return err
+	}
+	if _, err := upgradeEncryptedFiles(); err != nil {
+		return err
+	}
 	cipherKey, err := db.ChangePassword(form.OldPassword, form.NewPassword)
 	if err != nil {
 		return err
 	}
 	ProjectConfig.CipherKey = cipherKey
-	return writeProjectConfig()
+	if err := writeProjectConfig(); err != nil {
+		return err
+	}
+	return logEvent(c, model.EventChangePassword, 0, 0, nil, nil)
 }
 
 func adminLogin(c *fiber.Ctx) error {
@@ -119,18 +158,48 @@ func adminLogin(c *fiber.Ctx) error {
 	if err := parseValidate(form, c); err != nil {
 		return err
 	}
-	_, err := db.SetAESGCM(form.Text) // password = form.Text
-	return err
+	token, err := startSession(c, func() error {
+		return login(form.Text)
+	})
+	if err != nil {
+		return err
+	}
+	return c.JSON(model.OneTextForm{Text: token})
+}
+
+// login 檢查密碼並解密真正的密鑰.
+// 如果密鑰已在內存中 (已有其他 session), 則只檢查密碼, 以免影響其他 session 已解鎖的倉庫.
+func login(password string) error {
+	if db.IsLoggedIn() {
+		return db.CheckPassword(password)
+	}
+	if _, err := db.SetAESGCM(password); err != nil {
+		return err
+	}
+	// 加密舊版本留在 public 資料夾中的縮略圖 (啟動時已移出 public 資料夾).
+	if err := encryptLeakedThumbs(); err != nil {
+		return err
+	}
+	// 升級後第一次登入, 自動把舊版格式的 CipherKey 轉換為新格式 (密碼不變).
+	if !db.CipherKeyIsLegacy() {
+		return nil
+	}
+	cipherKey, err := db.ChangePassword(password, password)
+	if err != nil {
+		return err
+	}
+	ProjectConfig.CipherKey = cipherKey
+	return writeProjectConfig()
 }
 
 func logoutHandler(c *fiber.Ctx) error {
-	db.Logout()
+	endSession(c)
 	return nil
 }
 
 func getLoginStatus(c *fiber.Ctx) error {
 	status := model.OneTextForm{Text: "logged-out"}
-	if db.IsLoggedIn() {
+	if isAdmin(c) {
 		status.Text = "logged-in"
 	}
 	return c.JSON(status)
@@ -138,15 +207,45 @@ func getLoginStatus(c *fiber.Ctx) error {
 
 func autoGetKeywords(c *fiber.Ctx) error {
 	// 等遇到性能问题再改为手动刷新吧, 数据库有索引应该效率足够高了, 不会浪费计算资源.
-	keywords, err := db.AutoGetKeywords()
+	keywords, err := db.AutoGetKeywords(canSeeEncrypted(c))
 	if err != nil {
 		return err
 	}
 	return c.JSON(keywords)
 }
 
+func getTagCounts(c *fiber.Ctx) error {
+	counts, err := db.GetTagCounts(canSeeEncrypted(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(counts)
+}
+
+func renameTagHandler(c *fiber.Ctx) error {
+	form := new(model.RenameTagForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	if err := db.RenameTag(form.OldName, form.NewName); err != nil {
+		return err
+	}
+	return logEvent(c, model.EventRenameTag, 0, 0, form.OldName, form.NewName)
+}
+
+func mergeTagsHandler(c *fiber.Ctx) error {
+	form := new(model.MergeTagsForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	if err := db.MergeTags(form.Tags, form.Into); err != nil {
+		return err
+	}
+	return logEvent(c, model.EventMergeTags, 0, 0, form.Tags, form.Into)
+}
+
 func autoGetBuckets(c *fiber.Ctx) error {
-	buckets, err := db.AllBucketsStatus()
+	buckets, err := db.AllBucketsStatus(canSeeEncrypted(c))
 	if err != nil {
 		return err
 	}
@@ -162,7 +261,7 @@ func getBucketHandler(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	if err = checkRequireAdmin(bucket.Encrypted); err != nil {
+	if err = checkRequireAdmin(c, bucket.Name, bucket.Encrypted); err != nil {
 		return err
 	}
 	return c.JSON(bucket)
@@ -177,7 +276,7 @@ func updateBucketHandler(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	if err = checkRequireAdmin(bucket.Encrypted); err != nil {
+	if err = checkRequireAdmin(c, bucket.Name, bucket.Encrypted); err != nil {
 		return err
 	}
 	if form.Name == "" {
@@ -207,7 +306,14 @@ func updateBucketHandler(c *fiber.Ctx) error {
 		err2 := os.Rename(newBucketPath, oldBucketPath)
 		err = util.WrapErrors(err, err2)
 	}
-	return err
+	if err != nil {
+		return err
+	}
+	updated, err := db.GetBucket(bucket.ID)
+	if err != nil {
+		return err
+	}
+	return logEvent(c, model.EventUpdateBucket, 0, bucket.ID, bucket, updated)
 }
 
 func createBucket(c *fiber.Ctx) error {
@@ -220,9 +326,53 @@ func createBucket(c *fiber.Ctx) error {
 		return err
 	}
 	createBucketFolder(form.Name)
+	if err := logEvent(c, model.EventCreateBucket, 0, bucket.ID, nil, bucket); err != nil {
+		return err
+	}
 	return c.JSON(bucket)
 }
 
+func unlockBucket(c *fiber.Ctx) error {
+	form := new(model.BucketPasswordForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	bucket, err := db.GetBucket(form.ID)
+	if err != nil {
+		return err
+	}
+	return db.UnlockBucket(&bucket, form.Password)
+}
+
+func lockBucket(c *fiber.Ctx) error {
+	form := new(model.FileIdForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	bucket, err := db.GetBucket(form.ID)
+	if err != nil {
+		return err
+	}
+	db.LockBucket(&bucket)
+	return nil
+}
+
+// changeBucketPassword 更改倉庫專用密碼, 不需要重新加密倉庫中的檔案.
+func changeBucketPassword(c *fiber.Ctx) error {
+	form := new(model.BucketPasswordForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	bucket, err := db.GetBucket(form.ID)
+	if err != nil {
+		return err
+	}
+	if err := db.ChangeBucketPassword(&bucket, form.Password, form.NewPassword); err != nil {
+		return err
+	}
+	return logEvent(c, model.EventChangeBucketPassword, 0, bucket.ID, nil, nil)
+}
+
 func deleteBucket(c *fiber.Ctx) error {
 	form := new(model.FileIdForm)
 	if err := parseValidate(form, c); err != nil {
@@ -235,7 +385,10 @@ func deleteBucket(c *fiber.Ctx) error {
 	if err := db.DeleteBucket(bucket.ID); err != nil {
 		return err
 	}
-	return os.Remove(filepath.Join(BucketsFolder, bucket.Name))
+	if err := os.Remove(filepath.Join(BucketsFolder, bucket.Name)); err != nil {
+		return err
+	}
+	return logEvent(c, model.EventDeleteBucket, 0, bucket.ID, bucket, nil)
 }
 
 func getWaitingFolder(c *fiber.Ctx) error {
@@ -350,7 +503,15 @@ func overwriteFile(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	if err := checkRequireAdmin(dbFile.Encrypted); err != nil {
+	if err := checkNotDeleted(&dbFile.File); err != nil {
+		return err
+	}
+	if err := checkRequireAdmin(c, dbFile.BucketName, dbFile.Encrypted); err != nil {
+		return err
+	}
+	// dbFile 沒有 checksum, 因此事件記錄要另外獲取覆蓋前的檔案資訊.
+	before, err := db.GetFileByID(dbFile.ID)
+	if err != nil {
 		return err
 	}
 
@@ -368,7 +529,9 @@ func overwriteFile(c *fiber.Ctx) error {
 	file.ID = dbFile.ID
 	file.BucketName = dbFile.BucketName
 	file.UTime = model.Now()
-	waitingFile.Dst = filepath.Join(BucketsFolder, file.BucketName, file.Name)
+	// 密封仓库中的文档采用随机名称, 覆盖时名称不变.
+	diskName := lo.Ternary(dbFile.Sealed != "", dbFile.Name, file.Name)
+	waitingFile.Dst = filepath.Join(BucketsFolder, file.BucketName, diskName)
 
 	// 以上是收集信息及检查错误
 	// 以下开始操作文档和数据库
@@ -379,61 +542,81 @@ func overwriteFile(c *fiber.Ctx) error {
 		Src: filepath.Join(BucketsFolder, file.BucketName, dbFile.Name),
 		Dst: filepath.Join(TempFolder, dbFile.Name),
 	}
-	if err := tempFile.Move(); err != nil {
+	// 動手之前先寫入操作日誌 (見 journal.go), 以便程序中途退出後可以恢復.
+	j := overwriteJournal(&dbFile, waitingFile, tempFile, file.Checksum)
+	if err := db.BeginJournal(j); err != nil {
 		return err
 	}
+	if err := tempFile.Move(); err != nil {
+		return db.FailJournal(j, err)
+	}
 
 	if dbFile.Encrypted {
-		err = overwritePrivate(waitingFile, &tempFile, file)
+		err = overwritePrivate(j, waitingFile, &tempFile, file, &dbFile.File)
 	} else {
-		err = overwritePublic(waitingFile, &tempFile, file)
+		err = overwritePublic(j, waitingFile, &tempFile, file, &dbFile.File)
+	}
+	if err != nil {
+		return err
 	}
-	return err
+	return logFileEvent(c, model.EventOverwrite, &before, dbFile.ID)
 }
 
-func overwritePrivate(waitingFile, tempFile *MovedFile, file *File) error {
-	// 加密文档, 如果出错, 必须把旧文档移回原位.
-	if err := db.EncryptFile(waitingFile.Src, waitingFile.Dst, util.ReadonlyFilePerm); err != nil {
-		err2 := tempFile.Rollback()
-		return util.WrapErrors(err, err2)
+// overwriteJournal 覆盖文档的操作日志, oldFile 是覆盖前的文档信息.
+// 加密文档的 checksum 要在加密后才知道, 因此 Target 暂时为空 (视为未提交),
+// 由 overwritePrivate 在加密后补上.
+func overwriteJournal(oldFile *FilePlus, waitingFile *MovedFile, tempFile MovedFile, checksum string) *model.Journal {
+	j := model.NewJournal(model.EventOverwrite, oldFile.ID).Move(tempFile.Src, tempFile.Dst)
+	if oldFile.Encrypted {
+		j.Create(waitingFile.Dst).ThenRemove(waitingFile.Src)
+	} else {
+		j.Move(waitingFile.Src, waitingFile.Dst)
+		j.Target.Checksum = checksum
 	}
+	return j.ThenArchive(tempFile.Dst, &oldFile.File)
+}
 
-	// 获取加密后的 checksum
-	checksum, err := util.FileSum512(waitingFile.Dst)
-	if err != nil {
-		return err
+// oldFile 是覆盖前的文档信息, 旧内容 (tempFile) 会被保存为旧版本.
+// 更新数据库之前出错, 由 db.FailJournal 回滚 j 中的步骤.
+func overwritePrivate(j *model.Journal, waitingFile, tempFile *MovedFile, file, oldFile *File) error {
+	if err := db.EncryptFile(file.BucketName, waitingFile.Src, waitingFile.Dst, util.ReadonlyFilePerm); err != nil {
+		return db.FailJournal(j, err)
 	}
-	file.Checksum = checksum
 
-	// 更新数据库信息, 如果出错, 要删除刚才的加密文档, 并把 tempFile 都移回原位.
-	if err := db.UpdateFileContent(file); err != nil {
-		err2 := os.Remove(waitingFile.Dst)
-		err3 := tempFile.Rollback()
-		return util.WrapErrors(err, err2, err3)
+	// 获取加密后的 checksum, 并记入日志, 以便恢复时判断数据库是否已更新.
+	checksum, err := util.FileSum512(waitingFile.Dst)
+	if err == nil {
+		file.Checksum = checksum
+		j.Target.Checksum = checksum
+		err = db.SetJournalTarget(j)
+	}
+	if err == nil {
+		err = db.UpdateFileContent(file)
+	}
+	if err != nil {
+		return db.FailJournal(j, err)
 	}
 
-	// 重新生成缩略图, 然后删除 waitingFile 和 tempFile
-	createThumb(waitingFile.Src, file)
+	// 重新生成缩略图及提取文字, 然后删除 waitingFile, 并把 tempFile 保存为旧版本
+	createSecretThumb(waitingFile.Src, file)
+	indexFileText(waitingFile.Src, file)
 	e1 := os.Remove(waitingFile.Src)
-	e2 := os.Remove(tempFile.Dst)
-	return util.WrapErrors(e1, e2)
+	e2 := archiveVersion(tempFile.Dst, oldFile)
+	return endJournal(j, e1, e2)
 }
 
-func overwritePublic(waitingFile, tempFile *MovedFile, file *File) error {
-	// 移动新文档进仓库, 如果出错, 必须把旧文档移回原位.
-	if err := waitingFile.Move(); err != nil {
-		err2 := tempFile.Rollback()
-		return util.WrapErrors(err, err2)
+func overwritePublic(j *model.Journal, waitingFile, tempFile *MovedFile, file, oldFile *File) error {
+	err := waitingFile.Move()
+	if err == nil {
+		err = db.UpdateFileContent(file)
 	}
-	// 更新数据库信息, 如果出错, 要把 waitingFile 和 tempFile 都移回原位.
-	if err := db.UpdateFileContent(file); err != nil {
-		err2 := waitingFile.Rollback()
-		err3 := tempFile.Rollback()
-		return util.WrapErrors(err, err2, err3)
+	if err != nil {
+		return db.FailJournal(j, err)
 	}
-	// 重新生成缩略图, 然后删除 tempFile
+	// 重新生成缩略图及提取文字, 然后把 tempFile 保存为旧版本
 	createThumb(waitingFile.Dst, file)
-	return os.Remove(tempFile.Dst)
+	indexFileText(waitingFile.Dst, file)
+	return endJournal(j, archiveVersion(tempFile.Dst, oldFile))
 }
 
 func downloadSmallPic(c *fiber.Ctx) error {
@@ -444,10 +627,13 @@ func downloadSmallPic(c *fiber.Ctx) error {
 	if !file.IsImage() {
 		return fmt.Errorf("not an image (不是圖片)")
 	}
-	img, err := readImage(file)
+	img, err := readFileData(file)
 	if err != nil {
 		return err
 	}
+	if _, err := db.UnsealFile(&file.File); err != nil {
+		return err
+	}
 	dst := filepath.Join(WaitingFolder, file.Name)
 	return thumb.ResizeToFile(dst, img, 0, 0)
 }
@@ -459,7 +645,10 @@ func checkAndGetFilePlus(c *fiber.Ctx) (file FilePlus, err error) {
 	if err = util.WrapErrors(err1, err2); err != nil {
 		return
 	}
-	err = checkRequireAdmin(file.Encrypted)
+	if err = checkNotDeleted(&file.File); err != nil {
+		return
+	}
+	err = checkRequireAdmin(c, file.BucketName, file.Encrypted)
 	return
 }
 
@@ -469,12 +658,15 @@ func downloadFile(c *fiber.Ctx) error {
 		return err
 	}
 	srcPath := filepath.Join(BucketsFolder, file.BucketName, file.Name)
+	if _, err := db.UnsealFile(&file.File); err != nil {
+		return err
+	}
 	dstPath := filepath.Join(WaitingFolder, file.Name)
 	if util.PathExists(dstPath) {
 		return fmt.Errorf("file exists: %s", dstPath)
 	}
 	if file.Encrypted {
-		err = db.DecryptSaveFile(srcPath, dstPath, util.NormalFilePerm)
+		err = db.DecryptSaveFile(file.BucketName, srcPath, dstPath, util.NormalFilePerm)
 	} else {
 		err = util.CopyAndUnlockFile(dstPath, srcPath)
 	}
@@ -528,13 +720,16 @@ func importFiles(c *fiber.Ctx) error {
 		if err != nil {
 			return err
 		}
-		if err := checkRequireAdmin(bucket.Encrypted); err != nil {
+		if err := checkRequireAdmin(c, bucket.Name, bucket.Encrypted); err != nil {
 			return err
 		}
 		// 正式上传文档
 		if err := encryptOrMoveWaitingFile(file, bucket.Encrypted); err != nil {
 			return err
 		}
+		if err := logFileEvent(c, model.EventImport, nil, file.ID); err != nil {
+			return err
+		}
 		// 删除同名 toml
 		if err := os.Remove(tomlPath); err != nil {
 			return err
@@ -552,7 +747,7 @@ func uploadNewFiles(c *fiber.Ctx) error {
 	if err := util.WrapErrors(err1, err2); err != nil {
 		return err
 	}
-	if err := checkRequireAdmin(bucket.Encrypted); err != nil {
+	if err := checkRequireAdmin(c, bucket.Name, bucket.Encrypted); err != nil {
 		return err
 	}
 	files, err := checkAndGetWaitingFiles()
@@ -568,6 +763,9 @@ func uploadNewFiles(c *fiber.Ctx) error {
 		if err := encryptOrMoveWaitingFile(file, bucket.Encrypted); err != nil {
 			return err
 		}
+		if err := logFileEvent(c, model.EventUpload, nil, file.ID); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -612,34 +810,125 @@ func rebuildThumbs(start, end int64) error {
 		if !file.IsImage() {
 			continue
 		}
-		img, err := readImage(file)
+		// 跳过未解锁的仓库
+		if file.Encrypted && checkBucketUnlocked(file.BucketName) != nil {
+			continue
+		}
+		img, err := readFileData(file)
 		if err != nil {
 			return err
 		}
-		thumbPath := thumbFilePath(file.ID)
-		fmt.Println("rebuild thumb " + thumbPath)
-		if err = thumb.SmartCropBytes64(img, thumbPath); err != nil {
+		if err := rebuildThumbFrom(file, img); err != nil {
 			log.Println(err)
 		}
 	}
 	return nil
 }
 
-func readImage(file FilePlus) ([]byte, error) {
-	filePath := filepath.Join(BucketsFolder, file.BucketName, file.Name)
+// rebuildThumbFrom 用原图 img (已解密) 重新生成缩略图, 加密仓库中的图片的缩略图会被加密.
+func rebuildThumbFrom(file FilePlus, img []byte) error {
+	thumbPath := thumbPathOf(file)
+	fmt.Println("rebuild thumb " + thumbPath)
+	if file.Encrypted {
+		return rebuildSecretThumb(file.ID, img)
+	}
+	return thumb.SmartCropBytes64(img, thumbPath)
+}
+
+func readFileData(file FilePlus) ([]byte, error) {
+	filePath := filePathIn(BucketsFolder, &file.File)
 	if file.Encrypted {
-		return db.DecryptFile(filePath)
+		return db.DecryptFile(file.BucketName, filePath)
 	}
 	return os.ReadFile(filePath)
 }
 
+func upgradeEncryptedFilesHandler(c *fiber.Ctx) error {
+	n, err := upgradeEncryptedFiles()
+	if err != nil {
+		return err
+	}
+	return c.JSON(n)
+}
+
+// upgradeEncryptedFiles 把加密仓库中旧版格式 (一次性加密整个文档) 的文档
+// 转换为新格式 (分段加密), 返回被转换的文档数量.
+// 新格式的 checksum 不同, 因此下次备份时会自动覆盖备份专案中的旧文档.
+func upgradeEncryptedFiles() (n int, err error) {
+	files, err := db.GetEncryptedFiles(0)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		filePath := filePathIn(BucketsFolder, file)
+		legacy, err := database.IsLegacyEncrypted(filePath)
+		if err != nil {
+			return n, err
+		}
+		if !legacy {
+			continue
+		}
+		if err = reEncryptFile(file); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return
+}
+
+// reEncryptJournal 重新加密文档的操作日志. 新的 checksum 要在加密后才知道,
+// 因此 Target 暂时为空 (视为未提交), 中断时会删除新文档并把旧文档移回原位.
+func reEncryptJournal(file *File) (*model.Journal, MovedFile) {
+	tempFile := MovedFile{
+		Src: filePathIn(BucketsFolder, file),
+		Dst: filepath.Join(TempFolder, file.Name),
+	}
+	j := model.NewJournal(model.EventRotateDataKey, file.ID).
+		Move(tempFile.Src, tempFile.Dst).Create(tempFile.Src).ThenRemove(tempFile.Dst)
+	return j, tempFile
+}
+
+// reEncryptFile 先把旧文档临时移动到 TempFolder, 重新加密后保存回原位.
+func reEncryptFile(file *File) error {
+	j, tempFile := reEncryptJournal(file)
+	if err := db.BeginJournal(j); err != nil {
+		return err
+	}
+	err := tempFile.Move()
+	if err == nil {
+		err = db.ReEncryptFile(
+			file.BucketName, file.BucketName, tempFile.Dst, tempFile.Src, util.ReadonlyFilePerm)
+	}
+	checksum := ""
+	if err == nil {
+		checksum, err = util.FileSum512(tempFile.Src)
+	}
+	if err == nil {
+		j.Target.Checksum = checksum
+		err = db.SetJournalTarget(j)
+	}
+	// 更新数据库信息之前出错, 要删除新文档, 并把旧文档移回原位.
+	if err == nil {
+		err = db.UpdateChecksum(file.ID, checksum)
+	}
+	if err != nil {
+		return db.FailJournal(j, err)
+	}
+	file.Checksum = checksum
+	return endJournal(j, os.Remove(tempFile.Dst))
+}
+
 func encryptWaitingFileToBucket(file *File) error {
 	// srcPath 是待上传的原始文档
 	srcPath := filepath.Join(WaitingFolder, file.Name)
+	// 如果是密封仓库, 则加密文档名称等信息, 并采用随机名称保存.
+	if err := db.SealFile(file, ""); err != nil {
+		return err
+	}
 	// dstPath 是加密后保存到加密仓库中的文档
 	dstPath := filepath.Join(BucketsFolder, file.BucketName, file.Name)
 	// EncryptFile 读取 srcPath 的文件, 加密后保存到 dstPath.
-	if err := db.EncryptFile(srcPath, dstPath, util.ReadonlyFilePerm); err != nil {
+	if err := db.EncryptFile(file.BucketName, srcPath, dstPath, util.ReadonlyFilePerm); err != nil {
 		return err
 	}
 	// 获取加密后的 checksum
@@ -654,12 +943,13 @@ func encryptWaitingFileToBucket(file *File) error {
 		err2 := os.Remove(dstPath)
 		return util.WrapErrors(err, err2)
 	}
-	// 获取文档 ID, 生成缩略图.
+	// 获取文档 ID, 生成缩略图, 提取文字.
 	dbFile, err := db.GetFileByName(file.Name)
 	if err != nil {
 		return err
 	}
-	createThumb(srcPath, &dbFile)
+	createSecretThumb(srcPath, &dbFile)
+	indexFileText(srcPath, &dbFile)
 	// 一切正常, 可以删除原始文档
 	return os.Remove(srcPath)
 }
@@ -681,6 +971,7 @@ func moveWaitingFileToBucket(file *File) error {
 		return err
 	}
 	createThumb(movedFile.Dst, &dbFile)
+	indexFileText(movedFile.Dst, &dbFile)
 	return nil
 }
 
@@ -735,49 +1026,48 @@ func toWaitingFiles(files []string) (map[string]*File, error) {
 }
 
 func getFilesHandler(c *fiber.Ctx) error {
-	form, files, err := parseFilesOptions(c)
-	if err != nil {
-		return err
-	}
-	if form.UTime == "" {
-		form.UTime = model.Now()
-	}
-	if form.Sort == "" {
-		form.Sort = "utime"
-	}
-	if form.ID > 0 {
-		files, err = db.GetFilesInBucket(form.ID, form.UTime)
-	} else {
-		files, err = db.GetFilesLimit(form.Sort, form.UTime)
-	}
-	if err != nil {
-		return err
-	}
-	return c.JSON(files)
+	return listFiles(c, false)
 }
 
 func getPicsHandler(c *fiber.Ctx) error {
-	form, files, err := parseFilesOptions(c)
+	return listFiles(c, true)
+}
+
+// listFiles 列出一頁檔案, picsOnly 表示只列出圖片.
+func listFiles(c *fiber.Ctx, picsOnly bool) error {
+	form, err := parseFilesOptions(c)
 	if err != nil {
 		return err
 	}
 	if form.UTime == "" {
 		form.UTime = model.Now()
 	}
-	if form.ID > 0 {
-		files, err = db.GetPicsInBucket(form.ID, form.UTime)
-	} else {
-		files, err = db.GetPicsLimit(form.UTime)
-	}
+	q := database.FileQuery{
+		BucketID:  form.ID,
+		Type:      lo.Ternary(picsOnly && !strings.HasPrefix(form.Type, "image/"), "image/", form.Type),
+		Tag:       form.Tag,
+		MinSize:   form.MinSize,
+		MaxSize:   form.MaxSize,
+		MinLike:   form.MinLike,
+		CTimeFrom: form.CTimeFrom,
+		CTimeTo:   form.CTimeTo,
+		UTimeFrom: form.UTimeFrom,
+		UTimeTo:   form.UTime,
+		Damaged:   form.Damaged,
+		Encrypted: form.Encrypted,
+		Sort:      form.Sort,
+		Order:     form.Order,
+		Cursor:    form.Cursor,
+		Limit:     db.FilesLimit,
+	}
+	page, err := db.ListFiles(q, canSeeEncrypted(c))
 	if err != nil {
 		return err
 	}
-	return c.JSON(files)
+	return c.JSON(page)
 }
 
-func parseFilesOptions(c *fiber.Ctx) (
-	form *model.FilesOptions, files []*FilePlus, err error,
-) {
+func parseFilesOptions(c *fiber.Ctx) (form *model.FilesOptions, err error) {
 	form = new(model.FilesOptions)
 	if err = parseValidate(form, c); err != nil {
 		return
@@ -793,7 +1083,7 @@ func parseFilesOptions(c *fiber.Ctx) (
 	if form.ID <= 0 {
 		return
 	}
-	err = checkBucketRequireAdmin(form.ID)
+	err = checkBucketRequireAdmin(c, form.ID)
 	return
 }
 
@@ -802,7 +1092,7 @@ func searchFiles(c *fiber.Ctx) error {
 	if err := parseValidate(form, c); err != nil {
 		return err
 	}
-	files, err := db.SearchFiles(form.Text, "", ProjectConfig.RecentFilesLimit)
+	files, err := db.SearchFiles(form.Text, "", ProjectConfig.RecentFilesLimit, canSeeEncrypted(c))
 	if err != nil {
 		return err
 	}
@@ -814,7 +1104,7 @@ func searchPics(c *fiber.Ctx) error {
 	if err := parseValidate(form, c); err != nil {
 		return err
 	}
-	files, err := db.SearchFiles(form.Text, "image", ProjectConfig.RecentFilesLimit)
+	files, err := db.SearchFiles(form.Text, "image", ProjectConfig.RecentFilesLimit, canSeeEncrypted(c))
 	if err != nil {
 		return err
 	}
@@ -830,7 +1120,10 @@ func getFileByID(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	if err := checkRequireAdmin(file.Encrypted); err != nil {
+	if err := checkRequireAdmin(c, file.BucketName, file.Encrypted); err != nil {
+		return err
+	}
+	if _, err := db.UnsealFile(&file.File); err != nil {
 		return err
 	}
 	file.Checksum = ""
@@ -849,19 +1142,26 @@ func previewFile(c *fiber.Ctx) error {
 	if !file.CanBePreviewed() {
 		return fmt.Errorf("can not preview file type [%s]", file.Type)
 	}
-	if err := checkRequireAdmin(file.Encrypted); err != nil {
+	if err := checkNotDeleted(&file.File); err != nil {
+		return err
+	}
+	if err := checkRequireAdmin(c, file.BucketName, file.Encrypted); err != nil {
 		return err
 	}
-	setFileType(c, file)
 	filePath := filepath.Join(BucketsFolder, file.BucketName, file.Name)
+	if _, err := db.UnsealFile(&file.File); err != nil {
+		return err
+	}
+	setFileType(c, file)
 	if !file.Encrypted {
 		return c.SendFile(filePath)
 	}
-	decrypted, err := db.DecryptFile(filePath)
+	// 边读边解密, 不需要把整个文档读进内存. SendStream 会负责关闭 decrypted.
+	decrypted, err := db.OpenDecrypted(file.BucketName, filePath)
 	if err != nil {
 		return err
 	}
-	return c.Send(decrypted)
+	return c.SendStream(decrypted)
 }
 
 func setFileType(c *fiber.Ctx, file FilePlus) {
@@ -899,69 +1199,143 @@ func moveFileToBucket(c *fiber.Ctx) (err error) {
 	if err := util.WrapErrors(e1, e2); err != nil {
 		return err
 	}
+	if err := checkNotDeleted(&file.File); err != nil {
+		return err
+	}
+	srcBucket, err := db.GetBucketByName(file.BucketName)
+	if err != nil {
+		return err
+	}
+	e1 = checkRequireAdmin(c, srcBucket.Name, srcBucket.Encrypted)
+	e2 = checkRequireAdmin(c, bucket.Name, bucket.Encrypted)
+	if err := util.WrapErrors(e1, e2); err != nil {
+		return err
+	}
+	before := file.File
+
+	// 加密仓库之间移动文档, 如果其中一个仓库有自己的密钥, 则需要重新加密.
+	reEncrypt := file.Encrypted && bucket.Encrypted &&
+		(srcBucket.CipherKey != "" || bucket.CipherKey != "")
 
 	// 先处理在公开仓库与加密仓库之间移动文档的情况 (需要加密或解密)
-	if file.Encrypted != bucket.Encrypted {
-		if !db.IsLoggedIn() {
-			return fmt.Errorf("檔案移進或移出加密倉庫需要管理員權限")
-		}
+	if file.Encrypted != bucket.Encrypted || reEncrypt {
 		direction := lo.Ternary(file.Encrypted, "Pri->Pub", "Pub->Pri")
+		if reEncrypt {
+			direction = "Pri->Pri"
+		}
 		if err = moveFileBetweenPubAndPri(file, bucket.Name, direction); err != nil {
 			return err
 		}
 	}
 
 	// 再处理 “公开仓库之间” 或 “加密仓库之间” 移动文档的情况 (不需要加密解密)
-	if file.Encrypted == bucket.Encrypted {
+	if file.Encrypted == bucket.Encrypted && !reEncrypt {
 		moved := MovedFile{
 			Src: filepath.Join(BucketsFolder, file.BucketName, file.Name),
 			Dst: filepath.Join(BucketsFolder, bucket.Name, file.Name),
 		}
-		if err := moved.Move(); err != nil {
+		j := model.NewJournal(model.EventMove, file.ID).Move(moved.Src, moved.Dst)
+		j.Target.BucketName = bucket.Name
+		if err := db.BeginJournal(j); err != nil {
 			return err
 		}
-		if err := db.MoveFileToBucket(form.FileID, bucket.Name); err != nil {
-			err2 := moved.Rollback()
-			return util.WrapErrors(err, err2)
+		err := moved.Move()
+		if err == nil {
+			err = db.MoveFileToBucket(form.FileID, bucket.Name)
+		}
+		if err != nil {
+			return db.FailJournal(j, err)
+		}
+		if err := db.EndJournal(j); err != nil {
+			return err
 		}
 	}
 
+	if err := logFileEvent(c, model.EventMove, &before, file.ID); err != nil {
+		return err
+	}
+
 	// 最后获取更新后的文件, 返回给前端
 	fileplus, err := db.GetFilePlus(file.ID)
 	if err != nil {
 		return err
 	}
+	if _, err := db.UnsealFile(&fileplus.File); err != nil {
+		return err
+	}
 	return c.JSON(fileplus)
 }
 
-// direction is "Pri->Pub" or "Pub->Pri"
+// direction is "Pri->Pub", "Pub->Pri" or "Pri->Pri" (两个加密仓库的密钥不同)
 func moveFileBetweenPubAndPri(file FilePlus, newBucketName, direction string) (err error) {
+	// 如果移进或移出密封仓库, 文档名称会改变, 名称等信息要重新加密或解密.
+	newFile := file.File
+	if _, err := db.UnsealFile(&newFile); err != nil {
+		return err
+	}
+	newFile.BucketName = newBucketName
+	if err := db.SealFile(&newFile, ""); err != nil {
+		return err
+	}
 	srcPath := filepath.Join(BucketsFolder, file.BucketName, file.Name)
-	dstPath := filepath.Join(BucketsFolder, newBucketName, file.Name)
+	dstPath := filepath.Join(BucketsFolder, newBucketName, newFile.Name)
 
+	// 从公开转到加密, 还要删除临时文档
 	if direction == "Pub->Pri" {
-		// 从公开转到加密, 还要删除临时文档
 		if err = removeTempFile(file.ID); err != nil {
 			return err
 		}
-		err = db.EncryptFile(srcPath, dstPath, util.ReadonlyFilePerm)
-	} else {
-		err = db.DecryptSaveFile(srcPath, dstPath, util.ReadonlyFilePerm)
 	}
-	if err != nil {
+	j := model.NewJournal(model.EventMove, file.ID).Create(dstPath).ThenRemove(srcPath)
+	j.Target.BucketName = newBucketName
+	if err := db.BeginJournal(j); err != nil {
 		return err
 	}
+	err = transcodeFile(direction, file.BucketName, newBucketName, srcPath, dstPath)
 	// 获取新的 checksum
-	checksum, err := util.FileSum512(dstPath)
+	checksum := ""
+	if err == nil {
+		checksum, err = util.FileSum512(dstPath)
+	}
+	if err == nil {
+		newFile.Checksum = checksum
+		if file.Sealed != "" || newFile.Sealed != "" {
+			err = db.MoveSealedFile(&newFile)
+		} else {
+			err = db.UpdateChecksumAndBucket(file.ID, checksum, newBucketName)
+		}
+	}
+	// 更新数据库之前出错, 要删除新文档
 	if err != nil {
-		return err
+		return db.FailJournal(j, err)
 	}
-	if err := db.UpdateChecksumAndBucket(file.ID, checksum, newBucketName); err != nil {
-		err2 := os.Remove(dstPath)
-		return util.WrapErrors(err, err2)
+	// 缩略图也要加密或解密
+	if direction != "Pri->Pri" {
+		if err := moveThumb(file.ID, direction == "Pub->Pri"); err != nil {
+			log.Println(err)
+		}
+	}
+	// 提取的文字及旧版本也要用新仓库的密钥加密 (或解密)
+	if err := moveFileText(file.ID, file.BucketName, newBucketName); err != nil {
+		log.Println(err)
+	}
+	if err := moveFileVersions(file.ID, file.BucketName, newBucketName, direction); err != nil {
+		log.Println(err)
 	}
 	// 一切正常, 可以删除原始文档
-	return os.Remove(srcPath)
+	return endJournal(j, os.Remove(srcPath))
+}
+
+// transcodeFile 读取 srcPath 的文档, 根据 direction 加密, 解密或用新仓库的密钥重新加密后保存到 dstPath.
+func transcodeFile(direction, oldBucketName, newBucketName, srcPath, dstPath string) error {
+	switch direction {
+	case "Pub->Pri":
+		return db.EncryptFile(newBucketName, srcPath, dstPath, util.ReadonlyFilePerm)
+	case "Pri->Pri":
+		return db.ReEncryptFile(oldBucketName, newBucketName, srcPath, dstPath, util.ReadonlyFilePerm)
+	default:
+		return db.DecryptSaveFile(oldBucketName, srcPath, dstPath, util.ReadonlyFilePerm)
+	}
 }
 
 func updateFileInfo(c *fiber.Ctx) error {
@@ -976,9 +1350,18 @@ func updateFileInfo(c *fiber.Ctx) error {
 	if err != nil {
 		return err
 	}
-	if err := checkRequireAdmin(file.Encrypted); err != nil {
+	if err := checkNotDeleted(&file.File); err != nil {
+		return err
+	}
+	if err := checkRequireAdmin(c, file.BucketName, file.Encrypted); err != nil {
+		return err
+	}
+	before := file.File
+	diskName, err := db.UnsealFile(&file.File)
+	if err != nil {
 		return err
 	}
+	form.Keywords = model.NormalizeKeywords(form.Keywords)
 	if form.Name == file.Name &&
 		form.Notes == file.Notes &&
 		form.Keywords == file.Keywords &&
@@ -1002,10 +1385,13 @@ func updateFileInfo(c *fiber.Ctx) error {
 		if err := db.CheckSameFilename(form.Name); err != nil {
 			return err
 		}
-		moved.Src = filepath.Join(BucketsFolder, file.BucketName, file.Name)
-		moved.Dst = filepath.Join(BucketsFolder, file.BucketName, form.Name)
-		if err := moved.Move(); err != nil {
-			return err
+		// 密封仓库中的文档在硬碟上采用随机名称, 因此不需要重命名.
+		if file.Sealed == "" {
+			moved.Src = filepath.Join(BucketsFolder, file.BucketName, file.Name)
+			moved.Dst = filepath.Join(BucketsFolder, file.BucketName, form.Name)
+			if err := moved.Move(); err != nil {
+				return err
+			}
 		}
 		file.Rename(form.Name)
 	}
@@ -1016,14 +1402,25 @@ func updateFileInfo(c *fiber.Ctx) error {
 	file.CTime = form.CTime
 	file.UTime = form.UTime
 
+	if file.Sealed != "" {
+		if err := db.SealFile(&file.File, diskName); err != nil {
+			return err
+		}
+	}
 	if err := db.UpdateFileInfo(&file.File); err != nil {
 		err2 := moved.Rollback()
 		return util.WrapErrors(err, err2)
 	}
+	if err := logFileEvent(c, model.EventUpdateInfo, &before, file.ID); err != nil {
+		return err
+	}
 	fileplus, err := db.GetFilePlus(file.ID)
 	if err != nil {
 		return err
 	}
+	if _, err := db.UnsealFile(&fileplus.File); err != nil {
+		return err
+	}
 	return c.JSON(fileplus)
 }
 
@@ -1073,15 +1470,26 @@ func createBackupProject(bkProjRoot string) error {
 	if err := util.WriteTOML(bkProjCfg, bkProjCfgPath); err != nil {
 		return err
 	}
+	return createBackupProjectFolders(bkProjRoot)
+}
+
+// createBackupProjectFolders 建立備份專案的資料夾, 已存在的資料夾則跳過.
+func createBackupProjectFolders(bkProjRoot string) error {
 	bkProjBucketsDir := filepath.Join(bkProjRoot, BucketsFolderName)
 	bkProjTempDir := filepath.Join(bkProjRoot, TempFolderName)
 	bkProjPublicDir := filepath.Join(bkProjRoot, PublicFolderName)
 	bkProjThumbsDir := filepath.Join(bkProjPublicDir, ThumbsFolderName)
+	bkProjSecretThumbsDir := filepath.Join(bkProjRoot, SecretThumbsFolderName)
+	bkProjTrashDir := filepath.Join(bkProjRoot, TrashFolderName)
+	bkProjVersionsDir := filepath.Join(bkProjRoot, VersionsFolderName)
 	e1 := util.MkdirIfNotExists(bkProjBucketsDir)
 	e2 := util.MkdirIfNotExists(bkProjTempDir)
 	e3 := util.MkdirIfNotExists(bkProjPublicDir)
 	e4 := util.MkdirIfNotExists(bkProjThumbsDir)
-	return util.WrapErrors(e1, e2, e3, e4)
+	e5 := util.MkdirIfNotExists(bkProjSecretThumbsDir)
+	e6 := util.MkdirIfNotExists(bkProjTrashDir)
+	e7 := util.MkdirIfNotExists(bkProjVersionsDir)
+	return util.WrapErrors(e1, e2, e3, e4, e5, e6, e7)
 }
 
 func getBKProjStat(c *fiber.Ctx) error {
@@ -1115,11 +1523,42 @@ func openBackupDB(bkProjRoot string) (*DB, *ProjectStatus, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if _, err := recoverJournals(bk, bkProjRoot); err != nil {
+		return nil, nil, err
+	}
 
 	bkProjStat, err := bk.GetProjStat(&bkProjCfg)
 	return bk, &bkProjStat, err
 }
 
+// openBackupDBReadonly 以只讀方式打開備份專案 (用於預覽), 不升級數據庫, 也不處理中斷的操作,
+// 因此遇到數據庫版本不一致或有未完成的操作時拒絕打開, 需要先正式同步一次.
+// 注意 open 后应立即 defer bk.DB.Close()
+func openBackupDBReadonly(bkProjRoot string) (*DB, *ProjectStatus, error) {
+	bkPath := filepath.Join(bkProjRoot, DatabaseFileName)
+	bkProjCfgPath := filepath.Join(bkProjRoot, ProjectTOML)
+
+	bkProjCfg, err := readProjCfgFrom(bkProjCfgPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bk, err := database.OpenReadonlyDB(bkPath, &bkProjCfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	bkProjStat, err := bk.GetProjStat(&bkProjCfg)
+	if err == nil && bkProjStat.PendingJournals > 0 {
+		err = fmt.Errorf("備份專案有 %d 個未完成的操作, 請先同步: %s",
+			bkProjStat.PendingJournals, bkProjRoot)
+	}
+	if err != nil {
+		bk.DB.Close()
+		return nil, nil, err
+	}
+	return bk, &bkProjStat, nil
+}
+
 func repairFilesHandler(c *fiber.Ctx) error {
 	form := new(model.OneTextForm)
 	if err := parseValidate(form, c); err != nil {
@@ -1202,7 +1641,7 @@ func checkFilesChecksum(root string, db1 *DB) error {
 }
 
 func checkFile(root string, file *File, db1 *DB) (damaged bool, err error) {
-	filePath := filepath.Join(root, BucketsFolderName, file.BucketName, file.Name)
+	filePath := projectFilePath(root, file)
 	sum, err := util.FileSum512(filePath)
 	if err != nil {
 		return
@@ -1215,18 +1654,19 @@ func checkFile(root string, file *File, db1 *DB) (damaged bool, err error) {
 	return file.Damaged, err
 }
 
-func recheckFile(db1 *DB, root string, fileID int64) (damaged bool, err error) {
+func recheckFile(db1 *DB, root string, fileID int64) (file File, damaged bool, err error) {
 	// 如果在 db1 中标记了该文件已损坏，则直接返回结果。
-	file, err := db1.GetFileByID(fileID)
+	file, err = db1.GetFileByID(fileID)
 	if err != nil {
 		return
 	}
 	if file.Damaged {
-		return true, nil
+		return file, true, nil
 	}
 
 	// 如果在 db1 中标记了该文件未损坏，则再检查一次。
-	return checkFile(root, &file, db1)
+	damaged, err = checkFile(root, &file, db1)
+	return
 }
 
 // 从 badDB 中找出 badFiles, 然后尝试从 goodDB 中获取未损坏版本进行修复。
@@ -1239,7 +1679,7 @@ func repair(badDB, goodDB *DB, badRoot, goodRoot string) error {
 	}
 	for _, file := range badFiles {
 		// 如果 goodDB 中的文件已损坏或找不到文件，则无法修复，如果未损坏则进行修复。
-		damaged, err := recheckFile(goodDB, goodRoot, file.ID)
+		goodFile, damaged, err := recheckFile(goodDB, goodRoot, file.ID)
 		if err == sql.ErrNoRows {
 			continue
 		}
@@ -1250,9 +1690,9 @@ func repair(badDB, goodDB *DB, badRoot, goodRoot string) error {
 			continue
 		}
 
-		// 进行修复
-		goodFilePath := filepath.Join(goodRoot, BucketsFolderName, file.BucketName, file.Name)
-		badFilePath := filepath.Join(badRoot, BucketsFolderName, file.BucketName, file.Name)
+		// 进行修复 (两个专案中的文档可能一个在回收站中, 另一个不在)
+		goodFilePath := projectFilePath(goodRoot, &goodFile)
+		badFilePath := projectFilePath(badRoot, &file.File)
 		if err := util.CopyFile(badFilePath, goodFilePath); err != nil {
 			return err
 		}
@@ -1297,26 +1737,45 @@ func repairDamagedFiles(bkProjRoot string, bk *DB) error {
 }
 
 func syncBackup(c *fiber.Ctx) error {
-	form := new(model.OneTextForm)
+	form := new(model.SyncBackupForm)
 	if err := parseValidate(form, c); err != nil {
 		return err
 	}
-	bkProjStat, err := syncToBackupProject(form.Text)
+	bkProjStat, preview, err := syncToBackupProject(form.Text, form.Full, form.Confirm)
+	if e, ok := err.(model.ErrSyncNeedConfirm); ok {
+		return c.Status(409).JSON(e)
+	}
 	if err != nil {
 		return err
 	}
 	e1 := projCfgUpdateAndSync(bkProjStat)
 	e2 := syncPublicFolder(form.Text)
 	e3 := syncExeFile(bkProjStat.Root)
-	return util.WrapErrors(e1, e2, e3)
+	if err := util.WrapErrors(e1, e2, e3); err != nil {
+		return err
+	}
+	return logEvent(c, model.EventSyncBackup, 0, 0, nil, map[string]any{
+		"backup_root": bkProjStat.Root,
+		"files_count": bkProjStat.FilesCount,
+		"total_size":  bkProjStat.TotalSize,
+		"full":        preview.Full,
+		"deleted":     len(preview.Deleted),
+		"trashed":     len(preview.Trashed),
+		"confirmed":   preview.NeedConfirm,
+	})
 }
 
 func syncPublicFolder(bkProjRoot string) error {
 	bkPublicFolder := filepath.Join(bkProjRoot, PublicFolderName)
 	bkThumbsFolder := filepath.Join(bkPublicFolder, ThumbsFolderName)
+	bkSecretThumbs := filepath.Join(bkProjRoot, SecretThumbsFolderName)
+	if err := util.MkdirIfNotExists(bkSecretThumbs); err != nil {
+		return err
+	}
 	e1 := util.OneWaySyncDir(PublicFolder, bkPublicFolder)
 	e2 := util.OneWaySyncDir(ThumbsFolder, bkThumbsFolder)
-	return util.WrapErrors(e1, e2)
+	e3 := util.OneWaySyncDir(SecretThumbsFolder, bkSecretThumbs)
+	return util.WrapErrors(e1, e2, e3)
 }
 
 func syncExeFile(bkProjRoot string) error {
@@ -1340,44 +1799,79 @@ func syncExeFile(bkProjRoot string) error {
 
 // syncToBackupProject 以源仓库为准单向同步，
 // 最终效果相当于清空备份仓库后把主仓库的全部文档复制到备份仓库。
+// 默认只处理上次同步后发生了变化的文档及仓库 (见 planSync),
+// 将要删除的文档超过安全上限时, 需要 confirm 为 true 才会执行。
 // 注意这里不能使用事务 TX, 因为一旦回滚, 批量恢复文档名称太麻烦了.
-func syncToBackupProject(bkProjRoot string) (*ProjectStatus, error) {
-	projStat, err := db.GetProjStat(ProjectConfig)
-	if err != nil {
-		return nil, err
-	}
-	bk, bkProjStat, err := openBackupDB(bkProjRoot)
+func syncToBackupProject(
+	bkProjRoot string, full, confirm bool,
+) (*ProjectStatus, *model.SyncPreview, error) {
+	bk, bkStat, err := openBackupDB(bkProjRoot)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer bk.DB.Close()
 
-	if bkProjStat, err = syncProjectConfig(bkProjStat); err != nil {
-		return nil, err
+	// 打開備份專案時已自動升級其數據庫 (見 database.OpenDB),
+	// 這裡再補上舊版備份專案可能缺少的資料夾.
+	if err = upgradeBackupProject(bkProjRoot, bk); err != nil {
+		return nil, nil, err
 	}
 
-	if err := checkBackupDiskUsage(bkProjRoot, bkProjStat, &projStat); err != nil {
-		return nil, err
+	plan, err := planSync(bkProjRoot, bk, bkStat, full)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	bkBucketsDir := filepath.Join(bkProjRoot, BucketsFolderName)
-	bkTemp := filepath.Join(bkProjRoot, TempFolderName)
-
-	// 先处理仓库, 包括新建或删除仓库资料夹.
-	if err := syncBuckets(bkBucketsDir, bk); err != nil {
-		return nil, err
+	if plan.diskErr != nil {
+		return nil, plan.preview, plan.diskErr
+	}
+	if plan.preview.NeedConfirm && !confirm {
+		return nil, plan.preview, model.NewErrSyncNeedConfirm(plan.preview)
 	}
 
-	// 获取发生了变化的文档
-	changedFiles, err := getChangedFiles(db, bk, bkBucketsDir, bkTemp)
+	bkProjStat, err := syncProjectConfig(plan.bkProjStat)
 	if err != nil {
-		return nil, err
+		return nil, plan.preview, err
+	}
+
+	// 先处理仓库, 包括新建或删除仓库资料夹.
+	if plan.syncBuckets {
+		bkBucketsDir := filepath.Join(bkProjRoot, BucketsFolderName)
+		if err := syncBuckets(bkBucketsDir, plan.bk); err != nil {
+			return nil, plan.preview, err
+		}
 	}
 	// 同步文档(单向同步)
-	if err = changedFiles.Sync(); err != nil {
-		return nil, err
+	if err = plan.files.Sync(); err != nil {
+		return nil, plan.preview, err
+	}
+	// 同步旧版本, 必须在同步文档之后 (旧版本依赖文档)
+	if err = syncFileVersions(plan.bk, bkProjRoot); err != nil {
+		return nil, plan.preview, err
+	}
+	if err = plan.bk.SetSyncState(plan.seq); err != nil {
+		return nil, plan.preview, err
 	}
-	return bkProjStat, nil
+	// 同步完成后建立快照 (见 snapshot.go)
+	if snapshotsEnabled() {
+		if _, err = takeSnapshot(bkProjRoot, plan.bk); err != nil {
+			return nil, plan.preview, err
+		}
+	}
+	return bkProjStat, plan.preview, nil
+}
+
+// upgradeBackupProject 確保備份專案與主專案的數據庫結構版本一致, 並補上缺少的資料夾.
+func upgradeBackupProject(bkProjRoot string, bk *DB) error {
+	v1, err1 := db.SchemaVersion()
+	v2, err2 := bk.SchemaVersion()
+	if err := util.WrapErrors(err1, err2); err != nil {
+		return err
+	}
+	if v1 != v2 {
+		return fmt.Errorf("數據庫版本不一致: 主專案 %d, 備份專案 %d", v1, v2)
+	}
+	return createBackupProjectFolders(bkProjRoot)
 }
 
 type ChangedFiles struct {
@@ -1385,6 +1879,7 @@ type ChangedFiles struct {
 	BK         *DB
 	BKBuckets  string
 	BKTemp     string
+	Renamed    map[string]string // 备份专案中的仓库名称 => 主专案中的新名称 (见 renamedBuckets)
 	Deleted    []int64
 	Updated    []int64
 	Moved      []int64
@@ -1392,15 +1887,14 @@ type ChangedFiles struct {
 	Inserted   []int64
 }
 
-func getChangedFiles(db, bk *DB, bkBuckets, bkTemp string) (files ChangedFiles, err error) {
+func getChangedFiles(
+	db, bk *DB, bkBuckets, bkTemp string, renamed map[string]string,
+) (files ChangedFiles, err error) {
 	var (
 		bkFile File
 		dbFile File
 	)
-	files.DB = db
-	files.BK = bk
-	files.BKBuckets = bkBuckets
-	files.BKTemp = bkTemp
+	files = newChangedFiles(db, bk, bkBuckets, bkTemp, renamed)
 
 	rows, err := bk.Query(stmt.GetAllFiles)
 	if err != nil {
@@ -1424,21 +1918,7 @@ func getChangedFiles(db, bk *DB, bkBuckets, bkTemp string) (files ChangedFiles,
 		if err != nil {
 			return
 		}
-
-		// 更新了除 Checksum 和 BucketName 以外的属性的文档
-		if !filesHaveSameProperties(bkFile, dbFile) {
-			files.Updated = append(files.Updated, bkFile.ID)
-		}
-
-		// 已被移动 (到另一个仓库) 的文档
-		if bkFile.BucketName != dbFile.BucketName {
-			files.Moved = append(files.Moved, bkFile.ID)
-		}
-
-		// 更新了内容 (Checksum 已改变) 的文档
-		if bkFile.Checksum != dbFile.Checksum {
-			files.Overwrited = append(files.Overwrited, bkFile.ID)
-		}
+		files.compare(bkFile, dbFile)
 	}
 	if err = rows.Err(); err != nil {
 		return
@@ -1469,6 +1949,62 @@ func getChangedFiles(db, bk *DB, bkBuckets, bkTemp string) (files ChangedFiles,
 	return files, rows.Err()
 }
 
+// getChangedFilesIn 与 getChangedFiles 一样, 但只对比 fileIDs 中的文档 (增量同步).
+func getChangedFilesIn(
+	db, bk *DB, bkBuckets, bkTemp string, renamed map[string]string, fileIDs []int64,
+) (files ChangedFiles, err error) {
+	files = newChangedFiles(db, bk, bkBuckets, bkTemp, renamed)
+	for _, id := range fileIDs {
+		bkFile, e1 := bk.GetFileByID(id)
+		dbFile, e2 := db.GetFileByID(id)
+		bkNotFound := errors.Is(e1, sql.ErrNoRows)
+		dbNotFound := errors.Is(e2, sql.ErrNoRows)
+		if e1 != nil && !bkNotFound {
+			return files, e1
+		}
+		if e2 != nil && !dbNotFound {
+			return files, e2
+		}
+		switch {
+		case bkNotFound && dbNotFound:
+			// 上次同步后新增, 然后又被删除的文档
+		case bkNotFound:
+			files.Inserted = append(files.Inserted, id)
+		case dbNotFound:
+			files.Deleted = append(files.Deleted, id)
+		default:
+			files.compare(bkFile, dbFile)
+		}
+	}
+	return files, nil
+}
+
+func newChangedFiles(db, bk *DB, bkBuckets, bkTemp string, renamed map[string]string) ChangedFiles {
+	return ChangedFiles{DB: db, BK: bk, BKBuckets: bkBuckets, BKTemp: bkTemp, Renamed: renamed}
+}
+
+// compare 对比同一个文档在备份专案及主专案中的新旧版本.
+func (files *ChangedFiles) compare(bkFile, dbFile File) {
+	// 更新了除 Checksum 和 BucketName 以外的属性的文档
+	if !filesHaveSameProperties(bkFile, dbFile) {
+		files.Updated = append(files.Updated, bkFile.ID)
+	}
+
+	// 已被移动 (到另一个仓库) 的文档. 仓库改名不算移动, syncBuckets 会处理.
+	bkBucketName := bkFile.BucketName
+	if newName, ok := files.Renamed[bkBucketName]; ok {
+		bkBucketName = newName
+	}
+	if bkBucketName != dbFile.BucketName {
+		files.Moved = append(files.Moved, bkFile.ID)
+	}
+
+	// 更新了内容 (Checksum 已改变) 的文档
+	if bkFile.Checksum != dbFile.Checksum {
+		files.Overwrited = append(files.Overwrited, bkFile.ID)
+	}
+}
+
 func (files ChangedFiles) getFilePair(id int64) (bkFile, dbFile FilePlus, err error) {
 	bkFile, e1 := files.BK.GetFilePlus(id)
 	dbFile, e2 := files.DB.GetFilePlus(id)
@@ -1507,7 +2043,12 @@ func (files ChangedFiles) syncDelete() error {
 		if err != nil {
 			return err
 		}
-		if err := files.BK.DeleteFile(files.BKBuckets, files.BKTemp, thumbFilePath(id), &f); err != nil {
+		bkProjRoot := filepath.Dir(files.BKBuckets)
+		if err := removeFileVersions(files.BK, bkProjRoot, id); err != nil {
+			return err
+		}
+		filePath := filePathIn(files.BKBuckets, &f)
+		if err := files.BK.DeleteFile(filePath, files.BKTemp, thumbFilePath(id), &f); err != nil {
 			return err
 		}
 	}
@@ -1574,11 +2115,13 @@ func (files ChangedFiles) syncInsert() error {
 }
 
 func updateBKFile(bkFile, dbFile *FilePlus, bk *DB, bkBucketsDir string) error {
-	// 如果文档名不一致, 还要重命名
+	// 如果文档名不一致, 或移进/移出了回收站, 还要移动文档
 	moved := new(MovedFile)
-	if bkFile.Name != dbFile.Name {
-		moved.Src = filepath.Join(bkBucketsDir, bkFile.BucketName, bkFile.Name)
-		moved.Dst = filepath.Join(bkBucketsDir, bkFile.BucketName, dbFile.Name)
+	src := filePathIn(bkBucketsDir, &bkFile.File)
+	dst := filePathIn(bkBucketsDir, &dbFile.File)
+	if src != dst {
+		moved.Src = src
+		moved.Dst = dst
 		if err := moved.Move(); err != nil {
 			return err
 		}
@@ -1587,7 +2130,16 @@ func updateBKFile(bkFile, dbFile *FilePlus, bk *DB, bkBucketsDir string) error {
 		err2 := moved.Rollback()
 		return util.WrapErrors(err, err2)
 	}
-	return nil
+	return syncTrashTime(dbFile.ID, dbFile.Deleted, bk)
+}
+
+// syncTrashTime 同步文档移到回收站的时间.
+func syncTrashTime(id int64, deleted bool, bk *DB) error {
+	deletedAt, err := db.GetTrashTime(id)
+	if err != nil {
+		return err
+	}
+	return bk.SetFileDeleted(id, deleted, deletedAt)
 }
 
 // 更新备份专案的 Title, Subtitle, Cipherkey.
@@ -1635,12 +2187,18 @@ func syncBuckets(bkBucketsDir string, bk *DB) error {
 			// 这里不能 continue
 		}
 
-		// 处理完 Name, 剩下有可能改变的就只有 Title 和 Subtitle 了.
+		// 处理完 Name, 剩下有可能改变的就只有 Title, Subtitle 和 CipherKey 了.
 		if bkBucket.Title != bucket.Title || bkBucket.Subtitle != bucket.Subtitle {
 			if err := bk.UpdateBucketTitle(&bucket); err != nil {
 				return err
 			}
 		}
+		// 更改仓库密码或更换专案密钥后, 被加密的仓库密钥会改变.
+		if bkBucket.CipherKey != bucket.CipherKey {
+			if err := bk.UpdateBucketCipherKey(&bucket); err != nil {
+				return err
+			}
+		}
 	}
 
 	// 新增仓库
@@ -1680,12 +2238,14 @@ func renameBucket(oldName, newName, bkBuckets string, bucketid int64, bk *DB) er
 func moveBKFileToBucket(
 	bkBucketsDir, newBucketName string, bkFile *FilePlus, bk *DB,
 ) error {
-	moved := MovedFile{
-		Src: filepath.Join(bkBucketsDir, bkFile.BucketName, bkFile.Name),
-		Dst: filepath.Join(bkBucketsDir, newBucketName, bkFile.Name),
-	}
-	if err := moved.Move(); err != nil {
-		return err
+	// 回收站中的文档不需要移动
+	moved := MovedFile{Src: filePathIn(bkBucketsDir, &bkFile.File)}
+	bkFile.BucketName = newBucketName
+	moved.Dst = filePathIn(bkBucketsDir, &bkFile.File)
+	if moved.Src != moved.Dst {
+		if err := moved.Move(); err != nil {
+			return err
+		}
 	}
 	if err := bk.MoveFileToBucket(bkFile.ID, newBucketName); err != nil {
 		err2 := moved.Rollback()
@@ -1699,15 +2259,18 @@ func moveEncrypedBKFile(
 	bkBuckets, bkTemp string, bkFile, dbFile FilePlus, bk *DB,
 ) error {
 	tempFile := MovedFile{
-		Src: filepath.Join(bkBuckets, bkFile.BucketName, bkFile.Name),
+		Src: filePathIn(bkBuckets, &bkFile.File),
 		Dst: filepath.Join(bkTemp, bkFile.Name),
 	}
 	if err := tempFile.Move(); err != nil {
 		return err
 	}
 
-	dstFile := filepath.Join(bkBuckets, dbFile.BucketName, dbFile.Name)
-	srcFile := filepath.Join(BucketsFolder, dbFile.BucketName, dbFile.Name)
+	// 注意 dstFile 采用 bkFile.Name 和 bkFile.Deleted,
+	// 如果名称也改变了 (例如移出密封仓库) 或移进/移出了回收站, 之后的 syncUpdate 会处理.
+	bkFile.BucketName = dbFile.BucketName
+	dstFile := filePathIn(bkBuckets, &bkFile.File)
+	srcFile := filePathIn(BucketsFolder, &dbFile.File)
 	if err := util.CopyAndLockFile(dstFile, srcFile); err != nil {
 		return err
 	}
@@ -1725,16 +2288,18 @@ func moveEncrypedBKFile(
 // 另外, Checked 和 Damaged 也不對比.
 func filesHaveSameProperties(bkFile, file File) bool {
 	return file.Name == bkFile.Name &&
+		file.Sealed == bkFile.Sealed &&
 		file.Notes == bkFile.Notes &&
 		file.Keywords == bkFile.Keywords &&
 		file.Like == bkFile.Like &&
 		file.CTime == bkFile.CTime &&
-		file.UTime == bkFile.UTime
+		file.UTime == bkFile.UTime &&
+		file.Deleted == bkFile.Deleted
 }
 
 func insertBKFile(bkBuckets string, file *File, bk *DB) error {
-	dstFile := filepath.Join(bkBuckets, file.BucketName, file.Name)
-	srcFile := filepath.Join(BucketsFolder, file.BucketName, file.Name)
+	dstFile := filePathIn(bkBuckets, file)
+	srcFile := filePathIn(BucketsFolder, file)
 	if err := util.CopyAndLockFile(dstFile, srcFile); err != nil {
 		return err
 	}
@@ -1742,6 +2307,9 @@ func insertBKFile(bkBuckets string, file *File, bk *DB) error {
 		err2 := os.Remove(dstFile)
 		return util.WrapErrors(err, err2)
 	}
+	if file.Deleted {
+		return syncTrashTime(file.ID, true, bk)
+	}
 	return nil
 }
 
@@ -1749,7 +2317,7 @@ func insertBKFile(bkBuckets string, file *File, bk *DB) error {
 func overwriteBKFile(bkBucketsDir, bkTemp string, dbFile, bkFile *FilePlus, bk *DB) error {
 	// tempFile 把旧文档临时移动到安全的地方
 	tempFile := MovedFile{
-		Src: filepath.Join(bkBucketsDir, bkFile.BucketName, bkFile.Name),
+		Src: filePathIn(bkBucketsDir, &bkFile.File),
 		Dst: filepath.Join(bkTemp, bkFile.Name),
 	}
 	if err := tempFile.Move(); err != nil {
@@ -1758,7 +2326,7 @@ func overwriteBKFile(bkBucketsDir, bkTemp string, dbFile, bkFile *FilePlus, bk *
 
 	// 复制新文档到备份仓库, 如果出错, 必须把旧文档移回原位.
 	newFileDst := tempFile.Src
-	newFileSrc := filepath.Join(BucketsFolder, dbFile.BucketName, dbFile.Name)
+	newFileSrc := filePathIn(BucketsFolder, &dbFile.File)
 	if err := util.CopyAndLockFile(newFileDst, newFileSrc); err != nil {
 		err2 := tempFile.Rollback()
 		return util.WrapErrors(err, err2)
@@ -1775,17 +2343,18 @@ func overwriteBKFile(bkBucketsDir, bkTemp string, dbFile, bkFile *FilePlus, bk *
 	return os.Remove(tempFile.Dst)
 }
 
-func checkBackupDiskUsage(bkProjRoot string, bkStat, projStat *ProjectStatus) error {
-	usage := du.NewDiskUsage(bkProjRoot)
+// checkBackupDiskUsage 返回備份專案所在硬碟的可用空間, 空間不足時同時返回錯誤.
+func checkBackupDiskUsage(bkProjRoot string, bkStat, projStat *ProjectStatus) (uint64, error) {
+	avail := du.NewDiskUsage(bkProjRoot).Available()
 	addUp := projStat.TotalSize - bkStat.TotalSize // 備份後將會增加的體積
 	if addUp <= 0 {
-		return nil
+		return avail, nil
 	}
 	var margin uint64 = 1 << 30 // 1GB (現在U盤也是100GB起步了)
-	if uint64(addUp)+margin > usage.Available() {
-		return fmt.Errorf("not enough space (備份專案空間不足)")
+	if uint64(addUp)+margin > avail {
+		return avail, fmt.Errorf("not enough space (備份專案空間不足)")
 	}
-	return nil
+	return avail, nil
 }
 
 func deleteFile(c *fiber.Ctx) error {
@@ -1795,13 +2364,17 @@ func deleteFile(c *fiber.Ctx) error {
 	if err := util.WrapErrors(err1, err2); err != nil {
 		return err
 	}
-	if err := checkRequireAdmin(file.Encrypted); err != nil {
+	if err := checkNotDeleted(&file.File); err != nil {
+		return err
+	}
+	if err := checkRequireAdmin(c, file.BucketName, file.Encrypted); err != nil {
 		return err
 	}
-	if err := removeTempFile(file.ID); err != nil {
+	before := file.File
+	if err := moveFileToTrash(&file.File); err != nil {
 		return err
 	}
-	return db.DeleteFile(BucketsFolder, TempFolder, thumbFilePath(file.ID), &file.File)
+	return logFileEvent(c, model.EventDelete, &before, file.ID)
 }
 
 func createNewNote(c *fiber.Ctx) error {
@@ -1826,7 +2399,10 @@ func damagedFilesHandler(c *fiber.Ctx) error {
 		return err
 	}
 	for _, file := range files {
-		if err := checkRequireAdmin(file.Encrypted); err != nil {
+		if err := checkRequireAdmin(c, file.BucketName, file.Encrypted); err != nil {
+			return err
+		}
+		if _, err := db.UnsealFile(&file.File); err != nil {
 			return err
 		}
 	}
@@ -18,6 +18,7 @@ type (
 	Bucket        = model.Bucket
 	File          = model.File
 	FilePlus      = model.FilePlus
+	FileVersion   = model.FileVersion
 	MovedFile     = model.MovedFile
 	ProjectStatus = model.ProjectStatus
 	BucketStatus  = model.BucketStatus
@@ -40,6 +41,13 @@ const (
 	ThumbsFolderName  = "thumbs"
 	DotJPEG           = ".jpeg"
 	DotTOML           = ".toml"
+
+	SecretThumbsFolderName = "secret-thumbs"
+	LeakedThumbsFolderName = "leaked-thumbs"
+	TLSFolderName          = "tls"
+	TrashFolderName        = "trash"
+	VersionsFolderName     = "versions"
+	SnapshotsFolderName    = "snapshots"
 )
 
 var (
@@ -53,6 +61,12 @@ var (
 	TempFolder        = filepath.Join(ProjectRoot, TempFolderName)
 	PublicFolder      = filepath.Join(ProjectRoot, PublicFolderName)
 	ThumbsFolder      = filepath.Join(PublicFolder, ThumbsFolderName)
+
+	SecretThumbsFolder = filepath.Join(ProjectRoot, SecretThumbsFolderName)
+	LeakedThumbsFolder = filepath.Join(TempFolder, LeakedThumbsFolderName)
+	TLSFolder          = filepath.Join(ProjectRoot, TLSFolderName)
+	TrashFolder        = filepath.Join(ProjectRoot, TrashFolderName)
+	VersionsFolder     = filepath.Join(ProjectRoot, VersionsFolderName)
 )
 
 func init() {
@@ -60,6 +74,8 @@ func init() {
 	fmt.Println(ProjectConfig)
 	initDB()
 	createFolders()
+	lo.Must0(moveLeakedThumbs())
+	journalResults = lo.Must(recoverJournals(db, ProjectRoot))
 }
 
 func initDB() {
@@ -73,6 +89,10 @@ func createFolders() {
 		TempFolder,
 		PublicFolder,
 		ThumbsFolder,
+		SecretThumbsFolder,
+		LeakedThumbsFolder,
+		TrashFolder,
+		VersionsFolder,
 	}
 	for _, folder := range folders {
 		lo.Must0(util.MkdirIfNotExists(folder))
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// journalResults 是本次啟動時處理中斷操作的結果, 顯示在 /api/project-status 中.
+var journalResults []*model.JournalResult
+
+// recoverJournals 處理上次未完成的操作 (見 database/journal.go):
+// 數據庫未更新的回滾, 已更新的繼續完成清理工作. 處理失敗的日誌會保留, 下次啟動時再試.
+func recoverJournals(db1 *DB, root string) (results []*model.JournalResult, err error) {
+	journals, err := db1.GetJournals()
+	if err != nil {
+		return nil, err
+	}
+	for _, j := range journals {
+		result := &model.JournalResult{Op: j.Op, FileID: j.FileID, StartedAt: j.StartedAt}
+		committed, err := db1.JournalCommitted(j)
+		if err == nil {
+			if committed {
+				result.Result = "rolled forward"
+				err = rollForwardJournal(db1, root, j)
+			} else {
+				result.Result = "rolled back"
+				err = database.RollbackJournal(j)
+			}
+		}
+		if err == nil {
+			err = db1.EndJournal(j)
+		}
+		if err != nil {
+			result.Result = "failed"
+			result.Error = err.Error()
+		}
+		fmt.Printf("journal %d (%s, file %d): %s %s\n",
+			j.ID, j.Op, j.FileID, result.Result, result.Error)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// rollForwardJournal 數據庫已更新, 繼續執行剩下的清理步驟. 可以重複執行.
+func rollForwardJournal(db1 *DB, root string, j *database.Journal) error {
+	for _, step := range j.Cleanup {
+		switch step.Action {
+		case model.JournalRemove:
+			if util.PathExists(step.Dst) {
+				if err := os.Remove(step.Dst); err != nil {
+					return err
+				}
+			}
+		case model.JournalArchive:
+			if util.PathExists(step.Src) {
+				err := archiveVersionIn(db1, root, step.Src, j.FileID, step.Size, step.UTime)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// endJournal 數據庫已更新後調用, errs 是清理步驟的錯誤.
+// 清理全部成功才刪除日誌, 否則保留, 下次啟動時繼續完成 (見 rollForwardJournal).
+func endJournal(j *model.Journal, errs ...error) error {
+	if err := util.WrapErrors(errs...); err != nil {
+		return err
+	}
+	return db.EndJournal(j)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// 測試時的專案根目錄是測試程序所在的臨時資料夾 (見 init.go), 因此不影響真正的專案.
+
+const testBucket = "journal-test"
+
+func TestMain(m *testing.M) {
+	if _, err := db.SetAESGCM(database.DefaultPassword); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// newEncryptedTestFile 在加密倉庫中新建一個內容為 content 的檔案, 返回數據庫中的檔案資訊.
+func newEncryptedTestFile(t *testing.T, name, content string) *FilePlus {
+	t.Helper()
+	if _, err := db.GetBucketByName(testBucket); err != nil {
+		form := &model.CreateBucketForm{Name: testBucket, Encrypted: true}
+		if _, err := db.InsertBucket(form); err != nil {
+			t.Fatal(err)
+		}
+		if err := createBucketFolder(testBucket); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newTestFileIn(t, testBucket, name, content)
+}
+
+// newTestFileIn 在已有的倉庫 bucketName 中新建一個內容為 content 的檔案, 返回數據庫中的檔案資訊.
+// 密封倉庫中的檔案, 返回的 Name 是硬碟上的隨機名稱.
+func newTestFileIn(t *testing.T, bucketName, name, content string) *FilePlus {
+	t.Helper()
+	waiting := filepath.Join(WaitingFolder, name)
+	if err := os.WriteFile(waiting, []byte(content), util.NormalFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	file, err := model.NewWaitingFile(waiting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.BucketName = bucketName
+	if err := encryptWaitingFileToBucket(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(waiting); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	inserted, err := db.GetFileByName(file.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbFile, err := db.GetFilePlus(inserted.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &dbFile
+}
+
+// recoverOne 模擬重新啟動, 處理中斷的操作, 應只有一個日誌並且結果為 want.
+func recoverOne(t *testing.T, want string) {
+	t.Helper()
+	results, err := recoverJournals(db, ProjectRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Result != want {
+		for _, r := range results {
+			t.Logf("journal result: %+v", *r)
+		}
+		t.Fatalf("want one journal %q", want)
+	}
+	if n, err := db.GetJournals(); err != nil || len(n) > 0 {
+		t.Fatalf("journals left: %v, %v", n, err)
+	}
+}
+
+func assertChecksum(t *testing.T, filePath, want string) {
+	t.Helper()
+	sum, err := util.FileSum512(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != want {
+		t.Fatalf("%s: checksum changed", filePath)
+	}
+}
+
+// 覆蓋加密檔案時, 在加密完成並記錄 Target 之前中斷, 應回滾: 舊檔案移回原位, 保留 waiting 中的新檔案.
+func TestRecoverOverwriteBeforeTarget(t *testing.T) {
+	dbFile := newEncryptedTestFile(t, "overwrite.txt", "old content")
+	oldPath := filePathIn(BucketsFolder, &dbFile.File)
+	waitingFile := &MovedFile{Src: filepath.Join(WaitingFolder, dbFile.Name), Dst: oldPath}
+	if err := os.WriteFile(waitingFile.Src, []byte("new content"), util.NormalFilePerm); err != nil {
+		t.Fatal(err)
+	}
+	tempFile := MovedFile{Src: oldPath, Dst: filepath.Join(TempFolder, dbFile.Name)}
+
+	j := overwriteJournal(dbFile, waitingFile, tempFile, "")
+	if err := db.BeginJournal(j); err != nil {
+		t.Fatal(err)
+	}
+	if err := tempFile.Move(); err != nil {
+		t.Fatal(err)
+	}
+	// 模擬加密到一半時程序中斷: 新檔案只寫入了一部分.
+	if err := os.WriteFile(waitingFile.Dst, []byte("partial"), util.NormalFilePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	recoverOne(t, "rolled back")
+	assertChecksum(t, oldPath, dbFile.Checksum)
+	if util.PathNotExists(waitingFile.Src) {
+		t.Fatal("waiting file removed")
+	}
+	if util.PathExists(tempFile.Dst) {
+		t.Fatal("temp file left")
+	}
+	if err := os.Remove(waitingFile.Src); err != nil {
+		t.Fatal(err)
+	}
+}
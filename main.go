@@ -1,24 +1,66 @@
 package main
 
 import (
+	"flag"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+var (
+	fsckFlag = flag.Bool("fsck", false, "檢查專案的數據庫與檔案是否一致, 輸出 JSON 報告後退出")
+	rootFlag = flag.String("root", "", "fsck 檢查的專案根目錄 (例如備份專案), 默認為本專案")
+	fixFlag  = flag.String("fix", "", "fsck 的修復方式, 以逗號分隔: adopt,quarantine,thumbs,temp")
+
+	promoteFlag   = flag.Bool("promote", false, "把本備份專案就地升級為主專案, 完成後退出")
+	restoreToFlag = flag.String("restore-to", "", "把本備份專案複製到空資料夾作為新的主專案, 完成後退出")
+	backupsFlag   = flag.String("backups", "", "恢復後重新登記的其他備份專案, 以逗號分隔, 默認為 project.toml 中的 BackupProjects")
+
+	archiveFlag       = flag.String("archive", "", "把本專案打包為歸檔檔案, 保存在該資料夾中, 完成後退出")
+	formatFlag        = flag.String("format", "tar", "歸檔格式: tar 或 zip")
+	zstdFlag          = flag.Bool("zstd", false, "歸檔時用 zstd 壓縮")
+	verifyArchiveFlag = flag.String("verify-archive", "", "驗證歸檔檔案, 輸出 JSON 報告後退出")
+	importArchiveFlag = flag.String("import-archive", "", "驗證歸檔檔案後, 在 -import-to 指定的空資料夾中重建專案")
+	importToFlag      = flag.String("import-to", "", "導入歸檔的目標資料夾 (必須是空資料夾)")
 )
 
 func main() {
 	defer db.DB.Close()
+	flag.Parse()
+	if *fsckFlag {
+		lo.Must0(runFsckCLI(*rootFlag, *fixFlag))
+		return
+	}
+	if *promoteFlag || *restoreToFlag != "" {
+		lo.Must0(runRestoreCLI(*restoreToFlag, *backupsFlag))
+		return
+	}
+	if *archiveFlag != "" || *verifyArchiveFlag != "" || *importArchiveFlag != "" {
+		lo.Must0(runArchiveCLI(*archiveFlag, *formatFlag, *zstdFlag,
+			*verifyArchiveFlag, *importArchiveFlag, *importToFlag))
+		return
+	}
+	go purgeSessionsLoop()
+	if !ProjectConfig.IsBackup && ProjectConfig.TrashRetentionDays > 0 {
+		go purgeTrashLoop()
+	}
+
 	app := fiber.New(fiber.Config{
 		Immutable: true, // 以后试试删除该设定
 	})
 
+	// 在 sleep 等全部中间件之前检查客户端 IP.
+	app.Use(allowClients(lo.Must(parseAllowedCIDRs(ProjectConfig.AllowedCIDRs))))
 	app.Use(noCache)
 
 	app.Static("/", PublicFolder)
 
-	app.Get("/file/:id", previewFile)
+	app.Get("/file/:id", apiTokenAuth, previewFile)
+	app.Get("/secret-thumbs/:id", apiTokenAuth, secretThumbHandler)
+	app.Get("/file-version/:id", apiTokenAuth, previewVersion)
 
-	api := app.Group("/api", sleep)
+	api := app.Group("/api", sleep, apiTokenAuth)
 
 	api.Use("/update-bucket-info", notAllowInBackup)
 	api.Use("/delete-bucket", deleteBucket)
@@ -50,9 +92,69 @@ func main() {
 	api.Post("/move-file-to-bucket", moveFileToBucket) // resp.data: FilePlus
 	api.Post("/change-password", changePassword)
 
+	api.Use("/restore-file", notAllowInBackup)
+	api.Use("/empty-trash", requireAdmin, notAllowInBackup)
+	api.Get("/trash", getTrashHandler) // resp.data: FilePlus[]
+	api.Post("/restore-file", restoreFile)
+	api.Post("/empty-trash", emptyTrashHandler) // resp.data: number
+
+	api.Use("/restore-version", notAllowInBackup)
+	api.Use("/prune-versions", requireAdmin, notAllowInBackup)
+	api.Post("/file-versions", getFileVersionsHandler) // resp.data: FileVersion[]
+	api.Post("/download-version", downloadVersion)
+	api.Post("/restore-version", restoreVersion)
+	api.Post("/prune-versions", pruneVersionsHandler) // resp.data: number
+
+	api.Use("/rename-tag", requireAdmin, notAllowInBackup)
+	api.Use("/merge-tags", requireAdmin, notAllowInBackup)
+	api.Get("/tags", getTagCounts) // resp.data: TagCount[]
+	api.Post("/rename-tag", renameTagHandler)
+	api.Post("/merge-tags", mergeTagsHandler)
+
 	api.Use("/rebuild-thumbs", requireAdmin)
 	api.Post("/rebuild-thumbs", rebuildThumbsHandler)
 
+	api.Use("/reindex-text", requireAdmin)
+	api.Post("/reindex-text", reindexTextHandler)
+
+	api.Use("/upgrade-encrypted-files", requireAdmin, notAllowInBackup)
+	api.Post("/upgrade-encrypted-files", upgradeEncryptedFilesHandler) // resp.data: number
+
+	api.Use("/rotate-data-key", requireAdmin, notAllowInBackup)
+	api.Post("/rotate-data-key", rotateDataKeyHandler)
+
+	api.Use("/unlock-bucket", requireAdmin)
+	api.Use("/lock-bucket", requireAdmin)
+	api.Use("/change-bucket-password", requireAdmin, notAllowInBackup)
+	api.Post("/unlock-bucket", unlockBucket)
+	api.Post("/lock-bucket", lockBucket)
+	api.Post("/change-bucket-password", changeBucketPassword)
+
+	api.Use("/events", requireAdmin)
+	api.Use("/export-events", requireAdmin)
+	api.Post("/events", getEventsHandler)           // resp.data: Event[]
+	api.Post("/export-events", exportEventsHandler) // resp.data: JSONL
+
+	api.Use("/fsck", requireAdmin)
+	api.Post("/fsck", fsckHandler) // resp.data: FsckReport
+
+	api.Use("/restore-project", requireAdmin)
+	api.Post("/restore-project", restoreProjectHandler) // resp.data: RestoreResult
+
+	api.Use("/create-archive", requireAdmin)
+	api.Use("/verify-archive", requireAdmin)
+	api.Use("/import-archive", requireAdmin)
+	api.Post("/create-archive", createArchiveHandler) // resp.data: ArchiveReport
+	api.Post("/verify-archive", verifyArchiveHandler) // resp.data: ArchiveReport
+	api.Post("/import-archive", importArchiveHandler) // resp.data: ArchiveReport
+
+	api.Use("/create-api-token", requireAdmin, notAllowInBackup)
+	api.Use("/api-tokens", requireAdmin)
+	api.Use("/revoke-api-token", requireAdmin, notAllowInBackup)
+	api.Post("/create-api-token", createAPIToken) // resp.data: CreatedAPIToken
+	api.Get("/api-tokens", getAPITokens)          // resp.data: APIToken[]
+	api.Post("/revoke-api-token", revokeAPIToken)
+
 	api.Get("/waiting-folder", getWaitingFolder)   // resp.data: TextMsg
 	api.Get("/auto-get-keywords", autoGetKeywords) // resp.data: null | string[]
 	api.Get("/auto-get-buckets", autoGetBuckets)   // resp.data: null | BucketStatus[]
@@ -74,10 +176,19 @@ func main() {
 	api.Get("/damaged-files", damagedFilesHandler) // resp.data: FilePlus[]
 	api.Post("/repair-files", repairFilesHandler)
 	api.Post("/sync-backup", syncBackup)
+	api.Use("/sync-preview", requireAdmin)
+	api.Post("/sync-preview", syncPreviewHandler) // resp.data: SyncPreview
+
+	api.Use("/snapshots", requireAdmin)
+	api.Use("/snapshot-files", requireAdmin)
+	api.Use("/restore-from-snapshot", requireAdmin, notAllowInBackup)
+	api.Post("/snapshots", getSnapshotsHandler)             // resp.data: Snapshot[]
+	api.Post("/snapshot-files", getSnapshotFilesHandler)    // resp.data: FilePlus[]
+	api.Post("/restore-from-snapshot", restoreFromSnapshot) // resp.data: TextMsg
 
 	api.Get("/login-status", getLoginStatus) // resp.data: OneTextForm
 	api.Post("/admin-login", adminLogin)
 	api.Get("/logout", logoutHandler)
 
-	log.Fatal(app.Listen(ProjectConfig.Host))
+	log.Fatal(listen(app))
 }
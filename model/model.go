@@ -1,11 +1,13 @@
 package model
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -40,6 +42,26 @@ type Project struct {
 	LastBackupAt     string   `json:"last_backup_at"`  // RFC3339
 	DownloadExport   bool     `json:"download_export"` // 下載時導出
 	MarkdownStyle    string   `json:"markdown_style"`
+
+	SessionIdleTimeout int64 `json:"session_idle_timeout"` // 閒置多久後登出, 單位: 分鐘
+	SessionMaxAge      int64 `json:"session_max_age"`      // 登入後最長有效期, 單位: 小時
+
+	TLS            bool     `json:"tls"`              // 是否採用 https
+	CertFile       string   `json:"cert_file"`        // 留空則自動生成自簽名證書
+	KeyFile        string   `json:"key_file"`         // 與 CertFile 一起設置
+	ClientCertPins []string `json:"client_cert_pins"` // 允許的客戶端證書 sha256 指紋, 留空則不要求客戶端證書
+	AllowedCIDRs   []string `json:"allowed_cidrs"`    // 允許訪問的 IP 範圍, 留空則不限制
+
+	TrashRetentionDays int64 `json:"trash_retention_days"` // 回收站中的檔案保留多少天, 0 表示不自動清理
+
+	// 同步備份專案時, 將要刪除 (或移到回收站) 的檔案超過以下任何一個上限, 則需要確認後才同步.
+	// 0 表示採用默認值, 負數表示不限制.
+	SyncMaxDeletes       int64 `json:"sync_max_deletes"`        // 檔案數量
+	SyncMaxDeletePercent int64 `json:"sync_max_delete_percent"` // 佔備份專案檔案總數的百分比
+
+	// 每次同步後在備份專案中建立快照, 按以下規則保留, 兩者都為 0 表示不建立快照.
+	SnapshotKeepDaily   int64 `json:"snapshot_keep_daily"`   // 最近多少天, 每天保留最新的一個
+	SnapshotKeepMonthly int64 `json:"snapshot_keep_monthly"` // 最近多少個月, 每月保留最新的一個
 }
 
 func NewProject(title string, cipherkey string) *Project {
@@ -50,6 +72,13 @@ func NewProject(title string, cipherkey string) *Project {
 		RecentFilesLimit: 100,
 		CheckInterval:    30,
 		CheckSizeLimit:   1,
+
+		SessionIdleTimeout: 30,
+		SessionMaxAge:      24,
+		TrashRetentionDays: 30,
+
+		SyncMaxDeletes:       100,
+		SyncMaxDeletePercent: 10,
 	}
 }
 
@@ -60,6 +89,246 @@ type ProjectStatus struct {
 	FilesCount        int64  // 檔案數量合計
 	WaitingCheckCount int64  // 待檢查檔案數量合計
 	DamagedCount      int64  // 受損檔案數量合計
+
+	KeyRotationStartedAt string // 未完成的更換密鑰操作的開始時間, 空字符串表示沒有
+
+	PendingJournals int64            // 未能自動處理的操作日誌數量 (見 Journal)
+	JournalResults  []*JournalResult // 本次啟動時處理中斷操作的結果
+}
+
+// 操作日誌 (journal) 的步驟類型, 見 JournalStep.
+const (
+	JournalMove    = "move"    // 把 Src 移動到 Dst, 回滾時移回 Src
+	JournalCreate  = "create"  // 新建 Dst, 回滾時刪除 Dst
+	JournalRemove  = "remove"  // (提交後) 刪除 Dst
+	JournalArchive = "archive" // (提交後) 把 Src 保存為檔案的舊版本
+)
+
+// JournalStep 操作日誌中的一個步驟. 保存到數據庫時, 路徑是相對於專案根目錄的.
+// Size 及 UTime 只用於 archive, 是被覆蓋前的檔案資訊.
+type JournalStep struct {
+	Action string `json:"action"`
+	Src    string `json:"src,omitempty"`
+	Dst    string `json:"dst,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	UTime  string `json:"utime,omitempty"`
+}
+
+// JournalTarget 操作完成 (數據庫已更新) 後檔案在數據庫中的狀態, 用來判斷中斷的操作是否已提交.
+// 空字符串或 nil 表示不檢查該項, Gone 表示檔案已從數據庫中刪除.
+// 全部為空表示尚未記錄 (例如加密後才知道 checksum, 見 SetJournalTarget), 此時一律視為未提交.
+type JournalTarget struct {
+	Checksum   string `json:"checksum,omitempty"`
+	BucketName string `json:"bucket_name,omitempty"`
+	Deleted    *bool  `json:"deleted,omitempty"`
+	Gone       bool   `json:"gone,omitempty"`
+}
+
+func (t JournalTarget) IsEmpty() bool {
+	return t.Checksum == "" && t.BucketName == "" && t.Deleted == nil && !t.Gone
+}
+
+// Journal 操作日誌 (write-ahead journal). 需要先移動檔案, 再更新數據庫的操作,
+// 在動手之前先把計劃的步驟 (Steps) 寫入數據庫, 全部完成後再刪除日誌.
+// 如果程序中途退出, 下次啟動時根據 Target 判斷數據庫是否已更新:
+// 未更新則按相反順序回滾 Steps, 已更新則繼續執行 Cleanup.
+type Journal struct {
+	ID        int64         `json:"id"`
+	Op        string        `json:"op"` // 與事件的 Action 相同, 例如 "overwrite"
+	FileID    int64         `json:"file_id"`
+	Steps     []JournalStep `json:"steps"`
+	Cleanup   []JournalStep `json:"cleanup"`
+	Target    JournalTarget `json:"target"`
+	StartedAt string        `json:"started_at"`
+}
+
+func NewJournal(op string, fileID int64) *Journal {
+	return &Journal{Op: op, FileID: fileID}
+}
+
+func (j *Journal) Move(src, dst string) *Journal {
+	j.Steps = append(j.Steps, JournalStep{Action: JournalMove, Src: src, Dst: dst})
+	return j
+}
+
+func (j *Journal) Create(dst string) *Journal {
+	j.Steps = append(j.Steps, JournalStep{Action: JournalCreate, Dst: dst})
+	return j
+}
+
+func (j *Journal) ThenRemove(dst string) *Journal {
+	j.Cleanup = append(j.Cleanup, JournalStep{Action: JournalRemove, Dst: dst})
+	return j
+}
+
+func (j *Journal) ThenArchive(src string, oldFile *File) *Journal {
+	j.Cleanup = append(j.Cleanup, JournalStep{
+		Action: JournalArchive, Src: src, Size: oldFile.Size, UTime: oldFile.UTime})
+	return j
+}
+
+// JournalResult 啟動時處理一個中斷操作的結果.
+type JournalResult struct {
+	Op        string `json:"op"`
+	FileID    int64  `json:"file_id"`
+	StartedAt string `json:"started_at"`
+	Result    string `json:"result"` // "rolled back", "rolled forward" 或 "failed"
+	Error     string `json:"error,omitempty"`
+}
+
+// fsck 發現的問題類型 (見 fsck.go).
+const (
+	FsckOrphanFile          = "orphan-file"           // 倉庫資料夾或回收站中的檔案在數據庫中沒有記錄
+	FsckMissingFile         = "missing-file"          // 數據庫中有記錄, 但找不到檔案
+	FsckUnknownBucketFolder = "unknown-bucket-folder" // buckets 中的資料夾不屬於任何倉庫
+	FsckMissingBucketFolder = "missing-bucket-folder" // 倉庫的資料夾不存在
+	FsckOrphanVersion       = "orphan-version"        // versions 中的檔案在數據庫中沒有記錄
+	FsckMissingVersion      = "missing-version"       // 舊版本的記錄找不到檔案
+	FsckStaleTemp           = "stale-temp"            // temp 資料夾中的殘留檔案
+	FsckOrphanThumb         = "orphan-thumb"          // 縮略圖對應的檔案不存在
+	FsckMissingThumb        = "missing-thumb"         // 圖片沒有縮略圖
+)
+
+// fsck 的修復方式.
+const (
+	FsckFixAdopt      = "adopt"      // 把公開倉庫中的孤兒檔案收錄進數據庫
+	FsckFixQuarantine = "quarantine" // 把未知的檔案 (資料夾) 移到 quarantine 資料夾
+	FsckFixThumbs     = "thumbs"     // 重新生成缺失的縮略圖, 刪除多餘的縮略圖
+	FsckFixTemp       = "temp"       // 刪除 temp 資料夾中的殘留檔案
+)
+
+// FsckIssue fsck 發現的一個問題.
+type FsckIssue struct {
+	Kind   string `json:"kind"`
+	Path   string `json:"path"` // 相對於專案根目錄, 以 "/" 分隔
+	FileID int64  `json:"file_id,omitempty"`
+	Fix    string `json:"fix,omitempty"` // 可用的修復方式, 空字符串表示只能手動處理
+	Fixed  bool   `json:"fixed"`
+	Error  string `json:"error,omitempty"` // 修復失敗的原因
+}
+
+// FsckReport fsck 的檢查結果.
+type FsckReport struct {
+	Root      string         `json:"root"`
+	IsBackup  bool           `json:"is_backup"`
+	CheckedAt string         `json:"checked_at"`
+	Counts    map[string]int `json:"counts"` // 各類問題的數量
+	Issues    []*FsckIssue   `json:"issues"`
+}
+
+// FsckForm 檢查專案 Root (空字符串表示主專案), 並執行 Fix 中的修復方式.
+type FsckForm struct {
+	Root string   `json:"root"`
+	Fix  []string `json:"fix" validate:"dive,oneof=adopt quarantine thumbs temp"`
+}
+
+// change_log 表 (見 stmt.CreateChangeLogTable) 中的變化類型.
+const (
+	ChangeFile   = "file"
+	ChangeBucket = "bucket"
+)
+
+// SyncState 記錄備份專案上次同步到主專案的哪個變化序號 (change_log 的 seq).
+type SyncState struct {
+	SourceSeq int64
+	SyncedAt  string
+}
+
+// KeyRotation 記錄更換密鑰 (重新加密全部加密檔案) 的進度, 以便中斷後可以繼續.
+type KeyRotation struct {
+	CipherKey  string // 被加密的新密鑰 (用同一個密碼加密)
+	LastFileID int64  // 已處理到哪個檔案 (按檔案 ID 順序處理)
+	StartedAt  string // RFC3339
+}
+
+// API token 的權限範圍 (scope).
+const (
+	ScopeReadPublic    = "read:public"    // 讀取公開倉庫
+	ScopeReadEncrypted = "read:encrypted" // 讀取加密倉庫 (需要管理員已登入, 密鑰在內存中)
+	ScopeBackup        = "backup"         // 備份, 檢查檔案
+	ScopeWritePrefix   = "write:"         // write:倉庫資料夾名, 寫入指定倉庫
+)
+
+// APIToken 讓腳本等工具不需要管理員登入也可以訪問部分 API.
+// 數據庫中只保存 token 的 hash, token 本身只在新建時顯示一次.
+type APIToken struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Hash    string `json:"-"`
+	Scopes  string `json:"scopes"`  // 以空格分隔
+	CTime   string `json:"ctime"`   // RFC3339
+	Expires string `json:"expires"` // RFC3339, 空字符串表示永不過期
+	Revoked bool   `json:"revoked"`
+}
+
+// CreatedAPIToken 新建 API token 後返回給用戶, Token 只在此時顯示一次.
+type CreatedAPIToken struct {
+	*APIToken
+	Token string `json:"token"`
+}
+
+type CreateAPITokenForm struct {
+	Name   string   `json:"name"   validate:"required"`
+	Scopes []string `json:"scopes" validate:"required,min=1"`
+	Days   int64    `json:"days"   validate:"gte=0"` // 有效天數, 0 表示永不過期
+}
+
+func NewAPIToken(form *CreateAPITokenForm) (*APIToken, error) {
+	for _, scope := range form.Scopes {
+		if err := checkScope(scope); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	t := new(APIToken)
+	t.Name = strings.TrimSpace(form.Name)
+	t.Scopes = strings.Join(lo.Uniq(form.Scopes), " ")
+	t.CTime = now.Format(RFC3339)
+	if form.Days > 0 {
+		t.Expires = now.AddDate(0, 0, int(form.Days)).Format(RFC3339)
+	}
+	return t, nil
+}
+
+func checkScope(scope string) error {
+	switch scope {
+	case ScopeReadPublic, ScopeReadEncrypted, ScopeBackup:
+		return nil
+	}
+	bucketName, ok := strings.CutPrefix(scope, ScopeWritePrefix)
+	if !ok || bucketName == "" {
+		return fmt.Errorf("unknown scope: %s", scope)
+	}
+	return checkFilename(bucketName)
+}
+
+// WriteBuckets 返回 write:倉庫 中的倉庫資料夾名.
+func (t *APIToken) WriteBuckets() (buckets []string) {
+	for _, scope := range strings.Fields(t.Scopes) {
+		if bucketName, ok := strings.CutPrefix(scope, ScopeWritePrefix); ok {
+			buckets = append(buckets, bucketName)
+		}
+	}
+	return
+}
+
+func (t *APIToken) HasScope(scope string) bool {
+	return lo.Contains(strings.Fields(t.Scopes), scope)
+}
+
+// CanWrite 倉庫資料夾名不分大小寫.
+func (t *APIToken) CanWrite(bucketName string) bool {
+	return lo.ContainsBy(t.WriteBuckets(), func(name string) bool {
+		return strings.EqualFold(name, bucketName)
+	})
+}
+
+func (t *APIToken) Expired() bool {
+	if t.Expires == "" {
+		return false
+	}
+	expires, err := time.Parse(RFC3339, t.Expires)
+	return err != nil || time.Now().After(expires)
 }
 
 // Bucket 倉庫
@@ -76,20 +345,47 @@ type Bucket struct {
 	Title    string `json:"title"`
 	Subtitle string `json:"subtitle"`
 
-	// 是否加密 (在創建時決定, 不可更改) (密碼在 ProjectConfig 中統一設定)
+	// 是否加密 (在創建時決定, 不可更改)
 	Encrypted bool `json:"encrypted"`
+
+	// 被加密的倉庫密鑰, 空字符串表示直接使用專案的密鑰 (舊版倉庫).
+	// 倉庫密鑰被專案密鑰加密, 或被倉庫專用密碼加密.
+	CipherKey string `json:"-"`
+
+	// 是否密封 (在創建時決定, 不可更改, 只對加密倉庫有效).
+	// 密封倉庫中的檔案, 在硬碟上採用隨機名稱, 真正的名稱, 備註, 關鍵詞則被加密.
+	Sealed bool `json:"sealed"`
+}
+
+// Redact 隱藏未解鎖倉庫的標題等資訊.
+func (bucket *Bucket) Redact() {
+	bucket.Title = "🔒"
+	bucket.Subtitle = ""
 }
 
 type BucketStatus struct {
 	*Bucket
-	TotalSize  int64
-	FilesCount int64
+	TotalSize   int64
+	FilesCount  int64
+	HasPassword bool // 是否設有倉庫專用密碼
+	Locked      bool // 是否未解鎖
 }
 
 // CreateBucketForm 用於新建倉庫, 由前端傳給后端.
+// Password 是倉庫專用密碼, Sealed 表示密封倉庫, 兩者都只對加密倉庫有效.
 type CreateBucketForm struct {
 	Name      string `json:"name"      validate:"required"`
 	Encrypted bool   `json:"encrypted"`
+	Password  string `json:"password"`
+	Sealed    bool   `json:"sealed"`
+}
+
+// BucketPasswordForm 用於解鎖倉庫, 或更改倉庫專用密碼.
+// 解鎖時只需要 Password, 更改密碼時 NewPassword 留空表示取消專用密碼.
+type BucketPasswordForm struct {
+	ID          int64  `json:"id"           validate:"required,gt=0"`
+	Password    string `json:"password"`
+	NewPassword string `json:"new_password"`
 }
 
 func NewBucket(form *CreateBucketForm) (*Bucket, error) {
@@ -100,6 +396,7 @@ func NewBucket(form *CreateBucketForm) (*Bucket, error) {
 	b.Name = form.Name
 	b.Title = form.Name
 	b.Encrypted = form.Encrypted
+	b.Sealed = form.Encrypted && form.Sealed
 	return b, nil
 }
 
@@ -107,24 +404,28 @@ func (bucket *Bucket) CheckName() error {
 	return checkFilename(bucket.Name)
 }
 
+// FileExportImport 導出時寫入 TOML 檔案的檔案資訊.
+// Keywords 只用於導入舊版導出的 TOML 檔案, 新版導出時使用 Tags.
 type FileExportImport struct {
 	BucketName string
 	Notes      string
-	Keywords   string
+	Keywords   string `toml:",omitempty"`
+	Tags       []string
 	Like       int64
 	CTime      string
 	UTime      string
 }
 
 // File 檔案.
-// Notes 與 Keywords 本質上是一樣的, 只是一行字符串, 用來輔助搜尋.
+// Keywords 是標籤 (tag) 的列表, 以 ", " 分隔, 見 SplitTags.
+// 標籤同時保存在數據庫的 tag 及 file_tag 表中, Keywords 欄位用於顯示及全文搜尋.
 type File struct {
 	ID         int64  `json:"id"`          // 自增數字ID
 	Checksum   string `json:"checksum"`    // NOT NULL UNIQUE
 	BucketName string `json:"bucket_name"` // Bucket.Name
 	Name       string `json:"name"`        // 檔案名
 	Notes      string `json:"notes"`       // 備註
-	Keywords   string `json:"keywords"`    // 關鍵詞, 便於搜尋
+	Keywords   string `json:"keywords"`    // 標籤, 以 ", " 分隔
 	Size       int64  `json:"size"`        // length in bytes for regular files
 	Type       string `json:"type"`        // 檔案類型, 例: text/js, office/docx
 	Like       int64  `json:"like"`        // 點贊
@@ -133,6 +434,25 @@ type File struct {
 	Checked    string `json:"checked"`     // RFC3339 上次校驗檔案完整性的時間
 	Damaged    bool   `json:"damaged"`     // 上次校驗結果 (檔案是否損壞)
 	Deleted    bool   `json:"deleted"`     // 把檔案标记为 "已删除"
+	Sealed     string `json:"-"`           // 密封倉庫中的檔案的名稱等資訊 (已加密)
+}
+
+// FileVersion 是檔案被覆蓋前的舊版本.
+// 舊版本的內容保存在 versions 資料夾中, 以 ID 為檔案名稱, 加密倉庫中的檔案的舊版本也是加密的.
+type FileVersion struct {
+	ID       int64  `json:"id"`
+	FileID   int64  `json:"file_id"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+	UTime    string `json:"utime"` // RFC3339 該版本的檔案更新時間
+	CTime    string `json:"ctime"` // RFC3339 成為舊版本的時間 (被覆蓋的時間)
+}
+
+// SealedInfo 是密封倉庫中的檔案被加密的資訊.
+type SealedInfo struct {
+	Name     string `json:"name"`
+	Notes    string `json:"notes"`
+	Keywords string `json:"keywords"`
 }
 
 func (f *File) Rename(name string) {
@@ -146,7 +466,10 @@ func (f *File) Rename(name string) {
 func (f *File) ImportFrom(f2 FileExportImport) {
 	f.BucketName = f2.BucketName
 	f.Notes = f2.Notes
-	f.Keywords = f2.Keywords
+	f.Keywords = JoinTags(f2.Tags)
+	if len(f2.Tags) == 0 {
+		f.Keywords = NormalizeKeywords(f2.Keywords)
+	}
 	f.Like = f2.Like
 	f.CTime = f2.CTime
 	f.UTime = f2.UTime
@@ -181,7 +504,8 @@ func ExportFileFrom(f File) FileExportImport {
 	return FileExportImport{
 		f.BucketName,
 		f.Notes,
-		f.Keywords,
+		"",
+		SplitTags(f.Keywords),
 		f.Like,
 		f.CTime,
 		f.UTime,
@@ -197,10 +521,62 @@ func ImportFileFrom(tomlPath string) (imported FileExportImport, err error) {
 	return
 }
 
+// SplitTags 把關鍵詞字符串拆分為標籤.
+// 以逗號, 分號, 頓號 (包括全角) 或換行分隔, 去除首尾空格, 忽略空標籤,
+// 不分大小寫去重, 並按字母順序排序. 因此 "travel, 2023" 與 "2023, travel" 是相同的.
+func SplitTags(keywords string) []string {
+	fields := strings.FieldsFunc(keywords, func(r rune) bool {
+		return strings.ContainsRune(",，;；、\n", r)
+	})
+	var tags []string
+	for _, tag := range fields {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	tags = lo.UniqBy(tags, strings.ToLower)
+	sort.SliceStable(tags, func(i, j int) bool {
+		return strings.ToLower(tags[i]) < strings.ToLower(tags[j])
+	})
+	return tags
+}
+
+func JoinTags(tags []string) string {
+	return strings.Join(tags, ", ")
+}
+
+// NormalizeKeywords 整理關鍵詞字符串, 使相同的一組標籤總是得到相同的字符串.
+func NormalizeKeywords(keywords string) string {
+	return JoinTags(SplitTags(keywords))
+}
+
+// TagCount 一個標籤在一個倉庫中的檔案數量.
+type TagCount struct {
+	Name       string `json:"name"`
+	BucketName string `json:"bucket_name"`
+	Count      int64  `json:"count"`
+}
+
 // FilePlus 檔案以及更多資訊.
 type FilePlus struct {
 	File
 	Encrypted bool `json:"encrypted"`
+	Locked    bool `json:"locked"` // 所在倉庫未解鎖, 已隱藏檔案名稱等資訊
+
+	// Snippet 搜尋結果的摘要, 匹配的文字前後分別有 \x02 和 \x03 標記.
+	Snippet string `json:"snippet,omitempty"`
+
+	// DeletedAt 移到回收站的時間, 只在瀏覽回收站時有值.
+	DeletedAt string `json:"deleted_at,omitempty"`
+}
+
+// Redact 隱藏未解鎖倉庫中的檔案的名稱, 備註, 關鍵詞等資訊.
+func (f *FilePlus) Redact() {
+	f.Checksum = ""
+	f.Name = "🔒"
+	f.Notes = ""
+	f.Keywords = ""
+	f.Locked = true
 }
 
 // NewWaitingFile 根据 filePath 生成新檔案,
@@ -277,17 +653,283 @@ func checkFilename(name string) error {
 	return nil
 }
 
+// 事件 (event) 的類型, 見 Event.Action
+const (
+	EventUpload               = "upload"
+	EventImport               = "import"
+	EventOverwrite            = "overwrite"
+	EventUpdateInfo           = "update-info"
+	EventMove                 = "move"
+	EventDelete               = "delete" // 移到回收站
+	EventRestore              = "restore"
+	EventPurge                = "purge" // 從回收站中徹底刪除
+	EventRestoreVersion       = "restore-version"
+	EventRenameTag            = "rename-tag"
+	EventMergeTags            = "merge-tags"
+	EventCreateBucket         = "create-bucket"
+	EventUpdateBucket         = "update-bucket"
+	EventDeleteBucket         = "delete-bucket"
+	EventChangeBucketPassword = "change-bucket-password"
+	EventChangePassword       = "change-password"
+	EventRotateDataKey        = "rotate-data-key"
+	EventSyncBackup           = "sync-backup"
+	EventFsck                 = "fsck"
+	EventRestoreProject       = "restore-project" // 把備份專案恢復為主專案
+	EventCreateArchive        = "create-archive"
+	EventImportArchive        = "import-archive" // 從歸檔重建專案
+)
+
+// 事件的操作者, 使用 API token 時是 "token:" 加上 token 的名稱.
+const (
+	ActorAdmin  = "admin"
+	ActorGuest  = "guest"  // 未登入 (只能操作公開倉庫)
+	ActorSystem = "system" // 程序自動執行, 例如自動清理回收站
+)
+
+// Event 一條操作記錄 (審計日誌), 只增不改.
+// Before 及 After 是 JSON, 分別記錄操作前後的檔案或倉庫等資訊, 沒有則為空.
+type Event struct {
+	ID       int64           `json:"id"`
+	Time     string          `json:"time"`
+	Actor    string          `json:"actor"`
+	IP       string          `json:"ip"`
+	Action   string          `json:"action"`
+	FileID   int64           `json:"file_id,omitempty"`
+	BucketID int64           `json:"bucket_id,omitempty"`
+	Before   json.RawMessage `json:"before,omitempty"`
+	After    json.RawMessage `json:"after,omitempty"`
+}
+
+// FileSnapshot 事件中記錄的檔案資訊.
+// 密封檔案的名稱, 備註, 關鍵詞是加密的, 因此不記錄 (只記錄硬碟上的隨機名稱).
+type FileSnapshot struct {
+	BucketName string `json:"bucket_name"`
+	Name       string `json:"name"`
+	Notes      string `json:"notes,omitempty"`
+	Keywords   string `json:"keywords,omitempty"`
+	Checksum   string `json:"checksum"`
+	Size       int64  `json:"size"`
+	Like       int64  `json:"like"`
+	CTime      string `json:"ctime"`
+	UTime      string `json:"utime"`
+	Deleted    bool   `json:"deleted"`
+	Sealed     bool   `json:"sealed,omitempty"`
+}
+
+func (f *File) Snapshot() *FileSnapshot {
+	snap := &FileSnapshot{
+		BucketName: f.BucketName,
+		Name:       f.Name,
+		Notes:      f.Notes,
+		Keywords:   f.Keywords,
+		Checksum:   f.Checksum,
+		Size:       f.Size,
+		Like:       f.Like,
+		CTime:      f.CTime,
+		UTime:      f.UTime,
+		Deleted:    f.Deleted,
+	}
+	if f.Sealed != "" {
+		snap.Notes = ""
+		snap.Keywords = ""
+		snap.Sealed = true
+	}
+	return snap
+}
+
+// EventsOptions 查詢事件的條件, 零值表示不限, 時間範圍是閉區間.
+// 結果按 ID 降序排列, 下一頁使用上一頁最後一條事件的 ID 作為 BeforeID.
+type EventsOptions struct {
+	Action   string `json:"action"`
+	Actor    string `json:"actor"`
+	FileID   int64  `json:"file_id"   validate:"gte=0"`
+	BucketID int64  `json:"bucket_id" validate:"gte=0"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	BeforeID int64  `json:"before_id" validate:"gte=0"`
+	Limit    int64  `json:"limit"     validate:"gte=0"`
+}
+
+// FilesOptions 列出檔案的參數.
+// 第一頁 Cursor 為空, 之後每頁使用上一頁返回的 FilesPage.NextCursor.
+// UTime 非空時只列出更新時間不晚於 UTime 的檔案 (用於跳到指定日期).
+// 其餘欄位都是可選的篩選條件, 零值表示不限, 日期範圍都是閉區間.
 type FilesOptions struct {
-	ID    int64  `json:"id"   params:"id"`
-	Name  string `json:"name" params:"name"`
-	Sort  string `json:"sort" params:"sort"`
-	UTime string `json:"utime" params:"utime"`
+	ID     int64  `json:"id"     params:"id"`
+	Name   string `json:"name"   params:"name"`
+	Sort   string `json:"sort"   params:"sort"`
+	Order  string `json:"order"  params:"order"` // "desc" (默認) 或 "asc"
+	UTime  string `json:"utime"  params:"utime"`
+	Tag    string `json:"tag"    params:"tag"` // 只列出有該標籤的檔案
+	Cursor string `json:"cursor" params:"cursor"`
+
+	Type      string `json:"type"`       // 檔案類型前綴, 例如 "image/", "video/mp4"
+	MinSize   int64  `json:"min_size"`   // 單位: byte
+	MaxSize   int64  `json:"max_size"`   // 單位: byte
+	MinLike   int64  `json:"min_like"`   // 點讚數不少於
+	CTimeFrom string `json:"ctime_from"` // 創建時間範圍
+	CTimeTo   string `json:"ctime_to"`
+	UTimeFrom string `json:"utime_from"` // 更新時間不早於 (不晚於則使用 UTime)
+	Damaged   *bool  `json:"damaged"`
+	Encrypted *bool  `json:"encrypted"`
+}
+
+// FilesPage 一頁檔案. NextCursor 用於獲取下一頁, HasMore 表示是否還有下一頁.
+type FilesPage struct {
+	Files      []*FilePlus `json:"files"`
+	NextCursor string      `json:"next_cursor"`
+	HasMore    bool        `json:"has_more"`
 }
 
 type OneTextForm struct {
 	Text string `json:"text" validate:"required"`
 }
 
+// SyncBackupForm 同步備份專案 Text. 默認只同步上次同步後發生變化的檔案及倉庫,
+// Full 為 true 時對比全部檔案及倉庫. 將要刪除的檔案超過安全上限時,
+// 需要 Confirm 為 true 才會執行 (見 Project.SyncMaxDeletes).
+type SyncBackupForm struct {
+	Text    string `json:"text" validate:"required"`
+	Full    bool   `json:"full"`
+	Confirm bool   `json:"confirm"`
+}
+
+// SyncFileInfo 同步預覽中的一個檔案. 密封檔案的 Name 是硬碟上的隨機名稱.
+type SyncFileInfo struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Bucket   string `json:"bucket"`
+	BKBucket string `json:"bk_bucket,omitempty"` // 備份專案中原來的倉庫, 只用於 Moved
+}
+
+// SyncPreview 同步備份專案前計算的變化 (dry-run), 不會修改備份專案.
+type SyncPreview struct {
+	Root         string          `json:"root"`
+	Full         bool            `json:"full"` // 是否全量對比
+	Deleted      []*SyncFileInfo `json:"deleted"`
+	Trashed      []*SyncFileInfo `json:"trashed"` // 將被移到回收站的, 同時也在 Updated 中
+	Updated      []*SyncFileInfo `json:"updated"`
+	Moved        []*SyncFileInfo `json:"moved"`
+	Overwrited   []*SyncFileInfo `json:"overwrited"`
+	Inserted     []*SyncFileInfo `json:"inserted"`
+	BKFilesCount int64           `json:"bk_files_count"` // 備份專案現有的檔案數量
+	CopyBytes    int64           `json:"copy_bytes"`     // 需要從主專案複製的體積合計
+	AvailBytes   uint64          `json:"avail_bytes"`    // 備份專案所在硬碟的可用空間
+	DiskError    string          `json:"disk_error,omitempty"`
+
+	NeedConfirm   bool   `json:"need_confirm"`
+	ConfirmReason string `json:"confirm_reason,omitempty"`
+}
+
+// Snapshot 備份專案的一個快照 (見 snapshot.go).
+type Snapshot struct {
+	ID          string `json:"id"` // 快照資料夾名稱, 即建立時間
+	CreatedAt   string `json:"created_at"`
+	FilesCount  int64  `json:"files_count"`
+	TotalSize   int64  `json:"total_size"`
+	LinkedCount int64  `json:"linked_count"` // 以硬連結與備份專案共用的檔案數量
+	CopiedSize  int64  `json:"copied_size"`  // 無法建立硬連結而複製的體積
+}
+
+// SnapshotForm 指定備份專案 Root 中的一個快照, FileID 只用於從快照恢復檔案.
+type SnapshotForm struct {
+	Root   string `json:"root"    validate:"required"`
+	ID     string `json:"id"      validate:"required"`
+	FileID int64  `json:"file_id"`
+}
+
+// RestoreForm 把本備份專案恢復為主專案 (見 restore.go).
+// Target 為空表示就地升級, 否則複製到空資料夾 Target 作為新的主專案.
+// Backups 是要重新登記的其他備份專案, 為空則採用 project.toml 中原有的 BackupProjects.
+type RestoreForm struct {
+	Target  string   `json:"target"`
+	Backups []string `json:"backups"`
+}
+
+// RestoreResult 恢復主專案的結果. 有受損檔案 (Damaged) 時不會執行恢復.
+type RestoreResult struct {
+	Root       string            `json:"root"`    // 新的主專案根目錄
+	Checked    int64             `json:"checked"` // 校驗了的檔案數量 (包括舊版本)
+	Damaged    []string          `json:"damaged"` // 受損或找不到的檔案, 相對於專案根目錄
+	Registered []string          `json:"registered"`
+	Skipped    map[string]string `json:"skipped"` // 未能重新登記的備份專案 => 原因
+}
+
+// ArchiveForm 把本專案打包為一個歸檔檔案, 保存在資料夾 Dir 中 (見 archive.go).
+// Format 為 tar (默認) 或 zip, Zstd 表示用 zstd 壓縮.
+type ArchiveForm struct {
+	Dir    string `json:"dir"    validate:"required"`
+	Format string `json:"format" validate:"omitempty,oneof=tar zip"`
+	Zstd   bool   `json:"zstd"`
+}
+
+// ArchivePathForm 指定一個歸檔檔案 Path, Target 只用於導入 (必須是空資料夾).
+// Password 是歸檔中的 project.toml 的密碼, 用於驗證簽名,
+// 歸檔與本專案的密鑰相同並且已登入時可以省略.
+type ArchivePathForm struct {
+	Path     string `json:"path"     validate:"required"`
+	Target   string `json:"target"`
+	Password string `json:"password"`
+}
+
+// ArchiveEntry 歸檔中的一個檔案, Name 是相對於專案根目錄的路徑 (以 / 分隔).
+type ArchiveEntry struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"` // blake2b-512, 與 File.Checksum 相同
+}
+
+// ArchiveManifest 記錄歸檔中全部檔案的 checksum (不包括 manifest 自身).
+type ArchiveManifest struct {
+	Version       int64           `json:"version"`
+	Title         string          `json:"title"`
+	Source        string          `json:"source"` // 建立歸檔的專案根目錄
+	IsBackup      bool            `json:"is_backup"`
+	SchemaVersion int64           `json:"schema_version"`
+	CreatedAt     string          `json:"created_at"`
+	Entries       []*ArchiveEntry `json:"entries"`
+}
+
+// SignedManifest 是歸檔中的 manifest.json, Manifest 保留原本的 JSON 以便驗證簽名.
+type SignedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signature string          `json:"signature"`
+}
+
+// ArchiveReport 建立, 驗證或導入歸檔的結果.
+// 驗證時 Valid 為 true 表示簽名有效並且每個檔案都與 manifest 一致.
+type ArchiveReport struct {
+	Path      string   `json:"path"`
+	Root      string   `json:"root,omitempty"` // 導入時新建的專案根目錄
+	Title     string   `json:"title"`
+	CreatedAt string   `json:"created_at"`
+	Entries   int64    `json:"entries"`
+	TotalSize int64    `json:"total_size"`
+	Valid     bool     `json:"valid"`
+	SigError  string   `json:"sig_error,omitempty"`
+	Missing   []string `json:"missing"` // manifest 中有, 歸檔中沒有
+	Damaged   []string `json:"damaged"` // 體積或 checksum 與 manifest 不一致
+	Extra     []string `json:"extra"`   // 歸檔中有, manifest 中沒有
+}
+
+// ErrSyncNeedConfirm 同步將會刪除太多檔案, 需要確認後才執行.
+type ErrSyncNeedConfirm struct {
+	Preview *SyncPreview `json:"preview"`
+	ErrType string       `json:"errType"`
+}
+
+func NewErrSyncNeedConfirm(preview *SyncPreview) ErrSyncNeedConfirm {
+	return ErrSyncNeedConfirm{
+		Preview: preview,
+		ErrType: "ErrSyncNeedConfirm",
+	}
+}
+
+func (e ErrSyncNeedConfirm) Error() string {
+	return e.Preview.ConfirmReason + ", 請先預覽, 確認後再同步"
+}
+
 // FileIdForm 同時也用於 bucket id.
 type FileIdForm struct {
 	ID int64 `json:"id" params:"id" validate:"required,gt=0"`
@@ -298,11 +940,27 @@ type FileIdRangeForm struct {
 	End   int64 `json:"end"   params:"end"   validate:"required,gt=0"`
 }
 
+// PruneVersionsForm 刪除舊版本, 每個檔案保留最新的 Keep 個版本,
+// 並刪除超過 Days 日的版本. Keep 或 Days 為 0 表示不按該條件刪除.
+// FileID 為 0 表示處理全部檔案.
+type PruneVersionsForm struct {
+	FileID int64 `json:"file_id" validate:"gte=0"`
+	Keep   int64 `json:"keep"    validate:"gte=0"`
+	Days   int64 `json:"days"    validate:"gte=0"`
+}
+
 type ChangePwdForm struct {
 	OldPassword string `json:"old_password" validate:"required"`
 	NewPassword string `json:"new_password" validate:"required"`
 }
 
+// RotateDataKeyForm 更換密鑰時需要再次輸入密碼, 設有專用密碼的倉庫也要提供倉庫密碼
+// (BucketPasswords 的 key 是倉庫 ID), 因為新的密鑰要用同一個密碼加密.
+type RotateDataKeyForm struct {
+	Password        string           `json:"password"         validate:"required"`
+	BucketPasswords map[int64]string `json:"bucket_passwords"`
+}
+
 type RenameWaitingFileForm struct {
 	OldName string `json:"old_name" validate:"required"`
 	NewName string `json:"new_name" validate:"required"`
@@ -318,6 +976,18 @@ type UpdateFileInfoForm struct {
 	UTime    string `json:"utime"`
 }
 
+// RenameTagForm 如果 NewName 已存在, 則合併兩個標籤.
+type RenameTagForm struct {
+	OldName string `json:"old_name" validate:"required"`
+	NewName string `json:"new_name" validate:"required"`
+}
+
+// MergeTagsForm 把 Tags 合併到 Into (Into 可以是新標籤).
+type MergeTagsForm struct {
+	Tags []string `json:"tags" validate:"required,min=1"`
+	Into string   `json:"into" validate:"required"`
+}
+
 type MoveFileToBucketForm struct {
 	FileID     int64  `json:"file_id"     validate:"required,gt=0"`
 	BucketName string `json:"bucket_name" validate:"required"`
@@ -355,8 +1025,8 @@ func NewErrSameNameFiles(file File) ErrSameNameFiles {
 }
 
 func (e ErrSameNameFiles) Error() string {
-	return fmt.Sprintf(
-		"倉庫中已有同名檔案(檔案名稱不分大小寫): %s/%s", e.File.BucketName, e.File.Name)
+	return fmt.Sprintf("倉庫中已有同名檔案(檔案名稱不分大小寫): %s/%s%s",
+		e.File.BucketName, e.File.Name, lo.Ternary(e.File.Deleted, " (在回收站中)", ""))
 }
 
 // MIME types were copied from
@@ -184,6 +184,9 @@ const BackupButtonsArea = cc("div", {
   children: [m(BackupBtnAlert).addClass("mb-2")],
 });
 
+// 将要删除的檔案超过安全上限时, 后端拒绝同步, 需要再次点击按钮确认.
+let confirmSync = false;
+
 BackupButtonsArea.appendBackupButton = (bkProjRoot) => {
   BackupButtonsArea.elem().append(
     m(BackupButton).on("click", (event) => {
@@ -192,7 +195,15 @@ BackupButtonsArea.appendBackupButton = (bkProjRoot) => {
       axiosPost({
         url: "/api/sync-backup",
         alert: BackupBtnAlert,
-        body: { text: bkProjRoot },
+        body: { text: bkProjRoot, confirm: confirmSync },
+        data2str: (data) => {
+          if (data.errType == "ErrSyncNeedConfirm") {
+            confirmSync = true;
+            BackupButton.elem().text("Confirm Backup");
+            return `${data.preview.confirm_reason}, 如確定要同步, 請再次點擊按鈕.`;
+          }
+          return errorData_toString(data);
+        },
         onSuccess: () => {
           BackupButton.hide();
           BackupBtnAlert.insert("success", "備份完成!");
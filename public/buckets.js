@@ -52,6 +52,7 @@ function BucketItem(bucket) {
 
   let bucketName = bucket.name;
   if (bucket.encrypted) bucketName = "🔒" + bucketName;
+  if (bucket.sealed) bucketName += " (sealed)";
 
   let filesCount = `${bucket.FilesCount} files`;
   if (bucket.FilesCount <= 1) {
@@ -103,6 +104,16 @@ function BucketItem(bucket) {
                 text: "edit",
               }).addClass(`btn btn-sm ${btnColor} HideIfBackup me-2`),
 
+              MJBS.createLinkElem("#", {
+                text: bucket.Locked ? "unlock" : "lock",
+              })
+                .addClass(`btn btn-sm ${btnColor} me-2`)
+                .toggle(bucket.HasPassword)
+                .on("click", (event) => {
+                  event.preventDefault();
+                  toggleBucketLock(bucket, ItemAlert);
+                }),
+
               MJBS.createLinkElem("#", { text: "del" })
                 .addClass(`btn btn-sm ${btnColor} DelBtn HideIfBackup`)
                 .attr({ title: "delete" })
@@ -179,6 +190,26 @@ function getBuckets() {
   });
 }
 
+// 解鎖或鎖上設有專用密碼的倉庫, 成功後刷新頁面.
+function toggleBucketLock(bucket, alert) {
+  let url = "/api/lock-bucket";
+  let body = { id: bucket.id };
+  if (bucket.Locked) {
+    const password = window.prompt("倉庫密碼 (bucket password)");
+    if (!password) return;
+    url = "/api/unlock-bucket";
+    body.password = password;
+  }
+  axiosPost({
+    url: url,
+    alert: alert,
+    body: body,
+    onSuccess: () => {
+      window.location.reload();
+    },
+  });
+}
+
 function initProjectInfo() {
   axiosGet({
     url: "/api/project-status",
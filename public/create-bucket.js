@@ -18,6 +18,8 @@ const PageAlert = MJBS.createAlert();
 
 const BucketNameInput = MJBS.createInput("text", "required");
 const BucketEncryptBox = MJBS.createInput("checkbox");
+const BucketPasswordInput = MJBS.createInput("password");
+const BucketSealedBox = MJBS.createInput("checkbox");
 const CreateBucketBtn = MJBS.createButton("Create");
 
 const CreateBucketForm = cc("form", {
@@ -29,11 +31,23 @@ const CreateBucketForm = cc("form", {
       "倉庫資料夾名稱, 只能使用 0-9, a-z, A-Z, _(下劃線), -(連字號), .(點)"
     ),
     MJBS.createFormCheck(BucketEncryptBox, "Secret Bucket", "設為加密倉庫"),
+    MJBS.createFormControl(
+      BucketPasswordInput,
+      "Bucket Password",
+      "倉庫專用密碼 (可留空), 只對加密倉庫有效. 設有密碼的倉庫, 登入後還需要輸入該密碼才能解鎖."
+    ),
+    MJBS.createFormCheck(
+      BucketSealedBox,
+      "Sealed Bucket",
+      "密封倉庫 (只對加密倉庫有效): 檔案名稱, 備註, 關鍵詞也會被加密"
+    ),
     MJBS.hiddenButtonElem(),
     m(CreateBucketBtn).on("click", (event) => {
       event.preventDefault();
       const bucketName = BucketNameInput.val();
       const encrypted = BucketEncryptBox.isChecked();
+      const password = encrypted ? BucketPasswordInput.val() : "";
+      const sealed = encrypted && BucketSealedBox.isChecked();
       if (!bucketName) {
         PageAlert.insert("warning", "請填寫 Bucket Name");
         return;
@@ -44,6 +58,8 @@ const CreateBucketForm = cc("form", {
         body: {
           name: bucketName,
           encrypted: encrypted,
+          password: password,
+          sealed: sealed,
         },
         alert: PageAlert,
         onSuccess: (resp) => {
@@ -118,7 +118,7 @@ const EditFileForm = cc("form", {
     m(MoveToBucketGroup),
     MJBS.createFormControl(NameInput, "File Name"),
     MJBS.createFormControl(NotesInput, "Notes", "關於該檔案的簡單描述"),
-    MJBS.createFormControl(KeywordsInput, "Keywords", "關鍵詞, 用於輔助搜尋."),
+    MJBS.createFormControl(KeywordsInput, "Keywords", "標籤, 以逗號分隔, 例如: travel, 2023"),
     MJBS.createFormControl(SizeInput, "Size"),
     MJBS.createFormControl(
       LikeInput,
@@ -247,7 +247,7 @@ function initFileFormButtons(fileID) {
       MJBS.disable(delBtnID);
       FileFormButtonsAlert.clear().insert(
         "warning",
-        "等待 3 秒, 點擊紅色的 DELETE 按鈕刪除檔案 (注意, 一旦刪除, 不可恢復!)."
+        "等待 3 秒, 點擊紅色的 DELETE 按鈕刪除檔案 (檔案會移到回收站, 可以恢復)."
       );
       setTimeout(() => {
         MJBS.enable(delBtnID);
@@ -268,7 +268,7 @@ function initFileFormButtons(fileID) {
         onSuccess: () => {
           $("#F-" + fileID).hide();
           EditFileForm.hide();
-          FileInfoPageAlert.clear().insert("success", "該檔案已被刪除");
+          FileInfoPageAlert.clear().insert("success", "該檔案已移到回收站");
         },
         onAlways: () => {
           MJBS.enable(FileFormButtonsArea);
@@ -518,3 +518,23 @@ const MoreFilesForm = cc("form", {
 const MoreBtnArea = cc("div", {
   children: [m(MoreBtnAlert), m(MoreFilesForm)],
 });
+
+// 分頁: 點擊 More 時, 如果日期沒有被修改, 就用上一頁返回的 cursor 獲取下一頁;
+// 如果修改了日期, 則列出早於該日期的檔案.
+const MorePage = { cursor: "", utime: "" };
+
+// page: FilesPage
+function setMorePage(page) {
+  const files = page.files;
+  MorePage.cursor = page.next_cursor;
+  MorePage.utime = files[files.length - 1].utime.substr(0, 19);
+  MoreFilesDateInput.setVal(MorePage.utime);
+}
+
+function morePageBody() {
+  const utime = MoreFilesDateInput.val();
+  if (utime == MorePage.utime) {
+    return { cursor: MorePage.cursor, utime: "" };
+  }
+  return { cursor: "", utime: utime };
+}
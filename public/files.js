@@ -2,7 +2,9 @@ $("title").text("Files (檔案清單) - Local Buckets");
 
 const BucketID = getUrlParam("bucket");
 const BucketName = getUrlParam("bucketname");
+const Tag = getUrlParam("tag");
 const SortBy = getUrlParam("sort");
+const Order = getUrlParam("order");
 
 const SearchInput = MJBS.createInput("search", "required");
 const SearchBtn = MJBS.createButton("search", "primary", "submit");
@@ -176,7 +178,7 @@ function FileItem(file) {
           MJBS.disable(delBtnID);
           ItemAlert.insert(
             "warning",
-            "等待 3 秒, 點擊紅色的 DELETE 按鈕刪除檔案 (注意, 一旦刪除, 不可恢復!)."
+            "等待 3 秒, 點擊紅色的 DELETE 按鈕刪除檔案 (檔案會移到回收站, 可以恢復)."
           );
           setTimeout(() => {
             $(delBtnID).hide();
@@ -196,7 +198,7 @@ function FileItem(file) {
             body: { id: file.id },
             onSuccess: () => {
               $(fileInfoButtons).hide();
-              ItemAlert.clear().insert("success", "該檔案已被刪除");
+              ItemAlert.clear().insert("success", "該檔案已移到回收站");
             },
             onAlways: () => {
               MJBS.enable(fileInfoButtons);
@@ -260,6 +262,9 @@ function FileItem(file) {
         m("div").append(span(`[${file.keywords}]`).addClass("text-muted"))
       );
     }
+    if (file.snippet) {
+      rowOne.append(m("div").append(SnippetElem(file.snippet)));
+    }
 
     if (canBePreviewed(file.type)) {
       const css = PageConfig.projectInfo.markdown_style;
@@ -278,6 +283,20 @@ function FileItem(file) {
   return self;
 }
 
+// 搜尋結果的摘要, 匹配的文字前後分別有 \x02 和 \x03 標記.
+function SnippetElem(snippet) {
+  const elem = m("span").addClass("text-muted small");
+  snippet.split("\x02").forEach((part, i) => {
+    if (i == 0) {
+      elem.append(document.createTextNode(part));
+      return;
+    }
+    const [matched, rest] = part.split("\x03");
+    elem.append(m("mark").text(matched), document.createTextNode(rest || ""));
+  });
+  return elem;
+}
+
 $("#root")
   .css(RootCss)
   .append(
@@ -340,14 +359,22 @@ function initNavButtons(bucketID, bucketName) {
 function getFilesLimit(bucketID, bucketName) {
   axiosPost({
     url: "/api/files",
-    body: { id: parseInt(bucketID), name: bucketName, sort: SortBy, utime: "" },
+    body: {
+      id: parseInt(bucketID),
+      name: bucketName,
+      sort: SortBy,
+      order: Order,
+      utime: "",
+      tag: Tag,
+    },
     alert: PageAlert,
     onSuccess: (resp) => {
-      const files = resp.data;
+      const files = resp.data.files;
       if (files && files.length > 0) {
-        const lastUTime = files[files.length - 1].utime.substr(0, 19);
-        MoreBtnArea.show();
-        MoreFilesDateInput.setVal(lastUTime);
+        if (resp.data.has_more) {
+          setMorePage(resp.data);
+          MoreBtnArea.show();
+        }
         MJBS.appendToList(FileList, files.map(FileItem));
         initBackupProject(PageConfig.projectInfo, PageAlert);
       } else {
@@ -371,15 +398,18 @@ function getMoreFiles() {
       id: parseInt(BucketID),
       name: BucketName,
       sort: SortBy,
-      utime: MoreFilesDateInput.val(),
+      order: Order,
+      tag: Tag,
+      ...morePageBody(),
     },
     alert: MoreBtnAlert,
     onSuccess: (resp) => {
-      const files = resp.data;
+      const files = resp.data.files;
       if (files && files.length > 0) {
-        const lastUTime = files[files.length - 1].utime.substr(0, 19);
-        MoreFilesDateInput.setVal(lastUTime);
         MJBS.appendToList(FileList, files.map(FileItem));
+      }
+      if (resp.data.has_more) {
+        setMorePage(resp.data);
       } else {
         MoreBtnAlert.insert("warning", "沒有更多檔案了.");
         MoreFilesForm.hide();
@@ -435,6 +465,70 @@ function canBePreviewed(fileType) {
   );
 }
 
+// 重新提取檔案內容的文字 (用於搜尋), 在瀏覽器的 console 中使用, 例如 reindexText(1, 100)
+function reindexText(start, end) {
+  axiosPost({
+    url: "/api/reindex-text",
+    alert: PageAlert,
+    body: { start: start, end: end },
+    onSuccess: () => {
+      console.log("Success!");
+    },
+  });
+}
+
+// 以下是舊版本相關的函數, 在瀏覽器的 console 中使用.
+
+// 列出一個檔案的全部舊版本, 例如 getVersions(12)
+function getVersions(fileID) {
+  axiosPost({
+    url: "/api/file-versions",
+    alert: PageAlert,
+    body: { id: fileID },
+    onSuccess: (resp) => {
+      console.table(resp.data);
+    },
+  });
+}
+
+// 把舊版本下載到 waiting 資料夾, 參數是版本 ID (不是檔案 ID).
+// 預覽舊版本則直接訪問 /file-version/版本ID
+function downloadVersion(versionID) {
+  axiosPost({
+    url: "/api/download-version",
+    alert: PageAlert,
+    body: { id: versionID },
+    onSuccess: () => {
+      console.log(`成功下載到 waiting 資料夾 ${PageConfig.waitingFolder}`);
+    },
+  });
+}
+
+// 把舊版本恢復為當前內容, 參數是版本 ID (不是檔案 ID).
+function restoreVersion(versionID) {
+  axiosPost({
+    url: "/api/restore-version",
+    alert: PageAlert,
+    body: { id: versionID },
+    onSuccess: () => {
+      console.log("Success!");
+    },
+  });
+}
+
+// 刪除舊版本, 例如 pruneVersions(0, 5, 90) 表示每個檔案只保留最新的 5 個版本,
+// 並刪除 90 日前的版本. fileID 為 0 表示全部檔案, keep 或 days 為 0 表示不按該條件刪除.
+function pruneVersions(fileID, keep, days) {
+  axiosPost({
+    url: "/api/prune-versions",
+    alert: PageAlert,
+    body: { file_id: fileID, keep: keep, days: days },
+    onSuccess: (resp) => {
+      console.log(`已刪除 ${resp.data} 個舊版本`);
+    },
+  });
+}
+
 function showMoreButtons() {
   $(".FileInfoSamllBtn").show();
 }
@@ -27,14 +27,18 @@ const PageLoading = MJBS.createLoading(null, "large");
 
 const KeywordsList = cc("ul");
 
-function KeywordsItem(kw, i) {
-  const link = MJBS.createLinkElem(
-    "/files.html?search=" + encodeURIComponent(kw),
-    { text: kw }
-  ).addClass("text-reset text-decoration-none");
+// tag: { name, count, buckets: [{bucket_name, count}] }
+function KeywordsItem(tag, i) {
+  const link = MJBS.createLinkElem("/files.html?tag=" + encodeURIComponent(tag.name), {
+    text: tag.name,
+  }).addClass("text-reset text-decoration-none");
+  const buckets = tag.buckets.map((b) => `${b.bucket_name}: ${b.count}`).join(", ");
   return cc("li", {
     id: "Keywords-" + i,
-    children: [link],
+    children: [
+      link,
+      span(` (${tag.count})`).addClass("text-muted").attr({ title: buckets }),
+    ],
   });
 }
 
@@ -54,25 +58,31 @@ function init() {
   initFilesLimit();
 }
 
-function keywordsToItems(kwList) {
-  const allKeywords = [];
-  for (let i = 0; i < kwList.length; i++) {
-    if (kwList[i] == "") continue;
-    allKeywords.push(KeywordsItem(kwList[i], i));
+// 把 TagCount[] (每個標籤在每個倉庫中的數量) 按標籤名稱合併.
+function keywordsToItems(tagCounts) {
+  const tags = [];
+  for (const tc of tagCounts || []) {
+    let tag = tags[tags.length - 1];
+    if (!tag || tag.name.toLowerCase() != tc.name.toLowerCase()) {
+      tag = { name: tc.name, count: 0, buckets: [] };
+      tags.push(tag);
+    }
+    tag.count += tc.count;
+    tag.buckets.push(tc);
   }
-  return allKeywords;
+  return tags.map(KeywordsItem);
 }
 
 function initFilesLimit() {
   axiosGet({
-    url: "/api/auto-get-keywords",
+    url: "/api/tags",
     alert: PageAlert,
     onSuccess: (resp) => {
       const items = keywordsToItems(resp.data);
       if (items.length > 0) {
         MJBS.appendToList(KeywordsList, items);
       } else {
-        PageAlert.insert("warning", "未找到任何關鍵詞.");
+        PageAlert.insert("warning", "未找到任何標籤.");
       }
     },
     onAlways: () => {
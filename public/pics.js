@@ -2,6 +2,7 @@ $("title").text("Pics (圖片清單) - Local Buckets");
 
 const BucketID = getUrlParam("bucket");
 const BucketName = getUrlParam("bucketname");
+const Tag = getUrlParam("tag");
 
 const SearchInput = MJBS.createInput("search", "required");
 const SearchBtn = MJBS.createButton("search", "primary", "submit");
@@ -113,7 +114,8 @@ function FileItem(file) {
   });
 
   self.init = () => {
-    axios.get(`/thumbs/${file.id}`).then((resp) => {
+    const thumbsFolder = file.encrypted ? "secret-thumbs" : "thumbs";
+    axios.get(`/${thumbsFolder}/${file.id}`).then((resp) => {
       $(thumbID).attr({ src: resp.data });
     });
   };
@@ -173,14 +175,15 @@ function getPicsLimit(bucketID, bucketName) {
 
   axiosPost({
     url: "/api/pics",
-    body: { id: bucketID, name: bucketName },
+    body: { id: bucketID, name: bucketName, tag: Tag },
     alert: PageAlert,
     onSuccess: (resp) => {
-      const files = resp.data;
+      const files = resp.data.files;
       if (files && files.length > 0) {
-        const lastUTime = files[files.length - 1].utime.substr(0, 19);
-        MoreBtnArea.show();
-        MoreFilesDateInput.setVal(lastUTime);
+        if (resp.data.has_more) {
+          setMorePage(resp.data);
+          MoreBtnArea.show();
+        }
         MJBS.appendToList(FileList, files.map(FileItem));
       } else {
         const errMsg = bucketID
@@ -202,15 +205,17 @@ function getMoreFiles() {
     body: {
       id: parseInt(BucketID),
       name: BucketName,
-      utime: MoreFilesDateInput.val(),
+      tag: Tag,
+      ...morePageBody(),
     },
     alert: MoreBtnAlert,
     onSuccess: (resp) => {
-      const files = resp.data;
+      const files = resp.data.files;
       if (files && files.length > 0) {
-        const lastUTime = files[files.length - 1].utime.substr(0, 19);
-        MoreFilesDateInput.setVal(lastUTime);
         MJBS.appendToList(FileList, files.map(FileItem));
+      }
+      if (resp.data.has_more) {
+        setMorePage(resp.data);
       } else {
         MoreBtnAlert.insert("warning", "沒有更多圖片了.");
         MoreFilesForm.hide();
@@ -0,0 +1,168 @@
+$("title").text("Trash (回收站) - Local Buckets");
+
+const navBar = m("div")
+  .addClass("row")
+  .append(
+    m("div")
+      .addClass("col text-start")
+      .append(
+        MJBS.createLinkElem("index.html", { text: "Home" }),
+        span(" .. Trash (回收站)")
+      ),
+    m("div")
+      .addClass("col text-end")
+      .append(
+        MJBS.createLinkElem("/files.html", { text: "Files" }),
+        " | ",
+        MJBS.createLinkElem("/buckets.html", { text: "Buckets" })
+      )
+  );
+
+const PageConfig = {};
+
+const PageAlert = MJBS.createAlert();
+const PageLoading = MJBS.createLoading(null, "large");
+
+const FileList = cc("div");
+
+const EmptyTrashAlert = MJBS.createAlert();
+const EmptyTrashBtn = MJBS.createButton("Empty Trash", "secondary");
+const DangerEmptyTrashBtn = MJBS.createButton("EMPTY TRASH", "danger");
+const EmptyTrashArea = cc("div", {
+  classes: "text-center HideIfBackup",
+  children: [
+    m(EmptyTrashAlert),
+    m(EmptyTrashBtn).on("click", (event) => {
+      event.preventDefault();
+      MJBS.disable(EmptyTrashBtn);
+      EmptyTrashAlert.insert(
+        "warning",
+        "等待 3 秒, 點擊紅色的 EMPTY TRASH 按鈕清空回收站 (注意, 一旦清空, 不可恢復!)."
+      );
+      setTimeout(() => {
+        EmptyTrashBtn.hide();
+        DangerEmptyTrashBtn.show();
+      }, 2000);
+    }),
+    m(DangerEmptyTrashBtn)
+      .hide()
+      .on("click", (event) => {
+        event.preventDefault();
+        MJBS.disable(DangerEmptyTrashBtn);
+        axiosPost({
+          url: "/api/empty-trash",
+          alert: EmptyTrashAlert,
+          onSuccess: (resp) => {
+            FileList.elem().html("");
+            DangerEmptyTrashBtn.hide();
+            EmptyTrashAlert.clear().insert(
+              "success",
+              `已徹底刪除 ${resp.data} 個檔案`
+            );
+          },
+        });
+      }),
+  ],
+});
+
+function FileItem(file) {
+  const fileItemID = "F-" + file.id;
+  const ItemAlert = MJBS.createAlert(`${fileItemID}-alert`);
+
+  let bucketName = file.bucket_name;
+  if (file.encrypted) bucketName = "🔒" + bucketName;
+
+  const deletedAt = file.deleted_at ? file.deleted_at.substr(0, 10) : "";
+
+  const self = cc("div", {
+    id: fileItemID,
+    classes: "card mb-4",
+    children: [
+      m("div")
+        .addClass("card-header")
+        .append(span(bucketName + "/").addClass("fw-bold"), span(file.name)),
+      m("div")
+        .addClass("card-body")
+        .append(
+          m("div")
+            .addClass("text-end")
+            .append(
+              span(`(${fileSizeToString(file.size)})`).addClass("me-1"),
+              span("deleted: " + deletedAt)
+                .attr({ title: file.deleted_at })
+                .addClass("me-1"),
+              MJBS.createLinkElem("#", { text: "restore" })
+                .addClass("btn btn-sm btn-light text-muted HideIfBackup")
+                .on("click", (event) => {
+                  event.preventDefault();
+                  event.currentTarget.style.pointerEvents = "none";
+                  axiosPost({
+                    url: "/api/restore-file",
+                    alert: ItemAlert,
+                    body: { id: file.id },
+                    onSuccess: () => {
+                      self.elem().find(".card-body .text-end").hide();
+                      ItemAlert.clear().insert("success", "該檔案已恢復");
+                    },
+                    onAlways: () => {
+                      event.currentTarget.style.pointerEvents = "auto";
+                    },
+                  });
+                })
+            ),
+          m(ItemAlert)
+        ),
+    ],
+  });
+  return self;
+}
+
+$("#root")
+  .css(RootCss)
+  .append(
+    navBar.addClass("mt-3 mb-5"),
+    m(PageLoading).addClass("my-5"),
+    m(PageAlert).addClass("my-3"),
+    m(FileList).addClass("my-3"),
+    m(EmptyTrashArea).addClass("my-5").hide(),
+    bottomDot
+  );
+
+init();
+
+async function init() {
+  PageConfig.projectInfo = await getProjectInfo();
+  getTrashFiles();
+}
+
+function getTrashFiles() {
+  axiosGet({
+    url: "/api/trash",
+    alert: PageAlert,
+    onSuccess: (resp) => {
+      const files = resp.data;
+      if (files && files.length > 0) {
+        MJBS.appendToList(FileList, files.map(FileItem));
+        EmptyTrashArea.show();
+        initBackupProject(PageConfig.projectInfo, PageAlert);
+      } else {
+        PageAlert.insert("warning", "回收站是空的");
+      }
+    },
+    onAlways: () => {
+      PageLoading.hide();
+    },
+  });
+}
+
+function getProjectInfo() {
+  return new Promise((resolve) => {
+    axiosGet({
+      url: "/api/project-status",
+      alert: PageAlert,
+      onSuccess: (resp) => {
+        resolve(resp.data);
+      },
+    });
+  });
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// 主專案的硬碟損壞後, 可以在備份專案中執行恢復, 把備份專案恢復為主專案:
+//   - 就地升級 (promote): 把本備份專案直接改為主專案.
+//   - 複製: 把本備份專案複製到一個空資料夾作為新的主專案, 本備份專案保持不變,
+//     並成為新主專案的備份專案.
+//
+// 兩者都會先校驗全部檔案 (包括舊版本) 的 checksum, 有任何受損檔案都拒絕執行.
+// 完成後重新登記其他備份專案, 並清除它們的同步記錄 (新主專案的 change_log 序號
+// 與原來的主專案無關), 使下次同步時全量對比.
+
+var errRestoreDamaged = errors.New("備份專案中有受損檔案, 請先修復")
+
+// restoreProject 把本備份專案恢復為主專案. c 為 nil 表示通過命令行執行.
+func restoreProject(c *fiber.Ctx, form *model.RestoreForm) (*model.RestoreResult, error) {
+	if !ProjectConfig.IsBackup {
+		return nil, fmt.Errorf("這不是備份專案")
+	}
+	journals, err := db.GetJournals()
+	if err != nil {
+		return nil, err
+	}
+	if len(journals) > 0 {
+		return nil, fmt.Errorf("有 %d 個未處理完的操作日誌, 請先處理", len(journals))
+	}
+	result := &model.RestoreResult{Skipped: make(map[string]string)}
+	if err := verifyAllChecksums(result); err != nil {
+		return result, err
+	}
+	if len(result.Damaged) > 0 {
+		return result, errRestoreDamaged
+	}
+	backups := lo.Ternary(len(form.Backups) > 0, form.Backups, ProjectConfig.BackupProjects)
+	if form.Target == "" {
+		return result, promoteProject(c, backups, result)
+	}
+	return result, copyProjectTo(c, form.Target, backups, result)
+}
+
+// verifyAllChecksums 校驗本專案的全部檔案及舊版本, 受損的檔案會被標記 (見 checkFile).
+func verifyAllChecksums(result *model.RestoreResult) error {
+	files, err := db.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		damaged, err := checkFile(ProjectRoot, file, db)
+		if errors.Is(err, fs.ErrNotExist) {
+			damaged, err = true, nil
+		}
+		if err != nil {
+			return err
+		}
+		result.Checked++
+		if damaged {
+			result.Damaged = append(result.Damaged, relProjectPath(projectFilePath(ProjectRoot, file)))
+		}
+	}
+	versions, err := db.GetAllFileVersions()
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		path := versionFilePath(v.ID)
+		sum, err := util.FileSum512(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		result.Checked++
+		if sum != v.Checksum {
+			result.Damaged = append(result.Damaged, relProjectPath(path))
+		}
+	}
+	return nil
+}
+
+func relProjectPath(path string) string {
+	rel, err := filepath.Rel(ProjectRoot, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// promoteProject 把本備份專案就地升級為主專案.
+func promoteProject(c *fiber.Ctx, backups []string, result *model.RestoreResult) error {
+	if err := db.DeleteSyncState(); err != nil {
+		return err
+	}
+	cfg := *ProjectConfig
+	cfg.IsBackup = false
+	cfg.LastBackupAt = ""
+	cfg.BackupProjects = registerBackups(ProjectRoot, backups, result)
+	if err := util.WriteTOML(cfg, ProjectConfigPath); err != nil {
+		return err
+	}
+	*ProjectConfig = cfg
+	db.IsBackup = false
+	result.Root = ProjectRoot
+	return logEvent(c, model.EventRestoreProject, 0, 0, nil, restoreEventData("promote", result))
+}
+
+// copyProjectTo 把本備份專案複製到空資料夾 target 作為新的主專案.
+// 不複製快照 (snapshots), 本備份專案的快照仍然保留在本備份專案中.
+func copyProjectTo(c *fiber.Ctx, target string, backups []string, result *model.RestoreResult) error {
+	if util.PathNotExists(target) {
+		return fmt.Errorf("not found: %s", target)
+	}
+	notEmpty, err := util.DirIsNotEmpty(target)
+	if err != nil {
+		return err
+	}
+	if notEmpty {
+		return fmt.Errorf("不是空資料夾: %s", target)
+	}
+
+	newDBPath := filepath.Join(target, DatabaseFileName)
+	if err := db.Exec(stmt.BackupDatabase, newDBPath); err != nil {
+		return err
+	}
+	for _, name := range []string{BucketsFolderName, TrashFolderName, VersionsFolderName} {
+		if err := copyTree(filepath.Join(ProjectRoot, name), filepath.Join(target, name), true); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{PublicFolderName, SecretThumbsFolderName} {
+		if err := copyTree(filepath.Join(ProjectRoot, name), filepath.Join(target, name), false); err != nil {
+			return err
+		}
+	}
+	if err := syncExeFile(target); err != nil {
+		return err
+	}
+
+	cfg := *ProjectConfig
+	cfg.IsBackup = false
+	cfg.LastBackupAt = ""
+	newDB, err := database.OpenDB(newDBPath, &cfg)
+	if err != nil {
+		return err
+	}
+	defer newDB.DB.Close()
+	if err := newDB.DeleteSyncState(); err != nil {
+		return err
+	}
+
+	// 本備份專案成為新主專案的第一個備份專案.
+	backups = append([]string{ProjectRoot}, backups...)
+	cfg.BackupProjects = registerBackups(target, backups, result)
+	if err := util.WriteTOML(cfg, filepath.Join(target, ProjectTOML)); err != nil {
+		return err
+	}
+	result.Root = target
+	return logEventTo(newDB, c, model.EventRestoreProject, 0, 0, nil, restoreEventData("copy", result))
+}
+
+func restoreEventData(mode string, result *model.RestoreResult) map[string]any {
+	return map[string]any{
+		"mode":       mode,
+		"source":     ProjectRoot,
+		"root":       result.Root,
+		"checked":    result.Checked,
+		"registered": result.Registered,
+	}
+}
+
+// registerBackups 檢查並返回可以重新登記的備份專案, 不能登記的原因記錄在 result.Skipped 中.
+// 新主專案 newRoot 自身會被忽略.
+func registerBackups(newRoot string, backups []string, result *model.RestoreResult) (registered []string) {
+	for _, root := range lo.Uniq(backups) {
+		if same, err := util.SamePath(root, newRoot); err == nil && same {
+			continue
+		}
+		if err := registerBackup(root); err != nil {
+			result.Skipped[root] = err.Error()
+			continue
+		}
+		registered = append(registered, root)
+	}
+	result.Registered = registered
+	return
+}
+
+// registerBackup 確認 root 是同一個專案的備份專案, 然後清除其同步記錄.
+func registerBackup(root string) error {
+	if util.PathNotExists(root) {
+		return fmt.Errorf("not found: %s", root)
+	}
+	bk, _, err := getDatabaseFrom(root)
+	if err != nil {
+		return err
+	}
+	if bk != db {
+		defer bk.DB.Close()
+	}
+	bkCfg, err := readProjCfgFrom(filepath.Join(root, ProjectTOML))
+	if err != nil {
+		return err
+	}
+	if !bkCfg.IsBackup {
+		return fmt.Errorf("不是備份專案")
+	}
+	if bkCfg.CipherKey != ProjectConfig.CipherKey {
+		return fmt.Errorf("不是同一個專案的備份 (密鑰不一致)")
+	}
+	v1, err1 := db.SchemaVersion()
+	v2, err2 := bk.SchemaVersion()
+	if err := util.WrapErrors(err1, err2); err != nil {
+		return err
+	}
+	if v1 != v2 {
+		return fmt.Errorf("數據庫版本不一致: %d, %d", v1, v2)
+	}
+	return bk.DeleteSyncState()
+}
+
+// copyTree 把 src 資料夾 (包括子資料夾) 複製到 dst, lock 表示把檔案設為只讀.
+func copyTree(src, dst string, lock bool) error {
+	if util.PathNotExists(src) {
+		return nil
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return util.MkdirIfNotExists(target)
+		}
+		if lock {
+			return util.CopyAndLockFile(target, path)
+		}
+		return util.CopyFile(target, path)
+	})
+}
+
+func restoreProjectHandler(c *fiber.Ctx) error {
+	form := new(model.RestoreForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	result, err := restoreProject(c, form)
+	if errors.Is(err, errRestoreDamaged) {
+		return c.Status(409).JSON(result)
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(result)
+}
+
+// runRestoreCLI 通過命令行把本備份專案恢復為主專案, backups 以逗號分隔,
+// 結果以 JSON 格式輸出到 stdout.
+func runRestoreCLI(target, backups string) error {
+	form := &model.RestoreForm{Target: target}
+	for _, root := range strings.Split(backups, ",") {
+		if root = strings.TrimSpace(root); root != "" {
+			form.Backups = append(form.Backups, root)
+		}
+	}
+	result, err := restoreProject(nil, form)
+	if result != nil {
+		data, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+// rotateDataKeyHandler 更换真正的密钥以及各个加密仓库的密钥, 并用新密钥重新加密全部加密文档.
+// 如果中途出错或程序中断, 再次执行即可从中断处继续.
+// 需要再次输入密码, 设有专用密码的仓库也要提供仓库密码, 因为新密钥要用同一个密码加密.
+func rotateDataKeyHandler(c *fiber.Ctx) error {
+	form := new(model.RotateDataKeyForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	if err := rotateDataKey(form); err != nil {
+		return err
+	}
+	return logEvent(c, model.EventRotateDataKey, 0, 0, nil, nil)
+}
+
+func rotateDataKey(form *model.RotateDataKeyForm) error {
+	rotation, err := db.StartKeyRotation(form.Password, form.BucketPasswords)
+	if err != nil {
+		return err
+	}
+	if err := rotateAllFiles(rotation); err != nil {
+		return err
+	}
+	if err := rotateSecretThumbs(); err != nil {
+		return err
+	}
+	if err := db.RotateFileTexts(); err != nil {
+		return err
+	}
+	// 全部文档都已用新密钥加密后, 才替换仓库密钥, 然后把新密钥写入 project.toml, 最后删除进度记录.
+	// 如果在这几步之间中断, 再次执行时全部文档都已是新密钥, 会直接完成.
+	if err := db.ApplyBucketKeyRotation(); err != nil {
+		return err
+	}
+	ProjectConfig.CipherKey = rotation.CipherKey
+	if err := writeProjectConfig(); err != nil {
+		return err
+	}
+	return db.FinishKeyRotation(rotation)
+}
+
+func rotateAllFiles(rotation *database.KeyRotation) error {
+	files, err := db.GetEncryptedFiles(rotation.LastFileID)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := recoverRotationTemp(file); err != nil {
+			return err
+		}
+		filePath := filePathIn(BucketsFolder, file)
+		needsRotation, err := db.NeedsRotation(file.BucketName, filePath)
+		if err != nil {
+			return fmt.Errorf("%s: %w (請先修復受損檔案)", file.Name, err)
+		}
+		if needsRotation {
+			err = reEncryptFile(file)
+		} else {
+			err = syncFileChecksum(file)
+		}
+		if err != nil {
+			return err
+		}
+		if err := rotateFileVersions(file); err != nil {
+			return err
+		}
+		if err := db.RotateSealedInfo(file); err != nil {
+			return err
+		}
+		if err := db.UpdateKeyRotation(rotation, file.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateFileVersions 用新密钥重新加密一个文档的全部旧版本.
+func rotateFileVersions(file *File) error {
+	versions, err := db.GetFileVersions(file.ID)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		versionPath := versionFilePath(v.ID)
+		needsRotation, err := db.NeedsRotation(file.BucketName, versionPath)
+		if err != nil {
+			return fmt.Errorf("%s (version %d): %w", file.Name, v.ID, err)
+		}
+		if !needsRotation {
+			continue
+		}
+		tempPath := filepath.Join(TempFolder, "version-"+strconv.FormatInt(v.ID, 10))
+		err = db.ReEncryptFile(
+			file.BucketName, file.BucketName, versionPath, tempPath, util.ReadonlyFilePerm)
+		if err != nil {
+			return err
+		}
+		if err := replaceVersion(v, tempPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFileChecksum 用于已经用新密钥加密, 但数据库中的 checksum 可能未更新的文档
+// (程序在重新加密与更新数据库之间中断).
+func syncFileChecksum(file *File) error {
+	filePath := filePathIn(BucketsFolder, file)
+	checksum, err := util.FileSum512(filePath)
+	if err != nil || checksum == file.Checksum {
+		return err
+	}
+	file.Checksum = checksum
+	return db.UpdateChecksum(file.ID, checksum)
+}
+
+// recoverRotationTemp 处理 reEncryptFile 中断时留在 TempFolder 中的旧文档.
+// 只有当临时文档的 checksum 与数据库一致时, 才说明它是尚未完成更换密钥的原文档,
+// 此时仓库中的同名文档 (如果有) 是未完成的新文档, 应删除, 然后把原文档移回仓库.
+func recoverRotationTemp(file *File) error {
+	tempFile := MovedFile{
+		Src: filePathIn(BucketsFolder, file),
+		Dst: filepath.Join(TempFolder, file.Name),
+	}
+	if util.PathNotExists(tempFile.Dst) {
+		return nil
+	}
+	tempSum, err := util.FileSum512(tempFile.Dst)
+	if err != nil {
+		return err
+	}
+	if tempSum != file.Checksum {
+		// 新文档已写入数据库, 临时文档只是未来得及删除.
+		if util.PathExists(tempFile.Src) {
+			return os.Remove(tempFile.Dst)
+		}
+		return nil
+	}
+	if util.PathExists(tempFile.Src) {
+		if err := os.Remove(tempFile.Src); err != nil {
+			return err
+		}
+	}
+	return tempFile.Rollback()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+// 更換密鑰時, 在移走舊檔案之後, 記錄 Target 之前中斷, 應回滾: 刪除新檔案, 舊的密文移回原位.
+func TestRecoverRotationBeforeTarget(t *testing.T) {
+	tests := []struct {
+		name  string
+		crash func(t *testing.T, tempFile MovedFile)
+	}{
+		{"partial", func(t *testing.T, tempFile MovedFile) {
+			// 重新加密到一半: 新檔案只寫入了一部分.
+			if err := os.WriteFile(tempFile.Src, []byte("truncated"), util.NormalFilePerm); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"encrypted", func(t *testing.T, tempFile MovedFile) {
+			// 重新加密已完成, 但未來得及記錄 Target.
+			err := db.ReEncryptFile(testBucket, testBucket,
+				tempFile.Dst, tempFile.Src, util.ReadonlyFilePerm)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "rotate " + tt.name
+			file := newEncryptedTestFile(t, "rotate-"+tt.name+".txt", content)
+			j, tempFile := reEncryptJournal(&file.File)
+			if err := db.BeginJournal(j); err != nil {
+				t.Fatal(err)
+			}
+			if err := tempFile.Move(); err != nil {
+				t.Fatal(err)
+			}
+			tt.crash(t, tempFile)
+
+			recoverOne(t, "rolled back")
+			assertChecksum(t, tempFile.Src, file.Checksum)
+			if util.PathExists(tempFile.Dst) {
+				t.Fatal("temp file left")
+			}
+			data, err := db.DecryptFile(testBucket, tempFile.Src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != content {
+				t.Fatalf("got %q, want %q", data, content)
+			}
+		})
+	}
+}
+
+// 更換密鑰時, 有自己密鑰的倉庫 (包括設有專用密碼的倉庫及密封倉庫) 也要更換倉庫密鑰,
+// 並重新加密其中的檔案, 舊版本, 檔案內容及密封資訊.
+func TestRotateBucketKeys(t *testing.T) {
+	const bucketPwd = "rotate-pwd"
+	var buckets []*database.Bucket
+	for _, form := range []*model.CreateBucketForm{
+		{Name: "rotate-own", Encrypted: true},
+		{Name: "rotate-pwd", Encrypted: true, Password: bucketPwd},
+		{Name: "rotate-sealed", Encrypted: true, Sealed: true},
+	} {
+		b, err := db.InsertBucket(form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := createBucketFolder(b.Name); err != nil {
+			t.Fatal(err)
+		}
+		buckets = append(buckets, b)
+	}
+	pwdBucket := buckets[1]
+
+	type testFile struct {
+		file    *FilePlus
+		version *FileVersion
+		content string
+	}
+	var files []testFile
+	for _, b := range buckets {
+		content := "content of " + b.Name
+		file := newTestFileIn(t, b.Name, b.Name+".txt", content)
+		filePath := filePathIn(BucketsFolder, &file.File)
+		v := &FileVersion{FileID: file.ID, Checksum: file.Checksum, Size: file.Size,
+			UTime: file.UTime, CTime: model.Now()}
+		if err := db.InsertFileVersion(v); err != nil {
+			t.Fatal(err)
+		}
+		err := db.ReEncryptFile(b.Name, b.Name, filePath, versionFilePath(v.ID), util.ReadonlyFilePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.SaveFileText(file.ID, b.Name, content); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, testFile{file, v, content})
+	}
+
+	// 設有專用密碼的倉庫, 必須提供正確的倉庫密碼.
+	for _, passwords := range []map[int64]string{nil, {pwdBucket.ID: "wrong"}} {
+		form := &model.RotateDataKeyForm{Password: database.DefaultPassword, BucketPasswords: passwords}
+		if err := rotateDataKey(form); err == nil {
+			t.Fatal("want error for missing or wrong bucket password")
+		}
+		if rotation, err := db.GetKeyRotation(); err != nil || rotation != nil {
+			t.Fatalf("rotation started: %v, %v", rotation, err)
+		}
+	}
+	form := &model.RotateDataKeyForm{
+		Password:        database.DefaultPassword,
+		BucketPasswords: map[int64]string{pwdBucket.ID: bucketPwd},
+	}
+	if err := rotateDataKey(form); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新登入, 確認新的密鑰都已保存.
+	db.Logout()
+	if _, err := db.SetAESGCM(database.DefaultPassword); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := db.GetBucketByName(pwdBucket.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UnlockBucket(&rotated, bucketPwd); err != nil {
+		t.Fatal(err)
+	}
+	for i, f := range files {
+		b, err := db.GetBucketByName(buckets[i].Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.CipherKey == buckets[i].CipherKey {
+			t.Fatalf("%s: bucket key not rotated", b.Name)
+		}
+		dbFile, err := db.GetFilePlus(f.file.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dbFile.Checksum == f.file.Checksum {
+			t.Fatalf("%s: file not re-encrypted", b.Name)
+		}
+		assertChecksum(t, filePathIn(BucketsFolder, &dbFile.File), dbFile.Checksum)
+		for _, filePath := range []string{
+			filePathIn(BucketsFolder, &dbFile.File), versionFilePath(f.version.ID),
+		} {
+			data, err := db.DecryptFile(b.Name, filePath)
+			if err != nil {
+				t.Fatalf("%s: %v", filePath, err)
+			}
+			if string(data) != f.content {
+				t.Fatalf("%s: got %q, want %q", filePath, data, f.content)
+			}
+		}
+		text, err := db.GetFileText(f.file.ID, b.Name)
+		if err != nil || text != f.content {
+			t.Fatalf("%s: file text %q, %v", b.Name, text, err)
+		}
+		if b.Sealed {
+			if _, err := db.UnsealFile(&dbFile.File); err != nil {
+				t.Fatal(err)
+			}
+			if dbFile.Name != b.Name+".txt" {
+				t.Fatalf("unsealed name %q", dbFile.Name)
+			}
+		}
+	}
+}
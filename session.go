@@ -0,0 +1,212 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// 管理員登入後, 發給該客戶端一個 session (HttpOnly cookie, 也可以用 Authorization: Bearer 傳送).
+// 每個請求是否有管理員權限, 由該請求攜帶的 session 決定, 而不是由全局的登入狀態決定.
+// 真正的密鑰仍然只在內存中保存一份, 全部 session 都登出或過期後, 會自動從內存中刪除.
+
+const (
+	SessionCookieName = "lb_session"
+
+	DefaultSessionIdleTimeout = 30 // 單位: 分鐘
+	DefaultSessionMaxAge      = 24 // 單位: 小時
+)
+
+type session struct {
+	expiresAt time.Time // 登入時決定, 到期後必須重新登入
+	lastSeen  time.Time // 超過 idle timeout 沒有使用則過期
+}
+
+type sessionStore struct {
+	mu       sync.Mutex
+	secret   []byte // 用於簽名, 每次啟動程式都不同, 因此重啟後須重新登入
+	sessions map[string]*session
+}
+
+var sessions = &sessionStore{
+	secret:   lo.Must(randomBytes(32)),
+	sessions: make(map[string]*session),
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func sessionIdleTimeout() time.Duration {
+	minutes := lo.Ternary(ProjectConfig.SessionIdleTimeout > 0,
+		ProjectConfig.SessionIdleTimeout, DefaultSessionIdleTimeout)
+	return time.Duration(minutes) * time.Minute
+}
+
+func sessionMaxAge() time.Duration {
+	hours := lo.Ternary(ProjectConfig.SessionMaxAge > 0,
+		ProjectConfig.SessionMaxAge, DefaultSessionMaxAge)
+	return time.Duration(hours) * time.Hour
+}
+
+func (store *sessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, store.secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verify 檢查 token 的簽名, 返回 session id.
+func (store *sessionStore) verify(token string) (id string, ok bool) {
+	id, sig, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(store.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// create 執行 login (檢查密碼, 解密密鑰等), 成功後新建一個 session, 返回 token (格式為 id.簽名).
+// login 與新建 session 在同一個鎖內進行, 以免密鑰剛解密就因為沒有 session 而被刪除.
+func (store *sessionStore) create(login func() error) (token string, expiresAt time.Time, err error) {
+	b, err := randomBytes(32)
+	if err != nil {
+		return
+	}
+	id := hex.EncodeToString(b)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err = login(); err != nil {
+		return
+	}
+	now := time.Now()
+	expiresAt = now.Add(sessionMaxAge())
+	store.sessions[id] = &session{expiresAt: expiresAt, lastSeen: now}
+	token = id + "." + store.sign(id)
+	return
+}
+
+// check 檢查 token 是否有效, 有效則同時更新最後使用時間.
+func (store *sessionStore) check(token string) bool {
+	id, ok := store.verify(token)
+	if !ok {
+		return false
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	sess, ok := store.sessions[id]
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	if sess.expired(now) {
+		store.deleteLocked(id)
+		return false
+	}
+	sess.lastSeen = now
+	return true
+}
+
+func (sess *session) expired(now time.Time) bool {
+	return now.After(sess.expiresAt) || now.Sub(sess.lastSeen) > sessionIdleTimeout()
+}
+
+func (store *sessionStore) delete(token string) {
+	id, ok := store.verify(token)
+	if !ok {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.deleteLocked(id)
+}
+
+// deleteLocked 刪除一個 session, 如果已經沒有任何 session, 則從內存中刪除密鑰.
+// 調用者必須持有 store.mu.
+func (store *sessionStore) deleteLocked(id string) {
+	delete(store.sessions, id)
+	if len(store.sessions) == 0 && db.IsLoggedIn() {
+		db.Logout()
+	}
+}
+
+// purge 刪除全部已過期的 session.
+func (store *sessionStore) purge() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	for id, sess := range store.sessions {
+		if sess.expired(now) {
+			store.deleteLocked(id)
+		}
+	}
+}
+
+// purgeSessionsLoop 定時刪除過期的 session, 使密鑰在閒置一段時間後自動從內存中刪除.
+func purgeSessionsLoop() {
+	for range time.Tick(time.Minute) {
+		sessions.purge()
+	}
+}
+
+// getSessionToken 從 cookie 或 Authorization 頭部獲取 token.
+func getSessionToken(c *fiber.Ctx) string {
+	if token := c.Cookies(SessionCookieName); token != "" {
+		return token
+	}
+	auth := c.Get(fiber.HeaderAuthorization)
+	token, found := strings.CutPrefix(auth, "Bearer ")
+	return lo.Ternary(found, strings.TrimSpace(token), "")
+}
+
+// isAdmin 判斷當前請求是否已登入. 使用 API token 的請求一律不是管理員.
+func isAdmin(c *fiber.Ctx) bool {
+	if getAPIToken(c) != nil {
+		return false
+	}
+	token := getSessionToken(c)
+	if token == "" {
+		return false
+	}
+	return sessions.check(token) && db.IsLoggedIn()
+}
+
+// startSession 執行 login, 成功後新建 session 並通過 cookie 發給客戶端, 同時返回 token.
+func startSession(c *fiber.Ctx, login func() error) (string, error) {
+	token, expiresAt, err := sessions.create(login)
+	if err != nil {
+		return "", err
+	}
+	c.Cookie(&fiber.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HTTPOnly: true,
+		Secure:   ProjectConfig.TLS,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// endSession 刪除當前請求的 session.
+func endSession(c *fiber.Ctx) {
+	if token := getSessionToken(c); token != "" {
+		sessions.delete(token)
+	}
+	c.ClearCookie(SessionCookieName)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ahui2016/local-buckets/database"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/stmt"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// 備份專案的快照保存在備份專案根目錄下的 snapshots/<時間>/ 中, 包括數據庫, project.toml,
+// 以及 buckets, trash, versions 資料夾. 備份專案中的檔案從不原地修改 (覆蓋檔案時是新建檔案),
+// 因此快照中的檔案以硬連結與備份專案共用, 只有後來發生了變化的檔案才佔用空間.
+// 如果硬碟不支持硬連結 (例如 FAT32, exFAT), 則改為複製檔案.
+
+const (
+	SnapshotTimeLayout = "20060102-150405"
+	SnapshotInfoName   = "snapshot.json"
+	partialSuffix      = ".partial" // 未完成的快照
+)
+
+func snapshotsEnabled() bool {
+	return ProjectConfig.SnapshotKeepDaily > 0 || ProjectConfig.SnapshotKeepMonthly > 0
+}
+
+// snapshotDir 返回快照 id 的資料夾. id 必須是快照的建立時間, 以免被用於訪問其他路徑.
+func snapshotDir(bkProjRoot, id string) (string, error) {
+	if _, err := time.Parse(SnapshotTimeLayout, id); err != nil {
+		return "", fmt.Errorf("invalid snapshot id: %s", id)
+	}
+	dir := filepath.Join(bkProjRoot, SnapshotsFolderName, id)
+	if util.PathNotExists(dir) {
+		return "", fmt.Errorf("snapshot not found: %s", id)
+	}
+	return dir, nil
+}
+
+// takeSnapshot 在同步完成後為備份專案建立快照, 然後按保留規則刪除舊快照.
+// 先在 <時間>.partial 中建立, 完成後才改名, 因此中途出錯不會留下不完整的快照.
+func takeSnapshot(bkProjRoot string, bk *DB) (*model.Snapshot, error) {
+	id := time.Now().Format(SnapshotTimeLayout)
+	dir := filepath.Join(bkProjRoot, SnapshotsFolderName, id)
+	if util.PathExists(dir) {
+		return nil, fmt.Errorf("snapshot exists: %s", id)
+	}
+	partial := dir + partialSuffix
+	if err := os.RemoveAll(partial); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(partial, util.NormalFolerPerm); err != nil {
+		return nil, err
+	}
+	snapshot, err := fillSnapshot(bkProjRoot, partial, bk)
+	if err != nil {
+		err2 := os.RemoveAll(partial)
+		return nil, util.WrapErrors(err, err2)
+	}
+	snapshot.ID = id
+	e1 := util.WriteJSON(snapshot, filepath.Join(partial, SnapshotInfoName))
+	e2 := os.Rename(partial, dir)
+	if err := util.WrapErrors(e1, e2); err != nil {
+		err2 := os.RemoveAll(partial)
+		return nil, util.WrapErrors(err, err2)
+	}
+	return snapshot, pruneSnapshots(bkProjRoot)
+}
+
+func fillSnapshot(bkProjRoot, dir string, bk *DB) (*model.Snapshot, error) {
+	snapshot := &model.Snapshot{CreatedAt: model.Now()}
+	filesCount, e1 := bk.GetInt1(stmt.CountAllFiles)
+	totalSize, e2 := bk.GetInt1(stmt.TotalSize)
+	e3 := bk.Exec(stmt.BackupDatabase, filepath.Join(dir, DatabaseFileName))
+	e4 := util.CopyFile(filepath.Join(dir, ProjectTOML), filepath.Join(bkProjRoot, ProjectTOML))
+	if err := util.WrapErrors(e1, e2, e3, e4); err != nil {
+		return nil, err
+	}
+	snapshot.FilesCount = filesCount
+	snapshot.TotalSize = totalSize
+	for _, name := range []string{BucketsFolderName, TrashFolderName, VersionsFolderName} {
+		err := linkTree(filepath.Join(bkProjRoot, name), filepath.Join(dir, name), snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snapshot, nil
+}
+
+// linkTree 把 src 資料夾中的檔案以硬連結 (不支持則複製) 的方式放到 dst 中.
+func linkTree(src, dst string, snapshot *model.Snapshot) error {
+	if util.PathNotExists(src) {
+		return nil
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return util.MkdirIfNotExists(target)
+		}
+		if err := os.Link(path, target); err == nil {
+			snapshot.LinkedCount++
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := util.CopyAndLockFile(target, path); err != nil {
+			return err
+		}
+		snapshot.CopiedSize += info.Size()
+		return nil
+	})
+}
+
+// listSnapshots 返回備份專案中的全部快照, 最新的排在前面. 忽略未完成的快照.
+func listSnapshots(bkProjRoot string) (all []*model.Snapshot, err error) {
+	entries, err := os.ReadDir(filepath.Join(bkProjRoot, SnapshotsFolderName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		if _, err := time.Parse(SnapshotTimeLayout, entry.Name()); err != nil || !entry.IsDir() {
+			continue
+		}
+		infoPath := filepath.Join(bkProjRoot, SnapshotsFolderName, entry.Name(), SnapshotInfoName)
+		data, err := os.ReadFile(infoPath)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := new(model.Snapshot)
+		if err := json.Unmarshal(data, snapshot); err != nil {
+			return nil, err
+		}
+		all = append(all, snapshot)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID > all[j].ID })
+	return all, nil
+}
+
+// pruneSnapshots 按保留規則刪除舊快照: 最近 SnapshotKeepDaily 天每天保留最新的一個,
+// 最近 SnapshotKeepMonthly 個月每月保留最新的一個, 兩者的並集都保留.
+func pruneSnapshots(bkProjRoot string) error {
+	snapshots, err := listSnapshots(bkProjRoot)
+	if err != nil {
+		return err
+	}
+	ids := lo.Map(snapshots, func(s *model.Snapshot, _ int) string { return s.ID })
+	keep := make(map[string]bool)
+	keepLatest(ids, len("20060102"), ProjectConfig.SnapshotKeepDaily, keep)
+	keepLatest(ids, len("200601"), ProjectConfig.SnapshotKeepMonthly, keep)
+	for _, id := range ids {
+		if keep[id] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(bkProjRoot, SnapshotsFolderName, id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepLatest ids 按時間從新到舊排列, 以 id 的前 prefixLen 個字符 (日期或月份) 分組,
+// 在最近的 n 個組中各保留最新的一個.
+func keepLatest(ids []string, prefixLen int, n int64, keep map[string]bool) {
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if int64(len(seen)) >= n {
+			return
+		}
+		prefix := id[:prefixLen]
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+		keep[id] = true
+	}
+}
+
+// checkBackupRoot 只允許訪問本專案已登記的備份專案 (見 ProjectConfig.BackupProjects).
+func checkBackupRoot(root string) error {
+	for _, bkProjRoot := range ProjectConfig.BackupProjects {
+		if same, err := util.SamePath(root, bkProjRoot); err == nil && same {
+			return nil
+		}
+	}
+	return fmt.Errorf("不是本專案的備份專案: %s", root)
+}
+
+// openSnapshotDB 以只讀方式打開快照中的數據庫, 注意 open 后应立即 defer sdb.DB.Close()
+// 快照中的檔案與備份專案以硬連結共用, 因此不可修改, 也不執行遷移 (版本不一致則拒絕打開).
+func openSnapshotDB(bkProjRoot, id string) (sdb *DB, dir string, err error) {
+	if err = checkBackupRoot(bkProjRoot); err != nil {
+		return
+	}
+	if dir, err = snapshotDir(bkProjRoot, id); err != nil {
+		return
+	}
+	cfg, err := readProjCfgFrom(filepath.Join(dir, ProjectTOML))
+	if err != nil {
+		return
+	}
+	sdb, err = database.OpenReadonlyDB(filepath.Join(dir, DatabaseFileName), &cfg)
+	return
+}
+
+// mainBucketName 返回快照中的倉庫在主專案中的名稱 (倉庫可能已改名).
+// 加密檔案要用主專案中該倉庫的密鑰解密.
+func mainBucketName(sdb *DB, bucketName string) (string, error) {
+	bucket, err := sdb.GetBucketByName(bucketName)
+	if err != nil {
+		return "", err
+	}
+	mainBucket, err := db.GetBucket(bucket.ID)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && mainBucket.ID == 0 {
+		return "", fmt.Errorf("主專案中已沒有該倉庫: %s", bucketName)
+	}
+	return mainBucket.Name, err
+}
+
+// unsealSnapshotFile 用主專案的密鑰解密快照中的密封檔案的名稱等資訊, 無法解密則標記為 Locked.
+func unsealSnapshotFile(sdb *DB, file *FilePlus) {
+	if file.Sealed == "" {
+		return
+	}
+	name, err := mainBucketName(sdb, file.BucketName)
+	if err != nil {
+		file.Locked = true
+		return
+	}
+	f := file.File
+	f.BucketName = name
+	if _, err := db.UnsealFile(&f); err != nil {
+		file.Locked = true
+		return
+	}
+	file.Name, file.Notes, file.Keywords = f.Name, f.Notes, f.Keywords
+}
+
+func getSnapshotsHandler(c *fiber.Ctx) error {
+	form := new(model.OneTextForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	if err := checkBackupRoot(form.Text); err != nil {
+		return err
+	}
+	snapshots, err := listSnapshots(form.Text)
+	if err != nil {
+		return err
+	}
+	return c.JSON(snapshots)
+}
+
+// getSnapshotFilesHandler 瀏覽快照中的檔案, 沒有權限的不顯示加密倉庫中的檔案.
+func getSnapshotFilesHandler(c *fiber.Ctx) error {
+	form := new(model.SnapshotForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	sdb, _, err := openSnapshotDB(form.Root, form.ID)
+	if err != nil {
+		return err
+	}
+	defer sdb.DB.Close()
+
+	buckets, err := sdb.GetAllBuckets()
+	if err != nil {
+		return err
+	}
+	encrypted := make(map[string]bool)
+	for _, bucket := range buckets {
+		encrypted[bucket.Name] = bucket.Encrypted
+	}
+	files, err := sdb.GetAllFiles()
+	if err != nil {
+		return err
+	}
+	seeEncrypted := canSeeEncrypted(c)
+	result := []*FilePlus{}
+	for _, f := range files {
+		file := &FilePlus{File: *f, Encrypted: encrypted[f.BucketName]}
+		if file.Encrypted && !seeEncrypted {
+			continue
+		}
+		unsealSnapshotFile(sdb, file)
+		result = append(result, file)
+	}
+	return c.JSON(result)
+}
+
+// restoreFromSnapshot 把快照中的一個檔案 (解密後) 複製到主專案的 waiting 資料夾.
+func restoreFromSnapshot(c *fiber.Ctx) error {
+	form := new(model.SnapshotForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	if form.FileID <= 0 {
+		return fmt.Errorf("file_id is required")
+	}
+	sdb, dir, err := openSnapshotDB(form.Root, form.ID)
+	if err != nil {
+		return err
+	}
+	defer sdb.DB.Close()
+
+	file, err := sdb.GetFilePlus(form.FileID)
+	if err != nil {
+		return err
+	}
+	bucketName := file.BucketName
+	if file.Encrypted {
+		if bucketName, err = mainBucketName(sdb, file.BucketName); err != nil {
+			return err
+		}
+	}
+	if err := checkRequireAdmin(c, bucketName, file.Encrypted); err != nil {
+		return err
+	}
+	srcPath := projectFilePath(dir, &file.File)
+	unsealSnapshotFile(sdb, &file)
+	if file.Locked {
+		return fmt.Errorf("無法解密檔案名稱: %s", file.Name)
+	}
+	dstPath := filepath.Join(WaitingFolder, file.Name)
+	if util.PathExists(dstPath) {
+		return fmt.Errorf("file exists: %s", dstPath)
+	}
+	if file.Encrypted {
+		err = db.DecryptSaveFile(bucketName, srcPath, dstPath, util.NormalFilePerm)
+	} else {
+		err = util.CopyAndUnlockFile(dstPath, srcPath)
+	}
+	if err != nil {
+		return err
+	}
+	return c.JSON(TextMsg{dstPath})
+}
@@ -7,7 +7,9 @@ CREATE TABLE IF NOT EXISTS bucket
 	name         TEXT      NOT NULL COLLATE NOCASE UNIQUE,
 	title        TEXT      NOT NULL COLLATE NOCASE UNIQUE,
 	subtitle     TEXT      NOT NULL,
-	encrypted    BOOLEAN   NOT NULL
+	encrypted    BOOLEAN   NOT NULL,
+	cipherkey    TEXT      NOT NULL DEFAULT '',
+	sealed       BOOLEAN   NOT NULL DEFAULT FALSE
 );
 
 CREATE TABLE IF NOT EXISTS file
@@ -25,7 +27,8 @@ CREATE TABLE IF NOT EXISTS file
 	utime       TEXT      NOT NULL,
 	checked     TEXT      NOT NULL,
 	damaged     BOOLEAN   NOT NULL,
-	deleted     BOOLEAN   NOT NULL
+	deleted     BOOLEAN   NOT NULL,
+	sealed      TEXT      NOT NULL DEFAULT ''
 );
 
 CREATE INDEX IF NOT EXISTS idx_file_bucket_name ON file(bucket_name);
@@ -37,19 +40,66 @@ CREATE INDEX IF NOT EXISTS idx_file_like        ON file(like);
 CREATE INDEX IF NOT EXISTS idx_file_ctime       ON file(ctime);
 CREATE INDEX IF NOT EXISTS idx_file_utime       ON file(utime);
 CREATE INDEX IF NOT EXISTS idx_file_checked     ON file(checked);
+
+CREATE TABLE IF NOT EXISTS key_rotation
+(
+	id           INTEGER   PRIMARY KEY CHECK (id = 1),
+	cipherkey    TEXT      NOT NULL,
+	last_file_id INTEGER   NOT NULL,
+	started_at   TEXT      NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_token
+(
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	name         TEXT      NOT NULL COLLATE NOCASE UNIQUE,
+	hash         TEXT      NOT NULL UNIQUE,
+	scopes       TEXT      NOT NULL,
+	ctime        TEXT      NOT NULL,
+	expires      TEXT      NOT NULL,
+	revoked      BOOLEAN   NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS file_text
+(
+	id           INTEGER   PRIMARY KEY REFERENCES file(id) ON DELETE CASCADE,
+	text         TEXT      NOT NULL,
+	encrypted    BLOB      NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS trash
+(
+	id           INTEGER   PRIMARY KEY REFERENCES file(id) ON DELETE CASCADE,
+	deleted_at   TEXT      NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS file_version
+(
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	file_id      INTEGER   NOT NULL REFERENCES file(id) ON DELETE CASCADE,
+	checksum     TEXT      NOT NULL,
+	size         INTEGER   NOT NULL,
+	utime        TEXT      NOT NULL,
+	ctime        TEXT      NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_version_file_id ON file_version(file_id);
 `
 
 const InsertBucket = `INSERT INTO bucket (
-	name, title, subtitle, encrypted
-) VALUES (?, ?, ?, ?);`
+	name, title, subtitle, encrypted, cipherkey, sealed
+) VALUES (?, ?, ?, ?, ?, ?);`
 
 const InsertBucketWithID = `INSERT INTO bucket (
-	id, name, title, subtitle, encrypted
-) VALUES (?, ?, ?, ?, ?);`
+	id, name, title, subtitle, encrypted, cipherkey, sealed
+) VALUES (?, ?, ?, ?, ?, ?, ?);`
+
+const CountColumn = `SELECT count(*) FROM pragma_table_info(?) WHERE name=?;`
 
 const DeleteBucket = `DELETE FROM bucket WHERE id=?;`
 const UpdateBucketName = `UPDATE bucket SET name=? WHERE id=?;`
 const UpdateBucketTitle = `UPDATE bucket SET title=?, subtitle=? WHERE id=?;`
+const UpdateBucketCipherKey = `UPDATE bucket SET cipherkey=? WHERE id=?;`
 
 const GetAllBuckets = `SELECT * FROM bucket ORDER BY encrypted;`
 const GetPublicBuckets = `SELECT * FROM bucket WHERE encrypted=FALSE;`
@@ -62,39 +112,52 @@ const UpdateBucketInfo = `UPDATE bucket SET name=?, title=?, subtitle=?
 
 const InsertFile = `INSERT INTO file (
 	checksum, bucket_name, name,  notes,   keywords, size,   type,
-	like,     ctime,       utime, checked, damaged,  deleted
-) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	like,     ctime,       utime, checked, damaged,  deleted, sealed
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 
 const InsertFileWithID = `INSERT INTO file (
 	id,   checksum, bucket_name, name,  notes,   keywords, size,
-	type, like,     ctime,       utime, checked, damaged,  deleted
-) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
+	type, like,     ctime,       utime, checked, damaged,  deleted, sealed
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?);`
 
 const UpdateFileContent = `UPDATE file
 	SET checksum=?, size=?, utime=?, damaged=FALSE WHERE id=?;`
 
 const MoveFileToBucket = `UPDATE file SET bucket_name=? WHERE id=?;`
 
+const UpdateChecksum = `UPDATE file SET checksum=? WHERE id=?;`
+
 const UpdateChecksumAndBucket = `UPDATE file
 	SET checksum=?, bucket_name=? WHERE id=?;`
 
+const MoveSealedFile = `UPDATE file SET checksum=?, bucket_name=?,
+	name=?, notes=?, keywords=?, sealed=? WHERE id=?;`
+
+const UpdateFileSealed = `UPDATE file SET sealed=? WHERE id=?;`
+
 const UpdateFileInfo = `UPDATE file SET name=?, notes=?,
-	keywords=?, type=?, like=?, ctime=?, utime=? WHERE id=?;`
+	keywords=?, type=?, like=?, ctime=?, utime=?, sealed=? WHERE id=?;`
 
 const UpdateBackupFileInfo = `UPDATE file SET
 	checksum=?, bucket_name=?, name=?,  notes=?, keywords=?, size=?,
-	type=?,     like=?,        ctime=?, utime=?, deleted=? WHERE id=?;`
+	type=?,     like=?,        ctime=?, utime=?, deleted=?, sealed=? WHERE id=?;`
 
 const GetFileByID = `SELECT * FROM file WHERE id=?;`
 const GetFileByName = `SELECT * FROM file WHERE name=?;`
 const GetFileByChecksum = `SELECT * FROM file WHERE checksum=?;`
 const GetAllFiles = `SELECT * FROM file;`
+
+const GetEncryptedFiles = `SELECT file.* FROM file
+	INNER JOIN bucket ON file.bucket_name = bucket.name
+	WHERE bucket.encrypted=TRUE AND file.id > ? ORDER BY file.id;`
+
 const DeleteFile = `DELETE FROM file WHERE id=?;`
 
 const GetFilePlus = `SELECT file.id, file.checksum, file.bucket_name,
 	file.name,    file.notes,   file.keywords, file.size,
 	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
+	file.checked, file.damaged, file.deleted,  file.sealed,
+	bucket.encrypted
 FROM file
 	INNER JOIN bucket ON file.bucket_name = bucket.name
 	WHERE file.id=?;`
@@ -102,84 +165,25 @@ FROM file
 const GetFilePlusByName = `SELECT file.id, file.checksum, file.bucket_name,
 	file.name,    file.notes,   file.keywords, file.size,
 	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
+	file.checked, file.damaged, file.deleted,  file.sealed,
+	bucket.encrypted
 FROM file
 	INNER JOIN bucket ON file.bucket_name = bucket.name
 	WHERE file.name=?;`
 
-// Bug: 有注入風險, 但这是單用戶系統, 因此風險可控.
-const GetAllFilesLimit = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE file.utime < ?
-	ORDER BY %s DESC LIMIT ?;`
-
-const AllFilesInBucket = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.id=? AND file.utime < ?
-	ORDER BY utime DESC LIMIT ?;`
-
-const GetAllPicsLimit = `SELECT file.id, file.checksum, file.bucket_name,
+// ListFiles 列出檔案, 由 database.FileQuery 生成 WHERE 條件 (%[1]s),
+// 排序 (%[2]s) 及 LIMIT (%[3]s), 排序欄位及方向必須先通過 database.CheckSort 檢查.
+// 舊版數據庫中可能有 deleted=TRUE 但沒有 trash 記錄的檔案, 因此用 LEFT JOIN.
+const ListFiles = `SELECT file.id, file.checksum, file.bucket_name,
 	file.name,    file.notes,   file.keywords, file.size,
 	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
+	file.checked, file.damaged, file.deleted,  file.sealed,
+	bucket.encrypted, COALESCE(trash.deleted_at, '')
 FROM file
 	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE file.utime < ? AND file.type LIKE "image/%"
-	ORDER BY utime DESC LIMIT ?;`
-
-const AllPicsInBucket = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.id=? AND file.utime < ? AND file.type LIKE "image/%"
-	ORDER BY utime DESC LIMIT ?;`
-
-// Bug: 有注入風險, 但这是單用戶系統, 因此風險可控.
-const GetPublicFilesLimit = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.encrypted=FALSE AND file.utime < ?
-	ORDER BY %s DESC LIMIT ?;`
-
-const PublicFilesInBucket = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.id=? AND bucket.encrypted=FALSE AND file.utime < ?
-	ORDER BY file.utime DESC LIMIT ?;`
-
-const GetPublicPicsLimit = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.encrypted=FALSE AND file.utime < ? AND file.type LIKE "image/%"
-	ORDER BY file.utime DESC LIMIT ?;`
-
-const PublicPicsInBucket = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.id=? AND bucket.encrypted=FALSE AND file.utime < ? AND file.type LIKE "image/%"
-	ORDER BY file.utime DESC LIMIT ?;`
+	LEFT JOIN trash ON trash.id = file.id
+	WHERE %[1]s
+	ORDER BY %[2]s%[3]s;`
 
 const TotalSize = `SELECT COALESCE(sum(size),0) as totalsize FROM file;`
 const CountAllFiles = `SELECT count(*) FROM file;`
@@ -187,14 +191,6 @@ const CountFilesNeedCheck = `SELECT count(*) FROM file WHERE checked<?;`
 const GetFilesNeedCheck = `SELECT * FROM file WHERE checked<?;`
 const CountDamagedFiles = `SELECT count(*) FROM file WHERE damaged=TRUE;`
 
-const GetDamagedFiles = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE damaged=TRUE ORDER BY file.utime DESC;`
-
 const CheckFile = `UPDATE file SET checked=?, damaged=? WHERE id=?;`
 
 const BucketTotalSize = `SELECT COALESCE(sum(size),0) as totalsize FROM file
@@ -205,51 +201,400 @@ const BucketCountFiles = `SELECT count(*) FROM file
 	INNER JOIN bucket ON file.bucket_name = bucket.name
 	WHERE bucket.id=?;`
 
-const SearchAllFiles = `SELECT file.id, file.checksum, file.bucket_name,
+// SearchFiles 的各部分由 database.SearchQuery 生成: 摘要, 全文搜尋的 JOIN, WHERE, ORDER BY.
+// 摘要中用 char(2), char(3) 標記匹配的文字.
+const SearchFiles = `SELECT file.id, file.checksum, file.bucket_name,
 	file.name,    file.notes,   file.keywords, file.size,
 	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
+	file.checked, file.damaged, file.deleted,  file.sealed,
+	bucket.encrypted, %s
 FROM file
+	INNER JOIN bucket ON file.bucket_name = bucket.name%s
+	WHERE %s
+	ORDER BY %s LIMIT ?;`
+
+// SearchFileFTSJoin 用於按檔案名稱, 備註, 關鍵詞的相關度排序, 參數是全文搜尋表達式.
+const SearchFileFTSJoin = `
+	LEFT JOIN (SELECT rowid, bm25(file_fts, 10.0, 2.0, 5.0) AS score,
+		snippet(file_fts, -1, char(2), char(3), '…', 24) AS snip
+		FROM file_fts WHERE file_fts MATCH ?) AS fts ON fts.rowid = file.id`
+
+// SearchFileTextFTSJoin 用於按檔案內容 (提取的文字) 的相關度排序, 參數是全文搜尋表達式.
+const SearchFileTextFTSJoin = `
+	LEFT JOIN (SELECT rowid, bm25(file_text_fts) AS score,
+		snippet(file_text_fts, 0, char(2), char(3), '…', 24) AS snip
+		FROM file_text_fts WHERE file_text_fts MATCH ?) AS tfts ON tfts.rowid = file.id`
+
+const GetPublicTags = `SELECT tag.name FROM tag
+	INNER JOIN file_tag ON file_tag.tag_id = tag.id
+	INNER JOIN file ON file.id = file_tag.file_id
 	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE file.name LIKE ? OR file.notes LIKE ? OR file.keywords LIKE ?
-	ORDER BY file.utime DESC LIMIT ?;`
-
-const SearchPublicFiles = `SELECT file.id, file.checksum, file.bucket_name,
+	WHERE bucket.encrypted=FALSE AND file.deleted=FALSE
+	GROUP BY tag.id
+	ORDER BY tag.name;`
+
+const GetTagsWithBucket = `SELECT tag.name, file.bucket_name FROM tag
+	INNER JOIN file_tag ON file_tag.tag_id = tag.id
+	INNER JOIN file ON file.id = file_tag.file_id
+	WHERE file.deleted=FALSE
+	GROUP BY tag.id, file.bucket_name
+	ORDER BY tag.name;`
+
+const GetSealedFiles = `SELECT file.id, file.checksum, file.bucket_name,
 	file.name,    file.notes,   file.keywords, file.size,
 	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
+	file.checked, file.damaged, file.deleted,  file.sealed,
+	bucket.encrypted
 FROM file
 	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.encrypted=FALSE AND (
-		file.name LIKE ? OR file.notes LIKE ? OR file.keywords LIKE ?)
-	ORDER BY file.utime DESC LIMIT ?;`
+	WHERE file.sealed != ''
+	ORDER BY file.utime DESC;`
 
-const SearchAllPics = `SELECT file.id, file.checksum, file.bucket_name,
-	file.name,    file.notes,   file.keywords, file.size,
-	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
-FROM file
-	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE file.type LIKE "image/%" AND (
-		file.name LIKE ? OR file.notes LIKE ? OR file.keywords LIKE ?)
-	ORDER BY file.utime DESC LIMIT ?;`
+const GetKeyRotation = `SELECT cipherkey, last_file_id, started_at
+	FROM key_rotation WHERE id=1;`
+
+const InsertKeyRotation = `INSERT INTO key_rotation (
+	id, cipherkey, last_file_id, started_at
+) VALUES (1, ?, ?, ?);`
 
-const SearchPublicPics = `SELECT file.id, file.checksum, file.bucket_name,
+const UpdateKeyRotation = `UPDATE key_rotation SET last_file_id=? WHERE id=1;`
+const DeleteKeyRotation = `DELETE FROM key_rotation WHERE id=1;`
+
+// bucket_key_rotation 記錄更換密鑰時為每個有自己密鑰的加密倉庫生成的新密鑰,
+// 完成重新加密後才替換 bucket 表的 cipherkey, 見 database/rotate.go
+const CreateBucketKeyRotationTable = `
+CREATE TABLE IF NOT EXISTS bucket_key_rotation
+(
+	bucket_id    INTEGER   PRIMARY KEY REFERENCES bucket(id) ON DELETE CASCADE,
+	cipherkey    TEXT      NOT NULL
+);
+`
+
+const InsertBucketKeyRotation = `INSERT INTO bucket_key_rotation (bucket_id, cipherkey) VALUES (?, ?);`
+const GetBucketKeyRotation = `SELECT cipherkey FROM bucket_key_rotation WHERE bucket_id=?;`
+const GetBucketKeyRotations = `SELECT bucket_id, cipherkey FROM bucket_key_rotation;`
+const DeleteBucketKeyRotations = `DELETE FROM bucket_key_rotation;`
+
+const ApplyBucketKeyRotation = `UPDATE bucket SET cipherkey=(
+	SELECT cipherkey FROM bucket_key_rotation WHERE bucket_id=bucket.id
+) WHERE id IN (SELECT bucket_id FROM bucket_key_rotation);`
+
+const InsertAPIToken = `INSERT INTO api_token (
+	name, hash, scopes, ctime, expires, revoked
+) VALUES (?, ?, ?, ?, ?, ?);`
+
+const GetAPITokenByHash = `SELECT id, name, hash, scopes, ctime, expires, revoked
+	FROM api_token WHERE hash=?;`
+
+const GetAllAPITokens = `SELECT id, name, hash, scopes, ctime, expires, revoked
+	FROM api_token ORDER BY id;`
+
+const RevokeAPIToken = `UPDATE api_token SET revoked=TRUE WHERE id=?;`
+
+const CountTable = `SELECT count(*) FROM sqlite_master WHERE type='table' AND name=?;`
+
+// CreateFileFTS 全文搜尋索引, 用 trigram 分詞, 以便搜尋中文 (至少 3 個字).
+// 通過觸發器與 file 表保持同步.
+const CreateFileFTS = `
+CREATE VIRTUAL TABLE IF NOT EXISTS file_fts USING fts5(
+	name, notes, keywords,
+	content='file', content_rowid='id', tokenize='trigram'
+);
+
+CREATE TRIGGER IF NOT EXISTS file_fts_insert AFTER INSERT ON file BEGIN
+	INSERT INTO file_fts(rowid, name, notes, keywords)
+		VALUES (new.id, new.name, new.notes, new.keywords);
+END;
+
+CREATE TRIGGER IF NOT EXISTS file_fts_delete AFTER DELETE ON file BEGIN
+	INSERT INTO file_fts(file_fts, rowid, name, notes, keywords)
+		VALUES ('delete', old.id, old.name, old.notes, old.keywords);
+END;
+
+CREATE TRIGGER IF NOT EXISTS file_fts_update AFTER UPDATE OF name, notes, keywords ON file BEGIN
+	INSERT INTO file_fts(file_fts, rowid, name, notes, keywords)
+		VALUES ('delete', old.id, old.name, old.notes, old.keywords);
+	INSERT INTO file_fts(rowid, name, notes, keywords)
+		VALUES (new.id, new.name, new.notes, new.keywords);
+END;
+`
+
+const RebuildFileFTS = `INSERT INTO file_fts(file_fts) VALUES('rebuild');`
+
+// CreateFileTextFTS 檔案內容的全文搜尋索引, 只包含公開倉庫的檔案 (加密倉庫的 text 欄位為空).
+const CreateFileTextFTS = `
+CREATE VIRTUAL TABLE IF NOT EXISTS file_text_fts USING fts5(
+	text, content='file_text', content_rowid='id', tokenize='trigram'
+);
+
+CREATE TRIGGER IF NOT EXISTS file_text_fts_insert AFTER INSERT ON file_text BEGIN
+	INSERT INTO file_text_fts(rowid, text) VALUES (new.id, new.text);
+END;
+
+CREATE TRIGGER IF NOT EXISTS file_text_fts_delete AFTER DELETE ON file_text BEGIN
+	INSERT INTO file_text_fts(file_text_fts, rowid, text) VALUES ('delete', old.id, old.text);
+END;
+
+CREATE TRIGGER IF NOT EXISTS file_text_fts_update AFTER UPDATE OF text ON file_text BEGIN
+	INSERT INTO file_text_fts(file_text_fts, rowid, text) VALUES ('delete', old.id, old.text);
+	INSERT INTO file_text_fts(rowid, text) VALUES (new.id, new.text);
+END;
+`
+
+const RebuildFileTextFTS = `INSERT INTO file_text_fts(file_text_fts) VALUES('rebuild');`
+
+const UpsertFileText = `INSERT INTO file_text (id, text, encrypted) VALUES (?, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET text=excluded.text, encrypted=excluded.encrypted;`
+
+const GetFileText = `SELECT text, encrypted FROM file_text WHERE id=?;`
+const DeleteFileText = `DELETE FROM file_text WHERE id=?;`
+const UpdateFileTextEncrypted = `UPDATE file_text SET encrypted=? WHERE id=?;`
+
+const GetEncryptedFileTexts = `SELECT file_text.id, file.bucket_name, file_text.encrypted
+	FROM file_text INNER JOIN file ON file_text.id = file.id
+	WHERE length(file_text.encrypted) > 0;`
+
+// GetEncryptedTextFiles 有加密文字的檔案 (不包括密封檔案, 密封檔案另行處理).
+const GetEncryptedTextFiles = `SELECT file.id, file.checksum, file.bucket_name,
 	file.name,    file.notes,   file.keywords, file.size,
 	file.type,    file.like,    file.ctime,    file.utime,
-	file.checked, file.damaged, file.deleted,  bucket.encrypted
+	file.checked, file.damaged, file.deleted,  file.sealed,
+	bucket.encrypted
 FROM file
 	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.encrypted=FALSE AND file.type LIKE "image/%" AND (
-		file.name LIKE ? OR file.notes LIKE ? OR file.keywords LIKE ?)
-	ORDER BY file.utime DESC LIMIT ?;`
+	INNER JOIN file_text ON file_text.id = file.id
+	WHERE file.sealed = '' AND file.deleted = FALSE AND length(file_text.encrypted) > 0
+	ORDER BY file.utime DESC;`
+
+const SetFileDeleted = `UPDATE file SET deleted=? WHERE id=?;`
+
+const UpsertTrash = `INSERT INTO trash (id, deleted_at) VALUES (?, ?)
+	ON CONFLICT (id) DO UPDATE SET deleted_at=excluded.deleted_at;`
+
+const DeleteTrash = `DELETE FROM trash WHERE id=?;`
+const GetTrashTime = `SELECT deleted_at FROM trash WHERE id=?;`
+
+// GetExpiredTrashFiles 在回收站中超過保留期限的檔案.
+const GetExpiredTrashFiles = `SELECT file.* FROM file
+	INNER JOIN trash ON trash.id = file.id
+	WHERE file.deleted=TRUE AND trash.deleted_at < ?;`
+
+const InsertFileVersion = `INSERT INTO file_version (
+	file_id, checksum, size, utime, ctime
+) VALUES (?, ?, ?, ?, ?);`
+
+const InsertFileVersionWithID = `INSERT INTO file_version (
+	id, file_id, checksum, size, utime, ctime
+) VALUES (?, ?, ?, ?, ?, ?);`
+
+const GetFileVersion = `SELECT * FROM file_version WHERE id=?;`
+const GetAllFileVersions = `SELECT * FROM file_version ORDER BY id;`
+
+// GetFileVersions 一個檔案的全部舊版本, 最新的排在前面.
+const GetFileVersions = `SELECT * FROM file_version WHERE file_id=? ORDER BY id DESC;`
+
+const DeleteFileVersion = `DELETE FROM file_version WHERE id=?;`
+const UpdateFileVersionChecksum = `UPDATE file_version SET checksum=? WHERE id=?;`
+
+// schema_version 只有一行, 記錄數據庫結構的版本, 見 database/migrate.go
+const CreateSchemaVersion = `
+CREATE TABLE IF NOT EXISTS schema_version
+(
+	id           INTEGER   PRIMARY KEY CHECK (id = 1),
+	version      INTEGER   NOT NULL,
+	migrated_at  TEXT      NOT NULL
+);
+`
+
+const GetSchemaVersion = `SELECT version FROM schema_version WHERE id=1;`
+
+const SetSchemaVersion = `INSERT INTO schema_version (id, version, migrated_at)
+	VALUES (1, ?, ?)
+	ON CONFLICT (id) DO UPDATE SET
+	version=excluded.version, migrated_at=excluded.migrated_at;`
 
-const GetPublicKeywords = `SELECT file.keywords FROM file
+const CountAllTables = `SELECT count(*) FROM sqlite_master WHERE type='table';`
+
+// BackupDatabase 把整個數據庫複製到一個新檔案 (不能在事務中執行).
+const BackupDatabase = `VACUUM INTO ?;`
+
+// tag 與 file_tag 表, 見 database/tags.go
+const CreateTagTables = `
+CREATE TABLE IF NOT EXISTS tag
+(
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	name         TEXT      NOT NULL COLLATE NOCASE UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS file_tag
+(
+	file_id      INTEGER   NOT NULL REFERENCES file(id) ON DELETE CASCADE,
+	tag_id       INTEGER   NOT NULL REFERENCES tag(id) ON DELETE CASCADE,
+	PRIMARY KEY (file_id, tag_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_tag_tag_id ON file_tag(tag_id);
+`
+
+const GetIDAndKeywords = `SELECT id, keywords FROM file;`
+const UpdateKeywords = `UPDATE file SET keywords=? WHERE id=?;`
+
+const InsertTag = `INSERT INTO tag (name) VALUES (?) ON CONFLICT (name) DO NOTHING;`
+const GetTagByName = `SELECT id, name FROM tag WHERE name=?;`
+const RenameTag = `UPDATE tag SET name=? WHERE id=?;`
+const DeleteTag = `DELETE FROM tag WHERE id=?;`
+const DeleteUnusedTags = `DELETE FROM tag WHERE id NOT IN (SELECT tag_id FROM file_tag);`
+
+const InsertFileTag = `INSERT OR IGNORE INTO file_tag (file_id, tag_id) VALUES (?, ?);`
+const DeleteFileTags = `DELETE FROM file_tag WHERE file_id=?;`
+
+// MergeFileTags 把有第二個參數 (tag_id) 的檔案都加上第一個參數 (tag_id).
+const MergeFileTags = `INSERT OR IGNORE INTO file_tag (file_id, tag_id)
+	SELECT file_id, ? FROM file_tag WHERE tag_id=?;`
+
+const GetFileIDsByTag = `SELECT file_id FROM file_tag WHERE tag_id=?;`
+
+const GetFileTags = `SELECT tag.name FROM tag
+	INNER JOIN file_tag ON file_tag.tag_id = tag.id
+	WHERE file_tag.file_id=?;`
+
+const CountPublicTags = `SELECT tag.name, file.bucket_name, count(*) FROM tag
+	INNER JOIN file_tag ON file_tag.tag_id = tag.id
+	INNER JOIN file ON file.id = file_tag.file_id
 	INNER JOIN bucket ON file.bucket_name = bucket.name
-	WHERE bucket.encrypted=FALSE
-	GROUP BY file.keywords
-	ORDER BY file.keywords;`
+	WHERE bucket.encrypted=FALSE AND file.deleted=FALSE
+	GROUP BY tag.id, file.bucket_name
+	ORDER BY tag.name, file.bucket_name;`
+
+const CountAllTags = `SELECT tag.name, file.bucket_name, count(*) FROM tag
+	INNER JOIN file_tag ON file_tag.tag_id = tag.id
+	INNER JOIN file ON file.id = file_tag.file_id
+	WHERE file.deleted=FALSE
+	GROUP BY tag.id, file.bucket_name
+	ORDER BY tag.name, file.bucket_name;`
+
+// event 表只增不改, 見 database/events.go
+// file_id, bucket_id 為 0 表示與檔案或倉庫無關. 不設外鍵, 檔案或倉庫被刪除後仍保留記錄.
+const CreateEventTable = `
+CREATE TABLE IF NOT EXISTS event
+(
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	time         TEXT      NOT NULL,
+	actor        TEXT      NOT NULL,
+	ip           TEXT      NOT NULL,
+	action       TEXT      NOT NULL,
+	file_id      INTEGER   NOT NULL,
+	bucket_id    INTEGER   NOT NULL,
+	before       TEXT      NOT NULL,
+	after        TEXT      NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_event_time      ON event(time);
+CREATE INDEX IF NOT EXISTS idx_event_file_id   ON event(file_id);
+CREATE INDEX IF NOT EXISTS idx_event_bucket_id ON event(bucket_id);
+
+CREATE TRIGGER IF NOT EXISTS event_no_update BEFORE UPDATE ON event
+BEGIN
+	SELECT RAISE(ABORT, 'event is append-only');
+END;
+
+CREATE TRIGGER IF NOT EXISTS event_no_delete BEFORE DELETE ON event
+BEGIN
+	SELECT RAISE(ABORT, 'event is append-only');
+END;
+`
+
+const InsertEvent = `INSERT INTO event (
+	time, actor, ip, action, file_id, bucket_id, before, after
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+
+// GetEvents 的 WHERE 條件 (%[1]s) 及 LIMIT (%[2]s) 由 database.eventsWhere 生成.
+const GetEvents = `SELECT id, time, actor, ip, action, file_id, bucket_id, before, after
+	FROM event WHERE %[1]s ORDER BY id DESC%[2]s;`
+
+// journal 表記錄未完成的多步驟操作, 見 database/journal.go
+// steps, cleanup, target 都是 JSON.
+const CreateJournalTable = `
+CREATE TABLE IF NOT EXISTS journal
+(
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	op           TEXT      NOT NULL,
+	file_id      INTEGER   NOT NULL,
+	steps        TEXT      NOT NULL,
+	cleanup      TEXT      NOT NULL,
+	target       TEXT      NOT NULL,
+	started_at   TEXT      NOT NULL
+);
+`
+
+const InsertJournal = `INSERT INTO journal (
+	op, file_id, steps, cleanup, target, started_at
+) VALUES (?, ?, ?, ?, ?, ?);`
+
+const UpdateJournalTarget = `UPDATE journal SET target=? WHERE id=?;`
+const DeleteJournal = `DELETE FROM journal WHERE id=?;`
+const CountJournals = `SELECT count(*) FROM journal;`
+const GetJournals = `SELECT id, op, file_id, steps, cleanup, target, started_at
+	FROM journal ORDER BY id;`
+
+// change_log 由觸發器自動記錄檔案及倉庫的變化, 用於增量同步備份專案, 見 database/changes.go
+// 每個檔案 (倉庫) 只保留最新的一條記錄 (先刪除舊記錄再插入, 分配新的 seq),
+// 因此 seq 單調遞增, 而表的大小不超過檔案及倉庫的總數.
+// 只修改 checked, damaged 的不記錄, 因為同步時不對比這兩個屬性.
+const CreateChangeLogTable = `
+CREATE TABLE IF NOT EXISTS change_log
+(
+	seq          INTEGER   PRIMARY KEY AUTOINCREMENT,
+	kind         TEXT      NOT NULL,
+	target_id    INTEGER   NOT NULL,
+	UNIQUE (kind, target_id)
+);
+
+CREATE TRIGGER IF NOT EXISTS change_log_file_insert AFTER INSERT ON file BEGIN
+	DELETE FROM change_log WHERE kind='file' AND target_id=new.id;
+	INSERT INTO change_log (kind, target_id) VALUES ('file', new.id);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_file_delete AFTER DELETE ON file BEGIN
+	DELETE FROM change_log WHERE kind='file' AND target_id=old.id;
+	INSERT INTO change_log (kind, target_id) VALUES ('file', old.id);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_file_update AFTER UPDATE OF
+	checksum, bucket_name, name, notes, keywords, size, type,
+	like, ctime, utime, deleted, sealed ON file
+BEGIN
+	DELETE FROM change_log WHERE kind='file' AND target_id=new.id;
+	INSERT INTO change_log (kind, target_id) VALUES ('file', new.id);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_bucket_insert AFTER INSERT ON bucket BEGIN
+	DELETE FROM change_log WHERE kind='bucket' AND target_id=new.id;
+	INSERT INTO change_log (kind, target_id) VALUES ('bucket', new.id);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_bucket_delete AFTER DELETE ON bucket BEGIN
+	DELETE FROM change_log WHERE kind='bucket' AND target_id=old.id;
+	INSERT INTO change_log (kind, target_id) VALUES ('bucket', old.id);
+END;
+
+CREATE TRIGGER IF NOT EXISTS change_log_bucket_update AFTER UPDATE ON bucket BEGIN
+	DELETE FROM change_log WHERE kind='bucket' AND target_id=new.id;
+	INSERT INTO change_log (kind, target_id) VALUES ('bucket', new.id);
+END;
+
+CREATE TABLE IF NOT EXISTS sync_state
+(
+	id           INTEGER   PRIMARY KEY CHECK (id = 1),
+	source_seq   INTEGER   NOT NULL,
+	synced_at    TEXT      NOT NULL
+);
+`
+
+const GetMaxChangeSeq = `SELECT coalesce(max(seq), 0) FROM change_log;`
+const GetChangesSince = `SELECT kind, target_id FROM change_log WHERE seq>? ORDER BY seq;`
 
-const GetAllKeywords = `SELECT file.keywords FROM file
-	GROUP BY file.keywords
-	ORDER BY file.keywords;`
+const GetSyncState = `SELECT source_seq, synced_at FROM sync_state WHERE id=1;`
+const SetSyncState = `INSERT OR REPLACE INTO sync_state (id, source_seq, synced_at)
+	VALUES (1, ?, ?);`
+const DeleteSyncState = `DELETE FROM sync_state WHERE id=1;`
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// 同步備份專案分兩步: 先計算需要同步的變化 (planSync), 再執行 (syncToBackupProject).
+// 計算出的變化也可以只用於預覽 (dry-run), 此時以只讀方式打開備份專案 (見 openBackupDBReadonly).
+
+const (
+	DefaultSyncMaxDeletes       = 100
+	DefaultSyncMaxDeletePercent = 10
+)
+
+type syncPlan struct {
+	bk          *DB
+	bkProjStat  *ProjectStatus
+	seq         int64 // 主專案的變化序號, 同步成功後寫入備份專案
+	syncBuckets bool
+	files       ChangedFiles
+	diskErr     error // 備份專案空間不足
+	preview     *model.SyncPreview
+}
+
+// planSync 計算需要同步的變化, 不修改備份專案. bk 由調用者打開及關閉:
+// 正式同步時用 openBackupDB 打開並升級 (見 upgradeBackupProject),
+// 預覽時用 openBackupDBReadonly 以只讀方式打開.
+//
+// 默認只對比主專案 change_log 中上次同步後發生了變化的檔案及倉庫,
+// 如果 full 為 true 或備份專案沒有同步記錄, 則對比全部檔案及倉庫.
+func planSync(
+	bkProjRoot string, bk *DB, bkProjStat *ProjectStatus, full bool,
+) (plan *syncPlan, err error) {
+	projStat, err := db.GetProjStat(ProjectConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	plan = &syncPlan{bk: bk, bkProjStat: bkProjStat}
+	avail, diskErr := checkBackupDiskUsage(bkProjRoot, bkProjStat, &projStat)
+	plan.diskErr = diskErr
+
+	// 先記下主專案的變化序號, 同步期間發生的變化留到下次同步.
+	if plan.seq, err = db.ChangeSeq(); err != nil {
+		return nil, err
+	}
+	state, err := bk.GetSyncState()
+	if err != nil {
+		return nil, err
+	}
+	// 備份專案的序號比主專案還新, 說明主專案的數據庫被替換過, 只能全量對比.
+	full = full || state == nil || state.SourceSeq > plan.seq
+
+	var fileIDs, bucketIDs []int64
+	if !full {
+		if fileIDs, bucketIDs, err = db.GetChangesSince(state.SourceSeq); err != nil {
+			return nil, err
+		}
+	}
+	plan.syncBuckets = full || len(bucketIDs) > 0
+
+	renamed, err := renamedBuckets(bk)
+	if err != nil {
+		return nil, err
+	}
+	bkBucketsDir := filepath.Join(bkProjRoot, BucketsFolderName)
+	bkTemp := filepath.Join(bkProjRoot, TempFolderName)
+	if full {
+		plan.files, err = getChangedFiles(db, bk, bkBucketsDir, bkTemp, renamed)
+	} else {
+		plan.files, err = getChangedFilesIn(db, bk, bkBucketsDir, bkTemp, renamed, fileIDs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plan.preview, err = plan.files.preview(bkProjStat)
+	if err != nil {
+		return nil, err
+	}
+	plan.preview.Full = full
+	plan.preview.AvailBytes = avail
+	if diskErr != nil {
+		plan.preview.DiskError = diskErr.Error()
+	}
+	checkSyncDeleteLimit(plan.preview)
+	return plan, nil
+}
+
+// renamedBuckets 返回在主專案中已改名的倉庫, 備份專案中的名稱 => 主專案中的新名稱.
+func renamedBuckets(bk *DB) (map[string]string, error) {
+	dbBuckets, e1 := db.GetAllBuckets()
+	bkBuckets, e2 := bk.GetAllBuckets()
+	if err := util.WrapErrors(e1, e2); err != nil {
+		return nil, err
+	}
+	byID := lo.KeyBy(dbBuckets, func(b *Bucket) int64 { return b.ID })
+	renamed := make(map[string]string)
+	for _, bkBucket := range bkBuckets {
+		if bucket, ok := byID[bkBucket.ID]; ok && bucket.Name != bkBucket.Name {
+			renamed[bkBucket.Name] = bucket.Name
+		}
+	}
+	return renamed, nil
+}
+
+// preview 列出將要同步的檔案, 並計算需要複製的體積.
+func (files ChangedFiles) preview(bkProjStat *ProjectStatus) (*model.SyncPreview, error) {
+	p := &model.SyncPreview{
+		Root:         bkProjStat.Root,
+		BKFilesCount: bkProjStat.FilesCount,
+	}
+	encrypted := make(map[string]bool)
+	for _, db1 := range []*DB{files.BK, files.DB} {
+		buckets, err := db1.GetAllBuckets()
+		if err != nil {
+			return nil, err
+		}
+		for _, bucket := range buckets {
+			encrypted[bucket.Name] = bucket.Encrypted
+		}
+	}
+	for _, id := range files.Deleted {
+		bkFile, err := files.BK.GetFileByID(id)
+		if err != nil {
+			return nil, err
+		}
+		p.Deleted = append(p.Deleted, newSyncFileInfo(&bkFile))
+	}
+	for _, id := range files.Inserted {
+		dbFile, err := files.DB.GetFileByID(id)
+		if err != nil {
+			return nil, err
+		}
+		p.Inserted = append(p.Inserted, newSyncFileInfo(&dbFile))
+		p.CopyBytes += dbFile.Size
+	}
+	for _, id := range files.Overwrited {
+		_, dbFile, err := files.getFilePair(id)
+		if err != nil {
+			return nil, err
+		}
+		p.Overwrited = append(p.Overwrited, newSyncFileInfo(&dbFile.File))
+		p.CopyBytes += dbFile.Size
+	}
+	for _, id := range files.Moved {
+		bkFile, dbFile, err := files.getFilePair(id)
+		if err != nil {
+			return nil, err
+		}
+		info := newSyncFileInfo(&dbFile.File)
+		info.BKBucket = bkFile.BucketName
+		p.Moved = append(p.Moved, info)
+		// 在加密倉庫與公開倉庫之間移動的檔案需要重新複製 (見 moveEncrypedBKFile)
+		if encrypted[bkFile.BucketName] != encrypted[dbFile.BucketName] {
+			p.CopyBytes += dbFile.Size
+		}
+	}
+	for _, id := range files.Updated {
+		bkFile, dbFile, err := files.getFilePair(id)
+		if err != nil {
+			return nil, err
+		}
+		info := newSyncFileInfo(&dbFile.File)
+		p.Updated = append(p.Updated, info)
+		if dbFile.Deleted && !bkFile.Deleted {
+			p.Trashed = append(p.Trashed, info)
+		}
+	}
+	return p, nil
+}
+
+func newSyncFileInfo(file *File) *model.SyncFileInfo {
+	return &model.SyncFileInfo{
+		ID:     file.ID,
+		Name:   file.Name,
+		Size:   file.Size,
+		Bucket: file.BucketName,
+	}
+}
+
+// syncDeleteLimits 返回 ProjectConfig 中的安全上限, 0 採用默認值, 負數表示不限制.
+func syncDeleteLimits() (maxDeletes, maxPercent int64) {
+	maxDeletes = lo.Ternary(ProjectConfig.SyncMaxDeletes != 0,
+		ProjectConfig.SyncMaxDeletes, DefaultSyncMaxDeletes)
+	maxPercent = lo.Ternary(ProjectConfig.SyncMaxDeletePercent != 0,
+		ProjectConfig.SyncMaxDeletePercent, DefaultSyncMaxDeletePercent)
+	return
+}
+
+// checkSyncDeleteLimit 將要刪除 (包括移到回收站) 的檔案超過安全上限時, 標記為需要確認.
+func checkSyncDeleteLimit(p *model.SyncPreview) {
+	maxDeletes, maxPercent := syncDeleteLimits()
+	n := int64(len(p.Deleted) + len(p.Trashed))
+	if maxDeletes >= 0 && n > maxDeletes {
+		p.NeedConfirm = true
+		p.ConfirmReason = fmt.Sprintf("將要刪除 %d 個檔案, 超過上限 %d", n, maxDeletes)
+		return
+	}
+	if maxPercent >= 0 && p.BKFilesCount > 0 && n*100 > p.BKFilesCount*maxPercent {
+		p.NeedConfirm = true
+		p.ConfirmReason = fmt.Sprintf("將要刪除 %d 個檔案, 超過備份專案檔案總數 (%d) 的 %d%%",
+			n, p.BKFilesCount, maxPercent)
+	}
+}
+
+// syncPreviewHandler 預覽同步備份專案將會發生的變化, 不修改備份專案.
+func syncPreviewHandler(c *fiber.Ctx) error {
+	form := new(model.SyncBackupForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	bk, bkProjStat, err := openBackupDBReadonly(form.Text)
+	if err != nil {
+		return err
+	}
+	defer bk.DB.Close()
+
+	plan, err := planSync(form.Text, bk, bkProjStat, form.Full)
+	if err != nil {
+		return err
+	}
+	return c.JSON(plan.preview)
+}
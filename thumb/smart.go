@@ -1,9 +1,11 @@
 package thumb
 
 import (
+	"bytes"
 	"encoding/base64"
 	"image"
 	"image/jpeg"
+	"io"
 	"os"
 
 	"github.com/disintegration/imaging"
@@ -38,6 +40,36 @@ func SmartCropBytes64(imgBytes []byte, dstPath string) error {
 	return jpegEncodeBase64ToFile(dstPath, img, 0)
 }
 
+// SmartCropBase64 與 SmartCrop64 相同, 但不寫入檔案, 而是返回結果 (用於加密縮略圖).
+func SmartCropBase64(imgPath string) ([]byte, error) {
+	img, err := OpenImage(imgPath)
+	if err != nil {
+		return nil, err
+	}
+	return smartCropBase64(img)
+}
+
+// SmartCropBytesBase64 與 SmartCropBytes64 相同, 但不寫入檔案, 而是返回結果.
+func SmartCropBytesBase64(imgBytes []byte) ([]byte, error) {
+	img, err := ReadImage(imgBytes)
+	if err != nil {
+		return nil, err
+	}
+	return smartCropBase64(img)
+}
+
+func smartCropBase64(img image.Image) ([]byte, error) {
+	img, err := smartCropResize(img)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpegEncodeBase64(&buf, img, 0); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func OpenImage(imgPath string) (image.Image, error) {
 	f, err := os.Open(imgPath)
 	if err != nil {
@@ -94,21 +126,27 @@ func jpegEncodeToFile(dst string, src image.Image, quality int) error {
 // Use default quality(85) if quality is set to zero.
 // dst is the output file path.
 func jpegEncodeBase64ToFile(dst string, src image.Image, quality int) error {
-	if quality == 0 {
-		quality = defaultQuality
-	}
 	file, err := os.Create(dst)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	return jpegEncodeBase64(file, src, quality)
+}
 
+// jpegEncodeBase64 convert the image to base64 and add prefix "data:image/jpeg;base64,"
+// Use default quality(85) if quality is set to zero.
+func jpegEncodeBase64(w io.Writer, src image.Image, quality int) error {
+	if quality == 0 {
+		quality = defaultQuality
+	}
 	prefix := []byte("data:image/jpeg;base64,")
-	if _, err = file.Write(prefix); err != nil {
+	if _, err := w.Write(prefix); err != nil {
 		return err
 	}
-
-	encoder64 := base64.NewEncoder(base64.StdEncoding, file)
-	defer encoder64.Close()
-	return jpeg.Encode(encoder64, src, &jpeg.Options{Quality: quality})
+	encoder64 := base64.NewEncoder(base64.StdEncoding, w)
+	if err := jpeg.Encode(encoder64, src, &jpeg.Options{Quality: quality}); err != nil {
+		return err
+	}
+	return encoder64.Close()
 }
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/thumb"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+)
+
+// 加密仓库中的图片的缩略图, 用专案的真正密钥加密后保存在 SecretThumbsFolder 中,
+// 不放在 public 资料夹里, 因此不会被 app.Static 公开, 只能通过 secretThumbHandler 获取.
+
+func secretThumbPath(fileID int64) string {
+	filename := strconv.FormatInt(fileID, 10)
+	return filepath.Join(SecretThumbsFolder, filename)
+}
+
+// leakedThumbPath 是旧版本留在 public 资料夹中的加密图片的缩略图,
+// 启动时先移到这里, 等管理员登入后再加密.
+func leakedThumbPath(fileID int64) string {
+	filename := strconv.FormatInt(fileID, 10)
+	return filepath.Join(LeakedThumbsFolder, filename)
+}
+
+// thumbPathOf 根据文档是否加密, 返回缩略图的路径.
+func thumbPathOf(file FilePlus) string {
+	if file.Encrypted {
+		return secretThumbPath(file.ID)
+	}
+	return thumbFilePath(file.ID)
+}
+
+// createSecretThumb 为加密仓库中的图片生成缩略图并加密.
+// imgPath 是未加密的原图, 与 createThumb 一样, 出错时只打印错误.
+func createSecretThumb(imgPath string, file *File) {
+	if !file.IsImage() {
+		return
+	}
+	fmt.Println("create secret thumb " + secretThumbPath(file.ID))
+	data, err := thumb.SmartCropBase64(imgPath)
+	if err == nil {
+		err = writeSecretThumb(file.ID, data)
+	}
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// rebuildSecretThumb 用解密后的原图 img 重新生成缩略图并加密.
+func rebuildSecretThumb(fileID int64, img []byte) error {
+	data, err := thumb.SmartCropBytesBase64(img)
+	if err != nil {
+		return err
+	}
+	return writeSecretThumb(fileID, data)
+}
+
+func writeSecretThumb(fileID int64, data []byte) error {
+	blob, err := db.EncryptThumb(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(secretThumbPath(fileID), blob)
+}
+
+// writeFileAtomic 先写入临时文档, 再重命名, 以免中断时留下不完整的文档.
+func writeFileAtomic(name string, data []byte) error {
+	tmp := name + ".tmp"
+	if err := os.WriteFile(tmp, data, util.NormalFilePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+func readSecretThumb(fileID int64) ([]byte, error) {
+	blob, err := os.ReadFile(secretThumbPath(fileID))
+	if err != nil {
+		return nil, err
+	}
+	return db.DecryptThumb(blob)
+}
+
+func secretThumbHandler(c *fiber.Ctx) error {
+	form := new(model.FileIdForm)
+	if err := paramParseValidate(form, c); err != nil {
+		return err
+	}
+	file, err := db.GetFilePlus(form.ID)
+	if err != nil {
+		return err
+	}
+	if !file.Encrypted {
+		return c.SendFile(thumbFilePath(file.ID))
+	}
+	if err := checkRequireAdmin(c, file.BucketName, file.Encrypted); err != nil {
+		return err
+	}
+	data, err := readSecretThumb(file.ID)
+	if err != nil {
+		return err
+	}
+	c.Type("txt", "utf-8")
+	return c.Send(data)
+}
+
+// moveThumb 文档移进或移出加密仓库时, 缩略图也要加密或解密.
+func moveThumb(fileID int64, toSecret bool) error {
+	publicPath := thumbFilePath(fileID)
+	secretPath := secretThumbPath(fileID)
+	if toSecret {
+		if util.PathNotExists(publicPath) {
+			return nil
+		}
+		data, err := os.ReadFile(publicPath)
+		if err != nil {
+			return err
+		}
+		if err := writeSecretThumb(fileID, data); err != nil {
+			return err
+		}
+		return os.Remove(publicPath)
+	}
+	if util.PathNotExists(secretPath) {
+		return nil
+	}
+	data, err := readSecretThumb(fileID)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(publicPath, data); err != nil {
+		return err
+	}
+	return os.Remove(secretPath)
+}
+
+// moveLeakedThumbs 把旧版本生成在 public 资料夹中的加密图片的缩略图移出 public 资料夹.
+// 此时未登入, 无法加密, 因此先移到 LeakedThumbsFolder, 登入后再由 encryptLeakedThumbs 加密.
+func moveLeakedThumbs() error {
+	files, err := db.GetEncryptedFiles(0)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		publicPath := thumbFilePath(file.ID)
+		if util.PathNotExists(publicPath) {
+			continue
+		}
+		fmt.Println("move leaked thumb " + publicPath)
+		if err := os.Rename(publicPath, leakedThumbPath(file.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptLeakedThumbs 加密 moveLeakedThumbs 移出来的缩略图 (需要登入).
+func encryptLeakedThumbs() error {
+	files, err := util.GetRegularFiles(LeakedThumbsFolder)
+	if err != nil {
+		return err
+	}
+	for _, leaked := range files {
+		fileID, err := strconv.ParseInt(filepath.Base(leaked), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(leaked)
+		if err != nil {
+			return err
+		}
+		if err := writeSecretThumb(fileID, data); err != nil {
+			return err
+		}
+		if err := os.Remove(leaked); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateSecretThumbs 更换密钥时, 用新密钥重新加密缩略图, 可重复执行.
+func rotateSecretThumbs() error {
+	files, err := util.GetRegularFiles(SecretThumbsFolder)
+	if err != nil {
+		return err
+	}
+	for _, thumbPath := range files {
+		if filepath.Ext(thumbPath) == ".tmp" {
+			continue
+		}
+		blob, err := os.ReadFile(thumbPath)
+		if err != nil {
+			return err
+		}
+		newBlob, changed, err := db.ReEncryptThumb(blob)
+		if err != nil {
+			return fmt.Errorf("%s: %w", thumbPath, err)
+		}
+		if !changed {
+			continue
+		}
+		if err := writeFileAtomic(thumbPath, newBlob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
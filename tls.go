@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// 在局域网中使用 (例如用平板电脑访问) 时, 建议在 project.toml 中设置 TLS = true,
+// 以免密码以明文传输. 未设置 CertFile/KeyFile 时, 首次启动会自动生成自签名证书.
+
+const (
+	SelfSignedCertName = "cert.pem"
+	SelfSignedKeyName  = "key.pem"
+)
+
+// projectPath 把 project.toml 中的相对路径转换为以专案根目录为基准的路径.
+func projectPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(ProjectRoot, name)
+}
+
+// certKeyPaths 返回证书路径, 如果未设置则返回自签名证书的路径.
+func certKeyPaths() (certPath, keyPath string, selfSigned bool) {
+	if ProjectConfig.CertFile != "" || ProjectConfig.KeyFile != "" {
+		return projectPath(ProjectConfig.CertFile), projectPath(ProjectConfig.KeyFile), false
+	}
+	certPath = filepath.Join(TLSFolder, SelfSignedCertName)
+	keyPath = filepath.Join(TLSFolder, SelfSignedKeyName)
+	return certPath, keyPath, true
+}
+
+// newTLSConfig 加载证书 (必要时先生成自签名证书), 并设置客户端证书验证.
+func newTLSConfig() (*tls.Config, error) {
+	certPath, keyPath, selfSigned := certKeyPaths()
+	if selfSigned && util.PathNotExists(certPath) {
+		if err := createSelfSignedCert(certPath, keyPath); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("TLS certificate: %s\nsha256: %s\n", certPath, certFingerprint(cert.Certificate[0]))
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(ProjectConfig.ClientCertPins) > 0 {
+		// 客户端证书通常也是自签名的, 因此不验证证书链, 只比对指纹.
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = verifyClientCertPin
+	}
+	return cfg, nil
+}
+
+// certFingerprint 返回证书 (DER) 的 sha256 指纹.
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(pin string) string {
+	pin = strings.ReplaceAll(pin, ":", "")
+	return strings.ToLower(strings.TrimSpace(pin))
+}
+
+func verifyClientCertPin(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("client certificate required")
+	}
+	fingerprint := certFingerprint(rawCerts[0])
+	for _, pin := range ProjectConfig.ClientCertPins {
+		if normalizeFingerprint(pin) == fingerprint {
+			return nil
+		}
+	}
+	// 打印指纹, 方便把新设备的证书加入 ClientCertPins.
+	fmt.Println("client certificate not pinned, sha256:", fingerprint)
+	return fmt.Errorf("client certificate not pinned")
+}
+
+// createSelfSignedCert 生成自签名证书, 包含 localhost 以及本机全部 IP 地址.
+func createSelfSignedCert(certPath, keyPath string) error {
+	if err := util.MkdirIfNotExists(filepath.Dir(certPath)); err != nil {
+		return err
+	}
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "local-buckets " + ProjectConfig.Title},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           localIPs(),
+	}
+	if host, _, err := net.SplitHostPort(ProjectConfig.Host); err == nil {
+		if ip := net.ParseIP(host); ip == nil && host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, certPEM, util.NormalFilePerm)
+}
+
+// localIPs 返回本机全部 IP 地址 (包括 127.0.0.1).
+func localIPs() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips
+}
+
+// parseAllowedCIDRs 解析 project.toml 中的 AllowedCIDRs, 也可以直接写单个 IP 地址.
+func parseAllowedCIDRs(cidrs []string) (nets []*net.IPNet, err error) {
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			cidr += lo.Ternary(strings.Contains(cidr, ":"), "/128", "/32")
+		}
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+// allowClients is a middleware.
+// 只允许 AllowedCIDRs 中的 IP 访问, 本机 (loopback) 总是允许访问.
+func allowClients(allowed []*net.IPNet) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if len(allowed) == 0 {
+			return c.Next()
+		}
+		ip := net.ParseIP(c.IP())
+		if ip != nil && (ip.IsLoopback() || lo.ContainsBy(allowed, func(n *net.IPNet) bool {
+			return n.Contains(ip)
+		})) {
+			return c.Next()
+		}
+		return fiber.NewError(fiber.StatusForbidden, "IP not allowed: "+c.IP())
+	}
+}
+
+// listen 根据 project.toml 的设定, 以 http 或 https 启动服务.
+func listen(app *fiber.App) error {
+	if !ProjectConfig.TLS {
+		return app.Listen(ProjectConfig.Host)
+	}
+	cfg, err := newTLSConfig()
+	if err != nil {
+		return err
+	}
+	ln, err := tls.Listen("tcp", ProjectConfig.Host, cfg)
+	if err != nil {
+		return err
+	}
+	return app.Listener(ln)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// 刪除檔案時, 先移到回收站 (專案根目錄下的 trash 資料夾), 並在數據庫中標記為 "已刪除".
+// 回收站中的檔案不出現在檔案列表及搜尋結果中, 可以恢復, 也可以清空回收站.
+// 超過保留期限 (ProjectConfig.TrashRetentionDays) 的檔案會被自動徹底刪除.
+//
+// 檔案名稱是唯一的 (不分大小寫), 因此回收站不需要按倉庫分資料夾.
+
+// filePathIn 返回檔案在硬碟上的位置, bucketsDir 是主專案或備份專案的 buckets 資料夾.
+func filePathIn(bucketsDir string, file *File) string {
+	if file.Deleted {
+		return filepath.Join(filepath.Dir(bucketsDir), TrashFolderName, file.Name)
+	}
+	return filepath.Join(bucketsDir, file.BucketName, file.Name)
+}
+
+// projectFilePath 返回檔案在專案 root 中的位置.
+func projectFilePath(root string, file *File) string {
+	return filePathIn(filepath.Join(root, BucketsFolderName), file)
+}
+
+func checkNotDeleted(file *File) error {
+	if file.Deleted {
+		return fmt.Errorf("檔案在回收站中, 請先恢復: %s", file.Name)
+	}
+	return nil
+}
+
+func getTrashHandler(c *fiber.Ctx) error {
+	files, err := db.GetTrashFiles(canSeeEncrypted(c))
+	if err != nil {
+		return err
+	}
+	return c.JSON(files)
+}
+
+// moveFileToTrash 把檔案移到回收站, 如果出錯, 要把檔案移回原位.
+func moveFileToTrash(file *File) error {
+	if err := removeTempFile(file.ID); err != nil {
+		return err
+	}
+	return setFileDeleted(file, true, model.Now())
+}
+
+// setFileDeleted 把檔案移進或移出回收站的資料夾, 並更新數據庫.
+// 更新數據庫之前出錯, 要把檔案移回原位 (見 journal.go).
+func setFileDeleted(file *File, deleted bool, deletedAt string) error {
+	moved := MovedFile{Src: filePathIn(BucketsFolder, file)}
+	file.Deleted = deleted
+	moved.Dst = filePathIn(BucketsFolder, file)
+	op := lo.Ternary(deleted, model.EventDelete, model.EventRestore)
+	j := model.NewJournal(op, file.ID).Move(moved.Src, moved.Dst)
+	j.Target.Deleted = &deleted
+	if err := db.BeginJournal(j); err != nil {
+		return err
+	}
+	err := moved.Move()
+	if err == nil {
+		err = db.SetFileDeleted(file.ID, deleted, deletedAt)
+	}
+	if err != nil {
+		return db.FailJournal(j, err)
+	}
+	return db.EndJournal(j)
+}
+
+func restoreFile(c *fiber.Ctx) error {
+	form := new(model.FileIdForm)
+	err1 := parseValidate(form, c)
+	file, err2 := db.GetFilePlus(form.ID)
+	if err := util.WrapErrors(err1, err2); err != nil {
+		return err
+	}
+	if err := checkRequireAdmin(c, file.BucketName, file.Encrypted); err != nil {
+		return err
+	}
+	if !file.Deleted {
+		return fmt.Errorf("檔案不在回收站中: %s", file.Name)
+	}
+	before := file.File
+	if err := setFileDeleted(&file.File, false, ""); err != nil {
+		return err
+	}
+	return logFileEvent(c, model.EventRestore, &before, file.ID)
+}
+
+func emptyTrashHandler(c *fiber.Ctx) error {
+	files, err := db.GetTrashFiles(true)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := purgeFile(c, file.ID); err != nil {
+			return err
+		}
+	}
+	return c.JSON(len(files))
+}
+
+// purgeFile 徹底刪除回收站中的一個檔案, c 為 nil 表示自動清理.
+func purgeFile(c *fiber.Ctx, id int64) error {
+	file, err := db.GetFilePlus(id)
+	if err != nil {
+		return err
+	}
+	if !file.Deleted {
+		return fmt.Errorf("檔案不在回收站中: %s", file.Name)
+	}
+	if err := removeFileVersions(db, ProjectRoot, file.ID); err != nil {
+		return err
+	}
+	filePath := filePathIn(BucketsFolder, &file.File)
+	if err := db.DeleteFile(filePath, TempFolder, thumbPathOf(file), &file.File); err != nil {
+		return err
+	}
+	return logFileEvent(c, model.EventPurge, &file.File, file.ID)
+}
+
+// purgeExpiredTrash 徹底刪除回收站中超過保留期限的檔案, 返回被刪除的檔案數量.
+func purgeExpiredTrash() (n int, err error) {
+	days := ProjectConfig.TrashRetentionDays
+	before := time.Now().Add(-time.Duration(days) * 24 * time.Hour).Format(model.RFC3339)
+	files, err := db.GetExpiredTrashFiles(before)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if err = purgeFile(nil, file.ID); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+// purgeTrashLoop 啟動時及之後每小時清理一次回收站.
+func purgeTrashLoop() {
+	ticker := time.Tick(time.Hour)
+	for ; true; <-ticker {
+		n, err := purgeExpiredTrash()
+		if err != nil {
+			log.Println(err)
+		}
+		if n > 0 {
+			fmt.Printf("purge %d files from trash\n", n)
+		}
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ahui2016/local-buckets/extract"
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/thumb"
+	"github.com/ahui2016/local-buckets/util"
+	"github.com/gofiber/fiber/v2"
+	"github.com/samber/lo"
+)
+
+// 覆蓋檔案時, 舊的內容保存在 versions 資料夾中 (以版本 ID 為檔案名稱),
+// 加密倉庫中的檔案的舊版本也是加密的 (與檔案使用同一個倉庫密鑰).
+// 舊版本可以預覽, 下載到 waiting 資料夾, 或恢復為當前內容.
+
+// versionPathIn 返回舊版本在專案 root 中的位置.
+func versionPathIn(root string, versionID int64) string {
+	return filepath.Join(root, VersionsFolderName, strconv.FormatInt(versionID, 10))
+}
+
+func versionFilePath(versionID int64) string {
+	return versionPathIn(ProjectRoot, versionID)
+}
+
+// versionFileName 是下載舊版本時使用的檔案名稱, 例如 abc.txt 的第 3 號版本是 abc.v3.txt
+func versionFileName(name string, versionID int64) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.v%d%s", strings.TrimSuffix(name, ext), versionID, ext)
+}
+
+// archiveVersion 把被覆蓋的舊內容 (oldPath) 保存為舊版本, oldFile 是覆蓋前的檔案資訊.
+// 注意 oldFile 可能沒有 checksum (例如 FilePlus), 因此重新計算.
+func archiveVersion(oldPath string, oldFile *File) error {
+	return archiveVersionIn(db, ProjectRoot, oldPath, oldFile.ID, oldFile.Size, oldFile.UTime)
+}
+
+// archiveVersionIn 把 oldPath 保存為專案 root 中的檔案 fileID 的舊版本,
+// size 及 utime 是被覆蓋前的檔案資訊.
+func archiveVersionIn(db1 *DB, root, oldPath string, fileID, size int64, utime string) error {
+	checksum, err := util.FileSum512(oldPath)
+	if err != nil {
+		return err
+	}
+	v := &FileVersion{
+		FileID:   fileID,
+		Checksum: checksum,
+		Size:     size,
+		UTime:    utime,
+		CTime:    model.Now(),
+	}
+	if err := db1.InsertFileVersion(v); err != nil {
+		return err
+	}
+	moved := MovedFile{Src: oldPath, Dst: versionPathIn(root, v.ID)}
+	if err := moved.Move(); err != nil {
+		err2 := db1.DeleteFileVersion(v.ID)
+		return util.WrapErrors(err, err2)
+	}
+	return nil
+}
+
+// deleteVersion 刪除一個舊版本 (包括數據庫記錄與 versions 資料夾中的檔案).
+func deleteVersion(db1 *DB, root string, versionID int64) error {
+	if err := db1.DeleteFileVersion(versionID); err != nil {
+		return err
+	}
+	versionPath := versionPathIn(root, versionID)
+	if util.PathNotExists(versionPath) {
+		return nil
+	}
+	return os.Remove(versionPath)
+}
+
+// removeFileVersions 刪除一個檔案的全部舊版本, 用於徹底刪除檔案之前.
+func removeFileVersions(db1 *DB, root string, fileID int64) error {
+	versions, err := db1.GetFileVersions(fileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if err := deleteVersion(db1, root, v.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getFileVersionsHandler(c *fiber.Ctx) error {
+	file, err := checkAndGetFilePlus(c)
+	if err != nil {
+		return err
+	}
+	versions, err := db.GetFileVersions(file.ID)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		v.Checksum = ""
+	}
+	return c.JSON(versions)
+}
+
+// checkAndGetVersion 獲取舊版本及其所屬的檔案 (已解密名稱等資訊), 並檢查權限.
+func checkAndGetVersion(c *fiber.Ctx, form *model.FileIdForm) (
+	v FileVersion, file FilePlus, err error,
+) {
+	if v, err = db.GetFileVersion(form.ID); err != nil {
+		return
+	}
+	if file, err = db.GetFilePlus(v.FileID); err != nil {
+		return
+	}
+	if err = checkNotDeleted(&file.File); err != nil {
+		return
+	}
+	err = checkRequireAdmin(c, file.BucketName, file.Encrypted)
+	return
+}
+
+func previewVersion(c *fiber.Ctx) error {
+	form := new(model.FileIdForm)
+	if err := paramParseValidate(form, c); err != nil {
+		return err
+	}
+	v, file, err := checkAndGetVersion(c, form)
+	if err != nil {
+		return err
+	}
+	if !file.CanBePreviewed() {
+		return fmt.Errorf("can not preview file type [%s]", file.Type)
+	}
+	if _, err := db.UnsealFile(&file.File); err != nil {
+		return err
+	}
+	setFileType(c, file)
+	versionPath := versionFilePath(v.ID)
+	if !file.Encrypted {
+		return c.SendFile(versionPath)
+	}
+	decrypted, err := db.OpenDecrypted(file.BucketName, versionPath)
+	if err != nil {
+		return err
+	}
+	return c.SendStream(decrypted)
+}
+
+func downloadVersion(c *fiber.Ctx) error {
+	form := new(model.FileIdForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	v, file, err := checkAndGetVersion(c, form)
+	if err != nil {
+		return err
+	}
+	if _, err := db.UnsealFile(&file.File); err != nil {
+		return err
+	}
+	srcPath := versionFilePath(v.ID)
+	dstPath := filepath.Join(WaitingFolder, versionFileName(file.Name, v.ID))
+	if util.PathExists(dstPath) {
+		return fmt.Errorf("file exists: %s", dstPath)
+	}
+	if file.Encrypted {
+		return db.DecryptSaveFile(file.BucketName, srcPath, dstPath, util.NormalFilePerm)
+	}
+	return util.CopyAndUnlockFile(dstPath, srcPath)
+}
+
+// restoreVersion 把舊版本恢復為當前內容, 當前內容則成為一個新的舊版本.
+func restoreVersion(c *fiber.Ctx) error {
+	form := new(model.FileIdForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	v, file, err := checkAndGetVersion(c, form)
+	if err != nil {
+		return err
+	}
+	if err := db.CheckSameChecksum(&File{Name: file.Name, Checksum: v.Checksum}); err != nil {
+		return err
+	}
+	oldFile := file.File
+
+	// tempFile 把当前内容临时移动到安全的地方
+	filePath := filePathIn(BucketsFolder, &file.File)
+	tempFile := MovedFile{Src: filePath, Dst: filepath.Join(TempFolder, file.Name)}
+	if err := tempFile.Move(); err != nil {
+		return err
+	}
+	// 复制旧版本到仓库, 如果出错, 必须把当前内容移回原位.
+	if err := util.CopyAndLockFile(filePath, versionFilePath(v.ID)); err != nil {
+		err2 := tempFile.Rollback()
+		return util.WrapErrors(err, err2)
+	}
+	file.Checksum = v.Checksum
+	file.Size = v.Size
+	file.UTime = model.Now()
+	if err := db.UpdateFileContent(&file.File); err != nil {
+		err2 := os.Remove(filePath)
+		err3 := tempFile.Rollback()
+		return util.WrapErrors(err, err2, err3)
+	}
+	// 当前内容成为新的旧版本, 已恢复的旧版本则删除.
+	e1 := archiveVersion(tempFile.Dst, &oldFile)
+	e2 := deleteVersion(db, ProjectRoot, v.ID)
+	e3 := removeTempFile(file.ID)
+	if err := util.WrapErrors(e1, e2, e3); err != nil {
+		return err
+	}
+	refreshThumbAndText(file)
+	return logFileEvent(c, model.EventRestoreVersion, &oldFile, file.ID)
+}
+
+// refreshThumbAndText 在檔案內容改變後重新生成縮略圖及提取文字, 出錯時只打印錯誤.
+func refreshThumbAndText(file FilePlus) {
+	data, err := readFileData(file)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if file.IsImage() {
+		if file.Encrypted {
+			err = rebuildSecretThumb(file.ID, data)
+		} else {
+			err = thumb.SmartCropBytes64(data, thumbFilePath(file.ID))
+		}
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	if !extract.Supported(file.Type) || file.Size > extract.MaxFileSize {
+		saveFileText(&file.File, "")
+		return
+	}
+	indexFileTextBytes(data, &file.File)
+}
+
+func pruneVersionsHandler(c *fiber.Ctx) error {
+	form := new(model.PruneVersionsForm)
+	if err := parseValidate(form, c); err != nil {
+		return err
+	}
+	n, err := pruneVersions(form)
+	if err != nil {
+		return err
+	}
+	return c.JSON(n)
+}
+
+// pruneVersions 每個檔案保留最新的 form.Keep 個舊版本, 並刪除超過 form.Days 日的舊版本,
+// 返回被刪除的舊版本數量.
+func pruneVersions(form *model.PruneVersionsForm) (n int, err error) {
+	var versions []*FileVersion
+	if form.FileID > 0 {
+		versions, err = db.GetFileVersions(form.FileID)
+	} else {
+		versions, err = db.GetAllFileVersions()
+	}
+	if err != nil {
+		return
+	}
+	before := time.Now().Add(-time.Duration(form.Days) * 24 * time.Hour).Format(model.RFC3339)
+	groups := lo.GroupBy(versions, func(v *FileVersion) int64 { return v.FileID })
+	for _, group := range groups {
+		// 最新的排在前面
+		sort.Slice(group, func(i, j int) bool { return group[i].ID > group[j].ID })
+		for i, v := range group {
+			tooMany := form.Keep > 0 && int64(i) >= form.Keep
+			tooOld := form.Days > 0 && v.CTime < before
+			if !tooMany && !tooOld {
+				continue
+			}
+			if err = deleteVersion(db, ProjectRoot, v.ID); err != nil {
+				return
+			}
+			n++
+		}
+	}
+	return
+}
+
+// moveFileVersions 用於在公開倉庫與加密倉庫之間移動檔案 (或加密倉庫的密鑰不同),
+// 把舊版本也加密, 解密或用新倉庫的密鑰重新加密.
+func moveFileVersions(fileID int64, oldBucketName, newBucketName, direction string) error {
+	versions, err := db.GetFileVersions(fileID)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		versionPath := versionFilePath(v.ID)
+		tempPath := filepath.Join(TempFolder, "version-"+strconv.FormatInt(v.ID, 10))
+		err := transcodeFile(direction, oldBucketName, newBucketName, versionPath, tempPath)
+		if err != nil {
+			return err
+		}
+		if err := replaceVersion(v, tempPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceVersion 用 newPath 的檔案取代舊版本的內容, 並更新 checksum.
+func replaceVersion(v *FileVersion, newPath string) error {
+	checksum, err := util.FileSum512(newPath)
+	if err != nil {
+		return err
+	}
+	versionPath := versionFilePath(v.ID)
+	if err := os.Remove(versionPath); err != nil {
+		return err
+	}
+	moved := MovedFile{Src: newPath, Dst: versionPath}
+	if err := moved.Move(); err != nil {
+		return err
+	}
+	return db.UpdateFileVersionChecksum(v.ID, checksum)
+}
+
+// syncFileVersions 以源專案為準, 單向同步舊版本到備份專案.
+// 舊版本的內容只有在重新加密時才會改變 (checksum 也會改變).
+func syncFileVersions(bk *DB, bkProjRoot string) error {
+	bkVersionsDir := filepath.Join(bkProjRoot, VersionsFolderName)
+	if err := util.MkdirIfNotExists(bkVersionsDir); err != nil {
+		return err
+	}
+	dbVersions, e1 := db.GetAllFileVersions()
+	bkVersions, e2 := bk.GetAllFileVersions()
+	if err := util.WrapErrors(e1, e2); err != nil {
+		return err
+	}
+	dbMap := lo.KeyBy(dbVersions, func(v *FileVersion) int64 { return v.ID })
+	bkMap := lo.KeyBy(bkVersions, func(v *FileVersion) int64 { return v.ID })
+
+	for _, bkVersion := range bkVersions {
+		if _, ok := dbMap[bkVersion.ID]; !ok {
+			if err := deleteVersion(bk, bkProjRoot, bkVersion.ID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, v := range dbVersions {
+		bkVersion, ok := bkMap[v.ID]
+		if ok && bkVersion.Checksum == v.Checksum {
+			continue
+		}
+		bkPath := versionPathIn(bkProjRoot, v.ID)
+		if ok {
+			if err := os.Remove(bkPath); err != nil {
+				return err
+			}
+		}
+		if err := util.CopyAndLockFile(bkPath, versionFilePath(v.ID)); err != nil {
+			return err
+		}
+		if ok {
+			err := bk.UpdateFileVersionChecksum(v.ID, v.Checksum)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err := bk.InsertFileVersionWithID(v); err != nil {
+			err2 := os.Remove(bkPath)
+			return util.WrapErrors(err, err2)
+		}
+	}
+	return nil
+}
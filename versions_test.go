@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ahui2016/local-buckets/model"
+	"github.com/ahui2016/local-buckets/util"
+)
+
+func TestVersionFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		id   int64
+		want string
+	}{
+		{"abc.txt", 3, "abc.v3.txt"},
+		{"abc", 12, "abc.v12"},
+		{"a.tar.gz", 1, "a.tar.v1.gz"},
+		{".env", 2, ".v2.env"},
+	}
+	for _, tt := range tests {
+		if got := versionFileName(tt.name, tt.id); got != tt.want {
+			t.Errorf("versionFileName(%q, %d) = %q, want %q", tt.name, tt.id, got, tt.want)
+		}
+	}
+}
+
+// addTestVersions 為檔案新建舊版本, ages 是每個版本成為舊版本至今的天數 (從舊到新),
+// 返回 版本ID => 天數.
+func addTestVersions(t *testing.T, file *FilePlus, ages ...int) map[int64]int {
+	t.Helper()
+	versions := make(map[int64]int)
+	for _, age := range ages {
+		v := &FileVersion{
+			FileID:   file.ID,
+			Checksum: file.Checksum,
+			Size:     file.Size,
+			UTime:    file.UTime,
+			CTime:    time.Now().AddDate(0, 0, -age).Format(model.RFC3339),
+		}
+		if err := db.InsertFileVersion(v); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(versionFilePath(v.ID), nil, util.NormalFilePerm); err != nil {
+			t.Fatal(err)
+		}
+		versions[v.ID] = age
+	}
+	return versions
+}
+
+// remainingAges 返回檔案剩餘的舊版本的天數 (從新到舊), 並檢查 versions 資料夾中的檔案.
+func remainingAges(t *testing.T, fileID int64, versions map[int64]int) (ages []int) {
+	t.Helper()
+	remaining, err := db.GetFileVersions(fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := make(map[int64]bool)
+	for _, v := range remaining {
+		kept[v.ID] = true
+		ages = append(ages, versions[v.ID])
+	}
+	for id := range versions {
+		if util.PathExists(versionFilePath(id)) != kept[id] {
+			t.Fatalf("version %d: file and database record do not match", id)
+		}
+	}
+	return
+}
+
+func TestPruneVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       model.PruneVersionsForm
+		onlyFirst  bool
+		n          int
+		wantFirst  []int
+		wantSecond []int
+	}{
+		{"nothing", model.PruneVersionsForm{}, false, 0, []int{1, 10, 40}, []int{1, 10, 40}},
+		{"keep 1", model.PruneVersionsForm{Keep: 1}, false, 4, []int{1}, []int{1}},
+		{"keep more", model.PruneVersionsForm{Keep: 5}, false, 0, []int{1, 10, 40}, []int{1, 10, 40}},
+		{"days", model.PruneVersionsForm{Days: 30}, false, 2, []int{1, 10}, []int{1, 10}},
+		{"keep and days", model.PruneVersionsForm{Keep: 2, Days: 5}, false, 4, []int{1}, []int{1}},
+		{"one file", model.PruneVersionsForm{Keep: 1}, true, 2, []int{1}, []int{1, 10, 40}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first := newEncryptedTestFile(t, "prune-1-"+tt.name+".txt", "first "+tt.name)
+			second := newEncryptedTestFile(t, "prune-2-"+tt.name+".txt", "second "+tt.name)
+			firstVersions := addTestVersions(t, first, 40, 10, 1)
+			secondVersions := addTestVersions(t, second, 40, 10, 1)
+			t.Cleanup(func() {
+				for _, f := range []*FilePlus{first, second} {
+					if err := removeFileVersions(db, ProjectRoot, f.ID); err != nil {
+						t.Error(err)
+					}
+				}
+			})
+
+			form := tt.form
+			if tt.onlyFirst {
+				form.FileID = first.ID
+			}
+			n, err := pruneVersions(&form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.n {
+				t.Fatalf("pruned %d versions, want %d", n, tt.n)
+			}
+			if got := remainingAges(t, first.ID, firstVersions); !reflect.DeepEqual(got, tt.wantFirst) {
+				t.Fatalf("first file: got %v, want %v", got, tt.wantFirst)
+			}
+			if got := remainingAges(t, second.ID, secondVersions); !reflect.DeepEqual(got, tt.wantSecond) {
+				t.Fatalf("second file: got %v, want %v", got, tt.wantSecond)
+			}
+		})
+	}
+}